@@ -15,8 +15,80 @@ const (
 	XMIT_HAS_IDEV_DATA       = (1 << 9)
 	XMIT_SAME_DEV            = (1 << 10)
 	XMIT_RDEV_MINOR_IS_SMALL = (1 << 11)
+	XMIT_RDEV_MINOR_8_pre30  = XMIT_RDEV_MINOR_IS_SMALL /* Only in protocols 28 - 29 */
+
+	// Flags introduced with protocol 30:
+	XMIT_NO_CONTENT_DIR     = (1 << 8)  /* Only for directories */
+	XMIT_HLINKED            = (1 << 9)  /* Only for non-directories */
+	XMIT_USER_NAME_FOLLOWS  = (1 << 10) /* Only with inc_recurse */
+	XMIT_GROUP_NAME_FOLLOWS = (1 << 11) /* Only with inc_recurse */
+	XMIT_HLINK_FIRST        = (1 << 12) /* Only with XMIT_HLINKED */
+	XMIT_IO_ERROR_ENDLIST   = (1 << 12) /* Only with XMIT_EXTENDED_FLAGS, as end marker */
+
+	// Flags introduced with protocol 31:
+	XMIT_MOD_NSEC = (1 << 13)
+)
+
+// rsync.h: compatibility flags, sent by the server after the protocol version
+// negotiation (protocol >= 30).
+const (
+	CF_INC_RECURSE         = (1 << 0)
+	CF_SYMLINK_TIMES       = (1 << 1)
+	CF_SYMLINK_ICONV       = (1 << 2)
+	CF_SAFE_FLIST          = (1 << 3)
+	CF_AVOID_XATTR_OPTIM   = (1 << 4)
+	CF_CHKSUM_SEED_FIX     = (1 << 5)
+	CF_INPLACE_PARTIAL_DIR = (1 << 6)
+	CF_VARINT_FLIST_FLAGS  = (1 << 7)
+	CF_ID0_NAMES           = (1 << 8)
+)
+
+// rsync.h: item flags, sent along with the file index (protocol >= 29).
+const (
+	ITEM_REPORT_ATIME       = (1 << 0)
+	ITEM_REPORT_CHANGE      = (1 << 1)
+	ITEM_REPORT_SIZE        = (1 << 2) /* regular files only */
+	ITEM_REPORT_TIMEFAIL    = (1 << 2) /* symlinks only */
+	ITEM_REPORT_TIME        = (1 << 3)
+	ITEM_REPORT_PERMS       = (1 << 4)
+	ITEM_REPORT_OWNER       = (1 << 5)
+	ITEM_REPORT_GROUP       = (1 << 6)
+	ITEM_REPORT_ACL         = (1 << 7)
+	ITEM_REPORT_XATTR       = (1 << 8)
+	ITEM_BASIS_TYPE_FOLLOWS = (1 << 11)
+	ITEM_XNAME_FOLLOWS      = (1 << 12)
+	ITEM_IS_NEW             = (1 << 13)
+	ITEM_LOCAL_CHANGE       = (1 << 14)
+	ITEM_TRANSFER           = (1 << 15)
+)
+
+// rsync.h: special values sent in place of a file index.
+const (
+	// NDX_DONE signals the end of a phase (or, with incremental
+	// recursion, of a file list).
+	NDX_DONE = -1
+
+	// NDX_FLIST_EOF signals that the sender has sent all file lists
+	// (incremental recursion).
+	NDX_FLIST_EOF = -2
+
+	// NDX_FLIST_OFFSET minus a directory index introduces the file list
+	// with the contents of that directory (incremental recursion).
+	NDX_FLIST_OFFSET = -101
+)
+
+// rsync.h: I/O error flags, sent at the end of the file list and in
+// MSG_IO_ERROR messages.
+const (
+	IOERR_GENERAL   = (1 << 0) /* For backward compatibility, this must == 1 */
+	IOERR_VANISHED  = (1 << 1)
+	IOERR_DEL_LIMIT = (1 << 2)
 )
 
+// rsync.h: SYMLINK_PREFIX is prepended to symlink targets with --munge-links,
+// which makes the symlinks unusable (unless /rsyncd-munged/ exists).
+const SYMLINK_PREFIX = "/rsyncd-munged/"
+
 // as per /usr/include/bits/stat.h:
 const (
 	S_IFMT   = 0o0170000 // bits determining the file type
@@ -29,8 +101,27 @@ const (
 	S_IFSOCK = 0o0140000 // Socket
 )
 
-// ProtocolVersion defines the currently implemented rsync protocol
-// version. Protocol version 27 seems to be the safest bet for wide
-// compatibility: version 27 was introduced by rsync 2.6.0 (released 2004), and
-// is supported by openrsync and rsyn.
-const ProtocolVersion = 27
+// ProtocolVersion defines the newest implemented rsync protocol version.
+// Version 31 was introduced by rsync 3.1.0 (released 2013). Newer peers (e.g.
+// rsync 3.4, which speaks 32) fall back to version 31, and peers which only
+// speak an older version (e.g. openrsync, which speaks 27) are served using
+// their version, see MinProtocolVersion.
+const ProtocolVersion = 31
+
+// MinProtocolVersion is the oldest rsync protocol version that we can speak.
+// Version 26 is spoken by rsync 2.5.x. Peers announcing an older version are
+// rejected during negotiation.
+const MinProtocolVersion = 26
+
+// ShortSumLength is the length of the strong block checksums before protocol
+// 27, which does not transmit the length in the sum head.
+//
+// rsync/rsync.h:SHORT_SUM_LENGTH
+const ShortSumLength = 2
+
+// SumLength is the length of full (MD4 or MD5) strong checksums. Files which
+// failed verification are requested again with block checksums of this
+// length.
+//
+// rsync/rsync.h:SUM_LENGTH
+const SumLength = 16
@@ -2,6 +2,8 @@ package errors_test
 
 import (
 	"bytes"
+	"errors"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,6 +14,12 @@ import (
 	"github.com/google/go-cmp/cmp"
 )
 
+func TestMain(m *testing.M) {
+	if err := rsynctest.CommandMain(m); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func TestErrors(t *testing.T) {
 	t.Parallel()
 
@@ -122,8 +130,21 @@ func TestNoReadPermission(t *testing.T) {
 		dest)                         // directly into dest
 	rsync.Stdout = &buf
 	rsync.Stderr = &buf
-	if err := rsync.Run(); err != nil {
-		t.Fatalf("%v: %v", rsync.Args, err)
+	err := rsync.Run()
+	if os.Getuid() == 0 {
+		if err != nil {
+			t.Fatalf("%v: %v", rsync.Args, err)
+		}
+	} else {
+		// The server reports the file it could not open (MSG_ERROR_XFER),
+		// which results in exit code 23 (RERR_PARTIAL).
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 23 {
+			t.Fatalf("%v: %v, want exit code 23. output:\n%s", rsync.Args, err, buf.String())
+		}
+		if want := "send_files failed to open"; !strings.Contains(buf.String(), want) {
+			t.Fatalf("rsync output unexpectedly did not contain %q:\n%s", want, buf.String())
+		}
 	}
 
 	if os.Getuid() > 0 {
@@ -142,3 +163,48 @@ func TestNoReadPermission(t *testing.T) {
 		t.Fatalf("unexpected file contents: diff (-want +got):\n%s", diff)
 	}
 }
+
+func TestNoReadPermissionGokrRsync(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() == 0 {
+		t.Skip("uid 0 can read the file despite chmod(0)")
+	}
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dummy := filepath.Join(source, "dummy")
+	if err := os.WriteFile(dummy, []byte("dummy"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "other"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	output, err := rsynctest.CombinedOutput(
+		"gokr-rsync",
+		"--archive",
+		"rsync://localhost:"+srv.Port+"/interop/",
+		dest)
+	if err == nil {
+		t.Fatalf("gokr-rsync unexpectedly succeeded, output:\n%s", output)
+	}
+	if want := "code 23"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+	// The error message of the server is passed through verbatim.
+	want := "\ngokr-rsync [sender]: send_files failed to open dummy: "
+	if !strings.Contains(string(output), want) {
+		t.Errorf("output unexpectedly did not contain %q:\n%s", want, output)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "other")); err != nil {
+		t.Error(err)
+	}
+}
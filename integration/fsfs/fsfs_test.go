@@ -1,9 +1,12 @@
 package fsfs_test
 
 import (
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"testing/fstest"
 
@@ -169,3 +172,97 @@ func TestMapFSLargeFile(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// vanishingFS simulates files being deleted after the file list was sent:
+// they are still listed, but can no longer be opened.
+type vanishingFS struct {
+	fstest.MapFS
+
+	mu sync.Mutex
+	// opens is the number of times a file can be opened before it vanishes.
+	opens map[string]int
+}
+
+func (v *vanishingFS) Open(name string) (fs.File, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if left, ok := v.opens[name]; ok {
+		if left == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		v.opens[name] = left - 1
+	}
+	return v.MapFS.Open(name)
+}
+
+func TestVanishedFile(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range []string{"27", "30", "31"} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			dest := filepath.Join(tmp, "dest")
+
+			file := func(content string) *fstest.MapFile {
+				return &fstest.MapFile{
+					Data:    []byte(content),
+					Mode:    0o644,
+					ModTime: rsynctest.GosPublicRelease,
+				}
+			}
+			memfs := &vanishingFS{
+				MapFS: fstest.MapFS{
+					"hello.txt":    file("world"),
+					"racy.txt":     file("half gone"),
+					"vanished.txt": file("gone"),
+					"zzz.txt":      file("still here"),
+				},
+				opens: map[string]int{
+					// vanishes before the sender opens it
+					"vanished.txt": 0,
+					// vanishes between the sender opening it for
+					// transmission and for hashing
+					"racy.txt": 1,
+				},
+			}
+
+			srv := rsynctest.NewInMemory(t, rsyncd.Module{
+				Name: "memfs",
+				FS:   memfs,
+			}, rsynctest.DontRestrict())
+			args := []string{"-av", "--protocol=" + protocol}
+			_, err := srv.RunClientErr(t, args, []string{dest + "/"})
+			if protocol == "27" {
+				// Older protocols have no MSG_IO_ERROR, so the client does
+				// not learn about vanished files.
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "(code 24)") {
+				t.Fatalf("RunClient = %v, want an error containing (code 24)", err)
+			}
+
+			// The transfer continues after a skipped file: zzz.txt sorts
+			// after all vanished files.
+			for fn, want := range map[string]string{
+				"hello.txt": "world",
+				"zzz.txt":   "still here",
+			} {
+				got, err := os.ReadFile(filepath.Join(dest, fn))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff([]byte(want), got); diff != "" {
+					t.Fatalf("%s: unexpected file contents: diff (-want +got):\n%s", fn, diff)
+				}
+			}
+			for _, fn := range []string{"racy.txt", "vanished.txt"} {
+				if _, err := os.Stat(filepath.Join(dest, fn)); !os.IsNotExist(err) {
+					t.Fatalf("%s unexpectedly transferred (err=%v)", fn, err)
+				}
+			}
+		})
+	}
+}
@@ -120,6 +120,54 @@ func TestModuleListingClientPort(t *testing.T) {
 	}
 }
 
+func TestModuleListingComment(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(tmp, rsynctest.WithComment("interop test data")))
+
+	// request module list
+	args := []string{
+		"gokr-rsync",
+		"-aH",
+		"rsync://localhost:" + srv.Port + "/",
+	}
+	stdout, _ := rsynctest.Output(t, args...)
+
+	if want := "interop\tinterop test data"; !strings.Contains(string(stdout), want) {
+		t.Fatalf("rsync output unexpectedly did not contain %q:\n%s", want, string(stdout))
+	}
+}
+
+func TestModuleACLDenied(t *testing.T) {
+	t.Parallel()
+
+	_, source, dest := createSourceFiles(t)
+
+	// start a server which denies all clients
+	srv := rsynctest.New(t, rsynctest.InteropModule(source, rsynctest.WithACL([]string{"deny all"})))
+
+	args := []string{
+		"gokr-rsync",
+		"--gokr.dont_restrict",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	out, err := rsynctest.CombinedOutput(args...)
+	if err == nil {
+		t.Fatalf("%v unexpectedly succeeded:\n%s", args, out)
+	}
+	if want := "access denied"; !strings.Contains(err.Error(), want) && !bytes.Contains(out, []byte(want)) {
+		t.Errorf("%v failed with %v, want an error containing %q:\n%s", args, err, want, out)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "cheap", "dummy")); err == nil {
+		t.Errorf("unexpectedly synced files from a module which denies access")
+	}
+}
+
 func TestModuleContentsListingDirs(t *testing.T) {
 	t.Parallel()
 
@@ -519,6 +567,201 @@ func TestInteropSubdirExcludeMultipleNested(t *testing.T) {
 	}
 }
 
+// prepareExcludeDelete creates files in dest which a transfer from the source
+// created by createSourceFiles with --delete and --exclude=expensive must
+// delete (stale) or keep (expensive/local, excluded).
+func prepareExcludeDelete(t *testing.T, dest string) {
+	t.Helper()
+	for _, fn := range []string{"stale", "expensive/local"} {
+		fn = filepath.Join(dest, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkExcludeDelete(t *testing.T, dest string) {
+	t.Helper()
+	for _, fn := range []string{"expensive/dummy", "stale"} {
+		fn = filepath.Join(dest, fn)
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("Stat(%s) did not return -ENOENT, but %v", fn, err)
+		}
+	}
+	for _, fn := range []string{"expensive/local", "cheap/dummy"} {
+		fn = filepath.Join(dest, fn)
+		if _, err := os.Stat(fn); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestInteropExcludeDeleteGokrazy verifies that excluded files are neither
+// transferred nor deleted, no matter whether the client is the receiver or
+// the sender (which sends its filter rules to the server).
+func TestInteropExcludeDeleteGokrazy(t *testing.T) {
+	t.Parallel()
+
+	for _, direction := range []string{"pull", "push"} {
+		t.Run(direction, func(t *testing.T) {
+			t.Parallel()
+
+			_, source, dest := createSourceFiles(t)
+			prepareExcludeDelete(t, dest)
+
+			args := []string{
+				"gokr-rsync",
+				"--gokr.dont_restrict",
+				"-a",
+				"--delete",
+				"--exclude=expensive",
+			}
+			if direction == "pull" {
+				srv := rsynctest.New(t, rsynctest.InteropModule(source))
+				args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			} else {
+				srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+				args = append(args, source+"/", "rsync://localhost:"+srv.Port+"/interop/")
+			}
+			rsynctest.Run(t, args...)
+
+			checkExcludeDelete(t, dest)
+		})
+	}
+}
+
+// TestInteropExcludeDeleteTridgeSender verifies that gokrazy rsync sends its
+// filter rules to a tridge rsync sender, which then does not send the
+// excluded files.
+func TestInteropExcludeDeleteTridgeSender(t *testing.T) {
+	t.Parallel()
+
+	rsyncBin := rsynctest.TridgeOrGTFO(t, "stock rsync as the sender")
+
+	tmp, source, dest := createSourceFiles(t)
+	prepareExcludeDelete(t, dest)
+
+	// The remote shell runs tridge rsync instead of the remote command
+	// (rsync), skipping over the machine name.
+	rsh := filepath.Join(tmp, "rsh")
+	script := "#!/bin/sh\nshift 2\nexec " + rsyncBin + " \"$@\"\n"
+	if err := os.WriteFile(rsh, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rsynctest.Run(t,
+		"gokr-rsync",
+		"--gokr.dont_restrict",
+		"-a",
+		"--delete",
+		"--exclude=expensive",
+		"-e", rsh,
+		"localhost:"+source+"/",
+		dest)
+
+	checkExcludeDelete(t, dest)
+}
+
+// TestInteropOpenrsync verifies that openrsync can pull from and push to
+// gokrazy rsync, and that gokrazy rsync can pull from openrsync. openrsync
+// speaks protocol 27 and never multiplexes the data it sends as a client.
+func TestInteropOpenrsync(t *testing.T) {
+	t.Parallel()
+
+	openrsync := rsynctest.OpenrsyncOrSkip(t)
+
+	// copiedTo verifies that dest contains the files of source, but not the
+	// stale file which prepareStale created.
+	copiedTo := func(t *testing.T, dest string) {
+		t.Helper()
+		for _, subdir := range []string{"expensive", "cheap"} {
+			got, err := os.ReadFile(filepath.Join(dest, subdir, "dummy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(subdir, string(got)); diff != "" {
+				t.Errorf("unexpected file contents: diff (-want +got):\n%s", diff)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dest, "stale")); !os.IsNotExist(err) {
+			t.Errorf("Stat(stale) did not return -ENOENT, but %v", err)
+		}
+	}
+	prepareStale := func(t *testing.T, dest string) {
+		t.Helper()
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "stale"), []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runOpenrsync := func(t *testing.T, args ...string) {
+		t.Helper()
+		rsync := exec.Command(openrsync, args...)
+		rsync.Stdout = testlogger.New(t)
+		rsync.Stderr = testlogger.New(t)
+		if err := rsync.Run(); err != nil {
+			t.Fatalf("%v: %v", rsync.Args, err)
+		}
+	}
+
+	t.Run("Daemon", func(t *testing.T) {
+		t.Parallel()
+
+		_, source, dest := createSourceFiles(t)
+		prepareStale(t, dest)
+		srv := rsynctest.New(t, rsynctest.InteropModule(source))
+		runOpenrsync(t,
+			"-a",
+			"--delete",
+			"rsync://localhost:"+srv.Port+"/interop/",
+			dest)
+		copiedTo(t, dest)
+	})
+
+	t.Run("RemoteShellPush", func(t *testing.T) {
+		t.Parallel()
+
+		_, source, dest := createSourceFiles(t)
+		prepareStale(t, dest)
+		runOpenrsync(t,
+			"-a",
+			"--delete",
+			"-e", os.Args[0],
+			source+"/",
+			"localhost:"+dest)
+		copiedTo(t, dest)
+	})
+
+	t.Run("OpenrsyncSender", func(t *testing.T) {
+		t.Parallel()
+
+		tmp, source, dest := createSourceFiles(t)
+		prepareStale(t, dest)
+
+		// The remote shell runs openrsync instead of the remote command
+		// (rsync), skipping over the machine name.
+		rsh := filepath.Join(tmp, "rsh")
+		script := "#!/bin/sh\nshift 2\nexec " + openrsync + " \"$@\"\n"
+		if err := os.WriteFile(rsh, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		rsynctest.Run(t,
+			"gokr-rsync",
+			"--gokr.dont_restrict",
+			"-a",
+			"--delete",
+			"-e", rsh,
+			"localhost:"+source+"/",
+			dest)
+		copiedTo(t, dest)
+	})
+}
+
 func TestInteropRemoteCommand(t *testing.T) {
 	t.Parallel()
 
@@ -537,7 +780,6 @@ func TestInteropRemoteCommand(t *testing.T) {
 			append([]string{
 				//		"--debug=all4",
 				"--archive",
-				"--protocol=27",
 				"-v", "-v", "-v", "-v",
 				"-e", os.Args[0],
 			}, sourcesArgs...),
@@ -553,6 +795,81 @@ func TestInteropRemoteCommand(t *testing.T) {
 	}
 }
 
+// TestInteropProtocols verifies that tridge rsync can talk to gokrazy rsync
+// both via the daemon protocol and via a remote shell, at protocol 30 (rsync
+// 3.0.x) and at whichever version tridge rsync and gokrazy rsync negotiate by
+// default.
+func TestInteropProtocols(t *testing.T) {
+	t.Parallel()
+
+	rsyncBin := rsynctest.TridgeOrGTFO(t, "protocol 30 requires rsync 3.x")
+
+	for _, protocol := range []string{"30", "default"} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			var protocolArgs []string
+			if protocol != "default" {
+				protocolArgs = []string{"--protocol=" + protocol}
+			}
+
+			t.Run("Daemon", func(t *testing.T) {
+				t.Parallel()
+
+				_, source, dest := createSourceFiles(t)
+
+				// start a server to sync from
+				srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+				// sync into dest dir
+				args := append([]string{
+					"--archive",
+					"-v", "-v", "-v", "-v",
+					"--port=" + srv.Port,
+				}, protocolArgs...)
+				args = append(args, sourcesArgs(t)...)
+				rsync := exec.Command(rsyncBin, append(args, dest)...)
+				rsync.Stdout = testlogger.New(t)
+				rsync.Stderr = testlogger.New(t)
+				if err := rsync.Run(); err != nil {
+					t.Fatalf("%v: %v", rsync.Args, err)
+				}
+
+				if err := sourceFullySyncedTo(t, dest); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			t.Run("RemoteShell", func(t *testing.T) {
+				t.Parallel()
+
+				_, source, dest := createSourceFiles(t)
+
+				// sync into dest dir
+				args := append([]string{
+					"--archive",
+					"-v", "-v", "-v", "-v",
+					"-e", os.Args[0],
+				}, protocolArgs...)
+				args = append(args,
+					"localhost:"+source+"/expensive/", // copy contents of interop
+					":"+source+"/cheap",               // copy cheap directory
+					dest)
+				rsync := exec.Command(rsyncBin, args...)
+				rsync.Stdout = testlogger.New(t)
+				rsync.Stderr = testlogger.New(t)
+				if err := rsync.Run(); err != nil {
+					t.Fatalf("%v: %v", rsync.Args, err)
+				}
+
+				if err := sourceFullySyncedTo(t, dest); err != nil {
+					t.Fatal(err)
+				}
+			})
+		})
+	}
+}
+
 func TestInteropRemoteDaemon(t *testing.T) {
 	t.Parallel()
 
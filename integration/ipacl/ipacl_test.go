@@ -2,6 +2,7 @@ package ipacl_test
 
 import (
 	"bytes"
+	"log"
 	"net"
 	"os"
 	"os/exec"
@@ -14,6 +15,12 @@ import (
 	"github.com/gokrazy/rsync/internal/testlogger"
 )
 
+func TestMain(m *testing.M) {
+	if err := rsynctest.CommandMain(m); err != nil {
+		log.Fatal(err)
+	}
+}
+
 type connWithRemoteAddrListener struct {
 	net.Listener
 
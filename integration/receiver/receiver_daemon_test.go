@@ -284,13 +284,126 @@ func TestDaemonReceiverSyncHardLinks(t *testing.T) {
 	rsync.Stdout = &buf
 	rsync.Stderr = &buf
 	if err := rsync.Run(); err != nil {
-		if strings.Contains(buf.String(), "gokr-rsync [receiver]: support for hard links not yet implemented") {
-			return
-		}
-		t.Fatalf("%v: %v", rsync.Args, err)
+		t.Fatalf("%v: %v\n%s", rsync.Args, err, buf.String())
 	}
 
 	if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
 		t.Fatal(err)
 	}
 }
+
+// TestDaemonReceiverHardLinks verifies that gokr-rsyncd decodes the hard link
+// information which tridge rsync sends along with the file list (-H).
+func TestDaemonReceiverHardLinks(t *testing.T) {
+	t.Parallel()
+
+	rsyncBin := rsynctest.TridgeOrGTFO(t, "protocol 29 and 30 require rsync 3.x")
+
+	for _, protocol := range []string{"29", "30", "default"} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			want := writeHardLinkedTree(t, source)
+
+			// start a server which receives data
+			srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+			args := []string{
+				"-aH",
+				"--port=" + srv.Port,
+			}
+			if protocol != "default" {
+				args = append(args, "--protocol="+protocol)
+			}
+			rsync := exec.Command(rsyncBin, append(args,
+				source+"/", // copy contents of source
+				"rsync://localhost/interop/")...)
+			rsync.Stdout = testlogger.New(t)
+			rsync.Stderr = testlogger.New(t)
+			if err := rsync.Run(); err != nil {
+				t.Fatalf("%v: %v", rsync.Args, err)
+			}
+
+			for name, contents := range want {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != contents {
+					t.Errorf("%s: got %q, want %q", name, got, contents)
+				}
+			}
+		})
+	}
+}
+
+// TestReceiverFromTridgeRsync pulls from tridge rsync as the (remote shell)
+// server, so that gokr-rsync receives from an independent sender.
+func TestReceiverFromTridgeRsync(t *testing.T) {
+	t.Parallel()
+
+	testReceiverFrom(t, rsynctest.TridgeOrGTFO(t, "stock rsync as the sender"))
+}
+
+// TestReceiverFromOpenRsync is like TestReceiverFromTridgeRsync, but with
+// openrsync (the default rsync on macOS 15+), which speaks protocol 27.
+func TestReceiverFromOpenRsync(t *testing.T) {
+	t.Parallel()
+
+	testReceiverFrom(t, rsynctest.OpenrsyncOrSkip(t))
+}
+
+// testReceiverFrom pulls from rsyncBin as the remote shell server.
+func testReceiverFrom(t *testing.T, rsyncBin string) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	destLarge := filepath.Join(dest, "large-data-file")
+
+	headPattern := []byte{0x11}
+	bodyPattern := []byte{0xbb}
+	endPattern := []byte{0xee}
+	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+	if err := os.WriteFile(filepath.Join(source, "private"), []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("private", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote shell runs rsyncBin instead of the remote command
+	// (rsync), skipping over the machine name.
+	rsh := filepath.Join(tmp, "rsh")
+	script := "#!/bin/sh\nshift 2\nexec " + rsyncBin + " \"$@\"\n"
+	if err := os.WriteFile(rsh, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rsynctest.Run(t, "gokr-rsync",
+		"--gokr.dont_restrict",
+		"-a",
+		"-e", rsh,
+		"localhost:"+source+"/",
+		dest)
+
+	if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dest, "private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("private: got mode %v, want %v", got, want)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "private" {
+		t.Errorf("link: got target %q, want %q", target, "private")
+	}
+}
@@ -0,0 +1,323 @@
+package receiver_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"golang.org/x/sys/unix"
+)
+
+// FS_IMMUTABLE_FL from linux/fs.h, which golang.org/x/sys/unix lacks.
+const fsImmutableFl = 0x00000010
+
+// setImmutable sets or clears the immutable attribute of fn (like chattr +i),
+// which even root cannot bypass. The test is skipped if the file system does
+// not support it.
+func setImmutable(t *testing.T, fn string, immutable bool) {
+	t.Helper()
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		t.Skipf("FS_IOC_GETFLAGS: %v", err)
+	}
+	if immutable {
+		flags |= fsImmutableFl
+	} else {
+		flags &^= fsImmutableFl
+	}
+	if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags); err != nil {
+		t.Skipf("FS_IOC_SETFLAGS: %v", err)
+	}
+}
+
+func TestReceiverFileErrors(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.MkdirAll(filepath.Join(dir, "locked"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-1 * time.Hour)
+	for name, content := range map[string]string{
+		"locked/f": "old",
+		"frozen":   "old",
+	} {
+		fn := filepath.Join(dest, name)
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		"locked/f": "new",
+		"frozen":   "new",
+		"other":    "new",
+		"zzz":      "new",
+	} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The temporary file cannot be created in the immutable directory, and
+	// the immutable file cannot be replaced.
+	for _, fn := range []string{filepath.Join(dest, "locked"), filepath.Join(dest, "frozen")} {
+		setImmutable(t, fn, true)
+		t.Cleanup(func() { setImmutable(t, fn, false) })
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	_, err := srv.RunClientErr(t, []string{"-rt"}, []string{dest})
+	if err == nil || !strings.Contains(err.Error(), "(code 23)") {
+		t.Fatalf("transfer with failing files: got err=%v, want code 23", err)
+	}
+
+	// The failing files are left alone, the others are transferred.
+	for name, want := range map[string]string{
+		"locked/f": "old",
+		"frozen":   "old",
+		"other":    "new",
+		"zzz":      "new",
+	} {
+		b, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("%s: unexpected contents: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// attachLoop attaches fn to a free loop device and returns the device’s
+// name. The test is skipped if loop devices are unavailable.
+func attachLoop(t *testing.T, fn string) string {
+	t.Helper()
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ctl.Close()
+	n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		t.Skipf("LOOP_CTL_GET_FREE: %v", err)
+	}
+	dev := fmt.Sprintf("/dev/loop%d", n)
+	loop, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { loop.Close() })
+	backing, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backing.Close()
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+		t.Skipf("LOOP_SET_FD: %v", err)
+	}
+	t.Cleanup(func() { unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0) })
+	return dev
+}
+
+func TestReceiverWriteDevices(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skip("creating block devices requires root")
+	}
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := make([]byte, 64<<10)
+	rand.NewChaCha8([32]byte{}).Read(content)
+	if err := os.WriteFile(filepath.Join(source, "disk"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination is a block device node for a loop device, which is
+	// larger than the source file.
+	backing := filepath.Join(tmp, "backing.img")
+	if err := os.WriteFile(backing, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(attachLoop(t, backing), &st); err != nil {
+		t.Fatal(err)
+	}
+	disk := filepath.Join(dest, "disk")
+	if err := unix.Mknod(disk, unix.S_IFBLK|0644, int(st.Rdev)); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	srv.RunClient(t, []string{"-rt", "--write-devices"}, []string{dest})
+
+	fi, err := os.Lstat(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		t.Fatalf("%s was replaced: got mode %v, want a device", disk, fi.Mode())
+	}
+	got, err := os.ReadFile(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1<<20 {
+		t.Fatalf("device size changed: got %d bytes, want %d", len(got), 1<<20)
+	}
+	if !bytes.Equal(got[:len(content)], content) {
+		t.Errorf("device does not start with the source file’s contents")
+	}
+	if !bytes.Equal(got[len(content):], make([]byte, len(got)-len(content))) {
+		t.Errorf("device contents after the source file’s contents changed")
+	}
+}
+
+func TestReceiverKeepsMatchingDevices(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skip("creating device files requires root")
+	}
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(source, "char"), unix.S_IFCHR|0600, int(unix.Mkdev(1, 3))); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(source, "block"), unix.S_IFBLK|0600, int(unix.Mkdev(7, 42))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("char", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	args := []string{"-rtlD"}
+	srv.RunClient(t, args, []string{dest})
+
+	inodes := func() map[string]uint64 {
+		m := make(map[string]uint64)
+		for _, name := range []string{"char", "block", "link"} {
+			var st unix.Stat_t
+			if err := unix.Lstat(filepath.Join(dest, name), &st); err != nil {
+				t.Fatal(err)
+			}
+			m[name] = st.Ino
+		}
+		return m
+	}
+	before := inodes()
+
+	// A device with the wrong device number must be re-created.
+	block := filepath.Join(dest, "block")
+	if err := os.Remove(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(block, unix.S_IFBLK|0600, int(unix.Mkdev(7, 43))); err != nil {
+		t.Fatal(err)
+	}
+	srv.RunClient(t, args, []string{dest})
+
+	after := inodes()
+	for _, name := range []string{"char", "link"} {
+		if before[name] != after[name] {
+			t.Errorf("%s was re-created: inode changed from %d to %d", name, before[name], after[name])
+		}
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(block, &st); err != nil {
+		t.Fatal(err)
+	}
+	if got := st.Rdev; got != unix.Mkdev(7, 42) {
+		t.Errorf("block: got rdev %d:%d, want 7:42", unix.Major(got), unix.Minor(got))
+	}
+}
+
+func TestReceiverFreeSpace(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skip("mounting a tmpfs requires root")
+	}
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Mount("tmpfs", dest, "tmpfs", 0, "size=256k"); err != nil {
+		t.Skipf("mounting a tmpfs: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := unix.Unmount(dest, 0); err != nil {
+			t.Error(err)
+		}
+	})
+	big := make([]byte, 1<<20)
+	rand.NewChaCha8([32]byte{}).Read(big)
+	if err := os.WriteFile(filepath.Join(source, "big"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+
+	// By default, the receiver refuses to start the transfer.
+	_, err := srv.RunClientErr(t, []string{"-rt"}, []string{dest})
+	if err == nil || !strings.Contains(err.Error(), "bytes free") {
+		t.Fatalf("transfer unexpectedly did not fail the free space check: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "big")); !os.IsNotExist(err) {
+		t.Fatalf("big unexpectedly transferred: %v", err)
+	}
+
+	// A dry run writes nothing and hence does not check.
+	srv.RunClient(t, []string{"-rt", "--dry-run"}, []string{dest})
+
+	// Without the check, the transfer runs into ENOSPC, which aborts it.
+	for _, mode := range []string{"warn", "off"} {
+		_, err := srv.RunClientErr(t, []string{"-rt", "--gokr.space_check=" + mode}, []string{dest})
+		if err == nil || !strings.Contains(err.Error(), "(code 11)") {
+			t.Fatalf("--gokr.space_check=%s: got %v, want error in file IO (code 11)", mode, err)
+		}
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
@@ -1,22 +1,30 @@
 package receiver_test
 
 import (
+	"bytes"
+	"fmt"
 	"io/fs"
 	"log"
+	"math"
+	"math/rand/v2"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/gokrazy/rsync/internal/rsynccompress"
 	"github.com/gokrazy/rsync/internal/rsyncdconfig"
 	"github.com/gokrazy/rsync/internal/rsynctest"
 	"github.com/gokrazy/rsync/rsyncd"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/renameio/v2"
+	"golang.org/x/sys/unix"
 )
 
 func TestMain(m *testing.M) {
@@ -259,6 +267,437 @@ func TestReceiverSync(t *testing.T) {
 	}
 }
 
+// TestReceiverSyncProtocols verifies that transfers work with all supported
+// protocol versions, not just the newest one we implement.
+func TestReceiverSyncProtocols(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range []string{"26", "27", "28", "29", "30", "31"} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			destLarge := filepath.Join(dest, "large-data-file")
+
+			headPattern := []byte{0x11}
+			bodyPattern := []byte{0xbb}
+			endPattern := []byte{0xee}
+			rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+			if err := os.Symlink("large-data-file", filepath.Join(source, "link")); err != nil {
+				t.Fatal(err)
+			}
+			// Special files are encoded differently depending on the
+			// protocol version (no rdev since protocol 31).
+			if err := syscall.Mkfifo(filepath.Join(source, "fifo"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// So are device numbers (split into major and minor since
+			// protocol 28).
+			devices := filepath.Join(source, "devices")
+			if os.Getuid() == 0 {
+				rsynctest.CreateDummyDeviceFiles(t, devices)
+			}
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			args := []string{"-a", "--protocol=" + protocol}
+			srv.RunClient(t, args, []string{dest})
+
+			if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
+				t.Fatal(err)
+			}
+			target, err := os.Readlink(filepath.Join(dest, "link"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := target, "large-data-file"; got != want {
+				t.Errorf("unexpected symlink target: got %q, want %q", got, want)
+			}
+			if os.Getuid() == 0 {
+				rsynctest.VerifyDummyDeviceFiles(t, devices, filepath.Join(dest, "devices"))
+			}
+
+			// Change the middle of the large data file:
+			bodyPattern = []byte{0x66}
+			rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+			// Ensure the quick check (size and mtime) detects the modification.
+			later := time.Now().Add(1 * time.Minute)
+			if err := os.Chtimes(filepath.Join(source, "large-data-file"), later, later); err != nil {
+				t.Fatal(err)
+			}
+
+			incrementalStats := srv.RunClient(t, args, []string{dest})
+			if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := incrementalStats.Written, int64(2*1024*1024); got >= want {
+				t.Fatalf("rsync unexpectedly transferred more data than needed: got %d, want < %d", got, want)
+			}
+		})
+	}
+}
+
+// TestReceiverLargeFile verifies that files larger than 4 GiB keep their size
+// and contents, which protocols before 30 transfer as a 32-bit -1 followed by
+// the 64-bit length.
+func TestReceiverLargeFile(t *testing.T) {
+	t.Parallel()
+
+	const size = 5 << 30
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	large := filepath.Join(source, "large")
+	// A sparse file, so that the test only needs disk space for the copies.
+	f, err := os.Create(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := []byte("head of the large file")
+	tail := []byte("tail of the large file")
+	if _, err := f.WriteAt(head, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(tail, size-int64(len(tail))); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+
+	for _, protocol := range []string{"27", "31"} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(tmp, "dest-"+protocol)
+			args := []string{"-a", "--protocol=" + protocol}
+			stats := srv.RunClient(t, args, []string{dest})
+			// The total size also includes the directory.
+			if got, want := stats.Size, int64(size); got < want {
+				t.Errorf("total size: got %d, want at least %d", got, want)
+			}
+
+			f, err := os.Open(filepath.Join(dest, "large"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			st, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := st.Size(), int64(size); got != want {
+				t.Fatalf("unexpected size: got %d, want %d", got, want)
+			}
+			for _, want := range []struct {
+				off  int64
+				data []byte
+			}{
+				{0, head},
+				{size - int64(len(tail)), tail},
+			} {
+				got := make([]byte, len(want.data))
+				if _, err := f.ReadAt(got, want.off); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want.data) {
+					t.Errorf("unexpected contents at offset %d: got %q, want %q", want.off, got, want.data)
+				}
+			}
+		})
+	}
+}
+
+// interruptingListener breaks the first connection it accepts once the server
+// wrote limit bytes to it, like a dropped network connection would.
+type interruptingListener struct {
+	net.Listener
+	limit    int
+	accepted atomic.Bool
+}
+
+func (ln *interruptingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil || ln.accepted.Swap(true) {
+		return conn, err
+	}
+	return &interruptedConn{Conn: conn, remaining: ln.limit}, nil
+}
+
+type interruptedConn struct {
+	net.Conn
+	remaining int
+}
+
+func (c *interruptedConn) Write(p []byte) (int, error) {
+	if len(p) <= c.remaining {
+		c.remaining -= len(p)
+		return c.Conn.Write(p)
+	}
+	n, _ := c.Conn.Write(p[:c.remaining])
+	c.remaining = 0
+	c.Conn.Close()
+	return n, net.ErrClosed
+}
+
+// TestReceiverPartialDir verifies that an interrupted transfer with
+// --partial-dir keeps the data received so far, and that the next transfer
+// only needs to send the rest.
+func TestReceiverPartialDir(t *testing.T) {
+	t.Parallel()
+
+	const size = 8 << 20
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, size)
+	rand.NewChaCha8([32]byte{}).Read(content)
+	if err := os.WriteFile(filepath.Join(source, "large"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := rsynctest.New(t, rsynctest.InteropModule(source), rsynctest.Listener(&interruptingListener{
+		Listener: ln,
+		limit:    size / 2,
+	}))
+
+	args := []string{
+		"gokr-rsync",
+		"--gokr.dont_restrict",
+		"-a",
+		"--partial-dir=.rsync-partial",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if out, err := rsynctest.CombinedOutput(args...); err == nil {
+		t.Fatalf("%v unexpectedly succeeded despite the interruption:\n%s", args, out)
+	}
+	partialDir := filepath.Join(dest, ".rsync-partial")
+	st, err := os.Stat(filepath.Join(partialDir, "large"))
+	if err != nil {
+		t.Fatalf("partial file not kept: %v", err)
+	}
+	if st.Size() == 0 || st.Size() >= size {
+		t.Fatalf("partial file has size %d, want between 0 and %d", st.Size(), size)
+	}
+
+	stats := rsynctest.Run(t, args...)
+	// Besides the missing data, the sender transmits the block matches.
+	if got, limit := stats.Written, size-st.Size()+size/16; got > limit {
+		t.Errorf("sender wrote %d bytes, want at most %d (partial file has %d of %d bytes)", got, limit, st.Size(), size)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("destination file differs from the source file")
+	}
+	if _, err := os.Stat(partialDir); !os.IsNotExist(err) {
+		t.Errorf("partial directory not removed after the transfer: %v", err)
+	}
+}
+
+// TestReceiverCompress verifies that -z negotiates a compression algorithm
+// with the server and transfers file data with it.
+func TestReceiverCompress(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		choice string
+		want   string
+	}{
+		// Without --compress-choice, the negotiation picks the algorithm
+		// we prefer most.
+		{"", rsynccompress.Supported()[0]},
+		{rsynccompress.LZ4, rsynccompress.LZ4},
+		{rsynccompress.Zlibx, rsynccompress.Zlibx},
+		{rsynccompress.Zlib, rsynccompress.Zlib},
+		// rsync treats --compress-choice=none like --no-compress.
+		{rsynccompress.None, ""},
+	} {
+		name := tt.choice
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			destLarge := filepath.Join(dest, "large-data-file")
+
+			headPattern := []byte{0x11}
+			bodyPattern := []byte{0xbb}
+			endPattern := []byte{0xee}
+			rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			args := []string{"-az"}
+			if tt.choice != "" {
+				args = append(args, "--compress-choice="+tt.choice)
+			}
+			stats := srv.RunClient(t, args, []string{dest})
+			if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
+				t.Fatal(err)
+			}
+			if got := stats.Compression; got != tt.want {
+				t.Errorf("Compression = %q, want %q", got, tt.want)
+			}
+
+			// Change the middle of the large data file, so that the sender
+			// sends both literal data and block references.
+			bodyPattern = []byte{0x66}
+			rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+			later := time.Now().Add(1 * time.Minute)
+			if err := os.Chtimes(filepath.Join(source, "large-data-file"), later, later); err != nil {
+				t.Fatal(err)
+			}
+			srv.RunClient(t, args, []string{dest})
+			if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestReceiverRemoveSourceFiles verifies that the sender removes files once
+// the receiver has confirmed them, with and without multiplexed client output.
+func TestReceiverRemoveSourceFiles(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range []string{"27", "31"} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, fn := range []string{"hello", "dir/world"} {
+				if err := os.WriteFile(filepath.Join(source, fn), []byte(fn), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// An up-to-date file is removed, too, without transferring it.
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dest, "hello"), []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(filepath.Join(source, "hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filepath.Join(dest, "hello"), fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+
+			srv := rsynctest.NewInMemoryInterop(t, source, rsynctest.WithWritable(true))
+			args := []string{"-a", "--remove-source-files", "--protocol=" + protocol}
+			srv.RunClient(t, args, []string{dest})
+
+			for _, fn := range []string{"hello", "dir/world"} {
+				got, err := os.ReadFile(filepath.Join(dest, fn))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fn; string(got) != want {
+					t.Errorf("%s: unexpected content: got %q, want %q", fn, got, want)
+				}
+				if _, err := os.Lstat(filepath.Join(source, fn)); !os.IsNotExist(err) {
+					t.Errorf("source file %s unexpectedly not removed (err=%v)", fn, err)
+				}
+			}
+			// Directories are left in place.
+			if _, err := os.Stat(filepath.Join(source, "dir")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestReceiverDirectoryTouchUp verifies that directories end up with the
+// sender’s modification time and permissions, even though the receiver
+// creates files inside them after creating the directories.
+func TestReceiverDirectoryTouchUp(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	for _, fn := range []string{"sub/hello", "sub/deep/world", "readonly/file"} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)
+	dirs := []string{".", "sub", "sub/deep", "readonly"}
+	for _, dir := range dirs {
+		if err := os.Chtimes(filepath.Join(source, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(source, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemory(t, rsyncd.Module{
+		Name: "interop",
+		Path: source,
+	})
+	for _, args := range [][]string{
+		{"-a", "--protocol=29"},
+		{"-a", "--no-inc-recursive"},
+		{"-a"}, // incremental recursion
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			t.Cleanup(func() { os.Chmod(filepath.Join(dest, "readonly"), 0755) })
+			// The second run finds the directories unchanged.
+			for range 2 {
+				srv.RunClient(t, args, []string{dest})
+				for _, dir := range dirs {
+					st, err := os.Stat(filepath.Join(dest, dir))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := st.ModTime(); !got.Equal(mtime) {
+						t.Errorf("%s: unexpected mod time: got %v, want %v", dir, got, mtime)
+					}
+				}
+				st, err := os.Stat(filepath.Join(dest, "readonly"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := st.Mode().Perm(), fs.FileMode(0555); got != want {
+					t.Errorf("readonly: unexpected permissions: got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
 func TestReceiverSyncDelete(t *testing.T) {
 	t.Parallel()
 
@@ -299,15 +738,637 @@ func TestReceiverSyncDelete(t *testing.T) {
 	if err := os.WriteFile(extra2, []byte("deleteme"), 0644); err != nil {
 		t.Fatal(err)
 	}
+	// Nested directories are deleted after their contents.
+	nested := filepath.Join(extraDir, "nested", "empty")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	extra3 := filepath.Join(extraDir, "nested", "blocker")
+	if err := os.WriteFile(extra3, []byte("deleteme"), 0644); err != nil {
+		t.Fatal(err)
+	}
 
 	srv.RunClient(t, args, []string{dest})
-	for _, gone := range []string{extra, extraDir, extra2} {
+	for _, gone := range []string{extra, extraDir, extra2, nested, extra3} {
 		if _, err := os.Stat(gone); !os.IsNotExist(err) {
 			t.Errorf("expected %s to be deleted, but it still exists", gone)
 		}
 	}
 }
 
+// TestReceiverSyncDeleteModuleSubdir pulls a subdirectory of a module, so
+// that the top directory of the transfer is not the module itself.
+func TestReceiverSyncDeleteModuleSubdir(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	for fn, contents := range map[string]string{
+		"sub/hello":         "hello",
+		"sub/dir/world":     "world",
+		"sub/dir/deep/file": "deep",
+		"other/secret":      "secret",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+	url := "rsync://localhost:" + srv.Port + "/interop/"
+
+	for _, tt := range []struct {
+		desc string
+		src  string
+		top  string // the top directory within dest
+	}{
+		{desc: "contents", src: "sub/", top: ""},
+		{desc: "directory", src: "sub", top: "sub"},
+	} {
+		for _, args := range [][]string{
+			{"--protocol=29"},
+			{"--no-inc-recursive"},
+			{}, // incremental recursion
+		} {
+			t.Run(tt.desc+"/"+strings.Join(args, " "), func(t *testing.T) {
+				dest := filepath.Join(t.TempDir(), "dest")
+				args := append([]string{"gokr-rsync", "--gokr.dont_restrict", "-a", "--delete"}, args...)
+				args = append(args, url+tt.src, dest+"/")
+				rsynctest.Run(t, args...)
+
+				top := filepath.Join(dest, tt.top)
+				extraneous := []string{
+					filepath.Join(top, "extrafile"),
+					filepath.Join(top, "extradir", "nested", "file"),
+					filepath.Join(top, "dir", "extrafile"),
+					filepath.Join(top, "dir", "deep", "extradir", "file"),
+				}
+				for _, fn := range extraneous {
+					if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(fn, []byte("deleteme"), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// Outside of the top directory, nothing is deleted.
+				unrelated := filepath.Join(dest, "unrelated")
+				if tt.top != "" {
+					if err := os.WriteFile(unrelated, []byte("keep"), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				rsynctest.Run(t, args...)
+
+				for _, fn := range append(extraneous,
+					filepath.Join(top, "extradir"),
+					filepath.Join(top, "dir", "deep", "extradir")) {
+					if _, err := os.Lstat(fn); !os.IsNotExist(err) {
+						t.Errorf("expected %s to be deleted, but: %v", fn, err)
+					}
+				}
+				for _, fn := range []string{"hello", "dir/world", "dir/deep/file"} {
+					if _, err := os.Stat(filepath.Join(top, fn)); err != nil {
+						t.Error(err)
+					}
+				}
+				if tt.top != "" {
+					if _, err := os.Stat(unrelated); err != nil {
+						t.Error(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReceiverSyncDeleteIOError(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() == 0 {
+		t.Skip("uid 0 can read the directory despite chmod(0)")
+	}
+
+	for _, tt := range []struct {
+		desc        string
+		args        []string
+		wantDeleted bool
+	}{
+		{"inc-recursive", []string{"-a", "--delete"}, false},
+		{"no-inc-recursive", []string{"-a", "--delete", "--no-inc-recursive"}, false},
+		{"ignore-errors", []string{"-a", "--delete", "--ignore-errors"}, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			unreadable := filepath.Join(source, "unreadable")
+			if err := os.MkdirAll(unreadable, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(unreadable, "precious"), []byte("backup"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			srv.RunClient(t, tt.args, []string{dest})
+
+			// The sender cannot list the directory contents now, which
+			// must not make the receiver delete its copy of them.
+			if err := os.Chmod(unreadable, 0); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chmod(unreadable, 0755) })
+			srv.RunClient(t, tt.args, []string{dest})
+
+			// The receiver copied the permissions of the directory.
+			if err := os.Chmod(filepath.Join(dest, "unreadable"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			_, err := os.Stat(filepath.Join(dest, "unreadable", "precious"))
+			if tt.wantDeleted {
+				if !os.IsNotExist(err) {
+					t.Errorf("expected unreadable/precious to be deleted, but: %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unreadable/precious was deleted despite the I/O error: %v", err)
+			}
+		})
+	}
+}
+
+// writeHardLinkedTree creates files in source, some of which are hard-linked
+// to each other, also across directories.
+func writeHardLinkedTree(t *testing.T, source string) map[string]string {
+	t.Helper()
+	want := map[string]string{
+		"a":         "first group",
+		"b":         "first group",
+		"sub/a":     "first group",
+		"single":    "not linked",
+		"sub/other": "second group",
+		"sub/x/y":   "second group",
+	}
+	if err := os.MkdirAll(filepath.Join(source, "sub", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "single", "sub/other"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(want[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"b":       "a",
+		"sub/a":   "a",
+		"sub/x/y": "sub/other",
+	} {
+		if err := os.Link(filepath.Join(source, target), filepath.Join(source, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return want
+}
+
+func TestReceiverHardLinks(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		desc string
+		args []string
+	}{
+		{"inc-recursive", []string{"-aH"}},
+		{"no-inc-recursive", []string{"-aH", "--no-inc-recursive"}},
+		{"protocol-29", []string{"-aH", "--protocol=29"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			want := writeHardLinkedTree(t, source)
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			srv.RunClient(t, tt.args, []string{dest})
+
+			for name, contents := range want {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != contents {
+					t.Errorf("%s: got %q, want %q", name, got, contents)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiverSymlinkTimes(t *testing.T) {
+	t.Parallel()
+
+	lchtimes := func(t *testing.T, fn string, mtime time.Time) {
+		t.Helper()
+		ts := []unix.Timespec{
+			unix.NsecToTimespec(mtime.UnixNano()),
+			unix.NsecToTimespec(mtime.UnixNano()),
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, fn, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	linkMtime := time.Date(2009, 2, 13, 23, 31, 30, 0, time.UTC)
+	for _, tt := range []struct {
+		desc      string
+		args      []string
+		wantMtime bool
+	}{
+		{"times", []string{"-rlt"}, true},
+		{"protocol-29", []string{"-rlt", "--protocol=29"}, true},
+		{"omit-link-times", []string{"-rlt", "--omit-link-times"}, false},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if err := os.MkdirAll(source, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(source, "hello"), []byte("world"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			link := filepath.Join(source, "hey")
+			if err := os.Symlink("hello", link); err != nil {
+				t.Fatal(err)
+			}
+			lchtimes(t, link, linkMtime)
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			srv.RunClient(t, tt.args, []string{dest})
+
+			st, err := os.Lstat(filepath.Join(dest, "hey"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := st.ModTime().Equal(linkMtime); got != tt.wantMtime {
+				t.Errorf("symlink mtime = %v, want it to equal %v: %v", st.ModTime(), linkMtime, tt.wantMtime)
+			}
+			if !tt.wantMtime {
+				return
+			}
+
+			// An up to date symlink with a different mtime only has its
+			// mtime updated.
+			later := linkMtime.Add(time.Hour)
+			lchtimes(t, link, later)
+			srv.RunClient(t, tt.args, []string{dest})
+			st, err = os.Lstat(filepath.Join(dest, "hey"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.ModTime().Equal(later) {
+				t.Errorf("symlink mtime after resync = %v, want %v", st.ModTime(), later)
+			}
+			if target, err := os.Readlink(filepath.Join(dest, "hey")); err != nil {
+				t.Fatal(err)
+			} else if target != "hello" {
+				t.Errorf("symlink target = %q, want %q", target, "hello")
+			}
+		})
+	}
+}
+
+// TestReceiverCopyLinks verifies that with --copy-links, the destination
+// contains the referents of symlinks instead of symlinks, and that symlinks
+// which form a loop or lead nowhere do not stop the transfer.
+func TestReceiverCopyLinks(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		desc string
+		args []string
+	}{
+		{"inc-recursive", []string{"-rlL"}},
+		{"no-inc-recursive", []string{"-rlL", "--no-inc-recursive"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if err := os.MkdirAll(filepath.Join(source, "dir", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{
+				"hello":        "world",
+				"dir/sub/file": "nested",
+			} {
+				if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for link, target := range map[string]string{
+				"hey":          "hello",
+				"dirlink":      "dir",
+				"dir/sub/loop": "../..",
+				"dangling":     "nonexistent",
+			} {
+				if err := os.Symlink(target, filepath.Join(source, link)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			srv.RunClient(t, tt.args, []string{dest})
+
+			want := map[string]string{
+				"hello":            "world",
+				"hey":              "world",
+				"dir/sub/file":     "nested",
+				"dirlink/sub/file": "nested",
+			}
+			got := make(map[string]string)
+			err := filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(dest, path)
+				if err != nil {
+					return err
+				}
+				if d.Type()&fs.ModeSymlink != 0 {
+					t.Errorf("%s: unexpectedly a symlink", rel)
+					return nil
+				}
+				if d.IsDir() {
+					return nil
+				}
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				got[rel] = string(b)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected destination contents: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestReceiverModTimes verifies that modification times after 2038 and before
+// 1970 survive a transfer, or are clamped to the representable range (1970
+// until 2106) with protocols before 30.
+func TestReceiverModTimes(t *testing.T) {
+	t.Parallel()
+
+	mtimes := map[string]time.Time{
+		"future":     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		"far-future": time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC),
+		"pre-epoch":  time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, mtime := range mtimes {
+		fn := filepath.Join(source, name)
+		if err := os.WriteFile(fn, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+
+	for _, tt := range []struct {
+		protocol string
+		want     map[string]time.Time
+	}{
+		{
+			protocol: "27",
+			want: map[string]time.Time{
+				"future":     mtimes["future"],
+				"far-future": time.Unix(math.MaxUint32, 0),
+				"pre-epoch":  time.Unix(0, 0),
+			},
+		},
+		{
+			protocol: "31",
+			want:     mtimes,
+		},
+	} {
+		t.Run(tt.protocol, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(tmp, "dest-"+tt.protocol)
+			srv.RunClient(t, []string{"-a", "--protocol=" + tt.protocol}, []string{dest})
+			for name, want := range tt.want {
+				st, err := os.Stat(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := st.ModTime(); !got.Equal(want) {
+					t.Errorf("%s: mtime = %v, want %v", name, got.UTC(), want.UTC())
+				}
+			}
+		})
+	}
+}
+
+// TestReceiverNanosecondTimes verifies that the nanoseconds of modification
+// times are preserved with protocol 31, and that the quick check only
+// considers them when the sender transmits them.
+func TestReceiverNanosecondTimes(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "data"), []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(source, "data"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+
+	for _, tt := range []struct {
+		desc      string
+		args      []string
+		wantMtime time.Time
+		// destMtime is the mtime of an existing destination file with
+		// different contents (but the same size).
+		destMtime time.Time
+		wantSkip  bool
+	}{
+		{
+			desc:      "protocol-31",
+			args:      []string{"-a"},
+			wantMtime: mtime,
+			destMtime: mtime.Truncate(time.Second),
+			wantSkip:  false, // the nanoseconds differ
+		},
+		{
+			desc:      "protocol-30",
+			args:      []string{"-a", "--protocol=30"},
+			wantMtime: mtime.Truncate(time.Second),
+			destMtime: mtime.Add(-100 * time.Millisecond),
+			wantSkip:  true, // no nanoseconds transmitted
+		},
+		{
+			desc:      "modify-window",
+			args:      []string{"-a", "--modify-window=2"},
+			wantMtime: mtime,
+			destMtime: mtime.Add(2 * time.Second),
+			wantSkip:  true,
+		},
+		{
+			desc:      "beyond-modify-window",
+			args:      []string{"-a", "--modify-window=1"},
+			wantMtime: mtime,
+			destMtime: mtime.Add(2 * time.Second),
+			wantSkip:  false,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(tmp, "dest-"+tt.desc)
+			srv.RunClient(t, tt.args, []string{dest})
+			destData := filepath.Join(dest, "data")
+			st, err := os.Stat(destData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := st.ModTime(); !got.Equal(tt.wantMtime) {
+				t.Errorf("mtime = %v, want %v", got.UTC(), tt.wantMtime)
+			}
+
+			if err := os.WriteFile(destData, []byte("modify"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(destData, tt.destMtime, tt.destMtime); err != nil {
+				t.Fatal(err)
+			}
+			srv.RunClient(t, tt.args, []string{dest})
+			b, err := os.ReadFile(destData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "source"
+			if tt.wantSkip {
+				want = "modify"
+			}
+			if got := string(b); got != want {
+				t.Errorf("after syncing over a file with mtime %v: got %q, want %q", tt.destMtime, got, want)
+			}
+		})
+	}
+}
+
+func TestReceiverIncRecurse(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		desc string
+		args []string
+	}{
+		{"inc-recursive", []string{"-a", "--delete"}},
+		{"no-inc-recursive", []string{"-a", "--delete", "--no-inc-recursive"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+
+			// Enough directories and files for the sender to send more than
+			// one file list ahead of the generator.
+			want := make(map[string]string)
+			for i := range 30 {
+				dir := filepath.Join(fmt.Sprintf("dir%02d", i), "sub", "subsub")
+				if err := os.MkdirAll(filepath.Join(source, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+				for j := range 50 {
+					name := filepath.Join(dir, fmt.Sprintf("file%02d", j))
+					if j%2 == 0 {
+						name = filepath.Join(filepath.Dir(dir), fmt.Sprintf("file%02d", j))
+					}
+					want[name] = name
+					if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			// start a server to sync from
+			srv := rsynctest.NewInMemory(t, rsyncd.Module{
+				Name: "interop",
+				Path: source,
+			})
+			srv.RunClient(t, tt.args, []string{dest})
+
+			// Add more files to the destination, which should be deleted:
+			extra := filepath.Join(dest, "dir07", "sub", "extrafile")
+			if err := os.WriteFile(extra, []byte("deleteme"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			srv.RunClient(t, tt.args, []string{dest})
+			if _, err := os.Stat(extra); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be deleted, but it still exists", extra)
+			}
+
+			got := make(map[string]string)
+			err := filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(dest, path)
+				if err != nil {
+					return err
+				}
+				got[rel] = string(b)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected destination contents: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestReceiverAlwaysChecksum(t *testing.T) {
 	t.Parallel()
 
@@ -530,6 +1591,53 @@ func TestReceiverCommand(t *testing.T) {
 		dest)
 }
 
+// TestReceiverCommandRemoveSourceFiles verifies that the sender, running in
+// command mode with landlock (in a separate process, like over ssh), can
+// remove the source files it sent.
+func TestReceiverCommandRemoveSourceFiles(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"hello", "dir/world"} {
+		if err := os.WriteFile(filepath.Join(source, fn), []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The landlock rules of the test binary allow writing to $TMPDIR, so
+	// point the server to a different one.
+	serverTmp := filepath.Join(tmp, "servertmp")
+	if err := os.MkdirAll(serverTmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	rsynctest.Run(t, "gokr-rsync",
+		"--gokr.dont_restrict",
+		"-a",
+		"--remove-source-files",
+		"-e", "env TMPDIR="+serverTmp+" "+os.Args[0],
+		"localhost:"+source+"/",
+		dest)
+
+	for _, fn := range []string{"hello", "dir/world"} {
+		got, err := os.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fn; string(got) != want {
+			t.Errorf("%s: unexpected content: got %q, want %q", fn, got, want)
+		}
+		if _, err := os.Lstat(filepath.Join(source, fn)); !os.IsNotExist(err) {
+			t.Errorf("source file %s unexpectedly not removed (err=%v)", fn, err)
+		}
+	}
+}
+
 // TestReceiverSymlinkTraversal passes by default but is useful to simulate
 // a symlink race TOCTOU attack by modifying rsyncd/rsyncd.go.
 func TestReceiverSymlinkTraversal(t *testing.T) {
@@ -588,3 +1696,497 @@ func TestReceiverSymlinkTraversal(t *testing.T) {
 		}
 	}
 }
+
+// TestReceiverSymlinkRace swaps a destination directory for a symlink leading
+// out of the destination (and back) while transfers write into it. All file
+// operations of the receiver go through the destination's os.Root, so they
+// fail instead of following the symlink.
+func TestReceiverSymlinkRace(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(source, "dir"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 200 {
+		fn := filepath.Join(source, "dir", fmt.Sprintf("file%03d", i))
+		if err := os.WriteFile(fn, []byte("benign"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// With --delete, the receiver deletes stale files in dest/dir, which must
+	// not extend to the files in outside.
+	decoy := filepath.Join(outside, "decoy")
+	if err := os.WriteFile(decoy, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	args := []string{"-a", "--delete", "--ignore-times"}
+	srv.RunClient(t, args, []string{dest})
+
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		dir := filepath.Join(dest, "dir")
+		real := filepath.Join(dest, "dir.real")
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := os.Rename(dir, real); err != nil {
+				continue // the receiver re-created dir in the meantime
+			}
+			if err := os.Symlink(outside, dir); err == nil {
+				time.Sleep(100 * time.Microsecond)
+				os.Remove(dir)
+			}
+			os.Rename(real, dir)
+		}
+	}()
+	for range 10 {
+		// Failures are expected: files disappear and directories turn into
+		// symlinks during the transfer.
+		srv.RunClientErr(t, args, []string{dest})
+	}
+	close(done)
+	<-swapped
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if diff := cmp.Diff([]string{"decoy"}, names); diff != "" {
+		t.Errorf("files outside of the destination changed: diff (-want +got):\n%s", diff)
+	}
+	st, err := os.Stat(decoy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), fs.FileMode(0600); got != want {
+		t.Errorf("decoy: got mode %v, want %v", got, want)
+	}
+	got, err := os.ReadFile(decoy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "secret"; string(got) != want {
+		t.Errorf("decoy: got contents %q, want %q", got, want)
+	}
+}
+
+// TestReceiverDefaultPerms syncs without --perms: new files get the sender’s
+// permissions minus the umask, existing files keep theirs.
+func TestReceiverDefaultPerms(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{filepath.Join(source, "dir"), dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Find out the umask without changing it: open(2) applies it.
+	probe := filepath.Join(tmp, "probe")
+	f, err := os.OpenFile(probe, os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	st, err := os.Stat(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	umask := 0777 &^ st.Mode().Perm()
+
+	// chmod sets the exact modes, which are not subject to the umask.
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	write := func(fn, content string, mode os.FileMode) {
+		t.Helper()
+		if err := os.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fn, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(source, "new"), "new", 0666)
+	write(filepath.Join(source, "changed"), "new contents", 0644)
+	write(filepath.Join(source, "same"), "same", 0644)
+	if err := os.Chmod(filepath.Join(source, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(dest, "changed"), "old", 0600)
+	write(filepath.Join(dest, "same"), "same", 0640)
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	srv.RunClient(t, []string{"-rt"}, []string{dest})
+
+	for _, tt := range []struct {
+		name string
+		want os.FileMode
+	}{
+		{"new", 0666 &^ umask},
+		{"dir", 0777 &^ umask},
+		{"changed", 0600},
+		{"same", 0640},
+	} {
+		st, err := os.Stat(filepath.Join(dest, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode().Perm(); got != tt.want {
+			t.Errorf("%s: got mode %v, want %v (umask %03o)", tt.name, got, tt.want, umask)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "new contents"; string(got) != want {
+		t.Errorf("changed: got contents %q, want %q", got, want)
+	}
+}
+
+func TestReceiverSpecials(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	rsynctest.CreateDummySpecialFiles(t, source)
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	// --specials without --devices, which does not require root privileges.
+	args := []string{"-rpt", "--specials"}
+	srv.RunClient(t, args, []string{dest})
+	rsynctest.VerifyDummySpecialFiles(t, source, dest)
+
+	// The existing FIFO and socket are up to date, only the changed
+	// permissions need to be applied.
+	if err := os.Chmod(filepath.Join(source, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv.RunClient(t, args, []string{dest})
+	rsynctest.VerifyDummySpecialFiles(t, source, dest)
+}
+
+func TestReceiverSafeLinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"dir/up":      "../hello",
+		"passwd":      "../../../etc/passwd",
+		"absolute":    "/etc/passwd",
+		"dir/outside": "../../hello",
+	} {
+		if err := os.Symlink(target, filepath.Join(source, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	srv.RunClient(t, []string{"-rl", "--safe-links"}, []string{dest})
+
+	got, err := os.Readlink(filepath.Join(dest, "dir", "up"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "../hello"; got != want {
+		t.Errorf("dir/up: unexpected symlink target: got %q, want %q", got, want)
+	}
+	for _, fn := range []string{"passwd", "absolute", "dir/outside"} {
+		if _, err := os.Lstat(filepath.Join(dest, fn)); !os.IsNotExist(err) {
+			t.Errorf("unsafe symlink %s unexpectedly created (err=%v)", fn, err)
+		}
+	}
+}
+
+func TestReceiverMungeLinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hello", filepath.Join(source, "hey")); err != nil {
+		t.Fatal(err)
+	}
+	linkTarget := func(dir string) string {
+		t.Helper()
+		target, err := os.Readlink(filepath.Join(dir, "hey"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return target
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	srv.RunClient(t, []string{"-rl", "--munge-links"}, []string{dest})
+	if got, want := linkTarget(dest), "/rsyncd-munged/hello"; got != want {
+		t.Errorf("unexpected munged symlink target: got %q, want %q", got, want)
+	}
+
+	// Sending with --munge-links restores the original symlink.
+	restored := filepath.Join(tmp, "restored")
+	dsrv := rsynctest.New(t, rsynctest.WritableInteropModule(restored), rsynctest.DontRestrict())
+	rsynctest.Run(t,
+		"gokr-rsync",
+		"--gokr.dont_restrict",
+		"-rl",
+		"--munge-links",
+		dest+"/",
+		"rsync://localhost:"+dsrv.Port+"/interop/")
+	if got, want := linkTarget(restored), "hello"; got != want {
+		t.Errorf("unexpected restored symlink target: got %q, want %q", got, want)
+	}
+
+	// Receiving without --munge-links replaces the munged symlink.
+	srv.RunClient(t, []string{"-rl"}, []string{dest})
+	if got, want := linkTarget(dest), "hello"; got != want {
+		t.Errorf("unexpected symlink target: got %q, want %q", got, want)
+	}
+}
+
+func TestReceiverTypeConflicts(t *testing.T) {
+	t.Parallel()
+
+	// create creates a file of the specified kind at fn. Directories are
+	// not empty, so that replacing them requires deleting their contents.
+	create := func(t *testing.T, kind, fn string) {
+		t.Helper()
+		var err error
+		switch kind {
+		case "file":
+			err = os.WriteFile(fn, []byte("file"), 0644)
+		case "dir":
+			if err = os.MkdirAll(fn, 0755); err == nil {
+				err = os.WriteFile(filepath.Join(fn, "inner"), []byte("inner"), 0644)
+			}
+		case "symlink":
+			err = os.Symlink("target-"+filepath.Base(filepath.Dir(fn)), fn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	kindOf := func(t *testing.T, fn string) string {
+		t.Helper()
+		st, err := os.Lstat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case st.Mode().IsRegular():
+			return "file"
+		case st.IsDir():
+			return "dir"
+		case st.Mode().Type()&os.ModeSymlink != 0:
+			return "symlink"
+		}
+		return st.Mode().String()
+	}
+
+	for _, tt := range []struct {
+		source, dest string
+	}{
+		{source: "file", dest: "dir"},
+		{source: "file", dest: "symlink"},
+		{source: "dir", dest: "file"},
+		{source: "dir", dest: "symlink"},
+		{source: "symlink", dest: "file"},
+		{source: "symlink", dest: "dir"},
+	} {
+		t.Run(tt.source+"-over-"+tt.dest, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			for _, dir := range []string{source, dest} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			create(t, tt.source, filepath.Join(source, "x"))
+			create(t, tt.dest, filepath.Join(dest, "x"))
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+
+			args := []string{"-rl"}
+			if tt.dest == "dir" {
+				// Without --force (or --delete), rsync only deletes
+				// empty directories to make room.
+				if _, err := srv.RunClientErr(t, args, []string{dest}); err == nil {
+					t.Fatalf("replacing a non-empty directory without --force unexpectedly succeeded")
+				}
+				if got, want := kindOf(t, filepath.Join(dest, "x")), "dir"; got != want {
+					t.Fatalf("x: unexpected type: got %s, want %s", got, want)
+				}
+				args = append(args, "--force")
+			}
+			srv.RunClient(t, args, []string{dest})
+
+			fn := filepath.Join(dest, "x")
+			if got, want := kindOf(t, fn), tt.source; got != want {
+				t.Fatalf("x: unexpected type: got %s, want %s", got, want)
+			}
+			switch tt.source {
+			case "file":
+				b, err := os.ReadFile(fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := string(b), "file"; got != want {
+					t.Errorf("x: unexpected contents: got %q, want %q", got, want)
+				}
+			case "dir":
+				if _, err := os.Stat(filepath.Join(fn, "inner")); err != nil {
+					t.Error(err)
+				}
+			case "symlink":
+				target, err := os.Readlink(fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := target, "target-source"; got != want {
+					t.Errorf("x: unexpected symlink target: got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiverCopyDirlinks(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		desc string
+		args []string
+	}{
+		{"inc-recursive", []string{"-rlk"}},
+		{"no-inc-recursive", []string{"-rlk", "--no-inc-recursive"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if err := os.MkdirAll(filepath.Join(source, "dir", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{
+				"hello":        "world",
+				"dir/sub/file": "nested",
+			} {
+				if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for link, target := range map[string]string{
+				"hey":     "hello",
+				"dirlink": "dir",
+			} {
+				if err := os.Symlink(target, filepath.Join(source, link)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			srv := rsynctest.NewInMemoryInterop(t, source)
+			srv.RunClient(t, tt.args, []string{dest})
+
+			// The symlink to a directory is replaced by the directory…
+			st, err := os.Lstat(filepath.Join(dest, "dirlink"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.IsDir() {
+				t.Errorf("dirlink: unexpected type: got %v, want directory", st.Mode())
+			}
+			b, err := os.ReadFile(filepath.Join(dest, "dirlink", "sub", "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), "nested"; got != want {
+				t.Errorf("dirlink/sub/file: unexpected contents: got %q, want %q", got, want)
+			}
+			// …whereas the symlink to a file is kept.
+			target, err := os.Readlink(filepath.Join(dest, "hey"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := target, "hello"; got != want {
+				t.Errorf("hey: unexpected symlink target: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReceiverKeepDirlinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "dir", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dest, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dest, "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.NewInMemoryInterop(t, source)
+	srv.RunClient(t, []string{"-rtK"}, []string{dest})
+
+	// The symlink is kept and the directory contents go where it points to.
+	target, err := os.Readlink(filepath.Join(dest, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := target, "real"; got != want {
+		t.Errorf("dir: unexpected symlink target: got %q, want %q", got, want)
+	}
+	b, err := os.ReadFile(filepath.Join(dest, "real", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "hello"; got != want {
+		t.Errorf("real/file: unexpected contents: got %q, want %q", got, want)
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/gokrazy/rsync/internal/rsynctest"
 	"github.com/gokrazy/rsync/internal/testlogger"
+	"github.com/gokrazy/rsync/rsyncd"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/renameio/v2"
 )
@@ -391,7 +392,9 @@ func TestSenderTraversal(t *testing.T) {
 		"rsync://localhost:" + srv.Port + "/interop/../",
 		dest + "/",
 	}
-	rsynctest.Run(t, args...)
+	if out, err := rsynctest.CombinedOutput(args...); err == nil {
+		t.Fatalf("%v unexpectedly succeeded:\n%s", args, out)
+	}
 
 	passwd := filepath.Join(dest, "passwd")
 
@@ -401,6 +404,72 @@ func TestSenderTraversal(t *testing.T) {
 	}
 }
 
+func TestSenderModulePaths(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	other := filepath.Join(tmp, "other")
+	dest := filepath.Join(tmp, "dest")
+
+	for fn, contents := range map[string]string{
+		filepath.Join(source, "a", "hello"):       "a",
+		filepath.Join(source, "b", "hello"):       "b",
+		filepath.Join(source, "sub dir", "hello"): "sub dir",
+		filepath.Join(other, "secret"):            "secret",
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// start a server to sync from
+	srv := rsynctest.New(t, append(rsynctest.InteropModule(source), rsyncd.Module{
+		Name: "othermod",
+		Path: other,
+	}))
+	url := "rsync://localhost:" + srv.Port + "/"
+	// Each restricted client run stacks another landlock ruleset onto the
+	// test process, of which there can only be 16.
+
+	// Multiple paths from the same module end up in one file list.
+	rsynctest.Run(t, "gokr-rsync", "--gokr.dont_restrict", "-a", url+"interop/a", url+"interop/b", dest+"/")
+	for _, dir := range []string{"a", "b"} {
+		got, err := os.ReadFile(filepath.Join(dest, dir, "hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(dir, string(got)); diff != "" {
+			t.Errorf("%s: unexpected file contents: diff (-want +got):\n%s", dir, diff)
+		}
+	}
+
+	// Paths with spaces, copying the directory contents.
+	subdest := filepath.Join(tmp, "subdest")
+	rsynctest.Run(t, "gokr-rsync", "--gokr.dont_restrict", "-a", url+"interop/sub dir/", subdest+"/")
+	if _, err := os.Stat(filepath.Join(subdest, "hello")); err != nil {
+		t.Error(err)
+	}
+
+	// The module name alone refers to the module.
+	moddest := filepath.Join(tmp, "moddest")
+	rsynctest.Run(t, "gokr-rsync", "--gokr.dont_restrict", "-a", url+"interop", moddest+"/")
+	if _, err := os.Stat(filepath.Join(moddest, "a", "hello")); err != nil {
+		t.Error(err)
+	}
+
+	// Escaping the module is rejected.
+	hostile := filepath.Join(tmp, "hostile")
+	args := []string{"gokr-rsync", "--gokr.dont_restrict", "-a", url + "interop/../othermod/", hostile + "/"}
+	if out, err := rsynctest.CombinedOutput(args...); err == nil {
+		t.Fatalf("%v unexpectedly succeeded:\n%s", args, out)
+	}
+	if _, err := os.Stat(filepath.Join(hostile, "secret")); err == nil {
+		t.Errorf("unexpectedly synced a file from another module")
+	}
+}
+
 // like TestSender, but both source and dest are local directories
 func TestSenderBothLocal(t *testing.T) {
 	t.Parallel()
@@ -699,3 +768,138 @@ func TestReceiverCommandDryRun(t *testing.T) {
 		t.Fatalf("rsync error, output:\n%s", buf.String())
 	}
 }
+
+func TestSenderCopyUnsafeLinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	outside := filepath.Join(tmp, "outside")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(source, "inside"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "file"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"safe":      "inside",
+		"unsafe":    "../outside/file",
+		"unsafedir": "../outside",
+	} {
+		if err := os.Symlink(target, filepath.Join(source, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// start a server to sync to
+	srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--copy-unsafe-links",
+		source + "/",
+		"rsync://localhost:" + srv.Port + "/interop/",
+	}
+	rsynctest.Run(t, args...)
+
+	// The symlink within the transfer is kept…
+	got, err := os.Readlink(filepath.Join(dest, "safe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "inside"; got != want {
+		t.Errorf("safe: unexpected symlink target: got %q, want %q", got, want)
+	}
+	// …whereas those pointing outside of it are replaced by their referents.
+	for _, fn := range []string{"unsafe", "unsafedir/file"} {
+		st, err := os.Lstat(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !st.Mode().IsRegular() {
+			t.Errorf("%s: unexpectedly not a regular file: %v", fn, st.Mode())
+		}
+		b, err := os.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "outside"; got != want {
+			t.Errorf("%s: unexpected contents: got %q, want %q", fn, got, want)
+		}
+	}
+}
+
+// TestSenderToTridgeRsync pushes to tridge rsync as the (remote shell) server,
+// so that gokr-rsync sends to an independent receiver.
+func TestSenderToTridgeRsync(t *testing.T) {
+	t.Parallel()
+
+	testSenderTo(t, rsynctest.TridgeOrGTFO(t, "stock rsync as the receiver"))
+}
+
+// TestSenderToOpenRsync is like TestSenderToTridgeRsync, but with openrsync
+// (the default rsync on macOS 15+), which speaks protocol 27.
+func TestSenderToOpenRsync(t *testing.T) {
+	t.Parallel()
+
+	testSenderTo(t, rsynctest.OpenrsyncOrSkip(t))
+}
+
+// testSenderTo pushes to rsyncBin as the remote shell server.
+func testSenderTo(t *testing.T, rsyncBin string) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	destLarge := filepath.Join(dest, "large-data-file")
+
+	headPattern := []byte{0x11}
+	bodyPattern := []byte{0xbb}
+	endPattern := []byte{0xee}
+	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+	if err := os.WriteFile(filepath.Join(source, "private"), []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("private", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote shell runs rsyncBin instead of the remote command
+	// (rsync), skipping over the machine name.
+	rsh := filepath.Join(tmp, "rsh")
+	script := "#!/bin/sh\nshift 2\nexec " + rsyncBin + " \"$@\"\n"
+	if err := os.WriteFile(rsh, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rsynctest.Run(t, "gokr-rsync",
+		"--gokr.dont_restrict",
+		"-a",
+		"-e", rsh,
+		source+"/",
+		"localhost:"+dest)
+
+	if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dest, "private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("private: got mode %v, want %v", got, want)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "private" {
+		t.Errorf("link: got target %q, want %q", target, "private")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/gokrazy/rsync/internal/rsyncdconfig"
@@ -23,12 +24,39 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-type mainFunc func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+type mainFunc func(cfg *rsyncdconfig.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
 
 type anonssh struct {
 	cfg   *rsyncdconfig.Config
 	main  mainFunc
 	osenv *rsyncos.Env
+
+	// moduleKeys contains the authorized keys of each module which
+	// restricts access using ssh_authorized_keys.
+	moduleKeys map[string]map[string]bool
+}
+
+// pubKeyExtension is the ssh.Permissions extension under which
+// PublicKeyCallback stores the client’s (marshaled) public key.
+const pubKeyExtension = "gokrazy-rsync-pubkey"
+
+// configFor returns the configuration to use for a connection authenticated
+// with pubKey: modules whose ssh_authorized_keys do not list pubKey are
+// removed. restricted is true if any module was removed.
+func (as *anonssh) configFor(pubKey string) (cfg *rsyncdconfig.Config, restricted bool) {
+	if len(as.moduleKeys) == 0 {
+		return as.cfg, false
+	}
+	filtered := *as.cfg
+	filtered.Modules = nil
+	for _, mod := range as.cfg.Modules {
+		if keys, ok := as.moduleKeys[mod.Name]; ok && !keys[pubKey] {
+			restricted = true
+			continue
+		}
+		filtered.Modules = append(filtered.Modules, mod)
+	}
+	return &filtered, restricted
 }
 
 // env is a Environment Variable request as per RFC4254 6.4.
@@ -45,6 +73,12 @@ type execR struct {
 type session struct {
 	channel ssh.Channel
 	anonssh *anonssh
+
+	// cfg is the configuration for this connection’s public key.
+	cfg *rsyncdconfig.Config
+	// restricted is true if cfg lacks modules which the public key is not
+	// authorized for.
+	restricted bool
 }
 
 func (s *session) request(ctx context.Context, req *ssh.Request) error {
@@ -74,9 +108,14 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 
 		s.anonssh.osenv.Logf("cmdline: %q", cmdline)
 		// 2021/09/12 21:25:34 cmdline: ["rsync" "--server" "--daemon" "."]
+		if s.restricted && !slices.Contains(cmdline, "--daemon") {
+			// Command mode accesses paths instead of modules, which would
+			// bypass the module-level authorized keys.
+			return fmt.Errorf("public key not authorized for all modules, only rsync daemon mode (rsync://, or host::module) is permitted")
+		}
 		go func() {
 			stderr := s.channel.Stderr()
-			err := s.anonssh.main(cmdline, s.channel, s.channel, stderr)
+			err := s.anonssh.main(s.cfg, cmdline, s.channel, s.channel, stderr)
 			if err != nil {
 				fmt.Fprintf(stderr, "%s\n", err)
 			}
@@ -106,7 +145,7 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 	return nil
 }
 
-func (as *anonssh) handleSession(newChannel ssh.NewChannel) {
+func (as *anonssh) handleSession(newChannel ssh.NewChannel, cfg *rsyncdconfig.Config, restricted bool) {
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		as.osenv.Logf("Could not accept channel (%s)", err)
@@ -118,8 +157,10 @@ func (as *anonssh) handleSession(newChannel ssh.NewChannel) {
 		ctx, canc := context.WithCancel(context.Background())
 		defer canc()
 		s := session{
-			channel: channel,
-			anonssh: as,
+			channel:    channel,
+			anonssh:    as,
+			cfg:        cfg,
+			restricted: restricted,
 		}
 		for req := range requests {
 			if err := s.request(ctx, req); err != nil {
@@ -139,10 +180,10 @@ func (as *anonssh) handleSession(newChannel ssh.NewChannel) {
 	}(channel, requests)
 }
 
-func (as *anonssh) handleChannel(newChan ssh.NewChannel) {
+func (as *anonssh) handleChannel(newChan ssh.NewChannel, cfg *rsyncdconfig.Config, restricted bool) {
 	switch t := newChan.ChannelType(); t {
 	case "session":
-		as.handleSession(newChan)
+		as.handleSession(newChan, cfg, restricted)
 	default:
 		newChan.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %q", t))
 		return
@@ -282,16 +323,34 @@ func Serve(ctx context.Context, osenv *rsyncos.Env, ln net.Listener, listener *L
 		main:  main,
 		osenv: osenv,
 	}
+	for _, mod := range cfg.Modules {
+		if mod.SSHAuthorizedKeys == "" {
+			continue
+		}
+		keys, err := loadAuthorizedKeys(osenv, mod.SSHAuthorizedKeys)
+		if err != nil {
+			return fmt.Errorf("module %q: %v", mod.Name, err)
+		}
+		if as.moduleKeys == nil {
+			as.moduleKeys = make(map[string]map[string]bool)
+		}
+		as.moduleKeys[mod.Name] = keys
+	}
 
 	config := &ssh.ServerConfig{
 		PublicKeyCallback: func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			perms := &ssh.Permissions{
+				Extensions: map[string]string{
+					pubKeyExtension: string(pubKey.Marshal()),
+				},
+			}
 			if listener.authorizedKeys == nil {
 				osenv.Logf("user %q successfully authorized from remote addr %s", conn.User(), conn.RemoteAddr())
-				return nil, nil
+				return perms, nil
 			}
 			if listener.authorizedKeys[string(pubKey.Marshal())] {
 				osenv.Logf("user %q successfully authorized from remote addr %s", conn.User(), conn.RemoteAddr())
-				return nil, nil
+				return perms, nil
 			}
 			return nil, fmt.Errorf("public key not found in %s", listener.authorizedKeysPath)
 		},
@@ -318,7 +377,7 @@ func Serve(ctx context.Context, osenv *rsyncos.Env, ln net.Listener, listener *L
 		}
 
 		go func(conn net.Conn) {
-			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
 			if err != nil {
 				osenv.Logf("handshake: %v", err)
 				return
@@ -327,8 +386,15 @@ func Serve(ctx context.Context, osenv *rsyncos.Env, ln net.Listener, listener *L
 			// discard all out of band requests
 			go ssh.DiscardRequests(reqs)
 
+			// Re-check the module-level authorized keys now that the key
+			// passed the listener’s authorized keys.
+			cfg, restricted := as.configFor(sconn.Permissions.Extensions[pubKeyExtension])
+			if restricted {
+				osenv.Logf("user %q from remote addr %s: public key not authorized for all modules, restricting to %d of %d modules", sconn.User(), sconn.RemoteAddr(), len(cfg.Modules), len(as.cfg.Modules))
+			}
+
 			for newChannel := range chans {
-				as.handleChannel(newChannel)
+				as.handleChannel(newChannel, cfg, restricted)
 			}
 		}(conn)
 	}
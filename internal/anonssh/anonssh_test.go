@@ -0,0 +1,131 @@
+package anonssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncdconfig"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"golang.org/x/crypto/ssh"
+)
+
+func genClientKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func writeAuthorizedKeys(t *testing.T, path string, signers ...ssh.Signer) {
+	t.Helper()
+	var b []byte
+	for _, s := range signers {
+		b = append(b, ssh.MarshalAuthorizedKey(s.PublicKey())...)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleAuthorizedKeys(t *testing.T) {
+	tmp := t.TempDir()
+	alice := genClientKey(t)
+	bob := genClientKey(t)
+
+	listenerKeys := filepath.Join(tmp, "authorized_keys")
+	writeAuthorizedKeys(t, listenerKeys, alice, bob)
+	privateKeys := filepath.Join(tmp, "private_authorized_keys")
+	writeAuthorizedKeys(t, privateKeys, alice)
+
+	osenv := rsyncostest.New(t)
+	listener, err := ListenerFromConfig(osenv, rsyncdconfig.Listener{
+		HostKeyPath: filepath.Join(tmp, "ssh_host_ed25519_key"),
+		AuthorizedSSH: rsyncdconfig.SSHListener{
+			Address:        "localhost:0",
+			AuthorizedKeys: listenerKeys,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &rsyncdconfig.Config{
+		Modules: []rsyncd.Module{
+			{Name: "public", Path: tmp},
+			{Name: "private", Path: tmp, SSHAuthorizedKeys: privateKeys},
+		},
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// main prints the modules it was given instead of serving them.
+	main := func(cfg *rsyncdconfig.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		for _, mod := range cfg.Modules {
+			fmt.Fprintln(stdout, mod.Name)
+		}
+		return nil
+	}
+	go Serve(t.Context(), osenv, ln, listener, cfg, main)
+
+	run := func(t *testing.T, signer ssh.Signer, cmd string) (string, error) {
+		t.Helper()
+		client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User:            "rsync",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		out, err := session.Output(cmd)
+		return strings.TrimSpace(string(out)), err
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		signer ssh.Signer
+		want   string
+	}{
+		{desc: "authorized for all modules", signer: alice, want: "public\nprivate"},
+		{desc: "authorized for the listener only", signer: bob, want: "public"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := run(t, tt.signer, "rsync --server --daemon .")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected modules: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("command mode", func(t *testing.T) {
+		if _, err := run(t, alice, "rsync --server --sender -r . "+tmp); err != nil {
+			t.Errorf("command mode with a fully authorized key: %v", err)
+		}
+		if _, err := run(t, bob, "rsync --server --sender -r . "+tmp); err == nil {
+			t.Errorf("command mode with a restricted key unexpectedly succeeded")
+		}
+	})
+}
@@ -3,6 +3,9 @@ package log_test
 import (
 	"bytes"
 	"fmt"
+	"log/slog"
+	"path/filepath"
+	"testing"
 
 	"github.com/gokrazy/rsync/internal/log"
 )
@@ -21,3 +24,35 @@ func (f *fakeLogger) Output(calldepth int, s string) error {
 	fmt.Fprintf(f.out, "%s", s)
 	return nil
 }
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		AddSource: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch a.Key {
+			case slog.TimeKey:
+				return slog.Attr{}
+			case slog.SourceKey:
+				src := a.Value.Any().(*slog.Source)
+				return slog.String(slog.SourceKey, filepath.Base(src.File))
+			}
+			return a
+		},
+	})
+	logger := log.NewSlog(h)
+	logger.Printf("sending %d files", 3)
+	log.With(logger, "module", "interop").Output(1, "done\n")
+	want := `level=INFO source=logger_test.go msg="sending 3 files"
+level=INFO source=logger_test.go msg=done module=interop
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected log output: got %q, want %q", got, want)
+	}
+
+	// Loggers without fields are returned unchanged.
+	std := log.New(&buf)
+	if got := log.With(std, "module", "interop"); got != std {
+		t.Errorf("With(%T) = %v, want the logger itself", std, got)
+	}
+}
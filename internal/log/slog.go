@@ -0,0 +1,57 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// slogLogger adapts an slog.Handler to the Logger interface.
+type slogLogger struct {
+	h slog.Handler
+}
+
+// NewSlog returns a Logger which emits each message as an slog record at
+// level Info, whose message is the formatted Printf (or Output) text. Fields
+// added with With are attached to every record.
+func NewSlog(h slog.Handler) Logger {
+	return &slogLogger{h: h}
+}
+
+// With returns a Logger which attaches the fields in args (alternating keys
+// and values, or slog.Attr values, like slog.Logger.With) to every record.
+// Loggers not created by NewSlog have no notion of fields and are returned
+// unchanged.
+func With(l Logger, args ...any) Logger {
+	sl, ok := l.(*slogLogger)
+	if !ok {
+		return l
+	}
+	return &slogLogger{h: slog.New(sl.h).With(args...).Handler()}
+}
+
+func (l *slogLogger) Printf(msg string, a ...any) {
+	// Skip runtime.Callers, log and Printf.
+	l.log(3, fmt.Sprintf(msg, a...))
+}
+
+func (l *slogLogger) Output(calldepth int, s string) error {
+	// Like with log.Logger.Output, a calldepth of 1 refers to the caller of
+	// Output; additionally skip runtime.Callers and log.
+	return l.log(calldepth+2, s)
+}
+
+func (l *slogLogger) log(skip int, s string) error {
+	ctx := context.Background()
+	if !l.h.Enabled(ctx, slog.LevelInfo) {
+		return nil
+	}
+	var pcs [1]uintptr
+	runtime.Callers(skip, pcs[:])
+	// The log package adds a missing newline, slog does not need one.
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, strings.TrimSuffix(s, "\n"), pcs[0])
+	return l.h.Handle(ctx, r)
+}
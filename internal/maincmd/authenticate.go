@@ -0,0 +1,136 @@
+package maincmd
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncos"
+	"github.com/mmcloughlin/md4"
+)
+
+// authDigests are the digests we can use to answer an authentication
+// challenge, in rsync’s order of preference.
+//
+// rsync/checksum.c:valid_auth_checksums_items
+var authDigests = map[string]func() hash.Hash{
+	"sha512": sha512.New,
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+	"md4":    md4.New,
+}
+
+// negotiateAuthDigest returns the digest to use for authentication: the first
+// digest of the list the server sent in its greeting which we support. Servers
+// which do not send a list (rsync < 3.2) use MD5 starting with protocol 30,
+// and a seeded MD4 before that (name "md4-old").
+//
+// rsync/compat.c:negotiate_daemon_auth
+func negotiateAuthDigest(serverList []string, protocol int32) (string, error) {
+	if len(serverList) == 0 {
+		if protocol >= 30 {
+			return "md5", nil
+		}
+		return "md4-old", nil
+	}
+	for _, name := range serverList {
+		if _, ok := authDigests[name]; ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to negotiate a daemon auth choice: server offered %q", strings.Join(serverList, " "))
+}
+
+// authResponse hashes the password and the server’s challenge, encoded in
+// base64 without padding.
+//
+// rsync/authenticate.c:generate_hash
+func authResponse(digest, password, challenge string) string {
+	var h hash.Hash
+	if digest == "md4-old" {
+		h = md4.New()
+		// sum_init hashes the (zero) checksum seed first.
+		h.Write([]byte{0, 0, 0, 0})
+	} else {
+		h = authDigests[digest]()
+	}
+	io.WriteString(h, password)
+	io.WriteString(h, challenge)
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// authPassword returns the password for authenticating to an rsync daemon,
+// read from --password-file or the RSYNC_PASSWORD environment variable.
+//
+// Unlike rsync, we do not prompt for a password on the terminal.
+//
+// rsync/authenticate.c:auth_client
+func authPassword(osenv *rsyncos.Env, opts *rsyncopts.Options) (string, error) {
+	if fn := opts.PasswordFile(); fn != "" {
+		return readPasswordFile(osenv, fn)
+	}
+	if pass, ok := osenv.LookupEnv("RSYNC_PASSWORD"); ok {
+		return pass, nil
+	}
+	return "", errors.New("the rsync daemon requires authentication, but no password was provided (use --password-file or set RSYNC_PASSWORD)")
+}
+
+// rsync/authenticate.c:getpassf
+func readPasswordFile(osenv *rsyncos.Env, fn string) (string, error) {
+	var r io.Reader
+	if fn == "-" {
+		r = osenv.Stdin
+	} else {
+		f, err := os.Open(fn)
+		if err != nil {
+			return "", fmt.Errorf("could not open password file %s: %v", fn, err)
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if err := checkPasswordFileMode(st); err != nil {
+			return "", err
+		}
+		r = f
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// rsync/clientserver.c:start_inband_exchange (auth_client)
+func authenticate(osenv *rsyncos.Env, opts *rsyncopts.Options, w io.Writer, user, digest, challenge string) error {
+	if user == "" {
+		user = osenv.Getenv("USER")
+	}
+	if user == "" {
+		user = osenv.Getenv("LOGNAME")
+	}
+	if user == "" {
+		user = "nobody"
+	}
+	password, err := authPassword(osenv, opts)
+	if err != nil {
+		return err
+	}
+	if opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
+		osenv.Logf("authenticating as %q using %s", user, digest)
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", user, authResponse(digest, password, challenge))
+	return err
+}
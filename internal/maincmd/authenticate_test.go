@@ -0,0 +1,183 @@
+package maincmd
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncos"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/mmcloughlin/md4"
+)
+
+// fakeDaemon answers the inband exchange like an rsync daemon which requires
+// authentication, sending result after reading the client’s response.
+func fakeDaemon(t *testing.T, conn net.Conn, greeting, result string) <-chan string {
+	responses := make(chan string, 1)
+	go func() {
+		defer conn.Close()
+		defer close(responses)
+		rd := bufio.NewReader(conn)
+		// net.Pipe is unbuffered, so unlike rsync, we need to read the
+		// client greeting before sending ours.
+		if _, err := rd.ReadString('\n'); err != nil {
+			t.Errorf("reading client greeting: %v", err)
+			return
+		}
+		if _, err := conn.Write([]byte(greeting)); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := rd.ReadString('\n'); err != nil {
+			t.Errorf("reading module: %v", err)
+			return
+		}
+		if _, err := conn.Write([]byte("@RSYNCD: AUTHREQD 0123456789abcdef\n")); err != nil {
+			t.Error(err)
+			return
+		}
+		response, err := rd.ReadString('\n')
+		if err != nil {
+			return // client gave up
+		}
+		responses <- strings.TrimSuffix(response, "\n")
+		if _, err := conn.Write([]byte(result)); err != nil {
+			t.Error(err)
+			return
+		}
+		// Consume the arguments, if any.
+		for {
+			if _, err := rd.ReadString(0); err != nil {
+				return
+			}
+		}
+	}()
+	return responses
+}
+
+func TestAuthenticate(t *testing.T) {
+	const challenge = "0123456789abcdef"
+	const password = "secret"
+	sum := func(b []byte) string { return base64.RawStdEncoding.EncodeToString(b) }
+	sha512sum := sha512.Sum512([]byte(password + challenge))
+	md5sum := md5.Sum([]byte(password + challenge))
+	md4old := md4.New()
+	md4old.Write(append([]byte{0, 0, 0, 0}, password+challenge...))
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		greeting string
+		want     string
+	}{
+		{
+			desc:     "rsync 3.2",
+			greeting: "@RSYNCD: 31.0 sha512 sha256 sha1 md5 md4\n",
+			want:     "alice " + sum(sha512sum[:]),
+		},
+		{
+			desc:     "no digest list",
+			greeting: "@RSYNCD: 31.0\n",
+			want:     "alice " + sum(md5sum[:]),
+		},
+		{
+			desc:     "protocol 29",
+			greeting: "@RSYNCD: 29\n",
+			want:     "alice " + sum(md4old.Sum(nil)),
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, []string{"--password-file=" + passwordFile}, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			responses := fakeDaemon(t, server, tt.greeting, "@RSYNCD: OK\n")
+			done, err := StartInbandExchange(osenv, pc.Options, client, "alice", "module/path")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done {
+				t.Fatalf("StartInbandExchange unexpectedly done")
+			}
+			if got := <-responses; got != tt.want {
+				t.Errorf("unexpected auth response: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("auth failed", func(t *testing.T) {
+		osenv := rsyncostest.New(t)
+		pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+		if err := pc.ParseArguments(osenv, []string{"--password-file=" + passwordFile}, rsyncopts.ParseModeLibrary); err != nil {
+			t.Fatal(err)
+		}
+		client, server := net.Pipe()
+		defer client.Close()
+		fakeDaemon(t, server, "@RSYNCD: 31.0\n", "@ERROR: auth failed on module module\n")
+		_, err := StartInbandExchange(osenv, pc.Options, client, "alice", "module/path")
+		if err == nil || !strings.Contains(err.Error(), "authentication") {
+			t.Fatalf("StartInbandExchange = %v, want authentication error", err)
+		}
+	})
+
+	t.Run("RSYNC_PASSWORD", func(t *testing.T) {
+		osenv := rsyncos.WithEnvironment(map[string]string{
+			"RSYNC_PASSWORD": password,
+		}, rsyncostest.New(t))
+		pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+		client, server := net.Pipe()
+		defer client.Close()
+		responses := fakeDaemon(t, server, "@RSYNCD: 31.0\n", "@RSYNCD: OK\n")
+		if _, err := StartInbandExchange(osenv, pc.Options, client, "alice", "module/path"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := <-responses, "alice "+sum(md5sum[:]); got != want {
+			t.Errorf("unexpected auth response: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		osenv := rsyncos.WithEnvironment(map[string]string{}, rsyncostest.New(t))
+		pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+		client, server := net.Pipe()
+		defer client.Close()
+		fakeDaemon(t, server, "@RSYNCD: 31.0\n", "@RSYNCD: OK\n")
+		_, err := StartInbandExchange(osenv, pc.Options, client, "alice", "module/path")
+		if err == nil || !strings.Contains(err.Error(), "no password") {
+			t.Fatalf("StartInbandExchange = %v, want missing password error", err)
+		}
+	})
+
+	t.Run("other-accessible password file", func(t *testing.T) {
+		fn := filepath.Join(t.TempDir(), "password")
+		if err := os.WriteFile(fn, []byte(password), 0644); err != nil {
+			t.Fatal(err)
+		}
+		osenv := rsyncostest.New(t)
+		pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+		if err := pc.ParseArguments(osenv, []string{"--password-file=" + fn}, rsyncopts.ParseModeLibrary); err != nil {
+			t.Fatal(err)
+		}
+		client, server := net.Pipe()
+		defer client.Close()
+		fakeDaemon(t, server, "@RSYNCD: 31.0\n", "@RSYNCD: OK\n")
+		_, err := StartInbandExchange(osenv, pc.Options, client, "alice", "module/path")
+		if err == nil || !strings.Contains(err.Error(), "other-accessible") {
+			t.Fatalf("StartInbandExchange = %v, want password file permission error", err)
+		}
+	})
+}
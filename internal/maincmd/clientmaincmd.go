@@ -3,6 +3,7 @@ package maincmd
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -15,6 +16,7 @@ import (
 	"github.com/gokrazy/rsync/internal/progress"
 	"github.com/gokrazy/rsync/internal/receiver"
 	"github.com/gokrazy/rsync/internal/restrict"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
@@ -76,6 +78,20 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 			}
 		}
 	}
+	remotePaths := []string{path}
+	if !opts.Sender() {
+		// Additional source args must be on the same machine, e.g.
+		// host::module/a host::module/b.
+		//
+		// rsync/main.c:start_client
+		for _, extra := range sources[1:] {
+			extraHost, extraPath, extraPort, err := checkForHostspec(extra)
+			if err != nil || extraHost != host || extraPort != port {
+				return nil, fmt.Errorf("all source args must come from the same machine")
+			}
+			remotePaths = append(remotePaths, extraPath)
+		}
+	}
 
 	// TODO: if opts.AmSender(), verify extra source args have no hostspec
 	var roDirs, rwDirs []string
@@ -94,6 +110,12 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 		// other = src
 		paths = sources
 		roDirs = sources
+		if opts.RemoveSourceFiles() {
+			// Removing a file requires write access to its directory.
+			for _, source := range sources {
+				rwDirs = append(rwDirs, filepath.Dir(source))
+			}
+		}
 		if opts.LocalServer() {
 			// source and dest are both local
 			rwDirs = []string{dest}
@@ -105,7 +127,7 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 	}
 
 	if daemonConnection < 0 {
-		stats, err := socketClient(ctx, osenv, opts, host, path, port, paths, roDirs, rwDirs)
+		stats, err := socketClient(ctx, osenv, opts, host, remotePaths, port, paths, roDirs, rwDirs)
 		if err != nil {
 			return nil, err
 		}
@@ -118,7 +140,7 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 		user = machine[:idx]
 		machine = machine[idx+1:]
 	}
-	rc, wc, err := doCmd(osenv, opts, machine, user, path, daemonConnection)
+	rc, wc, err := doCmd(osenv, opts, machine, user, remotePaths, daemonConnection)
 	if err != nil {
 		return nil, err
 	}
@@ -133,11 +155,14 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 		if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
 			return nil, err
 		}
+		if err := restrict.MaybeSyscalls(); err != nil {
+			return nil, err
+		}
 	}
 
 	negotiate := true
 	if daemonConnection != 0 {
-		done, err := StartInbandExchange(osenv, opts, conn, path)
+		done, err := StartInbandExchange(osenv, opts, conn, user, remotePaths[0], remotePaths[1:]...)
 		if err != nil {
 			return nil, err
 		}
@@ -146,7 +171,7 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 		}
 		negotiate = false // already done
 	}
-	stats, err := ClientRun(osenv, opts, conn, paths, negotiate)
+	stats, err := ClientRun(ctx, osenv, opts, conn, paths, negotiate)
 	if err != nil {
 		return nil, err
 	}
@@ -154,17 +179,17 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 }
 
 // rsync/main.c:do_cmd
-func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path string, daemonConnection int) (io.ReadCloser, io.WriteCloser, error) {
+func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user string, paths []string, daemonConnection int) (io.ReadCloser, io.WriteCloser, error) {
 	if opts.Verbose() {
-		osenv.Logf("doCmd(machine=%q, user=%q, path=%q, daemonConnection=%d)",
-			machine, user, path, daemonConnection)
+		osenv.Logf("doCmd(machine=%q, user=%q, paths=%q, daemonConnection=%d)",
+			machine, user, paths, daemonConnection)
 	}
 	var args []string
 	if !opts.LocalServer() {
 		cmd := opts.ShellCommand()
 		if cmd == "" {
 			cmd = "ssh"
-			if e := os.Getenv("RSYNC_RSH"); e != "" {
+			if e := osenv.Getenv("RSYNC_RSH"); e != "" {
 				cmd = e
 			}
 		}
@@ -199,7 +224,14 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 	args = append(args, ".")
 
 	if daemonConnection == 0 {
-		args = append(args, path)
+		for _, path := range paths {
+			if !opts.LocalServer() {
+				// The remote shell parses the command line, so escape the
+				// path (unless --old-args is specified).
+				path = opts.SafeArg("", path)
+			}
+			args = append(args, path)
+		}
 	}
 
 	if opts.Verbose() {
@@ -207,6 +239,8 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 	}
 
 	if opts.LocalServer() {
+		// The local server stops when the client is cancelled.
+		ctx := osenv.Context()
 		stdinrd, stdinwr := io.Pipe()
 		stdoutrd, stdoutwr := io.Pipe()
 		go func() {
@@ -220,7 +254,7 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 				// (including the other end of the connection) are affected.
 				DontRestrict: true,
 			}
-			_, err := Main(context.Background(), osenv, args, nil)
+			_, err := Main(ctx, osenv, args, nil)
 			if err != nil {
 				osenv.Logf("Main(): %v", err)
 			}
@@ -254,16 +288,47 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 }
 
 // rsync/main.c:client_run
-func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter, paths []string, negotiate bool) (*rsyncstats.TransferStats, error) {
+// errPartialTransfer is returned after a transfer in which the server reported
+// errors for some files (MSG_ERROR_XFER), or in which files failed
+// verification twice. The errors were already printed.
+//
+// rsync/errcode.h:RERR_PARTIAL
+var errPartialTransfer = errors.New("rsync error: some files/attrs were not transferred (see previous errors) (code 23)")
+
+// errVanished is returned after an otherwise successful transfer in which the
+// sender skipped files which vanished after it sent the file list.
+//
+// rsync/errcode.h:RERR_VANISHED
+var errVanished = errors.New("rsync warning: some files vanished before they could be transferred (code 24)")
+
+// transferResult returns the error for a completed transfer: partial
+// transfers take precedence over vanished files.
+//
+// rsync/cleanup.c:_exit_cleanup
+func transferResult(xferError bool, ioErrors int32) error {
+	if xferError {
+		return errPartialTransfer
+	}
+	if ioErrors&rsync.IOERR_VANISHED != 0 {
+		return errVanished
+	}
+	return nil
+}
+
+func ClientRun(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter, paths []string, negotiate bool) (*rsyncstats.TransferStats, error) {
 	crd := &rsyncwire.CountingReader{R: conn}
 	cwr := &rsyncwire.CountingWriter{W: conn}
 	c := &rsyncwire.Conn{
 		Reader: crd,
 		Writer: cwr,
 	}
+	if dl, ok := conn.(rsyncwire.ReadDeadliner); ok {
+		c.ReadDeadliner = dl
+	}
 
 	if negotiate {
-		if err := c.WriteInt32(rsync.ProtocolVersion); err != nil {
+		local := min(opts.ProtocolVersion(), rsync.ProtocolVersion)
+		if err := c.WriteInt32(local); err != nil {
 			return nil, err
 		}
 		remoteProtocol, err := c.ReadInt32()
@@ -273,6 +338,24 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 		if opts.Verbose() {
 			osenv.Logf("remote protocol: %d", remoteProtocol)
 		}
+		protocol, err := rsynccommon.NegotiateProtocol(local, remoteProtocol)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetProtocolVersion(protocol)
+		opts.SetPeer(rsynccommon.PeerFromProtocol(remoteProtocol))
+	}
+	c.ProtocolVersion = opts.ProtocolVersion()
+	c.Capabilities.Peer = opts.Peer()
+
+	if err := rsynccommon.ExchangeCapabilities(c, false /* server */, "", false, opts.Compression()); err != nil {
+		return nil, err
+	}
+	if c.ProtocolVersion >= 30 && opts.Verbose() {
+		osenv.Logf("compat flags: 0x%x, checksum: %s", c.Capabilities.CompatFlags, rsynccommon.ChecksumName(c))
+	}
+	if c.Capabilities.Compression != "" && opts.Verbose() {
+		osenv.Logf("compression: %s", c.Capabilities.Compression)
 	}
 
 	seed, err := c.ReadInt32()
@@ -295,6 +378,17 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 	}
 	c.Reader = crd
 
+	if c.ProtocolVersion >= 30 || (!opts.Sender() && opts.RemoveSourceFiles()) {
+		// Starting with protocol 30, the client multiplexes its output, too.
+		// Older protocols only do so when the receiver needs to send
+		// messages (MSG_SUCCESS for --remove-source-files) to the sender.
+		cwr = &rsyncwire.CountingWriter{
+			W:            &rsyncwire.MultiplexWriter{Writer: conn},
+			BytesWritten: cwr.BytesWritten,
+		}
+		c.Writer = cwr
+	}
+
 	if opts.Sender() {
 		st := &sender.Transfer{
 			Logger:   osenv.Logger(),
@@ -304,6 +398,11 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			Env:      osenv,
 			Progress: progress.NewPrinter(osenv.Stdout, time.Now),
 		}
+		if opts.RemoveSourceFiles() {
+			// Remove source files once the receiver confirms them.
+			mrd.Success = st.RemoveSourceFile
+		}
+		mrd.Output = progressOutput(osenv, &st.Progress)
 		if opts.Verbose() {
 			osenv.Logf("sender(paths=%q)", paths)
 		}
@@ -325,17 +424,35 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			}
 		}
 
-		stats, err := st.Do(crd, cwr, FileSystemRoot, paths, nil)
+		// Like the server-side sender, we apply the filter rules to our file
+		// list. The remote receiver needs them to not delete excluded files.
+		excl, err := sender.ParseFilterRules(opts.FilterRules())
 		if err != nil {
 			return nil, err
 		}
-		return stats, nil
+		if opts.ReceiverWantsFilterList(c.ProtocolVersion) {
+			if err := sender.SendFilterList(c, opts.FilterRules()); err != nil {
+				return nil, err
+			}
+		}
+
+		stats, err := waitFor(ctx, func() (*rsyncstats.TransferStats, error) {
+			return st.Do(crd, cwr, FileSystemRoot, paths, excl)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return stats, transferResult(mrd.XferError() || st.RemoveFailures() > 0, st.IOErrors())
 	}
 
 	if len(paths) != 1 {
 		return nil, fmt.Errorf("BUG: expected exactly one path, got %q", paths)
 	}
 
+	spaceCheck, err := spaceCheckMode(opts)
+	if err != nil {
+		return nil, err
+	}
 	rt := &receiver.Transfer{
 		Logger: osenv.Logger(),
 		Opts: &receiver.TransferOpts{
@@ -344,16 +461,33 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			Progress: opts.Progress(),
 
 			DeleteMode:        opts.DeleteMode(),
+			Recurse:           opts.Recurse(),
+			ForceDelete:       opts.ForceDelete(),
+			IgnoreErrors:      opts.IgnoreErrors(),
 			PreserveGid:       opts.PreserveGid(),
 			PreserveUid:       opts.PreserveUid(),
+			NumericIds:        opts.NumericIds(),
 			PreserveLinks:     opts.PreserveLinks(),
+			SafeLinks:         opts.SafeLinks(),
+			MungeLinks:        opts.MungeLinks(),
+			KeepDirlinks:      opts.KeepDirlinks(),
+			WriteDevices:      opts.WriteDevices(),
 			PreservePerms:     opts.PreservePerms(),
 			PreserveDevices:   opts.PreserveDevices(),
 			PreserveSpecials:  opts.PreserveSpecials(),
 			PreserveTimes:     opts.PreserveMTimes(),
+			OmitLinkTimes:     opts.OmitLinkTimes(),
 			PreserveHardlinks: opts.PreserveHardLinks(),
 			IgnoreTimes:       opts.IgnoreTimes(),
 			AlwaysChecksum:    opts.AlwaysChecksum(),
+			ModifyWindow:      opts.ModifyWindow(),
+			KeepPartial:       opts.KeepPartial(),
+			PartialDir:        opts.PartialDir(),
+			RemoveSourceFiles: opts.RemoveSourceFiles(),
+			IOTimeout:         time.Duration(opts.IOTimeoutSeconds()) * time.Second,
+			KeepaliveInterval: time.Duration(opts.IOTimeoutSeconds()) * time.Second / 2,
+			SpaceCheck:        spaceCheck,
+			BatchSmallFiles:   opts.GokrazyClient.BatchSmallFiles == 1,
 
 			InfoGTE:  opts.InfoGTE,
 			DebugGTE: opts.DebugGTE,
@@ -364,6 +498,8 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 		Seed:     seed,
 		Progress: progress.NewPrinter(osenv.Stdout, time.Now),
 	}
+	mrd.NoSend = rt.NoSend
+	mrd.Output = progressOutput(osenv, &rt.Progress)
 	if opts.Verbose() {
 		osenv.Logf("receiving to dest=%s", rt.Dest)
 	}
@@ -382,21 +518,26 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			if err := restrict.MaybeFileSystem(nil, []string{rt.Dest}); err != nil {
 				return nil, fmt.Errorf("landlock: %v", err)
 			}
+			if err := restrict.MaybeSyscalls(); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	for _, rule := range opts.FilterRules() {
-		c.WriteInt32(int32(len(rule)))
-		c.WriteString(rule)
-	}
-	const exclusionListEnd = 0
-	if err := c.WriteInt32(exclusionListEnd); err != nil {
+	// The remote sender skips excluded files, and we do not delete them.
+	if err := sender.SendFilterList(c, opts.FilterRules()); err != nil {
 		return nil, err
 	}
-
 	if opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
 		osenv.Logf("exclusion list sent")
 	}
+	if opts.DeleteMode() && !opts.DeleteExcluded() {
+		excl, err := sender.ParseFilterRules(opts.FilterRules())
+		if err != nil {
+			return nil, err
+		}
+		rt.Opts.Excluded = excl.Excluded
+	}
 
 	// receive file list
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
@@ -406,11 +547,37 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 	if err != nil {
 		return nil, err
 	}
+	// A sender which could not use the file list end marker reports I/O
+	// errors with a MSG_IO_ERROR message instead.
+	rt.IOErrors |= mrd.IOError()
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
 		osenv.Logf("received %d names", len(fileList))
 	}
 
-	return rt.Do(c, fileList, false)
+	stats, err := rt.Do(ctx, c, fileList, false)
+	if err != nil {
+		return nil, err
+	}
+	return stats, transferResult(mrd.XferError() || rt.XferError(), mrd.IOError())
+}
+
+// spaceCheckMode returns what the receiver does when the destination lacks the
+// space for the files, as selected by --gokr.space_check. Dry runs write
+// nothing, so there is nothing to check.
+func spaceCheckMode(opts *rsyncopts.Options) (receiver.SpaceCheck, error) {
+	if opts.DryRun() {
+		return receiver.SpaceCheckOff, nil
+	}
+	switch mode := opts.GokrazyClient.SpaceCheck; mode {
+	case "", "error":
+		return receiver.SpaceCheckError, nil
+	case "warn":
+		return receiver.SpaceCheckWarn, nil
+	case "off":
+		return receiver.SpaceCheckOff, nil
+	default:
+		return 0, fmt.Errorf("--gokr.space_check=%s: expected error, warn or off", mode)
+	}
 }
 
 func clientMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options, remaining []string) (*rsyncstats.TransferStats, error) {
@@ -419,6 +586,16 @@ func clientMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options
 		fmt.Fprintln(osenv.Stderr, opts.Help())
 		return nil, fmt.Errorf("rsync error: syntax or usage error")
 	}
+	if osenv.Stdout != nil {
+		stdout, flush, err := outbuf(osenv, opts.OutbufMode())
+		if err != nil {
+			return nil, err
+		}
+		defer flush()
+		cpy := *osenv
+		cpy.Stdout = stdout
+		osenv = &cpy
+	}
 	if len(remaining) == 1 {
 		// Usages with just one SRC arg and no DEST arg list the source files
 		// instead of copying.
@@ -430,3 +607,33 @@ func clientMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options
 	sources := remaining[:len(remaining)-1]
 	return rsyncMain(ctx, osenv, opts, sources, dest)
 }
+
+// waitFor calls f and waits for it to complete, but only until ctx is
+// cancelled. f keeps running in the background until its I/O fails.
+func waitFor(ctx context.Context, f func() (*rsyncstats.TransferStats, error)) (*rsyncstats.TransferStats, error) {
+	type result struct {
+		stats *rsyncstats.TransferStats
+		err   error
+	}
+	resultc := make(chan result, 1)
+	go func() {
+		stats, err := f()
+		resultc <- result{stats, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-resultc:
+		return res.stats, res.err
+	}
+}
+
+// progressOutput returns a [rsyncwire.MultiplexReader.Output] which displays
+// the messages from the server on lines of their own, even while p shows the
+// progress of a file.
+func progressOutput(osenv *rsyncos.Env, p *progress.Printer) func(rsyncwire.MsgType, []byte) {
+	return func(tag rsyncwire.MsgType, payload []byte) {
+		p.EndLine()
+		rsyncwire.WriteOutput(osenv, tag, payload)
+	}
+}
@@ -12,13 +12,14 @@ import (
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/restrict"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
 )
 
 // rsync/clientserver.c:start_socket_client
-func socketClient(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options, host string, remotePath string, port int, paths []string, roDirs, rwDirs []string) (*rsyncstats.TransferStats, error) {
+func socketClient(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options, host string, remotePaths []string, port int, paths []string, roDirs, rwDirs []string) (*rsyncstats.TransferStats, error) {
 	if port < 0 {
 		if port := opts.RsyncPort(); port > 0 {
 			host += ":" + strconv.Itoa(port)
@@ -28,6 +29,11 @@ func socketClient(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Optio
 	} else {
 		host += ":" + strconv.Itoa(port)
 	}
+	var user string
+	if idx := strings.LastIndexByte(host, '@'); idx > -1 {
+		user = host[:idx]
+		host = host[idx+1:]
+	}
 	dialer := net.Dialer{
 		// Prefer the Go resolver: We know which files it uses (which makes life
 		// easier for the restrict package), whereas the C resolver can be
@@ -58,23 +64,30 @@ func socketClient(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Optio
 		if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
 			return nil, err
 		}
+		if err := restrict.MaybeSyscalls(); err != nil {
+			return nil, err
+		}
 	}
-	done, err := StartInbandExchange(osenv, opts, conn, remotePath)
+	done, err := StartInbandExchange(osenv, opts, conn, user, remotePaths[0], remotePaths[1:]...)
 	if err != nil {
 		return nil, err
 	}
 	if done {
 		return nil, nil
 	}
-	stats, err := ClientRun(osenv, opts, conn, paths, false)
+	stats, err := ClientRun(ctx, osenv, opts, conn, paths, false)
 	if err != nil {
 		return nil, err
 	}
 	return stats, nil
 }
 
+// StartInbandExchange selects the module of remotePath, authenticating as
+// user if the daemon requires it (user defaults to $USER). morePaths are
+// additional paths (including the module name) to request from the module.
+//
 // rsync/clientserver.c:start_inband_exchange
-func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter, remotePath string) (done bool, _ error) {
+func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter, user, remotePath string, morePaths ...string) (done bool, _ error) {
 	module := remotePath
 	if idx := strings.IndexByte(module, '/'); idx > -1 {
 		module = module[:idx]
@@ -84,7 +97,10 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 	rd := bufio.NewReader(conn)
 
 	// send client greeting
-	fmt.Fprintf(conn, "@RSYNCD: %d\n", rsync.ProtocolVersion)
+	local := min(opts.ProtocolVersion(), rsync.ProtocolVersion)
+	// rsync 3.x rejects greetings of protocol >= 30 which omit the
+	// sub-protocol version, so always send one (0 means a release version).
+	fmt.Fprintf(conn, "@RSYNCD: %d.0\n", local)
 
 	// read server greeting
 	serverGreeting, err := rd.ReadString('\n')
@@ -96,7 +112,7 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 	if !strings.HasPrefix(serverGreeting, serverGreetingPrefix) {
 		return false, fmt.Errorf("invalid server greeting: got %q", serverGreeting)
 	}
-	// protocol negotiation: require at least version 27
+	// protocol negotiation: pick the lower of both versions
 	serverGreeting = strings.TrimPrefix(serverGreeting, serverGreetingPrefix)
 	var remoteProtocol, remoteSub int32
 	if _, err := fmt.Sscanf(serverGreeting, "%d.%d", &remoteProtocol, &remoteSub); err != nil {
@@ -104,17 +120,23 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 			return false, fmt.Errorf("reading server greeting: %v", err)
 		}
 	}
-	if remoteProtocol < 27 {
-		return false, fmt.Errorf("server version %d too old", remoteProtocol)
+	protocol, err := rsynccommon.NegotiateProtocol(local, remoteProtocol)
+	if err != nil {
+		return false, err
 	}
+	opts.SetProtocolVersion(protocol)
+	opts.SetPeer(rsynccommon.PeerFromGreeting(serverGreeting))
+	// rsync 3.2 and newer follow the version with the digests they accept
+	// for authentication.
+	authList := strings.Fields(serverGreeting)[1:]
 
 	if opts.Verbose() {
-		osenv.Logf("(Client) Protocol versions: remote=%d, negotiated=%d", remoteProtocol, rsync.ProtocolVersion)
-		osenv.Logf("Client checksum: md4")
+		osenv.Logf("(Client) Protocol versions: remote=%d, negotiated=%d, peer: %v", remoteProtocol, protocol, opts.Peer())
 	}
 
 	// send module name
 	fmt.Fprintf(conn, "%s\n", module)
+	authenticated := false
 	for {
 		line, err := rd.ReadString('\n')
 		if err != nil {
@@ -125,9 +147,16 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 			osenv.Logf("read line: %q", line)
 		}
 
-		if strings.HasPrefix(line, "@RSYNCD: AUTHREQD ") {
-			// TODO: implement support for authentication
-			return false, fmt.Errorf("authentication not yet implemented")
+		if challenge, ok := strings.CutPrefix(line, "@RSYNCD: AUTHREQD "); ok {
+			digest, err := negotiateAuthDigest(authList, protocol)
+			if err != nil {
+				return false, err
+			}
+			if err := authenticate(osenv, opts, conn, user, digest, challenge); err != nil {
+				return false, err
+			}
+			authenticated = true
+			continue
 		}
 
 		if line == "@RSYNCD: OK" {
@@ -140,6 +169,9 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 
 		if strings.HasPrefix(line, "@ERROR") {
 			fmt.Fprintf(osenv.Stderr, "%s\n", line)
+			if authenticated && strings.Contains(line, "auth failed") {
+				return false, fmt.Errorf("authentication to rsync module %q failed", module)
+			}
 			return false, fmt.Errorf("abort (rsync fatal error)")
 		}
 
@@ -152,13 +184,20 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 	sargv := opts.ServerOptions()
 	sargv = append(sargv, ".")
 	sargv = append(sargv, remotePath)
+	sargv = append(sargv, morePaths...)
 	if opts.Verbose() {
 		osenv.Logf("sending daemon args: %s", sargv)
 	}
+	// Starting with protocol 30, arguments are NUL-terminated
+	// (rsync/clientserver.c:start_inband_exchange).
+	argDelim := "\n"
+	if opts.ProtocolVersion() >= 30 {
+		argDelim = "\x00"
+	}
 	for _, argv := range sargv {
-		fmt.Fprintf(conn, "%s\n", argv)
+		fmt.Fprintf(conn, "%s%s", argv, argDelim)
 	}
-	fmt.Fprintf(conn, "\n")
+	fmt.Fprintf(conn, "%s", argDelim)
 
 	return false, nil
 }
@@ -0,0 +1,50 @@
+package maincmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncdconfig"
+)
+
+// dparamListener lists the global parameters which --dparam can override,
+// keyed by their normalized name. Parameters which weaken the daemon’s
+// isolation (like dont_namespace) or which configure modules are not
+// overridable: the config file remains authoritative for them.
+var dparamListener = map[string]func(*rsyncdconfig.Listener, string){
+	"rsyncd":  func(l *rsyncdconfig.Listener, v string) { l.Rsyncd = v },
+	"anonssh": func(l *rsyncdconfig.Listener, v string) { l.AnonSSH = v },
+}
+
+// normalizeParam lowercases name and removes spaces and underscores, so that
+// e.g. "anon_ssh", "anon ssh" and "AnonSSH" all refer to the same parameter.
+//
+// rsync/loadparm.c:map_parameter
+func normalizeParam(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// parseDParam applies a --dparam=key=value override to the first listener of
+// cfg.
+//
+// rsync/loadparm.c:set_dparams
+func parseDParam(cfg *rsyncdconfig.Config, s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("--dparam value is missing an '=': %s", s)
+	}
+	set, ok := dparamListener[normalizeParam(strings.TrimSpace(key))]
+	if !ok {
+		return fmt.Errorf("--dparam: parameter %q cannot be overridden", key)
+	}
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = append(cfg.Listeners, rsyncdconfig.Listener{})
+	}
+	set(&cfg.Listeners[0], strings.TrimSpace(value))
+	return nil
+}
@@ -0,0 +1,46 @@
+package maincmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncdconfig"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDParam(t *testing.T) {
+	osenv := rsyncostest.New(t)
+	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+	args := []string{"--daemon", "-M", "rsyncd=localhost:8730", "--dparam=Anon SSH = localhost:22873"}
+	if err := pc.ParseArguments(osenv, args, rsyncopts.ParseModeLibrary); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &rsyncdconfig.Config{}
+	for _, dparam := range pc.Options.DParams() {
+		if err := parseDParam(cfg, dparam); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []rsyncdconfig.Listener{
+		{Rsyncd: "localhost:8730", AnonSSH: "localhost:22873"},
+	}
+	if diff := cmp.Diff(want, cfg.Listeners); diff != "" {
+		t.Errorf("unexpected listener config: diff (-want +got):\n%s", diff)
+	}
+
+	for _, tt := range []struct {
+		dparam      string
+		wantMessage string
+	}{
+		{dparam: "rsyncd", wantMessage: "missing an '='"},
+		{dparam: "dont_namespace=true", wantMessage: "cannot be overridden"},
+		{dparam: "path=/", wantMessage: "cannot be overridden"},
+	} {
+		err := parseDParam(&rsyncdconfig.Config{}, tt.dparam)
+		if err == nil || !strings.Contains(err.Error(), tt.wantMessage) {
+			t.Errorf("parseDParam(%q) = %v, want error containing %q", tt.dparam, err, tt.wantMessage)
+		}
+	}
+}
@@ -2,4 +2,22 @@
 
 package maincmd
 
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
 const FileSystemRoot = "/"
+
+// rsync/authenticate.c:getpassf
+func checkPasswordFileMode(st fs.FileInfo) error {
+	if st.Mode().Perm()&0o006 != 0 {
+		return errors.New("password file must not be other-accessible")
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && os.Getuid() == 0 && sys.Uid != 0 {
+		return errors.New("password file must be owned by root when running as root")
+	}
+	return nil
+}
@@ -1,3 +1,9 @@
 package maincmd
 
+import "io/fs"
+
 const FileSystemRoot = "\\\\?\\"
+
+// checkPasswordFileMode does nothing on Windows, which does not have Unix
+// permissions.
+func checkPasswordFileMode(fs.FileInfo) error { return nil }
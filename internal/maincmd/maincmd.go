@@ -6,11 +6,14 @@ package maincmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/gokrazy/rsync/internal/anonssh"
@@ -19,6 +22,7 @@ import (
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"github.com/gokrazy/rsync/rsyncd"
 
 	// For profiling and debugging
@@ -38,9 +42,18 @@ func (r *readWriter) Read(p []byte) (n int, err error)  { return r.r.Read(p) }
 func (r *readWriter) Write(p []byte) (n int, err error) { return r.w.Write(p) }
 
 func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdconfig.Config) (*rsyncstats.TransferStats, error) {
+	osenv = rsyncos.WithContext(ctx, osenv)
 	osenv.Logf("Main(osenv=%v, args=%q)", osenv, args)
 	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(osenv))
-	if err := pc.ParseArguments(osenv, args[1:]); err != nil {
+	if err := pc.ParseArguments(osenv, args[1:], rsyncopts.ParseModeLibrary); err != nil {
+		if hr, ok := err.(*rsyncopts.HelpRequested); ok {
+			// Like tridge rsync, print help to stdout and succeed, but
+			// leave exiting to our caller (the program or a library user).
+			if osenv.Stdout != nil {
+				fmt.Fprintln(osenv.Stdout, hr.Text)
+			}
+			return nil, nil
+		}
 		if pe, ok := err.(*rsyncopts.PoptError); ok &&
 			pe.Errno == rsyncopts.POPT_ERROR_BADOPT &&
 			strings.HasPrefix(pe.Error(), "--gokr.") {
@@ -62,9 +75,15 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 			if err != nil {
 				return nil, err
 			}
+			// We cannot tell which key the remote shell authenticated,
+			// so do not serve modules restricted to specific SSH keys.
+			cfg.Modules = slices.DeleteFunc(cfg.Modules, func(mod rsyncd.Module) bool {
+				return mod.SSHAuthorizedKeys != ""
+			})
 		}
 		rsyncdOpts := []rsyncd.Option{
 			rsyncd.WithStderr(osenv.Stderr),
+			rsyncd.WithGlobal(&cfg.Global),
 		}
 		if osenv.DontRestrict {
 			rsyncdOpts = append(rsyncdOpts, rsyncd.DontRestrict())
@@ -99,7 +118,21 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		}
 		var roDirs, rwDirs []string
 		if opts.Sender() {
-			roDirs = append(roDirs, paths...)
+			// Without a trailing slash, the sender transfers the directory
+			// itself and therefore opens its parent directory, see
+			// (*sender.Transfer).SendFileList.
+			for _, path := range paths {
+				if !strings.HasSuffix(path, "/") {
+					path = filepath.Dir(path)
+				}
+				roDirs = append(roDirs, path)
+			}
+			if opts.RemoveSourceFiles() {
+				// Removing a file requires write access to its directory.
+				for _, path := range paths {
+					rwDirs = append(rwDirs, filepath.Dir(path))
+				}
+			}
 		} else {
 			for _, path := range paths {
 				if err := os.MkdirAll(path, 0755); err != nil {
@@ -112,8 +145,16 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 			if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
 				return nil, err
 			}
+			if err := restrict.MaybeSyscalls(); err != nil {
+				return nil, err
+			}
 		}
-		conn := rsyncd.NewConnection(osenv.Stdin, osenv.Stdout, "<remote-shell>")
+		fc := &rsyncwire.FramedConn{
+			Reader: osenv.Stdin,
+			Writer: osenv.Stdout,
+			Stderr: osenv.Stderr,
+		}
+		conn := rsyncd.NewConnection(fc, fc, "<remote-shell>")
 		return nil, srv.InternalHandleConn(ctx, conn, nil, pc)
 	}
 
@@ -159,10 +200,15 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 			osenv.Logf("config file %s loaded", cfgfn)
 		}
 	}
+	for _, dparam := range opts.DParams() {
+		if err := parseDParam(cfg, dparam); err != nil {
+			return nil, err
+		}
+	}
 
 	if os.IsNotExist(cfgErr) {
-		if opts.GokrazyDaemon.Listen == "" &&
-			opts.GokrazyDaemon.AnonSSHListen == "" {
+		if cfg.Listeners[0].Rsyncd == "" &&
+			cfg.Listeners[0].AnonSSH == "" {
 			return nil, fmt.Errorf("neither -gokr.listen nor -gokr.anonssh_listen specified, and config file not found: %v", cfgErr)
 		}
 		// If no config file was found, and the user did not specify a
@@ -208,6 +254,13 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		}
 	}
 
+	// Load the certificates now: namespacing and restricting the process
+	// hide them.
+	tlsConfig, err := cfg.Listeners[0].TLS.ServerConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+
 	if moduleMap := opts.GokrazyDaemon.ModuleMap; moduleMap != "" {
 		parts := strings.Split(moduleMap, "=")
 		if len(parts) != 2 {
@@ -219,6 +272,13 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		}
 		cfg.Modules = append(cfg.Modules, module)
 	}
+	if cfg.Listeners[0].Rsyncd != "" {
+		for _, mod := range cfg.Modules {
+			if mod.SSHAuthorizedKeys != "" {
+				return nil, fmt.Errorf("module %q: ssh_authorized_keys must be used with anon_ssh or authorized_ssh listeners only", mod.Name)
+			}
+		}
+	}
 	if cfg.DontNamespace {
 		if cfg.Listeners[0].Rsyncd != "" ||
 			cfg.Listeners[0].AnonSSH != "" {
@@ -227,7 +287,7 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		version(osenv)
 		osenv.Logf("environment: not namespace due to dont_namespace option")
 	} else {
-		if err := namespace(osenv, cfg.Modules, listenAddr); err == errIsParent {
+		if err := namespace(osenv, cfg.Modules, listenAddr, &opts.GokrazyDaemon); err == errIsParent {
 			return nil, nil
 		} else if err != nil {
 			return nil, fmt.Errorf("namespace: %v", err)
@@ -244,19 +304,27 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		osenv.Logf("rsync module %q with path %s configured", mod.Name, mod.Path)
 	}
 
+	srv, err := rsyncd.NewServer(cfg.Modules,
+		rsyncd.WithStderr(osenv.Stderr),
+		rsyncd.WithGlobal(&cfg.Global))
+	if err != nil {
+		return nil, err
+	}
+
 	if monitoringListen := opts.GokrazyDaemon.MonitoringListen; monitoringListen != "" {
+		// Use a dedicated mux so that calling Main more than once within the same
+		// process (e.g. in tests) does not register /debug/rsyncd twice. All
+		// other paths (e.g. /debug/pprof) fall through to http.DefaultServeMux.
+		mux := http.NewServeMux()
+		mux.Handle("/debug/rsyncd", srv.DebugHandler())
+		mux.Handle("/", http.DefaultServeMux)
 		go func() {
-			osenv.Logf("HTTP server for monitoring listening on http://%s/debug/pprof", monitoringListen)
-			if err := http.ListenAndServe(monitoringListen, nil); err != nil {
+			osenv.Logf("HTTP server for monitoring listening on http://%s/debug/pprof (active sessions: /debug/rsyncd)", monitoringListen)
+			if err := http.ListenAndServe(monitoringListen, mux); err != nil {
 				osenv.Logf("-monitoring_listen: %v", err)
 			}
 		}()
 	}
-
-	srv, err := rsyncd.NewServer(cfg.Modules, rsyncd.WithStderr(osenv.Stderr))
-	if err != nil {
-		return nil, err
-	}
 	var ln net.Listener
 	listeners, err := systemdListeners()
 	if err != nil {
@@ -271,13 +339,18 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 			return nil, err
 		}
 	}
+	if tlsConfig != nil {
+		// Both the rsync protocol and SSH are spoken inside TLS.
+		ln = tls.NewListener(ln, tlsConfig)
+		osenv.Logf("TLS enabled on %s", ln.Addr())
+	}
 
 	if cfg.Listeners[0].AuthorizedSSH.Address != "" {
 		if cfg.Listeners[0].AuthorizedSSH.AuthorizedKeys == "" {
 			return nil, fmt.Errorf("misconfiguration: authorized_keys must not be empty when using an authorized_ssh listener")
 		}
 		osenv.Logf("rsync daemon listening (authorized SSH) on %s", ln.Addr())
-		return nil, anonssh.Serve(ctx, osenv, ln, sshListener, cfg, func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		return nil, anonssh.Serve(ctx, osenv, ln, sshListener, cfg, func(cfg *rsyncdconfig.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 			osenv := &rsyncos.Env{
 				Stdin:  stdin,
 				Stdout: stdout,
@@ -294,7 +367,7 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 
 	if cfg.Listeners[0].AnonSSH != "" {
 		osenv.Logf("rsync daemon listening (anon SSH) on %s", ln.Addr())
-		return nil, anonssh.Serve(ctx, osenv, ln, sshListener, cfg, func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		return nil, anonssh.Serve(ctx, osenv, ln, sshListener, cfg, func(cfg *rsyncdconfig.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 			osenv := &rsyncos.Env{
 				Stdin:  stdin,
 				Stdout: stdout,
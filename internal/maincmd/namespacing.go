@@ -10,11 +10,12 @@ import (
 	"os/exec"
 	"strconv"
 
+	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/rsyncd"
 )
 
-func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string) error {
+func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string, _ *rsyncopts.GokrazyDaemonOptions) error {
 	if os.Getenv("GOKRAZY_RSYNC_PRIVDROP") != "" {
 		osenv.Logf("pid %d (privileges dropped)", os.Getpid())
 
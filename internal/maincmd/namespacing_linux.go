@@ -9,9 +9,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"syscall"
 
+	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/rsyncd"
 	"golang.org/x/sys/unix"
@@ -70,7 +72,40 @@ func pivotRoot(newroot string) error {
 	return nil
 }
 
-func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string) error {
+// bindMountFile bind-mounts the file src to dest (relative to the current
+// directory), creating an empty dest file to mount onto.
+func bindMountFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dest, nil, 0644); err != nil {
+		return err
+	}
+	if err := syscall.Mount(src, dest, "none", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("mount(%s, %s): %v", src, dest, err)
+	}
+	return nil
+}
+
+// isolateNetwork reports whether the daemon should run in its own (empty)
+// network namespace: Only the inherited listener can be used in there, which
+// prevents writable modules from being used to make outbound connections
+// (e.g. when a client manages to write a file which is later executed).
+func isolateNetwork(osenv *rsyncos.Env, modules []rsyncd.Module, daemonOpts *rsyncopts.GokrazyDaemonOptions) bool {
+	if daemonOpts.NoNetworkNamespace == 1 {
+		return false
+	}
+	if !slices.ContainsFunc(modules, func(mod rsyncd.Module) bool { return mod.Writable }) {
+		return false
+	}
+	if daemonOpts.MonitoringListen != "" {
+		osenv.Logf("not creating a network namespace: --gokr.monitoring_listen needs to listen on the host network")
+		return false
+	}
+	return true
+}
+
+func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string, daemonOpts *rsyncopts.GokrazyDaemonOptions) error {
 	if os.Getenv("GOKRAZY_RSYNC_NAMESPACE") != "" {
 		osenv.Logf("pid %d (inside Linux mount/pid namespace)", os.Getpid())
 
@@ -100,17 +135,38 @@ func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string) error
 			return err
 		}
 
-		// prepare read-only bind mounts for each configured rsync module:
-		osenv.Logf("mounting rsync modules read-only:")
+		// Only the module paths and /dev/null are visible inside the namespace.
+		// Bind mounts for each configured rsync module (read-only unless the
+		// module is writable):
+		osenv.Logf("mounting rsync modules:")
 		for _, mod := range modules {
-			osenv.Logf("  rsync module %q from host=%s to namespace=/%s", mod.Name, mod.Path, mod.Name)
+			osenv.Logf("  rsync module %q from host=%s to namespace=/%s (writable: %v)", mod.Name, mod.Path, mod.Name, mod.Writable)
 			// TODO: restrict module names to not contain slashes. does rsync do that?
 			if err := os.MkdirAll(mod.Name, 0755); err != nil {
 				return err
 			}
-			if err := syscall.Mount(mod.Path, mod.Name, "none", syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+			if err := syscall.Mount(mod.Path, mod.Name, "none", syscall.MS_BIND, ""); err != nil {
 				return err
 			}
+			if mod.Writable {
+				continue
+			}
+			// MS_RDONLY only takes effect when remounting a bind mount.
+			if err := syscall.Mount(mod.Path, mod.Name, "none", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				return fmt.Errorf("mount -o remount,ro %s: %v", mod.Name, err)
+			}
+		}
+		if err := bindMountFile("/dev/null", "dev/null"); err != nil {
+			return err
+		}
+
+		// A separate tmpfs for /tmp stays writable when the root is remounted
+		// read-only by pivotRoot.
+		if err := os.Mkdir("tmp", 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", "tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mount(tmpfs, /tmp): %v", err)
 		}
 
 		wd, err := os.Getwd()
@@ -121,6 +177,8 @@ func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string) error
 		if err := pivotRoot(wd); err != nil {
 			return fmt.Errorf("pivotRoot(%q): %v", wd, err)
 		}
+		// $TMPDIR might refer to a directory outside of the namespace.
+		os.Setenv("TMPDIR", "/tmp")
 
 		if err := dropPrivileges(osenv); err != nil {
 			return fmt.Errorf("dropPrivileges: %v", err)
@@ -175,8 +233,14 @@ func namespace(osenv *rsyncos.Env, modules []rsyncd.Module, listen string) error
 		return err
 	}
 	cmd.ExtraFiles = []*os.File{lnFile}
+	cloneflags := uintptr(unix.CLONE_NEWNS | unix.CLONE_NEWPID)
+	if isolateNetwork(osenv, modules, daemonOpts) {
+		// The inherited listener keeps working in the new network namespace.
+		osenv.Logf("creating Linux network namespace for writable rsync modules")
+		cloneflags |= unix.CLONE_NEWNET
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags:                 unix.CLONE_NEWNS | unix.CLONE_NEWPID,
+		Cloneflags:                 cloneflags,
 		GidMappingsEnableSetgroups: false,
 	}
 	if err := cmd.Run(); err != nil {
@@ -127,3 +127,18 @@ func checkForHostspec(src string) (host, path string, port int, _ error) {
 	port = 0 // not a daemon-accessing spec
 	return host, path, port, nil
 }
+
+// SourceIsRemote reports whether the source argument src names a remote
+// location (host:path, host::module or rsync://host/module), like rsyncMain
+// decides whether the client is the sender.
+func SourceIsRemote(src string) bool {
+	_, _, _, err := checkForHostspec(src)
+	return err == nil
+}
+
+// DestIsRemote reports whether the destination argument dest names a remote
+// location, see SourceIsRemote.
+func DestIsRemote(dest string) bool {
+	_, path, _, _ := checkForHostspec(dest)
+	return path != ""
+}
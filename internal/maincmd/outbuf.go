@@ -0,0 +1,72 @@
+package maincmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gokrazy/rsync/internal/rsyncos"
+)
+
+// bufferedStdout buffers writes to stdout like C stdio does for rsync’s
+// --outbuf modes.
+type bufferedStdout struct {
+	// The transfer might still write from the background after clientMain
+	// returned on cancellation, see waitFor.
+	mu   sync.Mutex
+	w    *bufio.Writer
+	line bool // flush after every line
+}
+
+func (b *bufferedStdout) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	// Progress updates end in \r instead of \n, but should be displayed
+	// right away, too.
+	if b.line && bytes.ContainsAny(p, "\r\n") {
+		err = b.w.Flush()
+	}
+	return n, err
+}
+
+func (b *bufferedStdout) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Flush()
+}
+
+// outbuf returns the writer to use for stdout according to the --outbuf mode
+// (None, Line or Block), and a function to flush it. Without --outbuf, stdout
+// is line buffered if it is a terminal and block buffered otherwise, which is
+// the C stdio default rsync inherits.
+//
+// rsync/main.c:main
+func outbuf(osenv *rsyncos.Env, mode string) (io.Writer, func() error, error) {
+	if mode == "" {
+		mode = "B"
+		if osenv.IsTerminal() {
+			mode = "L"
+		}
+	}
+	var line bool
+	switch mode[0] {
+	case 'N', 'n':
+		return osenv.Stdout, func() error { return nil }, nil
+	case 'L', 'l':
+		line = true
+	case 'B', 'b':
+	default:
+		return nil, nil, fmt.Errorf("invalid --outbuf setting %q: specify N, L, or B", mode)
+	}
+	b := &bufferedStdout{
+		w:    bufio.NewWriter(osenv.Stdout),
+		line: line,
+	}
+	return b, b.Flush, nil
+}
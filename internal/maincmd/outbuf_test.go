@@ -0,0 +1,56 @@
+package maincmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncos"
+)
+
+func TestOutbuf(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want string // written through before flushing
+	}{
+		{mode: "", want: ""}, // not a terminal: block buffered
+		{mode: "N", want: "file\nprogress\r  more"},
+		{mode: "L", want: "file\nprogress\r"},
+		{mode: "b", want: ""},
+	} {
+		var buf bytes.Buffer
+		stdout, flush, err := outbuf(&rsyncos.Env{Stdout: &buf}, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"file\n", "progress\r", "  more"} {
+			if _, err := stdout.Write([]byte(s)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("--outbuf=%s: before flush, got %q, want %q", tt.mode, got, tt.want)
+		}
+		if err := flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf.String(), "file\nprogress\r  more"; got != want {
+			t.Errorf("--outbuf=%s: after flush, got %q, want %q", tt.mode, got, want)
+		}
+	}
+
+	if _, _, err := outbuf(&rsyncos.Env{}, "X"); err == nil {
+		t.Errorf("--outbuf=X unexpectedly succeeded")
+	}
+}
+
+func TestOutbufFlag(t *testing.T) {
+	osenv := &rsyncos.Env{}
+	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(osenv))
+	if err := pc.ParseArguments(osenv, []string{"--outbuf=L", "src", "dest"}, rsyncopts.ParseModeLibrary); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pc.Options.OutbufMode(), "L"; got != want {
+		t.Errorf("OutbufMode() = %q, want %q", got, want)
+	}
+}
@@ -20,7 +20,8 @@ type Printer struct {
 	first   bool
 	size    uint64
 	history [5]progressAt
-	oldest  int // index into history
+	oldest  int  // index into history
+	open    bool // a progress line was shown, but not ended yet
 }
 
 func NewPrinter(out io.Writer, now func() time.Time) Printer {
@@ -73,16 +74,25 @@ func (p *Printer) Show(offset uint64, last bool) {
 		offset: offset,
 	}
 
-	pct := int(float64(offset) / float64(p.size) * 100)
+	// Like rsync, report 100% once the offset reaches the size, which also
+	// covers empty files (a division by zero) and files that grew during the
+	// transfer.
+	pct := 100
+	if offset < p.size {
+		pct = int(float64(offset) / float64(p.size) * 100)
+	}
 
 	oldestOffset := p.history[p.oldest].offset
 	diff := now.Sub(p.history[p.oldest].when).Seconds()
 	if diff == 0 {
 		diff = 1
 	}
-	rate := float64(offset-oldestOffset) / diff
+	var rate float64
+	if offset > oldestOffset {
+		rate = float64(offset-oldestOffset) / diff
+	}
 	var remainSec float64 // seconds
-	if rate > 0 {
+	if rate > 0 && offset < p.size {
 		remainSec = float64(p.size-offset) / rate
 	}
 
@@ -111,9 +121,22 @@ func (p *Printer) Show(offset uint64, last bool) {
 		p.out.Write([]byte{'\r'})
 	}
 	fmt.Fprintf(p.out, "%15d %3d%% %7.2f%s %s", offset, pct, rate, unit, remaining)
+	p.open = !last
 	if last {
 		// TODO: show where we are within the file list
 		// (number of files transferred vs. number of files total)
 		p.out.Write([]byte{'\n'})
 	}
 }
+
+// EndLine ends the progress line which is still being updated (if any), so
+// that other output starts on a line of its own.
+//
+// rsync/log.c:rwrite (output_needs_newline)
+func (p *Printer) EndLine() {
+	if !p.open {
+		return
+	}
+	p.out.Write([]byte{'\n'})
+	p.open = false
+}
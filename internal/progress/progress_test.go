@@ -24,3 +24,49 @@ func TestProgress(t *testing.T) {
 		t.Errorf("progress.Show(617) = %q, want %q", got, want)
 	}
 }
+
+func TestProgressLarge(t *testing.T) {
+	now := time.Now()
+	var buf bytes.Buffer
+	p := NewPrinter(&buf, func() time.Time {
+		return now
+	})
+	for _, tt := range []struct {
+		size, offset uint64
+		want         string
+	}{
+		{size: 0, offset: 0, want: "              0 100%    0.00kB/s    0:00:00"},
+		{size: 5 << 30, offset: 4<<30 + 1<<29, want: "     4831838208  90%    4.50GB/s    0:00:00"},
+		{size: 5 << 30, offset: 5 << 30, want: "     5368709120 100%    5.00GB/s    0:00:00"},
+		// The file grew during the transfer.
+		{size: 1234, offset: 2000, want: "           2000 100%    1.95kB/s    0:00:00"},
+	} {
+		p.Reset(tt.size)
+		buf.Reset()
+		now = now.Add(1 * time.Second)
+		p.Show(tt.offset, false)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("Reset(%d); Show(%d) = %q, want %q", tt.size, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestProgressEndLine(t *testing.T) {
+	now := time.Now()
+	var buf bytes.Buffer
+	p := NewPrinter(&buf, func() time.Time {
+		return now
+	})
+	p.EndLine() // nothing shown yet
+	p.Reset(1234)
+	p.Show(617, false)
+	p.EndLine()
+	p.EndLine() // already ended
+	p.Show(1234, true)
+	p.EndLine() // ended by the last update
+	want := "            617  50%    0.60kB/s    0:00:01\n" +
+		"\r           1234 100%    1.21kB/s    0:00:00\n"
+	if got := buf.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package receiver
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sync"
+)
+
+// basisReader reads the blocks of the basis file which the sender’s matched
+// tokens refer to. Matches overwhelmingly arrive in ascending order, so
+// basisReader reads the file sequentially through a buffer (which also
+// benefits from the kernel’s readahead) and only falls back to ReadAt for a
+// token at a different offset, after which it continues sequentially from
+// there. The returned blocks share one buffer, which is only valid until the
+// next call.
+type basisReader struct {
+	f   io.ReaderAt
+	rd  *bufio.Reader
+	pos int64 // offset in f at which rd continues
+	buf []byte
+}
+
+// basisReaders holds the buffers of released basisReaders, so that they are
+// reused across files instead of allocated for each file.
+var basisReaders = sync.Pool{
+	New: func() any {
+		return &basisReader{rd: bufio.NewReaderSize(nil, 256*1024)}
+	},
+}
+
+// newBasisReader returns a basisReader for f, which must be released once
+// done.
+func newBasisReader(f io.ReaderAt) *basisReader {
+	br := basisReaders.Get().(*basisReader)
+	br.f = f
+	br.pos = 0
+	br.rd.Reset(io.NewSectionReader(f, 0, math.MaxInt64))
+	return br
+}
+
+// release returns br (and its buffers) to the pool.
+func (br *basisReader) release() {
+	br.f = nil
+	br.rd.Reset(nil)
+	basisReaders.Put(br)
+}
+
+// block returns the length bytes at offset.
+func (br *basisReader) block(offset int64, length int32) ([]byte, error) {
+	if cap(br.buf) < int(length) {
+		br.buf = make([]byte, length)
+	}
+	data := br.buf[:length]
+	if offset != br.pos {
+		if _, err := br.f.ReadAt(data, offset); err != nil {
+			return nil, err
+		}
+		br.pos = offset + int64(length)
+		br.rd.Reset(io.NewSectionReader(br.f, br.pos, math.MaxInt64-br.pos))
+		return data, nil
+	}
+	if _, err := io.ReadFull(br.rd, data); err != nil {
+		return nil, err
+	}
+	br.pos += int64(length)
+	return data, nil
+}
@@ -0,0 +1,77 @@
+package receiver
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeBasis(t testing.TB, size int) (*os.File, []byte) {
+	content := make([]byte, size)
+	rnd := rand.NewChaCha8([32]byte{})
+	rnd.Read(content)
+	fn := filepath.Join(t.TempDir(), "basis")
+	if err := os.WriteFile(fn, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, content
+}
+
+func TestBasisReader(t *testing.T) {
+	const blockLength = 700
+	f, content := writeBasis(t, 10*blockLength+123)
+	br := newBasisReader(f)
+	// In order, then backwards (e.g. a file whose halves were swapped),
+	// then in order again from there, ending with the short last block.
+	for _, token := range []int{0, 1, 2, 7, 3, 4, 5, 5, 10, 9, 10} {
+		offset := int64(token) * blockLength
+		length := int32(min(blockLength, len(content)-int(offset)))
+		got, err := br.block(offset, length)
+		if err != nil {
+			t.Fatalf("block(%d): %v", token, err)
+		}
+		if want := content[offset : offset+int64(length)]; !bytes.Equal(got, want) {
+			t.Fatalf("block(%d): got different data than the file contains", token)
+		}
+	}
+}
+
+// BenchmarkBasisReader reads all blocks of a large basis file in order, as
+// the receiver does for a mostly-unchanged file.
+func BenchmarkBasisReader(b *testing.B) {
+	const blockLength = 700
+	const size = 64 << 20
+	f, _ := writeBasis(b, size)
+	const blocks = size / blockLength
+
+	b.Run("ReadAt", func(b *testing.B) {
+		b.SetBytes(blocks * blockLength)
+		for b.Loop() {
+			for i := range int64(blocks) {
+				data := make([]byte, blockLength)
+				if _, err := f.ReadAt(data, i*blockLength); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Sequential", func(b *testing.B) {
+		b.SetBytes(blocks * blockLength)
+		for b.Loop() {
+			br := newBasisReader(f)
+			for i := range int64(blocks) {
+				if _, err := br.block(i*blockLength, blockLength); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
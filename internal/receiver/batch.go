@@ -0,0 +1,138 @@
+package receiver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+const (
+	// smallFileThreshold is the size below which files are batched when
+	// TransferOpts.BatchSmallFiles is set.
+	smallFileThreshold = 1 << 20
+
+	// A batch is committed once it holds this many files or bytes.
+	maxBatchFiles = 128
+	maxBatchBytes = 16 << 20
+)
+
+// smallFileBatch holds small files which were received into temporary files,
+// but not yet synced to disk, renamed into place or confirmed to the
+// generator. Committing the batch syncs all of them at once.
+type smallFileBatch struct {
+	files []*batchedFile
+	size  int64
+}
+
+// batchedFile is the pending file of receiveData for a file which goes into
+// the batch. Unlike pendingFile, closing it does not sync.
+type batchedFile struct {
+	batch *smallFileBatch
+	root  *os.Root
+	idx   int32
+	f     *File
+	tmp   string // name of the temporary file within root
+	out   *os.File
+	added bool
+}
+
+func (b *smallFileBatch) newFile(root *os.Root, idx int32, f *File) (*batchedFile, error) {
+	tmp, out, err := createTemp(root, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &batchedFile{
+		batch: b,
+		root:  root,
+		idx:   idx,
+		f:     f,
+		tmp:   tmp,
+		out:   out,
+	}, nil
+}
+
+// follows reports whether the file at idx can join the batch, which requires
+// ascending file indices.
+func (b *smallFileBatch) follows(idx int32) bool {
+	return len(b.files) == 0 || idx > b.files[len(b.files)-1].idx
+}
+
+func (b *smallFileBatch) full() bool {
+	return len(b.files) >= maxBatchFiles || b.size >= maxBatchBytes
+}
+
+func (p *batchedFile) Name() string { return p.tmp }
+
+func (p *batchedFile) Write(buf []byte) (int, error) { return p.out.Write(buf) }
+
+// CloseAtomicallyReplace adds the file to the batch. It is renamed into place
+// when the batch is committed.
+func (p *batchedFile) CloseAtomicallyReplace() error {
+	p.added = true
+	p.batch.files = append(p.batch.files, p)
+	p.batch.size += p.f.Length
+	return nil
+}
+
+// Cleanup removes the temporary file, unless it was added to the batch.
+func (p *batchedFile) Cleanup() error {
+	if p.added {
+		return nil
+	}
+	err := p.out.Close()
+	if err := p.root.Remove(p.tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return err
+}
+
+// commitBatch syncs all files of the batch, renames them into place, sets
+// their permissions and hands their indices to the generator.
+func (rt *Transfer) commitBatch() error {
+	b := &rt.batch
+	if len(b.files) == 0 {
+		return nil
+	}
+	if err := syncBatch(b.files); err != nil {
+		return err
+	}
+	for len(b.files) > 0 {
+		p := b.files[0]
+		err := rt.commitFile(p)
+		b.files = b.files[1:]
+		b.size -= p.f.Length
+		var fe *fileError
+		switch {
+		case errors.As(err, &fe):
+			rt.toGenerator.push(genMsg{ndx: p.idx, err: fe})
+		case err != nil:
+			return err
+		default:
+			rt.toGenerator.push(genMsg{ndx: p.idx})
+		}
+	}
+	return nil
+}
+
+// commitFile renames the synced file p into place and sets its permissions.
+func (rt *Transfer) commitFile(p *batchedFile) error {
+	if err := p.out.Close(); err != nil {
+		p.root.Remove(p.tmp)
+		return &fileError{msg: "close failed on " + p.f.Name, err: err}
+	}
+	if err := p.root.Rename(p.tmp, p.f.Name); err != nil {
+		p.root.Remove(p.tmp)
+		return &fileError{msg: "rename " + p.tmp + " -> " + p.f.Name + " failed", err: err}
+	}
+	return rt.setPerms(p.f, fs.FileMode(p.f.Mode))
+}
+
+// discardBatch removes the temporary files of a batch which could not be
+// committed.
+func (rt *Transfer) discardBatch() {
+	for _, p := range rt.batch.files {
+		p.out.Close()
+		p.root.Remove(p.tmp)
+	}
+	rt.batch = smallFileBatch{}
+}
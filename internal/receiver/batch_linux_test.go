@@ -0,0 +1,29 @@
+//go:build linux && (amd64 || arm64)
+
+package receiver
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/restrict"
+)
+
+// TestBatchSmallFilesSeccomp commits batches with the seccomp filter
+// installed, in a child process because the filter cannot be removed.
+func TestBatchSmallFilesSeccomp(t *testing.T) {
+	if os.Getenv("RECEIVER_SECCOMP_CHILD") == "1" {
+		if err := restrict.MaybeSyscalls(); err != nil {
+			t.Fatal(err)
+		}
+		testBatchSmallFiles(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBatchSmallFilesSeccomp$", "-test.v")
+	cmd.Env = append(os.Environ(), "RECEIVER_SECCOMP_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %v\n%s", cmd.Args, err, out)
+	}
+}
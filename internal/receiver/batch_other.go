@@ -0,0 +1,14 @@
+//go:build !linux
+
+package receiver
+
+// syncBatch syncs each file of the batch. Without syncfs(2), batching only
+// defers the renames.
+func syncBatch(files []*batchedFile) error {
+	for _, p := range files {
+		if err := p.out.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
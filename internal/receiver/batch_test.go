@@ -0,0 +1,154 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/gokrazy/rsync/internal/sender"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestBatchSmallFiles(t *testing.T) {
+	testBatchSmallFiles(t)
+}
+
+func testBatchSmallFiles(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Unix(1e9, 0)
+	files := make(map[string][]byte)
+	// More files than fit into one batch, interrupted by a large file which
+	// is not batched.
+	for i := range maxBatchFiles + 50 {
+		files[fmt.Sprintf("small%03d", i)] = []byte(fmt.Sprintf("contents of file %d", i))
+	}
+	files["small140-large"] = bytes.Repeat([]byte{0xab}, smallFileThreshold+1)
+	for name, contents := range files {
+		fn := filepath.Join(source, name)
+		if err := os.WriteFile(fn, contents, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toReceiver, fromSender := io.Pipe()
+	toSender, fromReceiver := io.Pipe()
+
+	osenv := rsyncostest.New(t)
+	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+	if err := pc.ParseArguments(osenv, []string{"--server", "--sender", "-rtp"}, rsyncopts.ParseModeLibrary); err != nil {
+		t.Fatal(err)
+	}
+	crd := &rsyncwire.CountingReader{R: toSender}
+	cwr := &rsyncwire.CountingWriter{W: fromSender}
+	st := &sender.Transfer{
+		Logger:   log.New(io.Discard),
+		Opts:     pc.Options,
+		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn: &rsyncwire.Conn{
+			Reader:          crd,
+			Writer:          cwr,
+			ProtocolVersion: 30,
+		},
+	}
+
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			PreserveTimes:   true,
+			PreservePerms:   true,
+			BatchSmallFiles: true,
+			InfoGTE:         func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE:        func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		Dest:     dest,
+		DestRoot: root,
+		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn: &rsyncwire.Conn{
+			Reader:          toReceiver,
+			Writer:          fromReceiver,
+			ProtocolVersion: 30,
+		},
+	}
+
+	// Each side closes the pipe it reads from when returning, so that an
+	// error does not leave the other side blocked.
+	var eg errgroup.Group
+	eg.Go(func() error {
+		defer fromSender.Close()
+		defer toSender.Close()
+		_, err := st.Do(crd, cwr, source, []string{"/"}, nil)
+		return err
+	})
+	eg.Go(func() error {
+		defer fromReceiver.Close()
+		defer toReceiver.Close()
+		fileList, err := rt.ReceiveFileList()
+		if err != nil {
+			return err
+		}
+		_, err = rt.Do(t.Context(), rt.Conn, fileList, false)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+	if got, want := len(entries), len(files); got != want {
+		t.Errorf("%d files in dest, want %d", got, want)
+	}
+	for name, want := range files {
+		fn := filepath.Join(dest, name)
+		got, err := os.ReadFile(fn)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: unexpected contents", name)
+		}
+		st, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := st.Mode().Perm(), os.FileMode(0640); got != want {
+			t.Errorf("%s: mode = %v, want %v", name, got, want)
+		}
+		if !st.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime = %v, want %v", name, st.ModTime(), mtime)
+		}
+	}
+}
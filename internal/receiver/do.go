@@ -2,70 +2,256 @@ package receiver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"syscall"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"golang.org/x/sync/errgroup"
 )
 
-func isTopDir(f *File) bool {
-	// TODO: once we check the f.Flags:
-	// if !f.FileMode().IsDir() {
-	//    // non-directories can get the top_dir flag set,
-	//    // but it must be ignored (only for protocol reasons).
-	//   return false
-	// }
-	// return (f.Flags & TOP_DIR) != 0
-	return f.Name == "."
-}
-
+// deleteFiles deletes the files which the sender did not list from all
+// directories whose contents the sender listed.
+//
+// rsync/generator.c:do_delete_pass
 func (rt *Transfer) deleteFiles(fileList []*File) error {
-	if rt.IOErrors > 0 {
+	// Files which vanished on the sender do not prevent deletion.
+	//
+	// rsync/generator.c:delete_in_dir
+	if rt.IOErrors&rsync.IOERR_GENERAL != 0 && !rt.Opts.IgnoreErrors {
 		rt.Logger.Printf("IO error encountered, skipping file deletion")
 		return nil
 	}
 
-	for _, f := range fileList {
-		if !isTopDir(f) {
+	var names map[string]struct{}
+	// The file list is sorted, so going backwards visits subdirectories
+	// before their parents (depth-first).
+	for _, f := range slices.Backward(fileList) {
+		if f.cleared || !f.contentDir {
 			continue
 		}
-		rt.Logger.Printf("deleting in %s", f.Name)
-		// Other rsync implementations generate a local file list and compare it
-		// with the remote file list, we re-implement the path→name mapping part
-		// of file list generation here. We could change it for consistency.
-		err := fs.WalkDir(rt.DestRoot.FS(), ".", func(path string, info fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			rt.Logger.Printf("WalkDir(%q)", path)
-			if findInFileList(fileList, path) {
-				return nil
-			}
-			if rt.Opts.Verbose {
-				rt.Logger.Printf("  deleting %s", path)
-			}
-			if rt.Opts.DryRun {
-				return nil
-			}
-			if err := rt.DestRoot.RemoveAll(path); err != nil {
-				rt.Logger.Printf("  deleting %s failed: %v", path, err)
-				// keep going
-			}
-			return fs.SkipDir // skip the just-deleted directory
-		})
+		if names == nil {
+			names = fileNames(fileList)
+		}
+		if f.TopDir {
+			rt.Logger.Printf("deleting in %s", f.Name)
+		}
+		if err := rt.deleteIn(f.Name, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteInDir deletes the files in the directory of the file list seg
+// (incremental recursion) which the sender did not list.
+//
+// rsync/generator.c:delete_in_dir
+func (rt *Transfer) deleteInDir(seg *fileSegment) error {
+	var dir string
+	if seg.parent != nil {
+		if !seg.parent.contentDir {
+			return nil
+		}
+		dir = seg.parent.Name
+	} else {
+		// The first file list holds the contents of the top directory “.”,
+		// the contents of all other directories follow in their own file
+		// lists.
+		idx := slices.IndexFunc(seg.files, func(f *File) bool { return f.Name == "." })
+		if idx == -1 || !seg.files[idx].contentDir {
+			return nil
+		}
+		dir = "."
+	}
+	if rt.IOErrors&rsync.IOERR_GENERAL != 0 && !rt.Opts.IgnoreErrors {
+		rt.Logger.Printf("IO error encountered, skipping file deletion in %s", dir)
+		return nil
+	}
+	return rt.deleteIn(dir, fileNames(seg.files))
+}
+
+// deleteIn deletes the entries of the destination directory dir which are not
+// in names, unless the filter rules protect them.
+//
+// rsync/generator.c:delete_in_dir
+func (rt *Transfer) deleteIn(dir string, names map[string]struct{}) error {
+	if err := rt.maybeSendKeepalive(); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(rt.DestRoot.FS(), dir)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return nil // directory does not exist (yet), nothing to do
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := rt.maybeSendKeepalive(); err != nil {
+			return err
+		}
+		name := path.Join(dir, entry.Name())
+		if _, ok := names[name]; ok {
+			continue
+		}
+		if rt.excluded(name, entry.IsDir()) {
+			continue
+		}
+		if err := rt.deleteStale(name, entry.IsDir()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excluded reports whether name is protected from deletion by the filter
+// rules.
+//
+// rsync/generator.c:delete_in_dir (check_filter)
+func (rt *Transfer) excluded(name string, isDir bool) bool {
+	if isDir && rt.isPartialDir(name) {
+		return true
+	}
+	return rt.Opts.Excluded != nil && rt.Opts.Excluded(name, isDir)
+}
+
+// deleteStale deletes name, which the sender did not list. Failures are
+// logged, but do not stop the transfer.
+//
+// With --force, a stale directory is deleted with all its contents in one go.
+// Otherwise, its files are deleted first, followed by its directories, deepest
+// first: a directory which is not empty by then is kept.
+//
+// rsync/delete.c:delete_item
+func (rt *Transfer) deleteStale(name string, isDir bool) error {
+	if rt.Opts.InfoGTE(rsyncopts.INFO_DEL, 1) {
+		rt.Logger.Printf("  deleting %s", name)
+	}
+	if !isDir {
+		if err := rt.remove(name, false); err != nil {
+			rt.Logger.Printf("  deleting %s failed: %v", name, err)
+		}
+		return nil
+	}
+	if rt.Opts.ForceDelete {
+		if err := rt.remove(name, true); err != nil {
+			rt.Logger.Printf("  deleting %s failed: %v", name, err)
+		}
+		return nil
+	}
+	var dirs []string
+	err := fs.WalkDir(rt.DestRoot.FS(), name, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			if os.IsNotExist(err) {
-				return nil // destination does not exist, nothing to do
-			}
+			rt.Logger.Printf("  deleting %s failed: %v", path, err)
+			return nil // keep going
+		}
+		if err := rt.maybeSendKeepalive(); err != nil {
 			return err
 		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if rt.Opts.InfoGTE(rsyncopts.INFO_DEL, 1) {
+			rt.Logger.Printf("  deleting %s", path)
+		}
+		if err := rt.remove(path, false); err != nil {
+			rt.Logger.Printf("  deleting %s failed: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// WalkDir visits each directory before its contents.
+	for _, dir := range slices.Backward(dirs) {
+		if err := rt.remove(dir, false); err != nil {
+			rt.Logger.Printf("cannot delete directory %s (use --force?): %v", dir, err)
+		}
 	}
 	return nil
 }
 
+// deleteStats counts what the receiver deleted.
+//
+// rsync/rsync.h:struct stats (deleted_files, deleted_dirs)
+type deleteStats struct {
+	files int64
+	dirs  int64
+	bytes int64
+}
+
+// remove deletes name (with all its contents if all is set) except in dry-run
+// mode, counts it in the deletion stats and reports the result to OnDelete.
+func (rt *Transfer) remove(name string, all bool) error {
+	// Count before deleting, there is nothing left to count afterwards.
+	counted := rt.countDeletion(name, all)
+	var err error
+	if !rt.Opts.DryRun {
+		if all {
+			err = rt.DestRoot.RemoveAll(name)
+		} else {
+			err = rt.DestRoot.Remove(name)
+		}
+	}
+	if err == nil {
+		rt.deleted.files += counted.files
+		rt.deleted.dirs += counted.dirs
+		rt.deleted.bytes += counted.bytes
+	}
+	if rt.OnDelete != nil {
+		rt.OnDelete(name, err)
+	}
+	return err
+}
+
+// countDeletion returns what deleting name (with all its contents if all is
+// set) deletes.
+func (rt *Transfer) countDeletion(name string, all bool) deleteStats {
+	var counted deleteStats
+	st, err := rt.DestRoot.Lstat(name)
+	if err != nil {
+		return counted // rm will fail as well
+	}
+	if st.IsDir() && !all {
+		counted.dirs++
+		return counted
+	}
+	if !st.IsDir() {
+		counted.files++
+		if st.Mode().IsRegular() {
+			counted.bytes += st.Size()
+		}
+		return counted
+	}
+	fs.WalkDir(rt.DestRoot.FS(), name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // keep counting what is readable
+		}
+		if d.IsDir() {
+			counted.dirs++
+			return nil
+		}
+		counted.files++
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				counted.bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return counted
+}
+
 // waitFor calls f and waits for it to complete, but only until the specified
 // context is cancelled.
 func waitFor(ctx context.Context, f func() error) error {
@@ -80,14 +266,36 @@ func waitFor(ctx context.Context, f func() error) error {
 }
 
 // rsync/main.c:do_recv
-func (rt *Transfer) Do(c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsyncstats.TransferStats, error) {
-	if rt.Opts.DeleteMode {
+//
+// Cancelling ctx makes Do return ctx.Err() without waiting for the generator
+// and receiver goroutines, which finish in the background.
+func (rt *Transfer) Do(ctx context.Context, c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsyncstats.TransferStats, error) {
+	if filepath.IsAbs(rt.Opts.PartialDir) {
+		return nil, fmt.Errorf("--partial-dir=%s: absolute partial directories are not supported", rt.Opts.PartialDir)
+	}
+	if err := rt.initChecksum(); err != nil {
+		return nil, err
+	}
+	tokens, err := rsynccommon.NewDecoder(c)
+	if err != nil {
+		return nil, err
+	}
+	rt.tokens = tokens
+	rt.keepalive.numFiles = len(fileList)
+
+	if err := rt.checkSpace(fileList); err != nil {
+		return nil, err
+	}
+
+	// With incremental recursion, the generator deletes per directory.
+	if rt.Opts.DeleteMode && !c.Capabilities.IncRecurse {
 		if err := rt.deleteFiles(fileList); err != nil {
 			return nil, err
 		}
 	}
 
-	ctx := context.Background()
+	rt.toGenerator = newGenQueue()
+
 	eg, ctx := errgroup.WithContext(ctx)
 	// Wrap both, the generator and the receiver goroutine, in waitFor() calls
 	// to ensure we don’t block on the generator when the receiver returns an
@@ -97,18 +305,30 @@ func (rt *Transfer) Do(c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsy
 		return waitFor(ctx, func() error { return rt.GenerateFiles(fileList) })
 	})
 	eg.Go(func() error {
-		return waitFor(ctx, func() error { return rt.RecvFiles(fileList) })
+		return waitFor(ctx, func() error {
+			defer rt.toGenerator.close()
+			return rt.RecvFiles(fileList)
+		})
 	})
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
-	if rt.retouchDirPerms /* || rt.retouchDirTimes */ {
-		if err := rt.touchUpDirs(fileList); err != nil {
+	// Before protocol 29, the generator returns before the receiver is done
+	// with the files which failed verification. Forward what is left.
+	if err := rt.drainReceiver(); err != nil {
+		return nil, err
+	}
+	if rt.retouchDirPerms || rt.retouchDirTimes {
+		dirs := fileList
+		if c.Capabilities.IncRecurse {
+			dirs = rt.dirs // fileList is only the initial file list
+		}
+		if err := rt.touchUpDirs(dirs); err != nil {
 			return nil, err
 		}
 	}
 
-	var stats *rsyncstats.TransferStats
+	stats := &rsyncstats.TransferStats{}
 	if !noReport {
 		var err error
 		stats, err = rt.report(c)
@@ -116,12 +336,33 @@ func (rt *Transfer) Do(c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsy
 			return nil, err
 		}
 	}
+	stats.DeletedFiles = rt.deleted.files
+	stats.DeletedDirs = rt.deleted.dirs
+	stats.DeletedBytes = rt.deleted.bytes
+	if rt.Opts.InfoGTE(rsyncopts.INFO_STATS, 2) {
+		// rsync/main.c:output_summary
+		rt.Logger.Printf("Number of deleted files: %d (dir: %d)", stats.DeletedFiles+stats.DeletedDirs, stats.DeletedDirs)
+		rt.Logger.Printf("Total deleted file size: %d bytes", stats.DeletedBytes)
+	}
 
 	// send final goodbye message
-	if err := c.WriteInt32(-1); err != nil {
+	if err := c.WriteNdx(rsync.NDX_DONE); err != nil {
 		return nil, err
 	}
 
+	if c.ProtocolVersion >= 31 {
+		// The sender acknowledges the goodbye message.
+		//
+		// rsync/main.c:read_final_goodbye
+		finish, err := c.ReadNdx()
+		if err != nil {
+			return nil, err
+		}
+		if finish != rsync.NDX_DONE {
+			return nil, fmt.Errorf("protocol error: expected final NDX_DONE, got %d", finish)
+		}
+	}
+
 	return stats, nil
 }
 
@@ -129,20 +370,34 @@ func (rt *Transfer) Do(c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsy
 func (rt *Transfer) report(c *rsyncwire.Conn) (*rsyncstats.TransferStats, error) {
 	// read statistics:
 	// total bytes read (from network connection)
-	read, err := c.ReadInt64()
+	read, err := c.ReadVarlong30(3)
 	if err != nil {
 		return nil, err
 	}
 	// total bytes written (to network connection)
-	written, err := c.ReadInt64()
+	written, err := c.ReadVarlong30(3)
 	if err != nil {
 		return nil, err
 	}
 	// total size of files
-	size, err := c.ReadInt64()
+	size, err := c.ReadVarlong30(3)
 	if err != nil {
 		return nil, err
 	}
+	if c.ProtocolVersion >= 29 {
+		// file list build time and transfer time (in milliseconds)
+		buildTime, err := c.ReadVarlong30(3)
+		if err != nil {
+			return nil, err
+		}
+		xferTime, err := c.ReadVarlong30(3)
+		if err != nil {
+			return nil, err
+		}
+		if rt.Opts.InfoGTE(rsyncopts.INFO_STATS, 2) {
+			rt.Logger.Printf("server sent file list times: build=%dms, xfer=%dms", buildTime, xferTime)
+		}
+	}
 	if rt.Opts.InfoGTE(rsyncopts.INFO_STATS, 1) {
 		rt.Logger.Printf("server sent stats: read=%d, written=%d, size=%d", read, written, size)
 	}
@@ -151,5 +406,7 @@ func (rt *Transfer) report(c *rsyncwire.Conn) (*rsyncstats.TransferStats, error)
 		Read:    read,
 		Written: written,
 		Size:    size,
+
+		Compression: c.Capabilities.Compression,
 	}, nil
 }
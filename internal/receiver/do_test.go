@@ -0,0 +1,88 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+func TestOnDelete(t *testing.T) {
+	for _, tt := range []struct {
+		dryRun bool
+		force  bool
+		want   []string
+	}{
+		{want: []string{"stale", "staledir/a", "staledir/sub/b", "staledir/sub", "staledir"}},
+		{force: true, want: []string{"stale", "staledir"}},
+		{dryRun: true, want: []string{"stale", "staledir/a", "staledir/sub/b", "staledir/sub", "staledir"}},
+	} {
+		t.Run(fmt.Sprintf("dryRun=%v/force=%v", tt.dryRun, tt.force), func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, "staledir", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"keep", "stale", "staledir/a", "staledir/sub/b"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			root, err := os.OpenRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+
+			var got []string
+			rt := &Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &TransferOpts{
+					DryRun:      tt.dryRun,
+					DeleteMode:  true,
+					ForceDelete: tt.force,
+					InfoGTE:     func(rsyncopts.InfoLevel, uint16) bool { return false },
+				},
+				DestRoot: root,
+				Conn:     &rsyncwire.Conn{Writer: io.Discard, ProtocolVersion: 31},
+				OnDelete: func(name string, err error) {
+					if err != nil {
+						t.Errorf("OnDelete(%q, %v)", name, err)
+					}
+					got = append(got, name)
+				},
+			}
+			fileList := []*File{
+				{Name: ".", Mode: rsync.S_IFDIR | 0755, TopDir: true, contentDir: true},
+				{Name: "keep", Mode: rsync.S_IFREG | 0644},
+			}
+			if err := rt.deleteFiles(fileList); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("OnDelete called for %q, want %q", got, tt.want)
+			}
+			// stale, staledir/a and staledir/sub/b contain their names.
+			wantStats := deleteStats{
+				files: 3,
+				dirs:  2,
+				bytes: int64(len("stale") + len("staledir/a") + len("staledir/sub/b")),
+			}
+			if rt.deleted != wantStats {
+				t.Errorf("deletion stats = %+v, want %+v", rt.deleted, wantStats)
+			}
+			for _, name := range tt.want {
+				_, err := os.Lstat(filepath.Join(dir, name))
+				if exists := err == nil; exists != tt.dryRun {
+					t.Errorf("%s: exists = %v, want %v", name, exists, tt.dryRun)
+				}
+			}
+		})
+	}
+}
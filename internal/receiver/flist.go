@@ -5,27 +5,74 @@ import (
 	"io"
 	"io/fs"
 	"path/filepath"
+	"slices"
 	"sort"
 	"time"
 
 	"github.com/gokrazy/rsync"
-	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 )
 
 // rsync/flist.c:flist_sort_and_clean
-func sortFileList(fileList []*File) {
-	sort.Slice(fileList, func(i, j int) bool {
-		return fileList[i].Name < fileList[j].Name
+func sortFileList(protocolVersion int32, fileList []*File) {
+	slices.SortFunc(fileList, func(a, b *File) int {
+		return rsynccommon.CompareFileNames(protocolVersion, a.Name, a.IsDir(), b.Name, b.IsDir())
 	})
 }
 
+// cleanFileList marks entries of the sorted fileList whose name another entry
+// already uses as cleared. Senders transmit duplicates when source arguments
+// overlap. The entries stay in the list, so file indices still match the
+// sender’s. Of two entries with the same name, the first one is kept, unless
+// only the second one is a directory: its contents might be in the file list.
+//
+// rsync/flist.c:flist_sort_and_clean
+func (rt *Transfer) cleanFileList(fileList []*File) {
+	protocol := rt.Conn.ProtocolVersion
+	prev := -1 // the last entry which was kept
+	for i, f := range fileList {
+		dup := -1
+		if prev >= 0 && rsynccommon.CompareFileNames(protocol, f.Name, f.IsDir(), fileList[prev].Name, fileList[prev].IsDir()) == 0 {
+			dup = prev
+		} else if prev >= 0 && protocol >= 29 && f.IsDir() {
+			// Starting with protocol 29, a non-directory of the same name
+			// sorts earlier, but not necessarily right before.
+			j, found := slices.BinarySearchFunc(fileList[:prev+1], f.Name, func(e *File, name string) int {
+				return rsynccommon.CompareFileNames(protocol, e.Name, e.IsDir(), name, false)
+			})
+			if found && !fileList[j].cleared {
+				dup = j
+			}
+		}
+		if dup == -1 {
+			prev = i
+			continue
+		}
+		keep, drop := dup, i
+		if f.IsDir() && !fileList[dup].IsDir() {
+			keep, drop = i, dup
+		}
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_DUP, 1) {
+			rt.Logger.Printf("removing duplicate name %s from file list (%d)", fileList[drop].Name, drop)
+		}
+		fileList[drop].cleared = true
+		if keep == i {
+			prev = i
+		}
+	}
+}
+
+// fileNames returns the set of names in fileList, which the deletion pass
+// consults for every file in the destination.
+//
 // rsync/receiver.c:delete_files
-func findInFileList(fileList []*File, name string) bool {
-	i := sort.Search(len(fileList), func(i int) bool {
-		return fileList[i].Name >= name
-	})
-	return i < len(fileList) && fileList[i].Name == name
+func fileNames(fileList []*File) map[string]struct{} {
+	names := make(map[string]struct{}, len(fileList))
+	for _, f := range fileList {
+		names[f.Name] = struct{}{}
+	}
+	return names
 }
 
 type File struct {
@@ -36,8 +83,40 @@ type File struct {
 	Uid        int32
 	Gid        int32
 	LinkTarget string
-	Rdev       int32
-	Checksum   [rsyncchecksum.Size]byte
+	RdevMajor  uint32
+	RdevMinor  uint32
+	Checksum   []byte
+
+	// HardLinked is set (with -H) for files which the sender found to be
+	// hard-linked to other files. All files of a group share the same
+	// HardLinkGroup: starting with protocol 30, the file index of the first
+	// file of the group, before that, a number assigned in order of arrival.
+	HardLinked    bool
+	HardLinkGroup int32
+
+	// TopDir is set for the directories which were requested on the
+	// sender’s command line (XMIT_TOP_DIR).
+	TopDir bool
+
+	// cleared is set for entries which duplicate another entry’s name (see
+	// cleanFileList). They keep their file index, but are not transferred.
+	cleared bool
+
+	// contentDir is set for directories whose contents the sender lists,
+	// i.e. in which the receiver deletes.
+	contentDir bool
+}
+
+// An idev identifies a file on the sender by device and inode number (-H,
+// protocol < 30).
+type idev struct {
+	dev int64
+	ino int64
+}
+
+// IsDir reports whether f is a directory.
+func (f *File) IsDir() bool {
+	return f.Mode&rsync.S_IFMT == rsync.S_IFDIR
 }
 
 // FileMode converts from the Linux permission bits to Go’s permission bits.
@@ -63,8 +142,13 @@ func (f *File) FileMode() fs.FileMode {
 	return ret
 }
 
+// receiveFileEntry reads the entry following flags. received holds the
+// entries of the current file list received so far, the first of which has
+// index ndxStart.
+//
 // rsync/flist.c:receive_file_entry
-func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
+func (rt *Transfer) receiveFileEntry(flags uint16, last *File, ndxStart int32, received []*File) (*File, error) {
+	protocol := rt.Conn.ProtocolVersion // for convenience
 	f := &File{}
 
 	var l1 int
@@ -78,7 +162,7 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 
 	var l2 int
 	if flags&rsync.XMIT_LONG_NAME != 0 {
-		l, err := rt.Conn.ReadInt32()
+		l, err := rt.Conn.ReadVarint30()
 		if err != nil {
 			return nil, err
 		}
@@ -106,11 +190,45 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 	if _, err := io.ReadFull(rt.Conn.Reader, readb); err != nil {
 		return nil, err
 	}
-	// TODO: does rsync’s clean_fname() and sanitize_path() combination do
-	// anything more than Go’s filepath.Clean()?
+	if err := checkName(string(b)); err != nil {
+		return nil, err
+	}
 	f.Name = filepath.Clean(string(b))
 
-	length, err := rt.Conn.ReadInt64()
+	hlinked := rt.Opts.PreserveHardlinks && flags&rsync.XMIT_HLINKED != 0
+	if protocol >= 30 && hlinked {
+		if flags&rsync.XMIT_HLINK_FIRST != 0 {
+			f.HardLinked = true
+			f.HardLinkGroup = ndxStart + int32(len(received))
+		} else {
+			ndx, err := rt.Conn.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			if end := ndxStart + int32(len(received)); ndx < 0 || ndx >= end {
+				return nil, fmt.Errorf("hard-link reference out of range: %d (%d)", ndx, end)
+			}
+			f.HardLinked = true
+			f.HardLinkGroup = ndx
+			if ndx >= ndxStart {
+				// The first file of the group is part of this file list,
+				// so the sender omits all other fields.
+				first := received[ndx-ndxStart]
+				f.Length = first.Length
+				f.ModTime = first.ModTime
+				f.Mode = first.Mode
+				f.Uid = first.Uid
+				f.Gid = first.Gid
+				f.RdevMajor = first.RdevMajor
+				f.RdevMinor = first.RdevMinor
+				f.LinkTarget = first.LinkTarget
+				f.Checksum = first.Checksum
+				return f, nil
+			}
+		}
+	}
+
+	length, err := rt.Conn.ReadVarlong30(3)
 	if err != nil {
 		return nil, err
 	}
@@ -118,12 +236,28 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 
 	if flags&rsync.XMIT_SAME_TIME != 0 {
 		f.ModTime = last.ModTime
+	} else if protocol >= 30 {
+		modTime, err := rt.Conn.ReadVarlong(4)
+		if err != nil {
+			return nil, err
+		}
+		f.ModTime = time.Unix(modTime, 0)
 	} else {
+		// Like tridge rsync, read the 32 bits as unsigned, which keeps
+		// working until 2106 at the expense of pre-1970 times.
 		modTime, err := rt.Conn.ReadInt32()
 		if err != nil {
 			return nil, err
 		}
-		f.ModTime = time.Unix(int64(modTime), 0)
+		f.ModTime = time.Unix(int64(uint32(modTime)), 0)
+	}
+	if flags&rsync.XMIT_MOD_NSEC != 0 {
+		// protocol >= 31
+		nsec, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return nil, err
+		}
+		f.ModTime = time.Unix(f.ModTime.Unix(), int64(nsec))
 	}
 
 	if flags&rsync.XMIT_SAME_MODE != 0 {
@@ -136,14 +270,41 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 		f.Mode = mode
 	}
 
+	if f.IsDir() {
+		switch {
+		case protocol >= 30:
+			if flags&rsync.XMIT_NO_CONTENT_DIR == 0 {
+				f.TopDir = flags&rsync.XMIT_TOP_DIR != 0
+				f.contentDir = true
+			}
+		case flags&rsync.XMIT_TOP_DIR != 0:
+			// Older protocols do not mark directories without contents,
+			// so everything below a top directory is assumed to be listed
+			// when recursing.
+			rt.inDelHier = rt.Opts.Recurse
+			f.TopDir = true
+			f.contentDir = true
+		case rt.inDelHier:
+			f.contentDir = true
+		}
+	}
+
 	if rt.Opts.PreserveUid {
 		if flags&rsync.XMIT_SAME_UID != 0 {
 			f.Uid = last.Uid
 		} else {
-			uid, err := rt.Conn.ReadInt32()
+			uid, err := rt.Conn.ReadVarint30()
 			if err != nil {
 				return nil, err
 			}
+			if rt.Conn.Capabilities.IncRecurse && flags&rsync.XMIT_USER_NAME_FOLLOWS != 0 {
+				if rt.Users == nil {
+					rt.Users = make(map[int32]mapping)
+				}
+				if err := rt.recvIdName(rt.Users, uid, localUid); err != nil {
+					return nil, err
+				}
+			}
 			f.Uid = uid
 		}
 	}
@@ -152,10 +313,18 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 		if flags&rsync.XMIT_SAME_GID != 0 {
 			f.Gid = last.Gid
 		} else {
-			gid, err := rt.Conn.ReadInt32()
+			gid, err := rt.Conn.ReadVarint30()
 			if err != nil {
 				return nil, err
 			}
+			if rt.Conn.Capabilities.IncRecurse && flags&rsync.XMIT_GROUP_NAME_FOLLOWS != 0 {
+				if rt.Groups == nil {
+					rt.Groups = make(map[int32]mapping)
+				}
+				if err := rt.recvIdName(rt.Groups, gid, localGid); err != nil {
+					return nil, err
+				}
+			}
 			f.Gid = gid
 		}
 	}
@@ -165,21 +334,58 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 	isSpecial := mode == rsync.S_IFIFO || mode == rsync.S_IFSOCK
 	isLink := mode == rsync.S_IFLNK
 
-	if rt.Opts.PreserveDevices && (isDev || isSpecial) {
-		// TODO(protocol >= 28): rdev/major/minor handling
-		if flags&rsync.XMIT_SAME_RDEV_pre28 != 0 {
-			f.Rdev = last.Rdev
+	// Starting with protocol 31, special files (FIFOs and sockets) no longer
+	// transmit an rdev number.
+	if (rt.Opts.PreserveDevices && isDev) ||
+		(rt.Opts.PreserveSpecials && isSpecial && protocol < 31) {
+		if protocol < 28 {
+			if flags&rsync.XMIT_SAME_RDEV_pre28 != 0 {
+				f.RdevMajor = last.RdevMajor
+				f.RdevMinor = last.RdevMinor
+			} else {
+				rdev, err := rt.Conn.ReadInt32()
+				if err != nil {
+					return nil, err
+				}
+				f.RdevMajor = rsynccommon.RdevMajor(rdev)
+				f.RdevMinor = rsynccommon.RdevMinor(rdev)
+			}
 		} else {
-			rdev, err := rt.Conn.ReadInt32()
-			if err != nil {
-				return nil, err
+			if flags&rsync.XMIT_SAME_RDEV_MAJOR == 0 {
+				major, err := rt.Conn.ReadVarint30()
+				if err != nil {
+					return nil, err
+				}
+				rt.rdevMajor = uint32(major)
 			}
-			f.Rdev = rdev
+			var minor uint32
+			switch {
+			case protocol >= 30:
+				m, err := rt.Conn.ReadVarint()
+				if err != nil {
+					return nil, err
+				}
+				minor = uint32(m)
+			case flags&rsync.XMIT_RDEV_MINOR_8_pre30 != 0:
+				m, err := rt.Conn.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				minor = uint32(m)
+			default:
+				m, err := rt.Conn.ReadInt32()
+				if err != nil {
+					return nil, err
+				}
+				minor = uint32(m)
+			}
+			f.RdevMajor = rt.rdevMajor
+			f.RdevMinor = minor
 		}
 	}
 
 	if rt.Opts.PreserveLinks && isLink {
-		length, err := rt.Conn.ReadInt32()
+		length, err := rt.Conn.ReadVarint30()
 		if err != nil {
 			return nil, err
 		}
@@ -188,10 +394,45 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 			return nil, err
 		}
 		f.LinkTarget = string(b)
+		if rt.Opts.SanitizePaths {
+			f.LinkTarget = sanitizePath(f.LinkTarget, dirDepth(f.Name))
+		}
 	}
 
-	if rt.Opts.AlwaysChecksum {
-		if _, err := io.ReadFull(rt.Conn.Reader, f.Checksum[:]); err != nil {
+	// Before protocol 28, the sender transmits the device and inode number
+	// of every regular file, without a flag.
+	if protocol < 28 && rt.Opts.PreserveHardlinks && mode == rsync.S_IFREG {
+		hlinked = true
+	}
+	if protocol < 30 && hlinked {
+		if flags&rsync.XMIT_SAME_DEV == 0 {
+			dev, err := rt.Conn.ReadInt64()
+			if err != nil {
+				return nil, err
+			}
+			rt.hlinkDev = dev
+		}
+		ino, err := rt.Conn.ReadInt64()
+		if err != nil {
+			return nil, err
+		}
+		if rt.hlinkGroups == nil {
+			rt.hlinkGroups = make(map[idev]int32)
+		}
+		id := idev{dev: rt.hlinkDev, ino: ino}
+		group, ok := rt.hlinkGroups[id]
+		if !ok {
+			group = int32(len(rt.hlinkGroups))
+			rt.hlinkGroups[id] = group
+		}
+		f.HardLinked = true
+		f.HardLinkGroup = group
+	}
+
+	// Starting with protocol 28, only regular files have a checksum.
+	if rt.Opts.AlwaysChecksum && (mode == rsync.S_IFREG || protocol < 28) {
+		f.Checksum = make([]byte, rt.checksum.Size())
+		if _, err := io.ReadFull(rt.Conn.Reader, f.Checksum); err != nil {
 			return nil, err
 		}
 	}
@@ -199,31 +440,82 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 	return f, nil
 }
 
+// readFileListFlags reads the flags which start each file list entry. 0 marks
+// the end of the file list.
+//
 // rsync/flist.c:recv_file_list
-func (rt *Transfer) ReceiveFileList() ([]*File, error) {
-	if rt.Opts.Progress {
-		fmt.Fprintln(rt.Env.Stdout, "receiving file list...")
-		fmt.Fprint(rt.Env.Stdout, "0 files to consider")
+func (rt *Transfer) readFileListFlags() (uint16, error) {
+	if rt.Conn.Capabilities.VarintFileListFlags {
+		flags, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return 0, err
+		}
+		if flags&^0xffff != 0 {
+			return 0, fmt.Errorf("unsupported file list flags: 0x%x", flags)
+		}
+		return uint16(flags), nil
+	}
+	b, err := rt.Conn.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	flags := uint16(b)
+	if flags != 0 && rt.Conn.ProtocolVersion >= 28 && flags&rsync.XMIT_EXTENDED_FLAGS != 0 {
+		b, err := rt.Conn.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		flags |= uint16(b) << 8
+	}
+	return flags, nil
+}
+
+// receiveFileEntries reads file list entries up to the end marker and returns
+// them in the order the sender sent them, along with the sender’s I/O error
+// flag (protocol >= 30).
+//
+// rsync/flist.c:recv_file_list
+func (rt *Transfer) receiveFileEntries(progress bool, ndxStart int32) ([]*File, int32, error) {
+	if rt.lastFile == nil {
+		rt.lastFile = new(File)
 	}
-	lastFileEntry := new(File)
 	var fileList []*File
+	var ioErrors int32
 	for {
-		b, err := rt.Conn.ReadByte()
+		flags, err := rt.readFileListFlags()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		if b == 0 {
+		if flags == 0 {
+			if rt.Conn.Capabilities.VarintFileListFlags {
+				// The end marker is followed by the I/O error flag.
+				ioErrors, err = rt.Conn.ReadVarint()
+				if err != nil {
+					return nil, 0, err
+				}
+			}
 			break
 		}
-		flags := uint16(b)
 		// rt.Logger.Printf("flags: %x", flags)
-		// TODO(protocol >= 28): extended flags
+		if flags == rsync.XMIT_EXTENDED_FLAGS|rsync.XMIT_IO_ERROR_ENDLIST {
+			// With a safe file list, the end marker carries the I/O error flag.
+			if !rt.Conn.Capabilities.SafeFileList {
+				return nil, 0, fmt.Errorf("invalid file list flags: 0x%x", flags)
+			}
+			ioErrors, err = rt.Conn.ReadVarint()
+			if err != nil {
+				return nil, 0, err
+			}
+			break
+		}
 
-		f, err := rt.receiveFileEntry(flags, lastFileEntry)
+		// The entries of all file lists are compressed relative to the
+		// previously received entry, even across file lists.
+		f, err := rt.receiveFileEntry(flags, rt.lastFile, ndxStart, fileList)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		lastFileEntry = f
+		rt.lastFile = f
 		// TODO: include depth in output?
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 			rt.Logger.Printf("[Receiver] i=%d ? %s mode=%o len=%d uid=%d gid=%d flags=?",
@@ -235,17 +527,44 @@ func (rt *Transfer) ReceiveFileList() ([]*File, error) {
 				f.Gid)
 		}
 		fileList = append(fileList, f)
-		if rt.Opts.Progress && len(fileList)%100 == 0 {
+		if progress && len(fileList)%100 == 0 {
 			fmt.Fprintf(rt.Env.Stdout, "\r%d files to consider", len(fileList))
 		}
 	}
+	return fileList, ioErrors, nil
+}
+
+// rsync/flist.c:recv_file_list
+func (rt *Transfer) ReceiveFileList() ([]*File, error) {
+	// The file list carries file checksums (--checksum) of the negotiated
+	// checksum’s length.
+	if err := rt.initChecksum(); err != nil {
+		return nil, err
+	}
+	if rt.Opts.Progress {
+		fmt.Fprintln(rt.Env.Stdout, "receiving file list...")
+		fmt.Fprint(rt.Env.Stdout, "0 files to consider")
+	}
+	var ndxStart int32
+	if rt.Conn.Capabilities.IncRecurse {
+		ndxStart = 1 // see firstSegment
+	}
+	fileList, ioErrors, err := rt.receiveFileEntries(rt.Opts.Progress, ndxStart)
+	if err != nil {
+		return nil, err
+	}
+	rt.IOErrors |= ioErrors
 	if rt.Opts.Progress {
 		fmt.Fprintf(rt.Env.Stdout, "\r%d files to consider\n", len(fileList))
 	}
 
-	sortFileList(fileList)
+	sortFileList(rt.Conn.ProtocolVersion, fileList)
+	rt.cleanFileList(fileList)
+	rt.addDirs(fileList)
 
-	if rt.Opts.PreserveUid || rt.Opts.PreserveGid {
+	// With incremental recursion, user and group names follow the file list
+	// entries instead. With --numeric-ids, there are no names.
+	if (rt.Opts.PreserveUid || rt.Opts.PreserveGid) && !rt.Conn.Capabilities.IncRecurse && !rt.Opts.NumericIds {
 		// receive the uid/gid list
 		users, groups, err := rt.RecvIdList()
 		if err != nil {
@@ -255,15 +574,110 @@ func (rt *Transfer) ReceiveFileList() ([]*File, error) {
 		rt.Groups = groups
 	}
 
-	// read the i/o error flag
-	ioErrors, err := rt.Conn.ReadInt32()
+	// read the i/o error flag (protocol >= 30 sends it in the end marker or
+	// as a MSG_IO_ERROR message instead)
+	if rt.Conn.ProtocolVersion < 30 {
+		ioErrors, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		rt.IOErrors = ioErrors
+	}
+	if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
+		rt.Logger.Printf("ioErrors: %v", rt.IOErrors)
+	}
+
+	return fileList, nil
+}
+
+// A fileSegment is one of the file lists a sender transmits: the initial file
+// list or, with incremental recursion, the contents of one directory, which
+// the sender transmits while the transfer is already running.
+//
+// rsync/flist.c:struct file_list
+type fileSegment struct {
+	files    []*File // sorted
+	ndxStart int32   // the file index of files[0]
+	// parent is the directory whose contents this file list holds, or nil
+	// for the initial file list.
+	parent   *File
+	ioErrors int32
+}
+
+// firstSegment returns the initial file list as a fileSegment. With
+// incremental recursion, file index 0 is reserved.
+//
+// rsync/flist.c:flist_new
+func (rt *Transfer) firstSegment(fileList []*File) *fileSegment {
+	seg := &fileSegment{files: fileList}
+	if rt.Conn.Capabilities.IncRecurse {
+		seg.ndxStart = 1
+	}
+	return seg
+}
+
+// addDirs appends the directories of a received file list to the list of
+// all directories, which the sender refers to by index when it sends their
+// contents (incremental recursion).
+//
+// rsync/flist.c:recv_file_list (dir_flist)
+func (rt *Transfer) addDirs(fileList []*File) {
+	if !rt.Conn.Capabilities.IncRecurse {
+		return
+	}
+	for _, f := range fileList {
+		if f.IsDir() {
+			rt.dirs = append(rt.dirs, f)
+		}
+	}
+}
+
+// receiveExtraFileList receives the file list holding the contents of the
+// directory with index dirNdx (incremental recursion), which follows the
+// previous file list prev.
+//
+// rsync/flist.c:recv_file_list
+func (rt *Transfer) receiveExtraFileList(dirNdx int32, prev *fileSegment) (*fileSegment, error) {
+	if dirNdx < 0 || int(dirNdx) >= len(rt.dirs) {
+		return nil, fmt.Errorf("protocol error: invalid directory index %d", dirNdx)
+	}
+	parent := rt.dirs[dirNdx]
+	ndxStart := prev.ndxStart + int32(len(prev.files)) + 1
+	fileList, ioErrors, err := rt.receiveFileEntries(false, ndxStart)
 	if err != nil {
 		return nil, err
 	}
+	for _, f := range fileList {
+		// Reject entries outside of the directory, which a malicious sender
+		// could otherwise use to write files anywhere.
+		if filepath.Dir(f.Name) != parent.Name {
+			return nil, fmt.Errorf("protocol error: file %q is not in directory %q", f.Name, parent.Name)
+		}
+	}
+	sortFileList(rt.Conn.ProtocolVersion, fileList)
+	rt.cleanFileList(fileList)
+	rt.addDirs(fileList)
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
-		rt.Logger.Printf("ioErrors: %v", ioErrors)
+		rt.Logger.Printf("received file list for %s: %d files", parent.Name, len(fileList))
 	}
-	rt.IOErrors = ioErrors
+	return &fileSegment{
+		files:    fileList,
+		ndxStart: ndxStart,
+		parent:   parent,
+		ioErrors: ioErrors,
+	}, nil
+}
 
-	return fileList, nil
+// findFile returns the file with index ndx from the file lists segs (ordered
+// by index), or nil if no file list holds ndx.
+//
+// rsync/flist.c:flist_for_ndx
+func findFile(segs []*fileSegment, ndx int32) *File {
+	i := sort.Search(len(segs), func(i int) bool {
+		return segs[i].ndxStart+int32(len(segs[i].files)) > ndx
+	})
+	if i == len(segs) || ndx < segs[i].ndxStart {
+		return nil
+	}
+	return segs[i].files[ndx-segs[i].ndxStart]
 }
@@ -0,0 +1,437 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/gokrazy/rsync/internal/sender"
+	"github.com/gokrazy/rsync/internal/testlogger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHardLinkRoundTrip(t *testing.T) {
+	source := t.TempDir()
+	for _, name := range []string{"a", "c", "f"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(source, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"b":   "a",
+		"d/e": "a",
+		"g":   "f",
+	} {
+		if err := os.Link(filepath.Join(source, target), filepath.Join(source, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		protocol     int32
+		capabilities rsyncwire.Capabilities
+	}{
+		{protocol: 27},
+		{protocol: 29},
+		{protocol: 30},
+		{protocol: 31, capabilities: rsyncwire.Capabilities{VarintFileListFlags: true}},
+	} {
+		t.Run(fmt.Sprint(tt.protocol), func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, []string{"-rlH"}, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			st := &sender.Transfer{
+				Logger: log.New(io.Discard),
+				Opts:   pc.Options,
+				Conn: &rsyncwire.Conn{
+					Writer:          &buf,
+					ProtocolVersion: tt.protocol,
+					Capabilities:    tt.capabilities,
+				},
+			}
+			if _, err := st.SendFileList(source, []string{"/"}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			rt := &Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &TransferOpts{
+					PreserveLinks:     true,
+					PreserveHardlinks: true,
+					InfoGTE:           func(rsyncopts.InfoLevel, uint16) bool { return false },
+					DebugGTE:          func(rsyncopts.DebugLevel, uint16) bool { return false },
+				},
+				Conn: &rsyncwire.Conn{
+					Reader:          &buf,
+					ProtocolVersion: tt.protocol,
+					Capabilities:    tt.capabilities,
+				},
+			}
+			fileList, err := rt.ReceiveFileList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() > 0 {
+				t.Fatalf("%d bytes left after receiving the file list", buf.Len())
+			}
+			files := make(map[string]*File)
+			for _, f := range fileList {
+				files[f.Name] = f
+			}
+			for _, name := range []string{"a", "b", "d/e", "f", "g"} {
+				f := files[name]
+				if f == nil {
+					t.Fatalf("%s missing from the file list", name)
+				}
+				if !f.HardLinked {
+					t.Errorf("%s: HardLinked = false, want true", name)
+				}
+			}
+			for _, group := range [][]string{{"a", "b", "d/e"}, {"f", "g"}} {
+				first := files[group[0]]
+				for _, name := range group[1:] {
+					f := files[name]
+					if f.HardLinkGroup != first.HardLinkGroup {
+						t.Errorf("%s: HardLinkGroup = %d, want %d (like %s)", name, f.HardLinkGroup, first.HardLinkGroup, first.Name)
+					}
+					if f.Length != first.Length || f.Mode != first.Mode || !f.ModTime.Equal(first.ModTime) {
+						t.Errorf("%s: attributes differ from %s: %+v vs. %+v", name, first.Name, f, first)
+					}
+				}
+			}
+			if files["a"].HardLinkGroup == files["f"].HardLinkGroup {
+				t.Errorf("a and f unexpectedly share HardLinkGroup %d", files["a"].HardLinkGroup)
+			}
+			// Before protocol 28, all regular files carry device and inode
+			// numbers, so only the grouping is meaningful.
+			if c := files["c"]; tt.protocol >= 28 && c.HardLinked {
+				t.Errorf("c: HardLinked = true, want false")
+			}
+			if files["d"].HardLinked {
+				t.Errorf("d: HardLinked = true for a directory")
+			}
+		})
+	}
+}
+
+func TestIdListMapping(t *testing.T) {
+	root, err := user.LookupId("0")
+	if err != nil {
+		t.Skipf("no local user with uid 0: %v", err)
+	}
+	const unknownName = "gokr-rsync-nonexistent"
+	if _, err := user.Lookup(unknownName); err == nil {
+		t.Skipf("user %q unexpectedly exists", unknownName)
+	}
+
+	// The sender’s root user has uid 4242, and uid 1000 belongs to a user
+	// which does not exist locally.
+	var buf rsyncwire.Buffer
+	for _, entry := range []struct {
+		id   int32
+		name string
+	}{
+		{4242, root.Username},
+		{1000, unknownName},
+	} {
+		buf.WriteVarint(entry.id)
+		buf.WriteByte(byte(len(entry.name)))
+		buf.WriteString(entry.name)
+	}
+	buf.WriteVarint(0) // end of uid list
+
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			PreserveUid: true,
+			InfoGTE:     func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE:    func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		Conn: &rsyncwire.Conn{
+			Reader:          bytes.NewReader([]byte(buf.String())),
+			ProtocolVersion: 31,
+		},
+	}
+	users, groups, err := rt.RecvIdList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups != nil {
+		t.Errorf("RecvIdList returned groups without PreserveGid: %v", groups)
+	}
+	rt.Users = users
+	for _, tt := range []struct {
+		remote int32
+		want   int32
+	}{
+		{remote: 4242, want: 0},    // mapped by name
+		{remote: 1000, want: 1000}, // unknown name: numeric fallback
+		{remote: 2000, want: 2000}, // not in the list
+	} {
+		if got := rt.matchUid(tt.remote); got != tt.want {
+			t.Errorf("matchUid(%d) = %d, want %d", tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestNumericIds(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, numericIds := range []bool{false, true} {
+		t.Run(fmt.Sprintf("numericIds=%v", numericIds), func(t *testing.T) {
+			args := []string{"-rog"}
+			if numericIds {
+				args = append(args, "--numeric-ids")
+			}
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, args, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			st := &sender.Transfer{
+				Logger: log.New(io.Discard),
+				Opts:   pc.Options,
+				Conn: &rsyncwire.Conn{
+					Writer:          &buf,
+					ProtocolVersion: 31,
+				},
+			}
+			if _, err := st.SendFileList(source, []string{"/"}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			rt := &Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &TransferOpts{
+					PreserveUid: true,
+					PreserveGid: true,
+					NumericIds:  numericIds,
+					InfoGTE:     func(rsyncopts.InfoLevel, uint16) bool { return false },
+					DebugGTE:    func(rsyncopts.DebugLevel, uint16) bool { return false },
+				},
+				Conn: &rsyncwire.Conn{
+					Reader:          &buf,
+					ProtocolVersion: 31,
+				},
+			}
+			if _, err := rt.ReceiveFileList(); err != nil {
+				t.Fatal(err)
+			}
+			// The sender must not transmit id lists which the receiver
+			// does not expect (and vice versa).
+			if buf.Len() > 0 {
+				t.Fatalf("%d bytes left after receiving the file list", buf.Len())
+			}
+		})
+	}
+}
+
+func TestCleanFileList(t *testing.T) {
+	const (
+		dir  = rsync.S_IFDIR | 0755
+		file = rsync.S_IFREG | 0644
+	)
+	for _, protocol := range []int32{27, 29, 31} {
+		t.Run(fmt.Sprint(protocol), func(t *testing.T) {
+			fileList := []*File{
+				{Name: ".", Mode: dir},
+				{Name: "b", Mode: dir},
+				{Name: "a", Mode: file},
+				{Name: "b", Mode: file},
+				{Name: "b.txt", Mode: file},
+				{Name: "a", Mode: file},
+				{Name: ".", Mode: dir},
+				{Name: "b/c", Mode: file},
+			}
+			logger := testlogger.New(t)
+			rt := &Transfer{
+				Logger: logger,
+				Opts: &TransferOpts{
+					DebugGTE: func(level rsyncopts.DebugLevel, _ uint16) bool { return level == rsyncopts.DEBUG_DUP },
+				},
+				Conn: &rsyncwire.Conn{ProtocolVersion: protocol},
+			}
+			sortFileList(protocol, fileList)
+			rt.cleanFileList(fileList)
+			if want := "removing duplicate name a from file list"; !strings.Contains(string(logger.Bytes()), want) {
+				t.Errorf("log output does not contain %q:\n%s", want, logger.Bytes())
+			}
+			var got []string
+			for _, f := range fileList {
+				if f.cleared {
+					continue
+				}
+				name := f.Name
+				if f.IsDir() {
+					name += "/"
+				}
+				got = append(got, name)
+			}
+			// Starting with protocol 29, directories sort as if their name
+			// had a trailing slash.
+			want := []string{"./", "a", "b/", "b.txt", "b/c"}
+			if protocol >= 29 {
+				want = []string{"./", "a", "b.txt", "b/", "b/c"}
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("cleanFileList: unexpected result: diff (-want +got):\n%s", diff)
+			}
+			if got, want := len(fileList), 8; got != want {
+				t.Errorf("len(fileList) = %d, want %d (entries must keep their index)", got, want)
+			}
+		})
+	}
+}
+
+func TestOverlappingSources(t *testing.T) {
+	tmp := t.TempDir()
+	src1 := filepath.Join(tmp, "src1")
+	src2 := filepath.Join(tmp, "src2")
+	for _, dir := range []string{src1, src2, filepath.Join(src2, "x")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fn := range []string{
+		filepath.Join(src1, "a"),
+		filepath.Join(src1, "x"),
+		filepath.Join(src2, "a"),
+		filepath.Join(src2, "x", "y"),
+	} {
+		if err := os.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, protocol := range []int32{27, 30} {
+		t.Run(fmt.Sprint(protocol), func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, []string{"-r"}, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			st := &sender.Transfer{
+				Logger: log.New(io.Discard),
+				Opts:   pc.Options,
+				Conn: &rsyncwire.Conn{
+					Writer:          &buf,
+					ProtocolVersion: protocol,
+				},
+			}
+			if _, err := st.SendFileList("/", []string{src1 + "/", src2 + "/"}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			rt := &Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &TransferOpts{
+					InfoGTE:  func(rsyncopts.InfoLevel, uint16) bool { return false },
+					DebugGTE: func(rsyncopts.DebugLevel, uint16) bool { return false },
+				},
+				Conn: &rsyncwire.Conn{
+					Reader:          &buf,
+					ProtocolVersion: protocol,
+				},
+			}
+			fileList, err := rt.ReceiveFileList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range fileList {
+				if f.cleared {
+					continue
+				}
+				name := f.Name
+				if f.IsDir() {
+					name += "/"
+				}
+				got = append(got, name)
+			}
+			// The sender sends . and a only once. Both x entries are sent, the
+			// receiver prefers the directory.
+			want := []string{"./", "a", "x/", "x/y"}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ReceiveFileList: unexpected result: diff (-want +got):\n%s", diff)
+			}
+			if got, want := len(fileList), 5; got != want {
+				t.Errorf("len(fileList) = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// BenchmarkFileNames looks up every name of a large file list, as the deletion
+// pass does for a destination which matches the source.
+func BenchmarkFileNames(b *testing.B) {
+	const protocol = 31
+	fileList := make([]*File, 0, 1_000_000)
+	for dir := range 1000 {
+		for file := range 999 {
+			fileList = append(fileList, &File{
+				Name: fmt.Sprintf("dir%03d/file%03d", dir, file),
+				Mode: rsync.S_IFREG | 0644,
+			})
+		}
+		fileList = append(fileList, &File{
+			Name: fmt.Sprintf("dir%03d", dir),
+			Mode: rsync.S_IFDIR | 0755,
+		})
+	}
+	slices.SortFunc(fileList, func(a, b *File) int {
+		return rsynccommon.CompareFileNames(protocol, a.Name, a.IsDir(), b.Name, b.IsDir())
+	})
+
+	b.Run("BinarySearch", func(b *testing.B) {
+		for b.Loop() {
+			for _, f := range fileList {
+				found := false
+				for _, isDir := range []bool{false, true} {
+					_, found = slices.BinarySearchFunc(fileList, f.Name, func(e *File, name string) int {
+						return rsynccommon.CompareFileNames(protocol, e.Name, e.IsDir(), name, isDir)
+					})
+					if found {
+						break
+					}
+				}
+				if !found {
+					b.Fatalf("%s not found", f.Name)
+				}
+			}
+		}
+	})
+
+	b.Run("Set", func(b *testing.B) {
+		for b.Loop() {
+			names := fileNames(fileList)
+			for _, f := range fileList {
+				if _, ok := names[f.Name]; !ok {
+					b.Fatalf("%s not found", f.Name)
+				}
+			}
+		}
+	})
+}
@@ -2,11 +2,12 @@ package receiver
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"syscall"
 	"time"
 
@@ -14,33 +15,91 @@ import (
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
 	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
 // rsync/generator.c:generate_files()
 func (rt *Transfer) GenerateFiles(fileList []*File) error {
-	phase := 0
-	for idx, f := range fileList {
-		if err := rt.recvGenerator(idx, f); err != nil {
+	phase := rsynccommon.PhaseTransfer
+	seg := rt.firstSegment(fileList)
+	// With incremental recursion, we delete per directory as its contents
+	// arrive (see [Transfer.deleteInDir]).
+	deleting := rt.Opts.DeleteMode && rt.Conn.Capabilities.IncRecurse
+	for seg != nil {
+		rt.IOErrors |= seg.ioErrors
+		if deleting {
+			if err := rt.deleteInDir(seg); err != nil {
+				return err
+			}
+		}
+		for i, f := range seg.files {
+			if err := rt.drainReceiver(); err != nil {
+				return err
+			}
+			if err := rt.maybeSendKeepalive(); err != nil {
+				return err
+			}
+			if err := rt.reportFileError(rt.recvGenerator(int(seg.ndxStart)+i, f)); err != nil {
+				return err
+			}
+		}
+		if err := rt.flushSums(); err != nil {
+			return err
+		}
+		var next *fileSegment
+		if rt.Conn.Capabilities.IncRecurse {
+			// The sender frees the file list once it sees our NDX_DONE,
+			// so all its files need to be through first.
+			if err := rt.waitForTransfers(); err != nil {
+				return err
+			}
+			// Each file list ends with NDX_DONE, the last one also ends
+			// the phase. Hence, we need to know whether more file lists
+			// follow before we are done with this one.
+			var err error
+			next, err = rt.nextSegment()
+			if err != nil {
+				return err
+			}
+		}
+		if err := rt.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
 			return err
 		}
+		seg = next
 	}
-	phase++
+	phase = rsynccommon.PhaseRedo
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
-		rt.Logger.Printf("generateFiles phase=%d", phase)
+		rt.Logger.Printf("generateFiles phase=%v", phase)
 	}
-	if err := rt.Conn.WriteInt32(-1); err != nil {
+	if err := rt.waitForReceiver(); err != nil {
 		return err
 	}
 
-	// TODO: re-do any files that failed
-	phase++
-	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
-		rt.Logger.Printf("generateFiles phase=%d", phase)
+	// Request the files which failed verification again. Without incremental
+	// recursion, the receiver reported all of them by the end of the first
+	// phase.
+	if err := rt.generateRedo(); err != nil {
+		return err
 	}
-	if err := rt.Conn.WriteInt32(-1); err != nil {
+	if err := rt.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
 		return err
 	}
 
+	if rsynccommon.MaxPhase(rt.Conn.ProtocolVersion) == rsynccommon.PhaseFinish {
+		if err := rt.waitForReceiver(); err != nil {
+			return err
+		}
+		// Protocol 29 introduced a third phase, in which rsync finishes hard
+		// links and directory attributes.
+		phase = rsynccommon.PhaseFinish
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
+			rt.Logger.Printf("generateFiles phase=%v", phase)
+		}
+		if err := rt.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
+			return err
+		}
+	}
+
 	// NOTE: touchUpDirs is called from [Transfer.Do]
 	// so that both goroutines (generator and receiver)
 	// have finished before we set final permissions.
@@ -51,22 +110,211 @@ func (rt *Transfer) GenerateFiles(fileList []*File) error {
 	return nil
 }
 
+// handleMsg processes a message from the receiver goroutine.
+func (rt *Transfer) handleMsg(msg genMsg) error {
+	switch {
+	case msg.segment != nil:
+		rt.segments = append(rt.segments, msg.segment)
+	case msg.ndx == rsync.NDX_FLIST_EOF:
+		rt.flistEOF = true
+	case msg.ndx == rsync.NDX_DONE:
+		rt.phasesDone++
+	case msg.noSend:
+		rt.inProgress--
+	case msg.redo:
+		rt.inProgress--
+		rt.redo = append(rt.redo, msg)
+	case msg.err != nil:
+		rt.inProgress--
+		return rt.reportFileError(msg.err)
+	case msg.file != nil:
+		rt.inProgress--
+		return rt.reportFailedVerification(msg.file)
+	default:
+		rt.inProgress--
+		return rt.sendSuccess(msg.ndx)
+	}
+	return nil
+}
+
+// requestTransfer asks the sender to transfer the file at idx, after the
+// files queued by [Transfer.queueSums].
+func (rt *Transfer) requestTransfer(idx int32, attrs rsynccommon.ItemAttrs) error {
+	if err := rt.flushSums(); err != nil {
+		return err
+	}
+	return rt.writeRequest(idx, attrs)
+}
+
+func (rt *Transfer) writeRequest(idx int32, attrs rsynccommon.ItemAttrs) error {
+	if err := rsynccommon.WriteNdxAndAttrs(rt.Conn, idx, attrs); err != nil {
+		return err
+	}
+	rt.inProgress++
+	return nil
+}
+
+// waitForTransfers forwards successes until the receiver received all files
+// requested so far (incremental recursion).
+//
+// rsync/generator.c:check_for_finished_files (first_flist->in_progress)
+func (rt *Transfer) waitForTransfers() error {
+	for rt.inProgress > 0 || len(rt.redo) > 0 {
+		if len(rt.redo) > 0 {
+			// The sender must transfer the files again before we release
+			// this file list.
+			if err := rt.generateRedo(); err != nil {
+				return err
+			}
+			continue
+		}
+		msg, ok := rt.toGenerator.pop()
+		if !ok {
+			return nil // receiver returned
+		}
+		if err := rt.handleMsg(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateRedo requests the files which failed verification again, this time
+// with full-length block checksums.
+//
+// rsync/generator.c:check_for_finished_files (get_redo_num)
+func (rt *Transfer) generateRedo() error {
+	rt.redoing = true
+	defer func() { rt.redoing = false }()
+	for len(rt.redo) > 0 {
+		msg := rt.redo[0]
+		rt.redo = rt.redo[1:]
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
+			rt.Logger.Printf("redoing %s(%d)", msg.file.Name, msg.ndx)
+		}
+		if err := rt.reportFileError(rt.recvGenerator(int(msg.ndx), msg.file)); err != nil {
+			return err
+		}
+	}
+	return rt.flushSums()
+}
+
+// reportFailedVerification reports a file which failed verification when
+// transferred again.
+//
+// rsync/receiver.c:recv_files (FERROR_XFER)
+func (rt *Transfer) reportFailedVerification(f *File) error {
+	return rt.reportXferError(fmt.Sprintf("ERROR: %s failed verification -- update discarded.", f.Name))
+}
+
+// reportFileError reports err if it is a *fileError, which does not stop the
+// transfer (unless the destination is full), and returns all other errors.
+func (rt *Transfer) reportFileError(err error) error {
+	var fe *fileError
+	if errors.As(err, &fe) {
+		if err := rt.reportXferError("rsync: " + fe.Error()); err != nil {
+			return err
+		}
+		if errors.Is(fe, syscall.ENOSPC) {
+			return errFileIO
+		}
+		return nil
+	}
+	return err
+}
+
+// reportXferError reports an error which affects a single file (or its
+// attributes). The client exits with code 23 once the transfer is done.
+//
+// rsync/log.c:rwrite (FERROR_XFER)
+func (rt *Transfer) reportXferError(msg string) error {
+	rt.xferError.Store(true)
+	rt.Logger.Printf("%s", msg)
+	if !rt.Opts.Server {
+		return nil
+	}
+	return rt.Conn.WriteMsg(rsyncwire.MsgError, []byte(msg+"\n"))
+}
+
+// drainReceiver processes all messages the receiver queued so far.
+func (rt *Transfer) drainReceiver() error {
+	for {
+		msg, ok, _ := rt.toGenerator.tryPop()
+		if !ok {
+			return nil
+		}
+		if err := rt.handleMsg(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// nextSegment waits until the receiver received the next file list and
+// returns it, or returns nil once the sender sent all file lists
+// (incremental recursion).
+//
+// rsync/generator.c:generate_files (cur_flist->next || flist_eof)
+func (rt *Transfer) nextSegment() (*fileSegment, error) {
+	for len(rt.segments) == 0 && !rt.flistEOF {
+		msg, ok := rt.toGenerator.pop()
+		if !ok {
+			return nil, nil // receiver returned
+		}
+		if err := rt.handleMsg(msg); err != nil {
+			return nil, err
+		}
+	}
+	if len(rt.segments) == 0 {
+		return nil, nil
+	}
+	seg := rt.segments[0]
+	rt.segments = rt.segments[1:]
+	return seg, nil
+}
+
+// waitForReceiver forwards successes until the receiver finished the current
+// phase, so that the sender has processed all of them before it sees our
+// NDX_DONE for the next phase.
+//
+// rsync/generator.c:generate_files (wait_for_receiver)
+func (rt *Transfer) waitForReceiver() error {
+	for rt.phasesDone == 0 {
+		msg, ok := rt.toGenerator.pop()
+		if !ok {
+			return nil // receiver returned
+		}
+		if err := rt.handleMsg(msg); err != nil {
+			return err
+		}
+	}
+	rt.phasesDone--
+	return nil
+}
+
+// userRWX is S_IRWXU, which package syscall does not define on all platforms.
+const userRWX fs.FileMode = 0o700
+
+// touchUpDirs sets the modification time of the directories in fileList,
+// which creating files inside them has changed, and restores the permissions
+// which recvGenerator relaxed. It visits subdirectories before their parents.
+//
+// rsync/generator.c:touch_up_dirs
 func (rt *Transfer) touchUpDirs(fileList []*File) error {
-	for idx, f := range fileList {
+	for idx, f := range slices.Backward(fileList) {
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_TIME, 2) {
 			rt.Logger.Printf("touchUpDirs: %s (%d)", f.Name, idx)
 		}
 		mode := fs.FileMode(f.Mode)
-		if mode&rsync.S_IFMT != rsync.S_IFDIR {
-			continue // not a directory
+		if mode&rsync.S_IFMT != rsync.S_IFDIR || f.cleared {
+			continue // not a directory, or a duplicate
 		}
 		if rt.Opts.DryRun {
 			continue
 		}
-		if mode&syscall.S_IWUSR > 0 {
-			continue // directory is writeable, no touchup needed
+		if mode&userRWX == userRWX && !rt.retouchDirTimes {
+			continue // directory was not tweaked, no touchup needed
 		}
-		if err := rt.setPerms(f, mode); err != nil {
+		if err := rt.reportFileError(rt.setPerms(f, mode)); err != nil {
 			return err
 		}
 	}
@@ -80,11 +328,11 @@ func (rt *Transfer) skipFile(f *File, st os.FileInfo) (bool, error) {
 	}
 
 	if rt.Opts.AlwaysChecksum {
-		checksum, err := rsyncchecksum.RootChecksum(rt.DestRoot, f.Name)
+		checksum, err := rsyncchecksum.RootChecksum(rt.checksum, rt.DestRoot, f.Name)
 		if err != nil {
 			return false, err
 		}
-		return bytes.Equal(f.Checksum[:], checksum[:]), nil
+		return bytes.Equal(f.Checksum, checksum), nil
 	}
 
 	// TODO: size only
@@ -93,13 +341,31 @@ func (rt *Transfer) skipFile(f *File, st os.FileInfo) (bool, error) {
 		return false, nil
 	}
 
-	return modTimeEqual(st.ModTime(), f.ModTime), nil
+	return rt.modTimeEqual(st.ModTime(), f.ModTime), nil
 }
 
-func modTimeEqual(a, b time.Time) bool {
-	a = a.Truncate(time.Second)
-	b = b.Truncate(time.Second)
-	return a.Equal(b)
+// modTimeEqual reports whether the local modification time matches the one
+// the sender transmitted. Nanoseconds are only compared if the sender
+// transmits them (protocol >= 31) and --modify-window is 0. Otherwise, the
+// seconds may differ by up to --modify-window (a negative value ignores just
+// the nanoseconds).
+//
+// rsync/util1.c:same_time
+func (rt *Transfer) modTimeEqual(local, remote time.Time) bool {
+	window := int64(rt.Opts.ModifyWindow)
+	if window == 0 && rt.Conn.ProtocolVersion >= 31 {
+		return local.Equal(remote)
+	}
+	window = max(window, 0)
+	diff := local.Unix() - remote.Unix()
+	return -window <= diff && diff <= window
+}
+
+// symlinkTimes returns whether to set the modification time of symlinks.
+//
+// rsync/rsync.c:set_file_attrs (PRESERVE_LINK_TIMES)
+func (rt *Transfer) symlinkTimes() bool {
+	return rt.Conn.Capabilities.SymlinkTimes && !rt.Opts.OmitLinkTimes
 }
 
 // rsync/rsync.c:set_perms
@@ -108,30 +374,39 @@ func (rt *Transfer) setPerms(f *File, mode fs.FileMode) error {
 		return nil
 	}
 
-	st, err := rt.DestRoot.Lstat(f.Name)
+	lstat := rt.DestRoot.Lstat
+	if mode&rsync.S_IFMT == rsync.S_IFDIR && rt.Opts.KeepDirlinks {
+		lstat = rt.DestRoot.Stat // see keepDirlink
+	}
+	st, err := lstat(f.Name)
 	if err != nil {
-		return err
+		return &fileError{msg: "stat " + f.Name, err: err}
 	}
 
 	perm := mode & os.ModePerm
 	mode = mode & rsync.S_IFMT
 	if rt.Opts.PreserveTimes &&
-		mode != rsync.S_IFLNK &&
-		!modTimeEqual(st.ModTime(), f.ModTime) {
-		if err := rt.DestRoot.Chtimes(f.Name, f.ModTime, f.ModTime); err != nil {
-			return err
+		(mode != rsync.S_IFLNK || rt.symlinkTimes()) &&
+		!rt.modTimeEqual(st.ModTime(), f.ModTime) {
+		if mode == rsync.S_IFLNK {
+			err = lchtimes(rt.DestRoot, f.Name, f.ModTime)
+		} else {
+			err = rt.DestRoot.Chtimes(f.Name, f.ModTime, f.ModTime)
+		}
+		if err != nil {
+			return &fileError{msg: "failed to set times on " + f.Name, err: err}
 		}
 	}
 
 	_, err = rt.setUid(f, st)
 	if err != nil {
-		return err
+		return &fileError{msg: "chown " + f.Name + " failed", err: err}
 	}
 
 	if mode != rsync.S_IFLNK {
 		if st.Mode().Perm() != perm { // only call Chmod if the permissions actually differ
 			if err := rt.DestRoot.Chmod(f.Name, perm); err != nil {
-				return err
+				return &fileError{msg: "failed to set permissions on " + f.Name, err: err}
 			}
 		}
 	}
@@ -141,6 +416,9 @@ func (rt *Transfer) setPerms(f *File, mode fs.FileMode) error {
 
 // rsync/generator.c:recv_generator
 func (rt *Transfer) recvGenerator(idx int, f *File) error {
+	if f.cleared {
+		return nil
+	}
 	if rt.listOnly() {
 		fmt.Fprintf(rt.Env.Stdout, "%s %11.0f %s %s\n",
 			f.FileMode().String(),
@@ -161,14 +439,27 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		if rt.Opts.DryRun {
 			return nil
 		}
+		if err == nil && rt.keepDirlink(f, st) {
+			// Stat follows the symlink, but (like all DestRoot methods)
+			// not out of the destination.
+			st, err = rt.DestRoot.Stat(f.Name)
+		}
 		if err == nil && !st.IsDir() {
 			// A file (not a directory) with this name exists. Delete it so that
 			// we can create a directory instead.
-			if err := rt.DestRoot.Remove(f.Name); err != nil {
-				return fmt.Errorf("unlinking to make room for directory: %v", err)
+			if err := rt.makeRoom(f, st); err != nil {
+				return err
 			}
 			err = fmt.Errorf("file removed")
 		}
+		if !rt.Opts.PreservePerms {
+			// rsync/generator.c:recv_generator (dest_mode)
+			var existing fs.FileInfo
+			if err == nil {
+				existing = st
+			}
+			f.Mode = destMode(f.Mode, existing, defaultPerms())
+		}
 		if err != nil {
 			perm := fs.FileMode(f.Mode) & os.ModePerm
 			if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
@@ -176,18 +467,23 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 			}
 			if err := rt.DestRoot.MkdirAll(f.Name, perm); err != nil {
 				// TODO: EEXIST is okay
-				return err
+				return &fileError{msg: "recv_generator: mkdir " + f.Name + " failed", err: err}
 			}
 			// fallthrough to setPerms and return nil
 		}
 		mode := fs.FileMode(f.Mode)
-		if mode&syscall.S_IWUSR == 0 {
-			// The directory is lacking write permission,
-			// so we need to create it writeable as long as
-			// we are creating files inside that directory.
+		if mode&userRWX != userRWX {
+			// The directory is lacking read, write or search
+			// permission, which we need as long as we are
+			// creating (or deleting) files inside that directory.
 			// GenerateFiles will fix permissions afterwards.
 			rt.retouchDirPerms = true
-			mode |= syscall.S_IWUSR
+			mode |= userRWX
+		}
+		// Creating files inside the directory changes its modification
+		// time, so touchUpDirs sets it again once all files are done.
+		if rt.Opts.PreserveTimes {
+			rt.retouchDirTimes = true
 		}
 		if err := rt.setPerms(f, mode); err != nil {
 			return err
@@ -196,18 +492,39 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 	}
 
 	if rt.Opts.PreserveLinks && mode == rsync.S_IFLNK {
-		// TODO: safe_symlinks option
+		if rt.Opts.SafeLinks && rsynccommon.UnsafeSymlink(f.LinkTarget, f.Name) {
+			if rt.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) {
+				rt.Logger.Printf("ignoring unsafe symlink %q -> %q", f.Name, f.LinkTarget)
+			}
+			return nil
+		}
+		if err == nil && st.IsDir() {
+			// Other files are atomically replaced by the symlink, but
+			// directories need to be deleted first.
+			if err := rt.makeRoom(f, st); err != nil {
+				return err
+			}
+			st, err = nil, os.ErrNotExist
+		}
+		// With --munge-links, symlinks are stored with a prefix, which
+		// makes symlinks stored without it out of date and vice versa.
+		//
+		// rsync/syscall.c:do_symlink
+		linkTarget := f.LinkTarget
+		if rt.Opts.MungeLinks {
+			linkTarget = rsync.SYMLINK_PREFIX + linkTarget
+		}
 		if err == nil {
 			// local file exists, verify target matches
 			if target, err := rt.DestRoot.Readlink(f.Name); err == nil {
 				if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 					rt.Logger.Printf("existing target: %q", target)
 				}
-				if target == f.LinkTarget {
+				if target == linkTarget {
 					if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
 						return err
 					}
-					return nil // skip
+					return rt.sendSuccess(int32(idx)) // skip
 				}
 				// fallthrough to create or replace the symlink
 			}
@@ -216,23 +533,57 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 			rt.Logger.Printf("symlink %s -> %s", f.Name, f.LinkTarget)
 		}
-		if err := symlink(rt.DestRoot, f.LinkTarget, f.Name); err != nil {
+		if err := rt.makeParents(f.Name); err != nil {
 			return err
 		}
+		if err := symlink(rt.DestRoot, linkTarget, f.Name); err != nil {
+			return &fileError{msg: "symlink " + f.Name + " -> " + linkTarget + " failed", err: err}
+		}
 		if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
 			return err
 		}
-		return nil
+		return rt.sendSuccess(int32(idx))
 	}
 
-	if rt.Opts.PreserveDevices && (mode == rsync.S_IFCHR ||
-		mode == rsync.S_IFBLK ||
-		mode == rsync.S_IFSOCK ||
-		mode == rsync.S_IFIFO) {
-		if err := rt.createDevice(f, st); err != nil {
-			return err
+	isDevice := mode == rsync.S_IFCHR || mode == rsync.S_IFBLK
+	isSpecial := mode == rsync.S_IFIFO || mode == rsync.S_IFSOCK
+	if rt.Opts.PreserveDevices && isDevice || rt.Opts.PreserveSpecials && isSpecial {
+		if rt.Opts.DryRun {
+			return nil
 		}
-		return nil
+		// An existing file of the same type (and device number) stays in
+		// place, setPerms only updates its attributes. Creating it again
+		// would change its inode number (and trigger udev events for
+		// devices).
+		//
+		// rsync/generator.c:recv_generator (BITS_EQUAL, st_rdev == rdev)
+		if st != nil && (!sameType(st, f) || isDevice && !sameRdev(st, f)) {
+			if err := rt.makeRoom(f, st); err != nil {
+				return err
+			}
+			st = nil
+		}
+		if !rt.Opts.PreservePerms {
+			f.Mode = destMode(f.Mode, st, defaultPerms())
+		}
+		if st == nil {
+			if err := rt.makeParents(f.Name); err != nil {
+				return err
+			}
+			if err := rt.createDevice(f); err != nil {
+				if !isSpecial {
+					return &fileError{msg: "mknod " + f.Name + " failed", err: err}
+				}
+				// Not all file systems support FIFOs and sockets, which
+				// is not worth aborting the transfer for.
+				//
+				// rsync/generator.c:recv_generator (do_mknod)
+				rt.Logger.Printf("mknod %s failed: %v", f.Name, err)
+				rt.Logger.Printf("skipping non-regular file %q", f.Name)
+				return nil
+			}
+		}
+		return rt.setPerms(f, fs.FileMode(f.Mode))
 	}
 
 	if rt.Opts.PreserveHardlinks {
@@ -242,6 +593,11 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 	if !f.FileMode().IsRegular() {
 		// None of the Preserve* options is enabled, so just skip over
 		// non-regular files.
+		//
+		// rsync/generator.c:recv_generator
+		if rt.Opts.InfoGTE(rsyncopts.INFO_NONREG, 1) {
+			rt.Logger.Printf("skipping non-regular file %q", f.Name)
+		}
 		return nil
 	}
 
@@ -249,7 +605,11 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 			rt.Logger.Printf("requesting: %s", f.Name)
 		}
-		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+		attrs := rsynccommon.ItemAttrs{Flags: rsync.ITEM_TRANSFER}
+		if st == nil {
+			attrs.Flags |= rsync.ITEM_IS_NEW
+		}
+		if err := rt.requestTransfer(int32(idx), attrs); err != nil {
 			return err
 		}
 		if rt.Opts.DryRun {
@@ -262,40 +622,76 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		return nil
 	}
 
-	if os.IsNotExist(err) {
-		return requestFullFile()
-	}
-	if err != nil {
+	// The partial file of an interrupted transfer (if any) is the basis
+	// instead of the destination file, as it contains more recent data.
+	//
+	// rsync/generator.c:recv_generator (partialptr)
+	partial := rt.partialFile(f.Name)
+
+	switch {
+	case os.IsNotExist(err):
+		if !rt.Opts.DryRun {
+			if err := rt.makeParents(f.Name); err != nil {
+				return err
+			}
+		}
+		if partial == nil {
+			return requestFullFile()
+		}
+
+	case err != nil:
 		return err
-	}
 
-	if !st.Mode().IsRegular() {
+	case rt.writesDevice(st):
+		// The sender’s data is written into the device as-is. Its contents
+		// are not used as the basis: without --inplace support in the
+		// sender, the delta could refer to blocks we overwrote already.
+		return requestFullFile()
+
+	case !st.Mode().IsRegular():
 		// A non-regular file with this name exists. Delete it so that we can
 		// create our file instead.
-		if err := rt.DestRoot.Remove(f.Name); err != nil {
-			return fmt.Errorf("unlinking to make room for regular file: %v", err)
+		if err := rt.makeRoom(f, st); err != nil {
+			return err
+		}
+		st = nil
+		if partial == nil {
+			return requestFullFile()
 		}
-		return requestFullFile()
-	}
 
-	// TODO: update-only check
+	default:
+		// TODO: update-only check
 
-	skip, err := rt.skipFile(f, st)
-	if err != nil {
-		return err
-	}
-	if skip {
-		if rt.Opts.InfoGTE(rsyncopts.INFO_SKIP, 1) {
-			rt.Logger.Printf("skipping %s", local)
-		}
-		if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
+		skip, err := rt.skipFile(f, st)
+		if err != nil {
 			return err
 		}
-		return nil
+		if skip {
+			if rt.Opts.InfoGTE(rsyncopts.INFO_SKIP, 1) {
+				rt.Logger.Printf("skipping %s", local)
+			}
+			mode := f.Mode
+			if !rt.Opts.PreservePerms {
+				// The receiver goroutine owns f.Mode of regular files.
+				mode = destMode(f.Mode, st, defaultPerms())
+			}
+			if err := rt.setPerms(f, fs.FileMode(mode)); err != nil {
+				return err
+			}
+			if partial != nil && !rt.Opts.DryRun {
+				rt.removePartial(f.Name) // outdated
+			}
+			// The file is already up to date, so the sender can remove it.
+			return rt.sendSuccess(int32(idx))
+		}
 	}
 
+	transfer := rsynccommon.ItemAttrs{Flags: rsync.ITEM_TRANSFER}
+	if st == nil {
+		transfer.Flags |= rsync.ITEM_IS_NEW
+	}
 	if rt.Opts.DryRun {
-		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+		if err := rt.requestTransfer(int32(idx), transfer); err != nil {
 			return err
 		}
 
@@ -304,47 +700,96 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 
 	// TODO: if deltas are disabled, request the file in full
 
-	in, err := rt.DestRoot.Open(f.Name)
+	basis := f.Name
+	var size int64
+	if partial != nil {
+		basis, size = rt.partialName(f.Name), partial.Size()
+	} else {
+		size = st.Size()
+	}
+	in, err := rt.DestRoot.Open(basis)
 	if err != nil {
-		rt.Logger.Printf("failed to open %s, continuing: %v", local, err)
+		rt.Logger.Printf("failed to open %s, continuing: %v", filepath.Join(rt.Dest, basis), err)
 		return requestFullFile()
 	}
-	defer in.Close()
 
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
-		rt.Logger.Printf("sending sums for: %s", f.Name)
+		rt.Logger.Printf("sending sums for: %s (basis %s)", f.Name, basis)
 	}
-	if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
-		return err
+	return rt.queueSums(int32(idx), transfer, in, size)
+}
+
+// keepDirlink reports whether st, the existing file at the name of directory
+// f, is a symlink to a directory which takes the place of f (--keep-dirlinks).
+//
+// rsync/generator.c:recv_generator (keep_dirlinks)
+func (rt *Transfer) keepDirlink(f *File, st fs.FileInfo) bool {
+	if !rt.Opts.KeepDirlinks || st.Mode().Type()&fs.ModeSymlink == 0 {
+		return false
 	}
+	linked, err := rt.DestRoot.Stat(f.Name)
+	return err == nil && linked.IsDir()
+}
 
-	return rt.generateAndSendSums(in, st.Size())
+// writesDevice reports whether st, the existing file at the name of a regular
+// file, is a device which receives the file’s data (--write-devices).
+//
+// rsync/generator.c:recv_generator (write_devices)
+func (rt *Transfer) writesDevice(st fs.FileInfo) bool {
+	return rt.Opts.WriteDevices && st.Mode()&fs.ModeDevice != 0
 }
 
-// rsync/generator.c:generate_and_send_sums
-func (rt *Transfer) generateAndSendSums(in *os.File, fileLen int64) error {
-	sh := rsynccommon.SumSizesSqroot(fileLen)
-	if err := sh.WriteTo(rt.Conn); err != nil {
-		return err
+// makeRoom deletes st, the existing file at f.Name, whose type conflicts with
+// f, so that f can be created in its place. Directories are only deleted
+// including their contents with --delete or --force. Failing to make room
+// skips f, but does not stop the transfer.
+//
+// rsync/generator.c:recv_generator (delete_item with DEL_FOR_*)
+func (rt *Transfer) makeRoom(f *File, st fs.FileInfo) error {
+	all := st.IsDir() && (rt.Opts.DeleteMode || rt.Opts.ForceDelete)
+	if rt.Opts.InfoGTE(rsyncopts.INFO_DEL, 1) {
+		rt.Logger.Printf("  deleting %s", f.Name)
+	}
+	err := rt.remove(f.Name, all)
+	if err == nil {
+		return nil
 	}
-	buf := make([]byte, int(sh.BlockLength))
-	remaining := fileLen
-	for i := int32(0); i < sh.ChecksumCount; i++ {
-		n1 := min(int64(sh.BlockLength), remaining)
-		b := buf[:n1]
-		if _, err := io.ReadFull(in, b); err != nil {
-			return err
-		}
+	what := "file"
+	switch f.Mode & rsync.S_IFMT {
+	case rsync.S_IFDIR:
+		what = "dir"
+	case rsync.S_IFLNK:
+		what = "symlink"
+	case rsync.S_IFCHR, rsync.S_IFBLK:
+		what = "device"
+	case rsync.S_IFIFO, rsync.S_IFSOCK:
+		what = "special file"
+	}
+	return &fileError{msg: fmt.Sprintf("could not make way for new %s: %s", what, f.Name), err: err}
+}
 
-		sum1 := rsyncchecksum.Checksum1(b)
-		sum2 := rsyncchecksum.Checksum2(rt.Seed, b)
-		if err := rt.Conn.WriteInt32(int32(sum1)); err != nil {
-			return err
-		}
-		if _, err := rt.Conn.Writer.Write(sum2); err != nil {
-			return err
-		}
-		remaining -= n1
+// sameType reports whether the existing file st has the type of f.
+func sameType(st fs.FileInfo, f *File) bool {
+	typ := st.Mode().Type()
+	if typ&fs.ModeCharDevice != 0 {
+		typ = fs.ModeCharDevice // os sets ModeDevice, too
 	}
-	return nil
+	return typ == f.FileMode().Type()
+}
+
+// makeParents creates the missing parent directories of fn with default
+// permissions. The sender usually lists directories before their contents, but
+// not always (e.g. with --files-from or overlapping sources). Should the entry
+// of such a directory follow, the generator sets its permissions then.
+//
+// rsync/util1.c:make_path (MKP_DROP_NAME)
+func (rt *Transfer) makeParents(fn string) error {
+	dir := filepath.Dir(fn)
+	if _, err := rt.DestRoot.Lstat(dir); !os.IsNotExist(err) {
+		return nil
+	}
+	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
+		rt.Logger.Printf("creating missing parent directories of %s", fn)
+	}
+	return rt.DestRoot.MkdirAll(dir, 0777)
 }
@@ -0,0 +1,110 @@
+package receiver
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/gokrazy/rsync/internal/sender"
+	"golang.org/x/sync/errgroup"
+)
+
+// TestMissingParentDirs transfers files without the entries of their parent
+// directories, like --files-from input listing only a/b/c.txt does.
+func TestMissingParentDirs(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{filepath.Join(source, "a", "b"), dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(source, "a", "b", "c.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	toReceiver, fromSender := io.Pipe()
+	toSender, fromReceiver := io.Pipe()
+
+	osenv := rsyncostest.New(t)
+	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+	if err := pc.ParseArguments(osenv, []string{"--server", "--sender", "-t"}, rsyncopts.ParseModeLibrary); err != nil {
+		t.Fatal(err)
+	}
+	const protocol = 31
+	crd := &rsyncwire.CountingReader{R: toSender}
+	cwr := &rsyncwire.CountingWriter{W: fromSender}
+	st := &sender.Transfer{
+		Logger:   log.New(io.Discard),
+		Opts:     pc.Options,
+		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn: &rsyncwire.Conn{
+			Reader:          crd,
+			Writer:          cwr,
+			ProtocolVersion: protocol,
+		},
+	}
+
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			PreserveTimes: true,
+			InfoGTE:       func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE:      func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		Dest:     dest,
+		DestRoot: root,
+		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn: &rsyncwire.Conn{
+			Reader:          toReceiver,
+			Writer:          fromReceiver,
+			ProtocolVersion: protocol,
+		},
+	}
+
+	var eg errgroup.Group
+	eg.Go(func() error {
+		defer fromSender.Close()
+		_, err := st.Do(crd, cwr, source, []string{"a/b/c.txt"}, nil)
+		return err
+	})
+	eg.Go(func() error {
+		defer fromReceiver.Close()
+		defer toReceiver.Close() // unblock the sender should we fail
+		fileList, err := rt.ReceiveFileList()
+		if err != nil {
+			return err
+		}
+		for _, f := range fileList {
+			if f.IsDir() {
+				t.Errorf("file list unexpectedly contains directory %s", f.Name)
+			}
+		}
+		_, err = rt.Do(t.Context(), rt.Conn, fileList, false)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "a", "b", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("a/b/c.txt = %q, want %q", got, "hello")
+	}
+}
@@ -1,6 +1,7 @@
 package receiver
 
 import (
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -10,30 +11,24 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
-	local := filepath.Join(rt.Dest, f.Name)
+// Unlike Linux, macOS offers no mknodat(2), so we create device files by path.
+// Resolving the parent directory through rt.DestRoot first rejects symlinks
+// leading out of the destination, but (unlike on Linux) the check is racy.
+func (rt *Transfer) createDevice(f *File) error {
+	if _, err := rt.DestRoot.Stat(filepath.Dir(f.Name)); err != nil {
+		return fmt.Errorf("Stat(parent(%s)): %v", f.Name, err)
+	}
+	local := filepath.Join(rt.DestRoot.Name(), f.Name)
 	perm := fs.FileMode(f.Mode) & os.ModePerm
 	mode := f.Mode & rsync.S_IFMT
 	switch mode {
 	case rsync.S_IFCHR:
-		if st != nil && st.Mode().Type()&os.ModeCharDevice != 0 {
-			return nil // file of correct type exists
-		}
-		return unix.Mknod(local, uint32(perm)|syscall.S_IFCHR, int(f.Rdev))
+		return unix.Mknod(local, uint32(perm)|syscall.S_IFCHR, int(unix.Mkdev(f.RdevMajor, f.RdevMinor)))
 
 	case rsync.S_IFBLK:
-		if st != nil && (st.Mode().Type()&os.ModeDevice != 0 ||
-			st.Mode().Type()&os.ModeCharDevice != 0) {
-			return nil // file of correct type exists
-		}
-
-		return unix.Mknod(local, uint32(perm)|syscall.S_IFBLK, int(f.Rdev))
+		return unix.Mknod(local, uint32(perm)|syscall.S_IFBLK, int(unix.Mkdev(f.RdevMajor, f.RdevMinor)))
 
 	case rsync.S_IFSOCK:
-		if st != nil && st.Mode().Type()&os.ModeSocket != 0 {
-			return nil // file of correct type exists
-		}
-
 		fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
 		if err != nil {
 			return err
@@ -49,10 +44,6 @@ func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
 		return nil
 
 	case rsync.S_IFIFO:
-		if st != nil && st.Mode().Type()&os.ModeNamedPipe != 0 {
-			return nil // file of correct type exists
-		}
-
 		return unix.Mkfifo(local, uint32(perm))
 	}
 	return nil
@@ -12,7 +12,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
+func (rt *Transfer) createDevice(f *File) error {
 	base := filepath.Base(f.Name)
 	parentDir, err := rt.DestRoot.OpenFile(filepath.Dir(f.Name), 0, 0)
 	if err != nil {
@@ -23,24 +23,12 @@ func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
 	mode := f.Mode & rsync.S_IFMT
 	switch mode {
 	case rsync.S_IFCHR:
-		if st != nil && st.Mode().Type()&os.ModeCharDevice != 0 {
-			return nil // file of correct type exists
-		}
-		return unix.Mknodat(int(parentDir.Fd()), base, uint32(perm)|syscall.S_IFCHR, int(f.Rdev))
+		return unix.Mknodat(int(parentDir.Fd()), base, uint32(perm)|syscall.S_IFCHR, int(unix.Mkdev(f.RdevMajor, f.RdevMinor)))
 
 	case rsync.S_IFBLK:
-		if st != nil && (st.Mode().Type()&os.ModeDevice != 0 ||
-			st.Mode().Type()&os.ModeCharDevice != 0) {
-			return nil // file of correct type exists
-		}
-
-		return unix.Mknodat(int(parentDir.Fd()), base, uint32(perm)|syscall.S_IFBLK, int(f.Rdev))
+		return unix.Mknodat(int(parentDir.Fd()), base, uint32(perm)|syscall.S_IFBLK, int(unix.Mkdev(f.RdevMajor, f.RdevMinor)))
 
 	case rsync.S_IFSOCK:
-		if st != nil && st.Mode().Type()&os.ModeSocket != 0 {
-			return nil // file of correct type exists
-		}
-
 		fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
 		if err != nil {
 			return err
@@ -61,10 +49,6 @@ func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
 		return nil
 
 	case rsync.S_IFIFO:
-		if st != nil && st.Mode().Type()&os.ModeNamedPipe != 0 {
-			return nil // file of correct type exists
-		}
-
 		return unix.Mkfifoat(int(parentDir.Fd()), base, uint32(perm))
 	}
 	return nil
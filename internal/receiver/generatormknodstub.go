@@ -4,6 +4,8 @@ package receiver
 
 import "io/fs"
 
-func (rt *Transfer) createDevice(*File, fs.FileInfo) error {
+func (rt *Transfer) createDevice(*File) error {
 	return nil
 }
+
+func sameRdev(fs.FileInfo, *File) bool { return true }
@@ -0,0 +1,21 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sameRdev reports whether the existing device st has the device number of
+// f.
+func sameRdev(st fs.FileInfo, f *File) bool {
+	stt, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	rdev := uint64(stt.Rdev)
+	return unix.Major(rdev) == f.RdevMajor && unix.Minor(rdev) == f.RdevMinor
+}
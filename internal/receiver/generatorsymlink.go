@@ -4,10 +4,30 @@ package receiver
 
 import (
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/google/renameio/v2"
+	"golang.org/x/sys/unix"
 )
 
 func symlink(root *os.Root, oldname, newname string) error {
 	return renameio.SymlinkRoot(root, oldname, newname)
 }
+
+// lchtimes sets the access and modification time of the symlink name itself,
+// like [os.Root.Chtimes] does for other files. Chtimes would follow the
+// symlink.
+func lchtimes(root *os.Root, name string, mtime time.Time) error {
+	dir, err := root.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	t := unix.NsecToTimespec(mtime.UnixNano())
+	ts := []unix.Timespec{t, t}
+	if err := unix.UtimesNanoAt(int(dir.Fd()), filepath.Base(name), ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lchtimes", Path: name, Err: err}
+	}
+	return nil
+}
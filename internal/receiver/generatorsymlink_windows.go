@@ -2,7 +2,11 @@
 
 package receiver
 
-import "os"
+import (
+	"errors"
+	"os"
+	"time"
+)
 
 func symlink(destroot *os.Root, oldname, newname string) error {
 	if err := destroot.Remove(newname); err != nil && !os.IsNotExist(err) {
@@ -10,3 +14,9 @@ func symlink(destroot *os.Root, oldname, newname string) error {
 	}
 	return destroot.Symlink(oldname, newname)
 }
+
+// lchtimes is never called on Windows, where we do not announce symlink
+// times (see rsynccommon.ClientInfo).
+func lchtimes(root *os.Root, name string, mtime time.Time) error {
+	return errors.ErrUnsupported
+}
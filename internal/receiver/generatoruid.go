@@ -35,13 +35,16 @@ var inGroup = func() map[uint32]bool {
 func (rt *Transfer) setUid(f *File, st fs.FileInfo) (fs.FileInfo, error) {
 	stt := st.Sys().(*syscall.Stat_t)
 
+	wantUid := uint32(rt.matchUid(f.Uid))
+	wantGid := uint32(rt.matchGid(f.Gid))
+
 	changeUid := rt.Opts.PreserveUid &&
 		amRoot &&
-		stt.Uid != uint32(f.Uid)
+		stt.Uid != wantUid
 
 	changeGid := rt.Opts.PreserveGid &&
-		(amRoot || inGroup[uint32(f.Gid)]) &&
-		stt.Gid != uint32(f.Gid)
+		(amRoot || inGroup[wantGid]) &&
+		stt.Gid != wantGid
 
 	if !changeUid && !changeGid {
 		return st, nil
@@ -49,11 +52,11 @@ func (rt *Transfer) setUid(f *File, st fs.FileInfo) (fs.FileInfo, error) {
 
 	uid := stt.Uid
 	if changeUid {
-		uid = uint32(f.Uid)
+		uid = wantUid
 	}
 	gid := stt.Gid
 	if changeGid {
-		gid = uint32(f.Gid)
+		gid = wantGid
 	}
 	if err := rt.DestRoot.Lchown(f.Name, int(uid), int(gid)); err != nil {
 		return nil, err
@@ -0,0 +1,82 @@
+package receiver
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// keepalive tracks when the generator last wrote to the sender.
+type keepalive struct {
+	written  int64     // bytes written to the connection when last checked
+	last     time.Time // when the generator last wrote (as far as we know)
+	numFiles int       // protocol 29 keepalives refer to this file index
+}
+
+// bytesWritten returns the number of bytes written to c so far, or 0 if c does
+// not count them.
+func bytesWritten(c *rsyncwire.Conn) int64 {
+	if cw, ok := c.Writer.(*rsyncwire.CountingWriter); ok {
+		return atomic.LoadInt64(&cw.BytesWritten)
+	}
+	return 0
+}
+
+// maybeSendKeepalive sends a keepalive message if the generator has not
+// written anything for KeepaliveInterval, so that the connection does not
+// look dead while we are busy locally (deleting files, checksumming large
+// files or skipping many up to date files).
+//
+// rsync/io.c:maybe_send_keepalive
+func (rt *Transfer) maybeSendKeepalive() error {
+	if rt.Opts.KeepaliveInterval <= 0 {
+		return nil
+	}
+	now := rt.now()
+	if n := bytesWritten(rt.Conn); n != rt.keepalive.written || rt.keepalive.last.IsZero() {
+		rt.keepalive.written = n
+		rt.keepalive.last = now
+		return nil
+	}
+	if now.Sub(rt.keepalive.last) < rt.Opts.KeepaliveInterval {
+		return nil
+	}
+	if err := rt.sendKeepalive(); err != nil {
+		return err
+	}
+	rt.keepalive.written = bytesWritten(rt.Conn)
+	rt.keepalive.last = now
+	return nil
+}
+
+// sendKeepalive sends a message which the sender ignores. Protocol 30
+// introduced MSG_NOOP for this purpose. With protocol 29, rsync sends the
+// file index one past the last file without ITEM_TRANSFER (see
+// [rsynccommon.IsKeepalive]). Older protocols offer no way to send a
+// keepalive.
+func (rt *Transfer) sendKeepalive() error {
+	switch protocol := rt.Conn.ProtocolVersion; {
+	case protocol >= 30:
+		if err := rt.Conn.WriteMsg(rsyncwire.MsgNoop, nil); err != nil {
+			return err
+		}
+	case protocol == 29:
+		attrs := rsynccommon.ItemAttrs{Flags: rsync.ITEM_IS_NEW}
+		if err := rsynccommon.WriteNdxAndAttrs(rt.Conn, int32(rt.keepalive.numFiles), attrs); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return rt.Conn.Flush()
+}
+
+func (rt *Transfer) now() time.Time {
+	if rt.clock != nil {
+		return rt.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,104 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// TestKeepalive verifies that the generator sends keepalives while it spends
+// 30 seconds (of an artificial clock) deleting files.
+func TestKeepalive(t *testing.T) {
+	for _, tt := range []struct {
+		protocol int32
+		want     int // keepalive messages
+	}{
+		{protocol: 31, want: 6},
+		{protocol: 29, want: 6},
+		{protocol: 27, want: 0}, // no way to send keepalives
+	} {
+		t.Run(fmt.Sprintf("protocol=%d", tt.protocol), func(t *testing.T) {
+			dir := t.TempDir()
+			for i := range 30 {
+				if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("extra%02d", i)), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			root, err := os.OpenRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+
+			var wire bytes.Buffer
+			var w io.Writer = &wire
+			if tt.protocol >= 30 {
+				w = &rsyncwire.MultiplexWriter{Writer: &wire}
+			}
+			now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+			rt := &Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &TransferOpts{
+					DeleteMode:        true,
+					KeepaliveInterval: 5 * time.Second,
+					InfoGTE:           func(rsyncopts.InfoLevel, uint16) bool { return false },
+				},
+				DestRoot: root,
+				Conn: &rsyncwire.Conn{
+					Writer:          &rsyncwire.CountingWriter{W: w},
+					ProtocolVersion: tt.protocol,
+				},
+				// Deleting each file takes a second.
+				clock: func() time.Time {
+					now = now.Add(time.Second)
+					return now
+				},
+			}
+			fileList := []*File{{Name: ".", Mode: rsync.S_IFDIR | 0755, TopDir: true, contentDir: true}}
+			rt.keepalive.numFiles = len(fileList)
+			if err := rt.deleteFiles(fileList); err != nil {
+				t.Fatal(err)
+			}
+
+			got := 0
+			if tt.protocol >= 30 {
+				mrd := &rsyncwire.MultiplexReader{Reader: &wire}
+				for wire.Len() > 0 {
+					tag, payload, err := mrd.ReadMsg()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if tag != rsyncwire.MsgNoop || len(payload) != 0 {
+						t.Fatalf("unexpected message: tag %d, payload %q", tag, payload)
+					}
+					got++
+				}
+			} else {
+				c := &rsyncwire.Conn{Reader: &wire, ProtocolVersion: tt.protocol}
+				for wire.Len() > 0 {
+					ndx, attrs, err := rsynccommon.ReadNdxAndAttrs(c)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !rsynccommon.IsKeepalive(c, ndx, attrs, len(fileList)) {
+						t.Fatalf("unexpected file index %d (attrs %+v)", ndx, attrs)
+					}
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("got %d keepalives, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package receiver
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partialName returns the name of the partial file for fn: fn in the partial
+// directory next to it.
+//
+// rsync/util1.c:partial_dir_fname
+func (rt *Transfer) partialName(fn string) string {
+	return filepath.Join(filepath.Dir(fn), rt.Opts.PartialDir, filepath.Base(fn))
+}
+
+// partialFile returns the partial file for fn, which an interrupted transfer
+// left behind, or nil if there is none (or it is not a regular file).
+func (rt *Transfer) partialFile(fn string) fs.FileInfo {
+	if rt.Opts.PartialDir == "" {
+		return nil
+	}
+	st, err := rt.DestRoot.Lstat(rt.partialName(fn))
+	if err != nil || !st.Mode().IsRegular() {
+		return nil
+	}
+	return st
+}
+
+// isPartialDir reports whether name is a partial directory, which --delete
+// leaves alone.
+//
+// rsync/options.c:parse_arguments (partial_dir filter rule)
+func (rt *Transfer) isPartialDir(name string) bool {
+	dir := rt.Opts.PartialDir
+	return dir != "" && (name == dir || strings.HasSuffix(name, "/"+dir))
+}
+
+// keepPartial keeps the data received so far for f, so that the next transfer
+// can use it as the basis: in the partial directory (created as needed), or
+// in place of the destination file.
+//
+// rsync/cleanup.c:_exit_cleanup (keep_partial)
+func (rt *Transfer) keepPartial(f *File, p *pendingFile) {
+	dst := f.Name
+	if rt.Opts.PartialDir != "" {
+		dst = rt.partialName(f.Name)
+		if err := rt.DestRoot.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			rt.Logger.Printf("creating partial directory for %s: %v", f.Name, err)
+			return
+		}
+	}
+	p.fn = dst
+	if err := p.CloseAtomicallyReplace(); err != nil {
+		rt.Logger.Printf("keeping partial file %s: %v", dst, err)
+		return
+	}
+	if rt.Opts.PartialDir == "" {
+		// The temporary file was created with mode 0600.
+		if err := rt.DestRoot.Chmod(dst, fs.FileMode(f.Mode)&os.ModePerm); err != nil {
+			rt.Logger.Printf("keeping partial file %s: %v", dst, err)
+		}
+	}
+}
+
+// removePartial removes the partial file for fn once it is no longer needed,
+// and the partial directory if it is empty then.
+//
+// rsync/util1.c:handle_partial_dir (PDIR_DELETE)
+func (rt *Transfer) removePartial(fn string) {
+	name := rt.partialName(fn)
+	if err := rt.DestRoot.Remove(name); err != nil && !os.IsNotExist(err) {
+		rt.Logger.Printf("removing partial file %s: %v", name, err)
+		return
+	}
+	rt.DestRoot.Remove(filepath.Dir(name)) // fails unless empty
+}
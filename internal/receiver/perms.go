@@ -0,0 +1,44 @@
+package receiver
+
+import (
+	"io/fs"
+	"os"
+)
+
+// chmodBits are the mode bits which chmod(2) changes (rsync's CHMOD_BITS).
+const chmodBits = 0o7777
+
+// destMode returns the mode to give the file f.Mode (sent without --perms)
+// in the destination: an existing file st keeps its permissions, a new file
+// (st == nil) gets the sender’s permissions, minus the bits of the umask and
+// the setuid, setgid and sticky bits (dfltPerms is 0777 &^ umask).
+//
+// rsync/rsync.c:dest_mode
+func destMode(flistMode int32, st fs.FileInfo, dfltPerms fs.FileMode) int32 {
+	if st != nil {
+		return flistMode&^chmodBits | unixPerms(st.Mode())
+	}
+	return flistMode & (^chmodBits | int32(dfltPerms&os.ModePerm))
+}
+
+// unixPerms returns the chmod(2) bits of mode.
+func unixPerms(mode fs.FileMode) int32 {
+	perms := int32(mode & os.ModePerm)
+	if mode&fs.ModeSetuid != 0 {
+		perms |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perms |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perms |= 0o1000
+	}
+	return perms
+}
+
+// defaultPerms returns the permissions of new files without --perms.
+//
+// rsync/main.c:main (dflt_perms)
+func defaultPerms() fs.FileMode {
+	return os.ModePerm &^ processUmask
+}
@@ -0,0 +1,56 @@
+package receiver
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+)
+
+func TestDestMode(t *testing.T) {
+	existing := filepath.Join(t.TempDir(), "existing")
+	if err := os.WriteFile(existing, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Not subject to the umask, unlike the mode passed to open(2).
+	if err := os.Chmod(existing, 0640); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		flistMode int32
+		umask     fs.FileMode
+		st        fs.FileInfo
+		want      int32
+	}{
+		// New files: the sender’s permissions minus the umask.
+		{flistMode: rsync.S_IFREG | 0o666, umask: 0o022, want: rsync.S_IFREG | 0o644},
+		{flistMode: rsync.S_IFREG | 0o666, umask: 0o077, want: rsync.S_IFREG | 0o600},
+		{flistMode: rsync.S_IFREG | 0o666, umask: 0o002, want: rsync.S_IFREG | 0o664},
+		{flistMode: rsync.S_IFREG | 0o666, umask: 0, want: rsync.S_IFREG | 0o666},
+		{flistMode: rsync.S_IFREG | 0o600, umask: 0o022, want: rsync.S_IFREG | 0o600},
+		{flistMode: rsync.S_IFREG | 0o755, umask: 0o027, want: rsync.S_IFREG | 0o750},
+		{flistMode: rsync.S_IFDIR | 0o777, umask: 0o022, want: rsync.S_IFDIR | 0o755},
+		// setuid, setgid and sticky are never carried over.
+		{flistMode: rsync.S_IFREG | 0o4755, umask: 0o022, want: rsync.S_IFREG | 0o755},
+		{flistMode: rsync.S_IFDIR | 0o1777, umask: 0, want: rsync.S_IFDIR | 0o777},
+
+		// Existing files keep their permissions, regardless of the umask.
+		{flistMode: rsync.S_IFREG | 0o777, umask: 0o022, st: st, want: rsync.S_IFREG | 0o640},
+		{flistMode: rsync.S_IFREG | 0o600, umask: 0o077, st: st, want: rsync.S_IFREG | 0o640},
+	} {
+		t.Run(fmt.Sprintf("%o/umask=%03o/exists=%v", tt.flistMode, tt.umask, tt.st != nil), func(t *testing.T) {
+			got := destMode(tt.flistMode, tt.st, os.ModePerm&^tt.umask)
+			if got != tt.want {
+				t.Errorf("destMode(%o) = %o, want %o", tt.flistMode, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package receiver
+
+import "sync"
+
+// A genMsg is sent from the receiver goroutine to the generator goroutine. It
+// holds either a file list which the receiver received (incremental
+// recursion), or a file index: that of a successfully received file (or, if
+// noSend is true, of a file the sender could not open), NDX_DONE at the end of
+// a phase or NDX_FLIST_EOF after the last file list.
+//
+// Files which failed verification carry file: with redo set, the generator
+// requests them again, otherwise they failed for the second time.
+type genMsg struct {
+	ndx     int32
+	noSend  bool
+	segment *fileSegment
+	file    *File
+	redo    bool
+	err     *fileError // the file at ndx could not be (fully) received
+}
+
+// genQueue carries messages from the receiver goroutine to the generator
+// goroutine. Adding to the queue never blocks: the receiver must keep reading
+// from the sender, which might be blocked writing to us.
+//
+// rsync uses a pipe between its receiver and generator processes instead.
+type genQueue struct {
+	mu     sync.Mutex
+	msgs   []genMsg
+	closed bool
+	notify chan struct{} // buffered (1), signals new messages or close
+}
+
+func newGenQueue() *genQueue {
+	return &genQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *genQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *genQueue) push(msg genMsg) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close signals that the receiver goroutine has returned.
+func (q *genQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// tryPop returns the next message, if any. closed is true once the queue is
+// empty and closed.
+func (q *genQueue) tryPop() (msg genMsg, ok, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.msgs) == 0 {
+		return genMsg{}, false, q.closed
+	}
+	msg = q.msgs[0]
+	q.msgs = q.msgs[1:]
+	return msg, true, false
+}
+
+// pop waits for the next message. ok is false once the queue is empty and
+// closed.
+func (q *genQueue) pop() (msg genMsg, ok bool) {
+	for {
+		msg, ok, closed := q.tryPop()
+		if ok || closed {
+			return msg, ok
+		}
+		<-q.notify
+	}
+}
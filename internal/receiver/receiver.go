@@ -1,47 +1,142 @@
 package receiver
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
-	"github.com/mmcloughlin/md4"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
 // rsync/receiver.c:recv_files
 func (rt *Transfer) RecvFiles(fileList []*File) error {
-	phase := 0
+	maxPhase := rsynccommon.MaxPhase(rt.Conn.ProtocolVersion)
+	phase := rsynccommon.PhaseTransfer
+	incRecurse := rt.Conn.Capabilities.IncRecurse
+	// segments holds the file lists the generator is not done with yet, last
+	// is the most recently received one.
+	last := rt.firstSegment(fileList)
+	segments := []*fileSegment{last}
+	// redone holds the indices of files which failed verification once.
+	redone := make(map[int32]bool)
+	batching := rt.Opts.BatchSmallFiles && !rt.Opts.DryRun && !incRecurse
+	defer rt.discardBatch()
 	for {
-		idx, err := rt.Conn.ReadInt32()
+		idx, attrs, err := rsynccommon.ReadNdxAndAttrs(rt.Conn)
 		if err != nil {
 			return err
 		}
-		if idx == -1 {
-			if phase == 0 {
-				phase++
-				if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
-					rt.Logger.Printf("recvFiles phase=%d", phase)
+		if idx == rsync.NDX_DONE {
+			if err := rt.commitBatch(); err != nil {
+				return err
+			}
+			if incRecurse && len(segments) > 0 {
+				// The generator is done with the oldest file list. The
+				// phase only ends with the last file list.
+				segments = segments[1:]
+				if len(segments) > 0 {
+					continue
 				}
-				// TODO: send done message
+			}
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
+				rt.Logger.Printf("recvFiles phase=%v", phase)
+			}
+			// Signal the generator that this phase is done.
+			rt.toGenerator.push(genMsg{ndx: rsync.NDX_DONE})
+			continue
+		}
+		if incRecurse && idx == rsync.NDX_FLIST_EOF {
+			rt.toGenerator.push(genMsg{ndx: rsync.NDX_FLIST_EOF})
+			continue
+		}
+		if incRecurse && idx <= rsync.NDX_FLIST_OFFSET {
+			seg, err := rt.receiveExtraFileList(rsync.NDX_FLIST_OFFSET-idx, last)
+			if err != nil {
+				return err
+			}
+			last = seg
+			segments = append(segments, seg)
+			rt.toGenerator.push(genMsg{segment: seg})
+			continue
+		}
+		f := findFile(segments, idx)
+		if f == nil {
+			if rsynccommon.IsKeepalive(rt.Conn, idx, attrs, len(fileList)) {
 				continue
 			}
-			break
+			return fmt.Errorf("protocol error: invalid file index %d", idx)
+		}
+		if attrs.Flags&rsync.ITEM_TRANSFER == 0 {
+			// An item which the sender only echoed (protocol >= 29).
+			continue
 		}
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
-			rt.Logger.Printf("receiving file idx=%d: %+v", idx, fileList[idx])
+			rt.Logger.Printf("receiving file idx=%d: %+v", idx, f)
 		}
 		if rt.Opts.Progress {
-			fmt.Fprintln(rt.Env.Stdout, fileList[idx].Name)
+			fmt.Fprintln(rt.Env.Stdout, f.Name)
 		}
-		if err := rt.recvFile1(fileList[idx]); err != nil {
-			return err
+		if rt.FileStarted != nil {
+			rt.FileStarted(f.Name)
+		}
+		batched := batching && f.Length < smallFileThreshold && rt.batch.follows(idx) && !rt.deviceDest(f)
+		if !batched {
+			if err := rt.commitBatch(); err != nil {
+				return err
+			}
+		}
+		if err := rt.recvFile1(idx, f, batched); err != nil {
+			var fe *fileError
+			if errors.As(err, &fe) {
+				// The generator reports the error, as only it writes to
+				// the connection.
+				rt.toGenerator.push(genMsg{ndx: idx, err: fe})
+				continue
+			}
+			if !errors.Is(err, errFailedVerification) {
+				return err
+			}
+			// rsync/receiver.c:recv_files (!recv_ok)
+			if redone[idx] {
+				rt.xferError.Store(true)
+				rt.toGenerator.push(genMsg{ndx: idx, file: f})
+				continue
+			}
+			if rt.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) {
+				rt.Logger.Printf("WARNING: %s failed verification -- update discarded (will try again).", f.Name)
+			}
+			redone[idx] = true
+			rt.toGenerator.push(genMsg{ndx: idx, file: f, redo: true})
+			continue
+		}
+		if batched {
+			// commitBatch hands the index to the generator.
+			if rt.batch.full() {
+				if err := rt.commitBatch(); err != nil {
+					return err
+				}
+			}
+			continue
 		}
+		// Hand the index to the generator goroutine, which forwards it to
+		// the sender. The receiver must not write to the connection itself.
+		//
+		// rsync/receiver.c:recv_files (send_msg_int(MSG_SUCCESS, ndx))
+		rt.toGenerator.push(genMsg{ndx: idx})
 	}
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
 		rt.Logger.Printf("recvFiles finished")
@@ -49,7 +144,64 @@ func (rt *Transfer) RecvFiles(fileList []*File) error {
 	return nil
 }
 
-func (rt *Transfer) recvFile1(f *File) error {
+// errFailedVerification is returned by receiveData when the checksum of the
+// received file does not match the sender’s. The update is discarded.
+var errFailedVerification = errors.New("failed verification")
+
+// errFileIO aborts the transfer once a write fails because the destination is
+// full: all remaining files would fail the same way.
+//
+// rsync/errcode.h:RERR_FILEIO
+var errFileIO = errors.New("rsync error: error in file IO (code 11)")
+
+// A fileError is a failure which affects only a single file (or its
+// attributes), like a failed chown. rsync reports such errors and continues
+// with the remaining files, but exits with code 23.
+//
+// rsync/errcode.h:RERR_PARTIAL
+type fileError struct {
+	msg string // e.g. "chown foo failed"
+	err error
+}
+
+func (e *fileError) Error() string {
+	// The msg already names the file.
+	err := e.err
+	if pe, ok := err.(*fs.PathError); ok {
+		err = pe.Err
+	} else if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return e.msg + ": " + err.Error()
+}
+
+func (e *fileError) Unwrap() error { return e.err }
+
+// XferError reports whether a file failed verification even when it was
+// transferred again, i.e. whether the transfer is incomplete.
+func (rt *Transfer) XferError() bool { return rt.xferError.Load() }
+
+// NoSend is called (via [rsyncwire.MultiplexReader]) for each file the sender
+// could not open, so that the generator stops waiting for it.
+func (rt *Transfer) NoSend(idx int32) error {
+	rt.toGenerator.push(genMsg{ndx: idx, noSend: true})
+	return nil
+}
+
+// sendSuccess confirms to the sender that the file at idx was received
+// successfully (or is already up to date), so that the sender can remove its
+// source file (--remove-source-files). Only the generator goroutine writes
+// to the connection.
+func (rt *Transfer) sendSuccess(idx int32) error {
+	if !rt.Opts.RemoveSourceFiles || rt.Opts.DryRun {
+		return nil
+	}
+	var buf rsyncwire.Buffer
+	buf.WriteInt32(idx)
+	return rt.Conn.WriteMsg(rsyncwire.MsgSuccess, []byte(buf.String()))
+}
+
+func (rt *Transfer) recvFile1(idx int32, f *File, batched bool) error {
 	if rt.Opts.DryRun {
 		if !rt.Opts.Server {
 			fmt.Fprintln(rt.Env.Stdout, f.Name)
@@ -57,19 +209,42 @@ func (rt *Transfer) recvFile1(f *File) error {
 		return nil
 	}
 
-	localFile, err := rt.openLocalFile(f)
+	// Like the generator, prefer the partial file of an interrupted transfer
+	// over the destination file.
+	basis := f.Name
+	partial := rt.partialFile(f.Name) != nil
+	if partial {
+		basis = rt.partialName(f.Name)
+	}
+	localFile, err := rt.openLocalFile(f, basis)
 	if err != nil && !os.IsNotExist(err) {
 		rt.Logger.Printf("opening local file failed, continuing: %v", err)
 	}
 	defer localFile.Close()
-	if err := rt.receiveData(f, localFile); err != nil {
+	if !rt.Opts.PreservePerms {
+		// Without --perms, an existing file keeps its permissions, a new
+		// file gets the sender’s filtered through the umask.
+		//
+		// rsync/receiver.c:recv_files (dest_mode)
+		var existing fs.FileInfo
+		if localFile != nil {
+			existing, _ = localFile.Stat()
+		}
+		f.Mode = destMode(f.Mode, existing, defaultPerms())
+	}
+	if err := rt.receiveData(idx, f, localFile, batched); err != nil {
 		return err
 	}
+	if partial {
+		rt.removePartial(f.Name)
+	}
 	return nil
 }
 
-func (rt *Transfer) openLocalFile(f *File) (*os.File, error) {
-	in, err := rt.DestRoot.Open(f.Name)
+// openLocalFile opens basis, the local file on which the sender based its
+// delta for f.
+func (rt *Transfer) openLocalFile(f *File, basis string) (*os.File, error) {
+	in, err := rt.DestRoot.Open(basis)
 	if err != nil {
 		return nil, err
 	}
@@ -84,20 +259,34 @@ func (rt *Transfer) openLocalFile(f *File) (*os.File, error) {
 	}
 
 	if !st.Mode().IsRegular() {
+		in.Close()
 		return nil, nil
 	}
 
-	if !rt.Opts.PreservePerms {
-		// If the file exists already and we are not preserving permissions,
-		// then act as though the remote sent us the existing permissions:
-		f.Mode = int32(st.Mode().Perm())
+	return in, nil
+}
+
+// deviceDest reports whether the destination of f is a device which receives
+// its data (see [Transfer.writesDevice]).
+func (rt *Transfer) deviceDest(f *File) bool {
+	if !rt.Opts.WriteDevices {
+		return false
 	}
+	st, err := rt.DestRoot.Lstat(f.Name)
+	return err == nil && rt.writesDevice(st)
+}
 
-	return in, nil
+// tempFile is the destination of receiveData, which replaces the file once
+// complete.
+type tempFile interface {
+	io.Writer
+	Name() string
+	CloseAtomicallyReplace() error
+	Cleanup() error
 }
 
 // rsync/receiver.c:receive_data
-func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
+func (rt *Transfer) receiveData(idx int32, f *File, localFile *os.File, batched bool) (err error) {
 	rt.Progress.Reset(uint64(f.Length))
 	var sh rsync.SumHead
 	if err := sh.ReadFrom(rt.Conn); err != nil {
@@ -108,19 +297,64 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 		local := filepath.Join(rt.Dest, f.Name)
 		rt.Logger.Printf("creating %s", local)
 	}
-	out, err := newPendingFile(rt.DestRoot, f.Name)
+	var out tempFile
+	failed := "mkstemp " + f.Name + " failed"
+	switch {
+	case batched:
+		out, err = rt.batch.newFile(rt.DestRoot, idx, f)
+	case rt.deviceDest(f):
+		out, err = openDevice(rt.DestRoot, f.Name)
+		failed = "open " + f.Name + " failed"
+	default:
+		out, err = newPendingFile(rt.DestRoot, f.Name)
+	}
+	// Even if we cannot write the file, its data needs to be consumed.
+	//
+	// rsync/receiver.c:discard_receive_data
+	sw := newStickyWriter(out, f.Name)
+	defer sw.release()
 	if err != nil {
-		return err
+		out = nil
+		sw.err = &fileError{msg: failed, err: err}
+	} else {
+		defer out.Cleanup()
 	}
-	defer out.Cleanup()
 
-	h := md4.New()
-	binary.Write(h, binary.LittleEndian, rt.Seed)
+	// gotLiteral is whether the sender sent data which the basis file did
+	// not contain, which is worth keeping when the transfer is interrupted.
+	var gotLiteral bool
+	defer func() {
+		if err == nil || !gotLiteral || !rt.Opts.KeepPartial || errors.Is(err, errFailedVerification) || sw.err != nil {
+			return
+		}
+		if p, ok := out.(*pendingFile); ok && sw.Flush() == nil {
+			rt.keepPartial(f, p)
+		}
+	}()
+
+	h := rt.checksum.NewFileHash()
+
+	wr := io.MultiWriter(sw, h)
 
-	wr := io.MultiWriter(out, h)
+	var basis *basisReader
+	if localFile != nil {
+		basis = newBasisReader(localFile)
+		defer basis.release()
+	}
 
-	offset := 0
+	var offset int64
+	if rt.Opts.IOTimeout > 0 {
+		// Clear the deadline once this file is done, as the generator might
+		// take arbitrarily long before requesting the next file.
+		defer rt.Conn.SetReadDeadline(time.Time{})
+	}
 	for {
+		if rt.Opts.IOTimeout > 0 {
+			// Abort a transfer that stalls in the middle of a file.
+			if err := rt.Conn.SetReadDeadline(time.Now().Add(rt.Opts.IOTimeout)); err != nil {
+				return err
+			}
+		}
 		token, data, err := rt.recvToken()
 		if err != nil {
 			return err
@@ -141,11 +375,12 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 			if err != nil {
 				return err
 			}
-			offset += n
+			offset += int64(n)
+			gotLiteral = true
 			continue
 		}
 		if localFile == nil {
-			return fmt.Errorf("BUG: local file %s not open for copying chunk", out.Name())
+			return fmt.Errorf("BUG: local file %s not open for copying chunk", f.Name)
 		}
 		token = -(token + 1)
 		offset2 := int64(token) * int64(sh.BlockLength)
@@ -153,31 +388,41 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 		if token == sh.ChecksumCount-1 && sh.RemainderLength != 0 {
 			dataLen = sh.RemainderLength
 		}
-		data = make([]byte, dataLen)
-		if _, err := localFile.ReadAt(data, offset2); err != nil {
+		data, err = basis.block(offset2, dataLen)
+		if err != nil {
 			return err
 		}
+		rt.seeToken(data)
 
 		n, err := wr.Write(data)
 		if err != nil {
 			return err
 		}
-		offset += n
+		offset += int64(n)
 	}
 	localSum := h.Sum(nil)
 	remoteSum := make([]byte, len(localSum))
 	if _, err := io.ReadFull(rt.Conn.Reader, remoteSum); err != nil {
 		return err
 	}
+	if err := sw.Flush(); err != nil {
+		return err
+	}
 	if !bytes.Equal(localSum, remoteSum) {
-		return fmt.Errorf("file corruption in %s", f.Name)
+		return errFailedVerification
 	}
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_DELTASUM, 1) {
 		rt.Logger.Printf("checksum %x matches!", localSum)
 	}
 
 	if err := out.CloseAtomicallyReplace(); err != nil {
-		return err
+		if _, ok := out.(*deviceFile); ok {
+			return &fileError{msg: "close failed on " + f.Name, err: err}
+		}
+		return &fileError{msg: "rename " + out.Name() + " -> " + f.Name + " failed", err: err}
+	}
+	if batched {
+		return nil // commitBatch sets the permissions
 	}
 
 	if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
@@ -186,3 +431,56 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 
 	return nil
 }
+
+// writeBuffers holds the write buffers of released stickyWriters, which are
+// reused across files. Tokens are at most 32 KiB (rsync’s CHUNK_SIZE), and
+// matched blocks often smaller, so writing them to the file unbuffered would
+// make for many small writes.
+var writeBuffers = sync.Pool{
+	New: func() any { return bufio.NewWriterSize(nil, 256*1024) },
+}
+
+// stickyWriter writes to w (through a buffer) until a write fails. It
+// discards all data after that, so that the rest of the file’s data is still
+// consumed.
+type stickyWriter struct {
+	bw   *bufio.Writer
+	name string
+	err  error // the first error, a *fileError
+}
+
+// newStickyWriter returns a stickyWriter for w, which must be released once
+// done.
+func newStickyWriter(w io.Writer, name string) *stickyWriter {
+	bw := writeBuffers.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return &stickyWriter{bw: bw, name: name}
+}
+
+func (s *stickyWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return len(p), nil
+	}
+	if _, err := s.bw.Write(p); err != nil {
+		s.err = &fileError{msg: "write failed on " + s.name, err: err}
+	}
+	return len(p), nil
+}
+
+// Flush writes the buffered data to w and returns the first error.
+func (s *stickyWriter) Flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.bw.Flush(); err != nil {
+		s.err = &fileError{msg: "write failed on " + s.name, err: err}
+	}
+	return s.err
+}
+
+// release returns the buffer to the pool, discarding unflushed data.
+func (s *stickyWriter) release() {
+	s.bw.Reset(nil)
+	writeBuffers.Put(s.bw)
+	s.bw = nil
+}
@@ -0,0 +1,266 @@
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+func TestReceiveDataIOTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			IOTimeout: 100 * time.Millisecond,
+			InfoGTE:   func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE:  func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		DestRoot: root,
+		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn: &rsyncwire.Conn{
+			Reader:        local,
+			Writer:        local,
+			ReadDeadliner: local,
+		},
+	}
+
+	if err := rt.initChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := rsynccommon.NewDecoder(rt.Conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.tokens = tokens
+
+	// Send the sum head and the first token of a file, then stall.
+	go func() {
+		c := &rsyncwire.Conn{Reader: remote, Writer: remote}
+		head := rsync.SumHead{BlockLength: 700, ChecksumLength: 16}
+		head.WriteTo(c)
+		c.WriteInt32(5)
+		c.WriteString("hello")
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rt.receiveData(0, &File{Name: "stalled"}, nil, false)
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("receiveData: got %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("receiveData did not time out")
+	}
+}
+
+// writeFileList encodes a file list (protocol 30, without options that
+// add fields to the entries).
+func writeFileList(t *testing.T, c *rsyncwire.Conn, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		mode := int32(rsync.S_IFREG | 0644)
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			mode = rsync.S_IFDIR | 0755
+		}
+		for _, err := range []error{
+			c.WriteByte(rsync.XMIT_LONG_NAME),
+			c.WriteVarint30(int32(len(name))),
+			c.WriteString(name),
+			c.WriteVarlong30(0, 3), // length
+			c.WriteVarlong(1e9, 4), // mtime
+			c.WriteInt32(mode),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := c.WriteByte(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveExtraFileList(t *testing.T) {
+	var buf bytes.Buffer
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			InfoGTE:  func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE: func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		Conn: &rsyncwire.Conn{
+			Reader:          &buf,
+			Writer:          &buf,
+			ProtocolVersion: 30,
+			Capabilities:    rsyncwire.Capabilities{IncRecurse: true},
+		},
+	}
+
+	writeFileList(t, rt.Conn, "./", "b/", "a/", "top")
+	fileList, err := rt.ReceiveFileList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := rt.firstSegment(fileList)
+	// File index 0 is reserved with incremental recursion.
+	if got, want := first.ndxStart, int32(1); got != want {
+		t.Errorf("initial file list starts at %d, want %d", got, want)
+	}
+	var dirs []string
+	for _, d := range rt.dirs {
+		dirs = append(dirs, d.Name)
+	}
+	if got, want := strings.Join(dirs, " "), ". a b"; got != want {
+		t.Errorf("directories = %q, want %q", got, want)
+	}
+
+	// The contents of directory 2 (b) follow the initial file list.
+	writeFileList(t, rt.Conn, "b/z", "b/y")
+	seg, err := rt.receiveExtraFileList(2, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.parent.Name != "b" {
+		t.Errorf("file list parent = %q, want b", seg.parent.Name)
+	}
+	if got, want := seg.ndxStart, int32(1+4+1); got != want {
+		t.Errorf("file list starts at %d, want %d", got, want)
+	}
+	segs := []*fileSegment{first, seg}
+	for ndx, want := range map[int32]string{
+		1: ".",
+		2: "top",
+		4: "b",
+		6: "b/y",
+		7: "b/z",
+	} {
+		f := findFile(segs, ndx)
+		if f == nil {
+			t.Errorf("findFile(%d) = nil, want %s", ndx, want)
+			continue
+		}
+		if f.Name != want {
+			t.Errorf("findFile(%d) = %s, want %s", ndx, f.Name, want)
+		}
+	}
+	for _, ndx := range []int32{0, 5, 8} {
+		if f := findFile(segs, ndx); f != nil {
+			t.Errorf("findFile(%d) = %s, want nil", ndx, f.Name)
+		}
+	}
+
+	// Entries outside of the directory are rejected.
+	writeFileList(t, rt.Conn, "a/x", "b/escape")
+	if _, err := rt.receiveExtraFileList(1, seg); err == nil {
+		t.Errorf("receiveExtraFileList unexpectedly accepted an entry outside of its directory")
+	}
+	if _, err := rt.receiveExtraFileList(int32(len(rt.dirs)), seg); err == nil {
+		t.Errorf("receiveExtraFileList unexpectedly accepted an invalid directory index")
+	}
+}
+
+// BenchmarkReceiveData receives a 64 MiB file, three quarters of which match
+// blocks of the basis file, the rest arrives as literal data in tokens of
+// rsync’s CHUNK_SIZE. The file goes into a batch, so that syncing it to disk
+// does not dominate the measurement.
+func BenchmarkReceiveData(b *testing.B) {
+	const blockLength = 32 << 10
+	const size = 64 << 20
+	basis, content := writeBasis(b, size)
+
+	root, err := os.OpenRoot(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer root.Close()
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			InfoGTE:  func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE: func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		DestRoot: root,
+		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn:     &rsyncwire.Conn{ProtocolVersion: 31},
+	}
+	if err := rt.initChecksum(); err != nil {
+		b.Fatal(err)
+	}
+	tokens, err := rsynccommon.NewDecoder(rt.Conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rt.tokens = tokens
+
+	// Encode what the sender sends for the file once.
+	var stream bytes.Buffer
+	c := &rsyncwire.Conn{Writer: &stream, ProtocolVersion: 31}
+	enc, err := rsynccommon.NewEncoder(c, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	head := rsync.SumHead{
+		ChecksumCount:  size / blockLength,
+		BlockLength:    blockLength,
+		ChecksumLength: 16,
+	}
+	if err := head.WriteTo(c); err != nil {
+		b.Fatal(err)
+	}
+	literal := bytes.Repeat([]byte{0xbb}, blockLength)
+	h := rt.checksum.NewFileHash()
+	for i := range head.ChecksumCount {
+		if i%4 == 0 {
+			if err := enc.WriteData(c.Writer, literal); err != nil {
+				b.Fatal(err)
+			}
+			h.Write(literal)
+			continue
+		}
+		if err := enc.WriteToken(c.Writer, i); err != nil {
+			b.Fatal(err)
+		}
+		h.Write(content[i*blockLength : (i+1)*blockLength])
+	}
+	if err := enc.WriteToken(c.Writer, -1); err != nil { // end of file
+		b.Fatal(err)
+	}
+	stream.Write(h.Sum(nil))
+
+	f := &File{Name: "file", Mode: 0644, Length: size}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for b.Loop() {
+		rt.Conn.Reader = bytes.NewReader(stream.Bytes())
+		if err := rt.receiveData(0, f, basis, true); err != nil {
+			b.Fatal(err)
+		}
+		rt.discardBatch()
+		rt.batch = smallFileBatch{}
+	}
+}
@@ -0,0 +1,161 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/gokrazy/rsync/internal/sender"
+	"golang.org/x/sync/errgroup"
+)
+
+// corruptingWriter flips the first occurrence of pattern in each of the first
+// remaining writes which contain it (all writes if remaining is negative).
+type corruptingWriter struct {
+	w         io.Writer
+	pattern   byte
+	remaining int
+}
+
+func (c *corruptingWriter) Write(p []byte) (int, error) {
+	if idx := bytes.IndexByte(p, c.pattern); idx > -1 && c.remaining != 0 {
+		c.remaining--
+		p = bytes.Clone(p)
+		p[idx] ^= 0xff
+	}
+	return c.w.Write(p)
+}
+
+func TestRedo(t *testing.T) {
+	const pattern = 0xab
+	for _, tt := range []struct {
+		protocol int32
+		corrupt  int
+	}{
+		{protocol: 26, corrupt: 1},
+		{protocol: 30, corrupt: 1},
+		{protocol: 26, corrupt: -1},
+		{protocol: 30, corrupt: -1},
+	} {
+		t.Run(fmt.Sprintf("protocol=%d/corrupt=%d", tt.protocol, tt.corrupt), func(t *testing.T) {
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			for _, dir := range []string{source, dest} {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := bytes.Repeat([]byte{pattern}, 4096)
+			if err := os.WriteFile(filepath.Join(source, "data"), want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			// The existing file makes the generator send block checksums,
+			// which are short before protocol 27 (except when redoing).
+			old := bytes.Repeat([]byte{0xcd}, 4096)
+			if err := os.WriteFile(filepath.Join(dest, "data"), old, 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Unix(1e9, 0)
+			if err := os.Chtimes(filepath.Join(source, "data"), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			toReceiver, fromSender := io.Pipe()
+			toSender, fromReceiver := io.Pipe()
+
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, []string{"--server", "--sender", "-rt"}, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			crd := &rsyncwire.CountingReader{R: toSender}
+			cwr := &rsyncwire.CountingWriter{W: &corruptingWriter{
+				w:         fromSender,
+				pattern:   pattern,
+				remaining: tt.corrupt,
+			}}
+			st := &sender.Transfer{
+				Logger:   log.New(io.Discard),
+				Opts:     pc.Options,
+				Progress: progress.NewPrinter(io.Discard, time.Now),
+				Conn: &rsyncwire.Conn{
+					Reader:          crd,
+					Writer:          cwr,
+					ProtocolVersion: tt.protocol,
+				},
+			}
+
+			root, err := os.OpenRoot(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+			rt := &Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &TransferOpts{
+					PreserveTimes: true,
+					InfoGTE:       func(rsyncopts.InfoLevel, uint16) bool { return false },
+					DebugGTE:      func(rsyncopts.DebugLevel, uint16) bool { return false },
+				},
+				Dest:     dest,
+				DestRoot: root,
+				Progress: progress.NewPrinter(io.Discard, time.Now),
+				Conn: &rsyncwire.Conn{
+					Reader:          toReceiver,
+					Writer:          fromReceiver,
+					ProtocolVersion: tt.protocol,
+				},
+			}
+
+			var eg errgroup.Group
+			eg.Go(func() error {
+				defer fromSender.Close()
+				_, err := st.Do(crd, cwr, source, []string{"/"}, nil)
+				return err
+			})
+			eg.Go(func() error {
+				defer fromReceiver.Close()
+				fileList, err := rt.ReceiveFileList()
+				if err != nil {
+					return err
+				}
+				_, err = rt.Do(t.Context(), rt.Conn, fileList, false)
+				return err
+			})
+			if err := eg.Wait(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dest, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt < 0 {
+				// The update failed verification twice and was discarded.
+				if !bytes.Equal(got, old) {
+					t.Errorf("destination file unexpectedly modified")
+				}
+				if !rt.XferError() {
+					t.Errorf("XferError() = false, want true")
+				}
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("destination file does not match the source after redoing it")
+			}
+			if rt.XferError() {
+				t.Errorf("XferError() = true, want false")
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package receiver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkName returns an error if name, as received from the sender, is
+// absolute or contains .. elements, which could make the receiver write
+// outside of the destination. Like rsync, we do not try to repair such names
+// and abort the transfer instead: a well-behaved sender never sends them.
+//
+// rsync/flist.c:receive_file_entry (clean_fname with CFN_REFUSE_DOT_DOT_DIRS)
+func checkName(name string) error {
+	if strings.HasPrefix(name, "/") {
+		return fmt.Errorf("unsafe file name from sender (absolute path): %q", name)
+	}
+	for elem := range strings.SplitSeq(name, "/") {
+		if elem == ".." {
+			return fmt.Errorf("unsafe file name from sender (.. element): %q", name)
+		}
+	}
+	return nil
+}
+
+// sanitizePath makes p relative and removes . elements, empty elements and
+// .. elements which would go above depth directories, so that a symlink with
+// target p, which is located depth directories below the destination, does
+// not point outside of the destination.
+//
+// rsync/util1.c:sanitize_path
+func sanitizePath(p string, depth int) string {
+	var elems []string
+	start := 0 // elems[:start] are leading .. elements, which we keep
+	for elem := range strings.SplitSeq(p, "/") {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(elems) > start {
+				elems = elems[:len(elems)-1]
+				continue
+			}
+			if depth <= 0 {
+				continue
+			}
+			depth--
+			elems = append(elems, elem)
+			start = len(elems)
+			continue
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return "."
+	}
+	return strings.Join(elems, "/")
+}
+
+// dirDepth returns the number of directories name is located in.
+//
+// rsync/util1.c:count_dir_elements
+func dirDepth(name string) int {
+	depth := 0
+	for elem := range strings.SplitSeq(name, "/") {
+		if elem != "" && elem != "." {
+			depth++
+		}
+	}
+	if depth > 0 {
+		depth-- // the last element is the name itself
+	}
+	return depth
+}
@@ -0,0 +1,139 @@
+package receiver
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+type hostileEntry struct {
+	name   string
+	mode   int32
+	target string // for symlinks
+}
+
+// hostileFileList encodes entries as a protocol 29 file list, like a
+// malicious sender could send it.
+func hostileFileList(entries []hostileEntry) []byte {
+	var buf rsyncwire.Buffer
+	for _, e := range entries {
+		buf.WriteByte(rsync.XMIT_SAME_UID | rsync.XMIT_SAME_GID)
+		buf.WriteByte(byte(len(e.name)))
+		buf.WriteString(e.name)
+		buf.WriteInt64(0)          // length
+		buf.WriteInt32(1700000000) // modification time
+		buf.WriteInt32(e.mode)
+		if e.mode&rsync.S_IFMT == rsync.S_IFLNK {
+			buf.WriteInt32(int32(len(e.target)))
+			buf.WriteString(e.target)
+		}
+	}
+	buf.WriteByte(0)  // end of file list
+	buf.WriteInt32(0) // I/O errors
+	return []byte(buf.String())
+}
+
+func receiveHostile(t *testing.T, sanitize bool, entries []hostileEntry) ([]*File, error) {
+	t.Helper()
+	rt := &Transfer{
+		Logger: log.New(io.Discard),
+		Opts: &TransferOpts{
+			PreserveLinks: true,
+			SanitizePaths: sanitize,
+			InfoGTE:       func(rsyncopts.InfoLevel, uint16) bool { return false },
+			DebugGTE:      func(rsyncopts.DebugLevel, uint16) bool { return false },
+		},
+		Conn: &rsyncwire.Conn{
+			Reader:          bytes.NewReader(hostileFileList(entries)),
+			ProtocolVersion: 29,
+		},
+	}
+	return rt.ReceiveFileList()
+}
+
+func TestUnsafeFileNames(t *testing.T) {
+	const regular = rsync.S_IFREG | 0644
+	for _, name := range []string{
+		"../escape",
+		"dir/../../escape",
+		"dir/..",
+		"/etc/cron.d/x",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := receiveHostile(t, false, []hostileEntry{
+				{name: ".", mode: rsync.S_IFDIR | 0755},
+				{name: name, mode: regular},
+			})
+			if err == nil || !strings.Contains(err.Error(), "unsafe file name") {
+				t.Fatalf("ReceiveFileList() = %v, want unsafe file name error", err)
+			}
+		})
+	}
+
+	// Safe names are cleaned, but accepted.
+	files, err := receiveHostile(t, false, []hostileEntry{
+		{name: ".", mode: rsync.S_IFDIR | 0755},
+		{name: "dir", mode: rsync.S_IFDIR | 0755},
+		{name: "dir//./file..txt", mode: regular},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := files[len(files)-1].Name, "dir/file..txt"; got != want {
+		t.Errorf("unexpected name: got %q, want %q", got, want)
+	}
+}
+
+func TestSanitizeSymlinks(t *testing.T) {
+	entries := []hostileEntry{
+		{name: ".", mode: rsync.S_IFDIR | 0755},
+		{name: "a", mode: rsync.S_IFDIR | 0755},
+		{name: "a/abs", mode: rsync.S_IFLNK | 0777, target: "/etc/passwd"},
+		{name: "a/up", mode: rsync.S_IFLNK | 0777, target: "../../../etc/passwd"},
+		{name: "a/sibling", mode: rsync.S_IFLNK | 0777, target: "../b/./c"},
+		{name: "top", mode: rsync.S_IFLNK | 0777, target: "a/x/../../.."},
+	}
+	for _, tt := range []struct {
+		sanitize bool
+		want     map[string]string
+	}{
+		{
+			sanitize: false,
+			want: map[string]string{
+				"a/abs":     "/etc/passwd",
+				"a/up":      "../../../etc/passwd",
+				"a/sibling": "../b/./c",
+				"top":       "a/x/../../..",
+			},
+		},
+		{
+			sanitize: true,
+			want: map[string]string{
+				"a/abs":     "etc/passwd",
+				"a/up":      "../etc/passwd",
+				"a/sibling": "../b/c",
+				"top":       ".",
+			},
+		},
+	} {
+		files, err := receiveHostile(t, tt.sanitize, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			want, ok := tt.want[f.Name]
+			if !ok {
+				continue
+			}
+			if f.LinkTarget != want {
+				t.Errorf("sanitize=%v: %s: LinkTarget = %q, want %q", tt.sanitize, f.Name, f.LinkTarget, want)
+			}
+		}
+	}
+}
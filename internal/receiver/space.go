@@ -0,0 +1,55 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SpaceCheck selects what the receiver does when the destination obviously
+// lacks the space for the files it is about to receive.
+type SpaceCheck int
+
+const (
+	SpaceCheckOff   SpaceCheck = iota // do not check
+	SpaceCheckWarn                    // log a warning and transfer anyway
+	SpaceCheckError                   // refuse to start the transfer
+)
+
+// checkSpace compares the free space of the destination with the space the
+// regular files in fileList need beyond the size of the destination files
+// they replace. Temporary files and deletions are not taken into account, so
+// the check only catches transfers which obviously cannot fit.
+func (rt *Transfer) checkSpace(fileList []*File) error {
+	if rt.Opts.SpaceCheck == SpaceCheckOff || rt.Opts.DryRun || rt.listOnly() {
+		return nil
+	}
+	free, err := freeSpace(rt.DestRoot)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			rt.Logger.Printf("not checking free space: %v", err)
+		}
+		return nil
+	}
+	var need int64
+	for _, f := range fileList {
+		if f.cleared || !f.FileMode().IsRegular() {
+			continue
+		}
+		grow := f.Length
+		if st, err := rt.DestRoot.Lstat(f.Name); err == nil && st.Mode().IsRegular() {
+			grow -= st.Size()
+		}
+		if grow > 0 {
+			need += grow
+		}
+	}
+	if need <= 0 || uint64(need) <= free {
+		return nil
+	}
+	msg := fmt.Sprintf("%s has %d bytes free, but the files need at least %d bytes", rt.Dest, free, need)
+	if rt.Opts.SpaceCheck == SpaceCheckWarn {
+		rt.Logger.Printf("WARNING: %s", msg)
+		return nil
+	}
+	return fmt.Errorf("%s (use --gokr.space_check=warn or --gokr.space_check=off to transfer anyway)", msg)
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system of root.
+func freeSpace(root *os.Root) (uint64, error) {
+	dir, err := root.Open(".")
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(dir.Fd()), &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: root.Name(), Err: err}
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
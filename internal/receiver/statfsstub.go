@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package receiver
+
+import (
+	"errors"
+	"os"
+)
+
+func freeSpace(*os.Root) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
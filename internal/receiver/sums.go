@@ -0,0 +1,166 @@
+package receiver
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+)
+
+// A sumJob computes the block checksums of a basis file in its own goroutine.
+// The generator writes the transfer request and the checksums once done.
+type sumJob struct {
+	idx   int32
+	attrs rsynccommon.ItemAttrs
+	head  rsync.SumHead
+	done  chan struct{} // closed once head.Sums (or err) is set
+	err   error
+}
+
+// sumParallelism returns how many basis files the generator checksums at
+// once.
+func (rt *Transfer) sumParallelism() int {
+	if n := rt.Opts.SumParallelism; n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// sumHead returns the checksum header for a basis file of fileLen bytes.
+//
+// rsync/generator.c:generate_and_send_sums
+func (rt *Transfer) sumHead(fileLen int64) (rsync.SumHead, error) {
+	sh, err := rsynccommon.SumSizesSqroot(rt.Conn.ProtocolVersion, fileLen)
+	if err != nil {
+		return sh, err
+	}
+	if rt.redoing {
+		// rsync/generator.c:generate_files (csum_length = SUM_LENGTH)
+		sh.ChecksumLength = rsync.SumLength
+	} else if rt.Opts.AlwaysChecksum && rt.Conn.ProtocolVersion >= 27 {
+		// With --checksum, the user asked for the stronger guarantee, so we
+		// send full block checksums instead of truncated ones.
+		sh.ChecksumLength = rsync.SumLength
+	}
+	// The xxhash checksums are shorter than MD4 and MD5.
+	sh.ChecksumLength = min(sh.ChecksumLength, int32(rt.checksum.Size()))
+	return sh, nil
+}
+
+// queueSums requests the file at idx with the checksums of basis file in,
+// which queueSums closes. Up to [Transfer.sumParallelism] files are
+// checksummed in parallel, but their requests are written in the order in
+// which they were queued: see [Transfer.flushSums].
+func (rt *Transfer) queueSums(idx int32, attrs rsynccommon.ItemAttrs, in *os.File, fileLen int64) error {
+	sh, err := rt.sumHead(fileLen)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	job := &sumJob{
+		idx:   idx,
+		attrs: attrs,
+		head:  sh,
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(job.done)
+		defer in.Close()
+		job.err = computeSums(rt.checksum, in, &job.head, fileLen)
+	}()
+	rt.pendingSums = append(rt.pendingSums, job)
+	if len(rt.pendingSums) < rt.sumParallelism() {
+		return nil
+	}
+	return rt.writeOldestSums()
+}
+
+// flushSums writes all queued requests. The generator calls it before writing
+// anything else which refers to a file index, so that indices do not
+// interleave with the queued requests, and before waiting for the receiver.
+func (rt *Transfer) flushSums() error {
+	for len(rt.pendingSums) > 0 {
+		if err := rt.writeOldestSums(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOldestSums waits for the checksums of the oldest queued request and
+// writes the request.
+func (rt *Transfer) writeOldestSums() error {
+	job := rt.pendingSums[0]
+	rt.pendingSums = rt.pendingSums[1:]
+	if err := rt.waitForSums(job); err != nil {
+		return err
+	}
+	if job.err != nil {
+		return job.err
+	}
+	if err := rt.writeRequest(job.idx, job.attrs); err != nil {
+		return err
+	}
+	sh := &job.head
+	if err := sh.WriteTo(rt.Conn); err != nil {
+		return err
+	}
+	for _, sum := range sh.Sums {
+		if err := rt.Conn.WriteInt32(int32(sum.Sum1)); err != nil {
+			return err
+		}
+		if _, err := rt.Conn.Writer.Write(sum.Sum2[:sh.ChecksumLength]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForSums waits until job is done, sending keepalives meanwhile (large
+// files take a while to checksum).
+func (rt *Transfer) waitForSums(job *sumJob) error {
+	if rt.Opts.KeepaliveInterval <= 0 {
+		<-job.done
+		return nil
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.done:
+			return nil
+		case <-ticker.C:
+			if err := rt.maybeSendKeepalive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// computeSums reads the basis file from in and fills sh.Sums.
+//
+// rsync/generator.c:generate_and_send_sums
+func computeSums(checksum rsyncchecksum.Checksum, in io.Reader, sh *rsync.SumHead, fileLen int64) error {
+	sh.Sums = make([]rsync.SumBuf, sh.ChecksumCount)
+	buf := make([]byte, int(sh.BlockLength))
+	remaining := fileLen
+	for i := range sh.Sums {
+		n1 := min(int64(sh.BlockLength), remaining)
+		b := buf[:n1]
+		if _, err := io.ReadFull(in, b); err != nil {
+			return err
+		}
+		sum := &sh.Sums[i]
+		sum.Offset = fileLen - remaining
+		sum.Len = n1
+		sum.Index = int32(i)
+		sum.Sum1 = rsyncchecksum.Checksum1(b)
+		copy(sum.Sum2[:], checksum.Block(b))
+		remaining -= n1
+	}
+	return nil
+}
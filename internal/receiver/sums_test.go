@@ -0,0 +1,113 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// writeBasisFiles writes num files of random sizes up to maxSize and returns
+// their names.
+func writeBasisFiles(t testing.TB, num, maxSize int) []string {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewPCG(1, 2))
+	content := make([]byte, maxSize)
+	rand.NewChaCha8([32]byte{}).Read(content)
+	names := make([]string, num)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("file%04d", i))
+		if err := os.WriteFile(names[i], content[:rnd.IntN(maxSize)], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+// sendSums queues the checksums of all files with the given parallelism and
+// writes the requests to w.
+func sendSums(t testing.TB, w io.Writer, names []string, parallelism int) {
+	checksum, err := rsyncchecksum.New(rsyncchecksum.MD5, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &Transfer{
+		Opts: &TransferOpts{SumParallelism: parallelism},
+		Conn: &rsyncwire.Conn{
+			Writer:          w,
+			ProtocolVersion: 31,
+		},
+		checksum: checksum,
+	}
+	attrs := rsynccommon.ItemAttrs{Flags: rsync.ITEM_TRANSFER}
+	for idx, name := range names {
+		in, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := in.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.queueSums(int32(idx), attrs, in, st.Size()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.flushSums(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rt.inProgress, len(names); got != want {
+		t.Errorf("inProgress = %d, want %d", got, want)
+	}
+}
+
+// TestParallelSums verifies that checksumming in parallel writes the same
+// requests, in the same order, as checksumming one file at a time.
+func TestParallelSums(t *testing.T) {
+	names := writeBasisFiles(t, 50, 256<<10)
+	var want bytes.Buffer
+	sendSums(t, &want, names, 1)
+	for _, parallelism := range []int{2, 8} {
+		var got bytes.Buffer
+		sendSums(t, &got, names, parallelism)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("SumParallelism=%d: requests differ from SumParallelism=1", parallelism)
+		}
+	}
+}
+
+// BenchmarkParallelSums checksums a few thousand medium-sized basis files
+// with an increasing number of files in parallel.
+func BenchmarkParallelSums(b *testing.B) {
+	names := writeBasisFiles(b, 2000, 128<<10)
+	var total int64
+	for _, name := range names {
+		st, err := os.Stat(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		total += st.Size()
+	}
+	parallelisms := []int{1, 2, 4}
+	if n := runtime.GOMAXPROCS(0); !slices.Contains(parallelisms, n) {
+		parallelisms = append(parallelisms, n)
+	}
+	for _, parallelism := range parallelisms {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			b.SetBytes(total)
+			for b.Loop() {
+				sendSums(b, io.Discard, names, parallelism)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package receiver
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// maxTempBase is the longest base name a temporary file name includes, such
+// that the dot and the suffix still fit into NAME_MAX (255).
+const maxTempBase = 255 - 8
+
+// tempName returns a name for a temporary file which receives the contents of
+// fn: a dot, the base name of fn (truncated if necessary), a dot and six
+// random characters, in the directory of fn.
+//
+// rsync/receiver.c:get_tmpname
+func tempName(fn string) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	dir, base := filepath.Split(fn)
+	if len(base) > maxTempBase {
+		base = base[:maxTempBase]
+	}
+	suffix := make([]byte, 6)
+	for i := range suffix {
+		suffix[i] = chars[rand.IntN(len(chars))]
+	}
+	return dir + "." + base + "." + string(suffix)
+}
+
+// createTemp creates a temporary file for fn within root. The file is created
+// next to fn (not in a separate temporary directory), so that renaming it into
+// place cannot fail due to crossing file systems.
+func createTemp(root *os.Root, fn string) (string, *os.File, error) {
+	for {
+		tmp := tempName(fn)
+		f, err := root.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue // name collision, try again
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return tmp, f, nil
+	}
+}
+
+// pendingFile is a temporary file in the destination, which atomically
+// replaces the destination file once complete. All operations go through the
+// *os.Root of the destination.
+type pendingFile struct {
+	root *os.Root
+	fn   string
+	tmp  string // name of the temporary file within root
+	f    *os.File
+	done bool // renamed into place or removed
+}
+
+func newPendingFile(root *os.Root, fn string) (*pendingFile, error) {
+	tmp, f, err := createTemp(root, fn)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingFile{
+		root: root,
+		fn:   fn,
+		tmp:  tmp,
+		f:    f,
+	}, nil
+}
+
+func (p *pendingFile) Name() string { return p.tmp }
+
+func (p *pendingFile) Write(buf []byte) (int, error) { return p.f.Write(buf) }
+
+// CloseAtomicallyReplace syncs and closes the temporary file and renames it to
+// the destination file.
+func (p *pendingFile) CloseAtomicallyReplace() error {
+	// Without syncing before the rename, a crash could leave behind an empty
+	// destination file instead of the old or the new contents.
+	if err := p.f.Sync(); err != nil {
+		return err
+	}
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+	if err := p.root.Rename(p.tmp, p.fn); err != nil {
+		return err
+	}
+	p.done = true
+	return nil
+}
+
+// Cleanup closes and removes the temporary file, unless it was renamed into
+// place already.
+func (p *pendingFile) Cleanup() error {
+	if p.done {
+		return nil
+	}
+	p.done = true
+	err := p.f.Close()
+	if err := p.root.Remove(p.tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return err
+}
+
+// deviceFile is a device in the destination, which receives the data of a
+// file directly (--write-devices). Devices cannot be replaced atomically.
+//
+// rsync/receiver.c:recv_files (write_devices)
+type deviceFile struct {
+	fn   string
+	f    *os.File
+	done bool // closed
+}
+
+func openDevice(root *os.Root, fn string) (*deviceFile, error) {
+	f, err := root.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceFile{fn: fn, f: f}, nil
+}
+
+func (d *deviceFile) Name() string { return d.fn }
+
+func (d *deviceFile) Write(buf []byte) (int, error) { return d.f.Write(buf) }
+
+// CloseAtomicallyReplace closes the device, which was written in place. Unlike
+// for a pendingFile, there is no rename for a crash to interfere with, so
+// rsync does not sync the data (without --fsync) and neither do we.
+func (d *deviceFile) CloseAtomicallyReplace() error {
+	d.done = true
+	return d.f.Close()
+}
+
+// Cleanup closes the device, unless it was closed already. The data written
+// so far stays in the device.
+func (d *deviceFile) Cleanup() error {
+	if d.done {
+		return nil
+	}
+	d.done = true
+	return d.f.Close()
+}
@@ -0,0 +1,83 @@
+package receiver
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTempName(t *testing.T) {
+	for _, tt := range []struct {
+		fn   string
+		want string
+	}{
+		{fn: "file", want: `^\.file\.[a-zA-Z0-9]{6}$`},
+		{fn: "dir/sub/file.txt", want: `^dir/sub/\.file\.txt\.[a-zA-Z0-9]{6}$`},
+		{fn: strings.Repeat("x", 300), want: `^\.x{247}\.[a-zA-Z0-9]{6}$`},
+	} {
+		if got := tempName(tt.fn); !regexp.MustCompile(tt.want).MatchString(got) {
+			t.Errorf("tempName(%q) = %q, want a match for %q", tt.fn, got, tt.want)
+		}
+	}
+}
+
+func TestPendingFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	// A failed transfer leaves the destination file untouched.
+	p, err := newPendingFile(root, "sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filepath.Dir(p.Name()), "sub"; got != want {
+		t.Errorf("temporary file created in %q, want %q", got, want)
+	}
+	if _, err := p.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary file not removed: %v", entries)
+	}
+
+	p, err = newPendingFile(root, "sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+	if _, err := p.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CloseAtomicallyReplace(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "new"; got != want {
+		t.Errorf("destination file contains %q, want %q", got, want)
+	}
+}
@@ -1,20 +1,11 @@
 package receiver
 
-import "io"
-
-// rsync/token.c:recvToken
+// rsync/token.c:recv_token
 func (rt *Transfer) recvToken() (token int32, data []byte, _ error) {
-	var err error
-	token, err = rt.Conn.ReadInt32()
-	if err != nil {
-		return 0, nil, err
-	}
-	if token <= 0 {
-		return token, nil, nil
-	}
-	data = make([]byte, int(token))
-	if _, err := io.ReadFull(rt.Conn.Reader, data); err != nil {
-		return 0, nil, err
-	}
-	return token, data, nil
+	return rt.tokens.ReadToken(rt.Conn.Reader)
+}
+
+// rsync/token.c:see_token
+func (rt *Transfer) seeToken(data []byte) {
+	rt.tokens.SeeToken(data)
 }
@@ -2,9 +2,14 @@ package receiver
 
 import (
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
@@ -18,6 +23,7 @@ type TransferOpts struct {
 	Progress bool
 
 	DeleteMode        bool
+	Recurse           bool
 	PreserveGid       bool
 	PreserveUid       bool
 	PreserveLinks     bool
@@ -25,10 +31,98 @@ type TransferOpts struct {
 	PreserveDevices   bool
 	PreserveSpecials  bool
 	PreserveTimes     bool
+	OmitLinkTimes     bool
 	PreserveHardlinks bool
 	IgnoreTimes       bool
 	AlwaysChecksum    bool
 
+	// ModifyWindow is the number of seconds by which modification times may
+	// differ and still be considered equal (--modify-window).
+	ModifyWindow int
+
+	// SanitizePaths confines the targets of received symlinks to the
+	// destination, like an rsync daemon without chroot does. The daemon sets
+	// this, as other programs might follow the symlinks.
+	SanitizePaths bool
+
+	// SafeLinks makes the receiver ignore symlinks pointing outside of the
+	// destination (--safe-links).
+	SafeLinks bool
+
+	// MungeLinks prefixes the targets of symlinks with rsync.SYMLINK_PREFIX
+	// (--munge-links), so that they are stored but cannot be followed.
+	MungeLinks bool
+
+	// KeepDirlinks treats symlinks to directories in the destination like
+	// the directories they point to (--keep-dirlinks), instead of replacing
+	// them with the directories the sender lists.
+	KeepDirlinks bool
+
+	// WriteDevices writes the data of files into existing devices in the
+	// destination (--write-devices), instead of replacing the devices.
+	WriteDevices bool
+
+	// NumericIds disables mapping users and groups by name (--numeric-ids),
+	// in which case the sender transmits no id lists.
+	NumericIds bool
+
+	// ForceDelete makes the receiver delete stale directories including
+	// any contents it could not delete individually (--force).
+	ForceDelete bool
+
+	// Excluded (if non-nil) reports whether a file is excluded by the filter
+	// rules, which protects it from deletion (rsync does not delete excluded
+	// files without --delete-excluded).
+	Excluded func(name string, isDir bool) bool
+
+	// KeepPartial keeps the data received for a file whose transfer was
+	// interrupted (--partial): in PartialDir if set, otherwise in place of
+	// the destination file.
+	KeepPartial bool
+
+	// PartialDir (if non-empty) is the directory, relative to the directory
+	// of each file, which holds the partial files of interrupted transfers
+	// (--partial-dir). A partial file is the basis for the next transfer of
+	// its file and removed once that succeeds. Absolute directories are not
+	// supported, as the receiver only accesses the destination.
+	PartialDir string
+
+	// IgnoreErrors makes the receiver delete files even though the sender
+	// reported I/O errors (--ignore-errors).
+	IgnoreErrors bool
+
+	// RemoveSourceFiles makes the receiver confirm each successfully
+	// received (or already up to date) file to the sender, which then
+	// removes its source file (--remove-source-files).
+	RemoveSourceFiles bool
+
+	// IOTimeout (if non-zero) aborts a transfer when no data was received
+	// from the sender for this long (--timeout).
+	IOTimeout time.Duration
+
+	// BatchSmallFiles makes the receiver write files smaller than 1 MiB
+	// without syncing each of them, and instead sync them to disk in batches
+	// (received with ascending file indices) before renaming them into place.
+	// Not used with incremental recursion, where the generator waits for all
+	// requested files before finishing a file list. The client sets it with
+	// --gokr.batch_small_files; rsyncd does not use it.
+	BatchSmallFiles bool
+
+	// KeepaliveInterval (if non-zero) makes the generator send keepalive
+	// messages when it has not written anything for this long while busy
+	// locally, e.g. deleting files. rsync uses half of --timeout.
+	KeepaliveInterval time.Duration
+
+	// SpaceCheck selects whether the receiver compares the size of the
+	// files in the (initial) file list against the free space of the
+	// destination before the transfer starts.
+	SpaceCheck SpaceCheck
+
+	// SumParallelism is how many basis files the generator checksums in
+	// parallel. The requests are still written to the sender in order. If
+	// zero, runtime.GOMAXPROCS(0) is used.
+	SumParallelism int
+
 	InfoGTE  func(rsyncopts.InfoLevel, uint16) bool
 	DebugGTE func(rsyncopts.DebugLevel, uint16) bool
 }
@@ -42,6 +136,16 @@ type Transfer struct {
 	Env      *rsyncos.Env
 	Progress progress.Printer
 
+	// FileStarted, if non-nil, is called with the name of each file before
+	// its data is received.
+	FileStarted func(name string)
+
+	// OnDelete, if non-nil, is called with the name (relative to the
+	// destination) of each file or directory that the receiver deleted (or
+	// would have deleted, in dry-run mode) because the sender did not list
+	// it, and the result of deleting it.
+	OnDelete func(name string, err error)
+
 	// state
 	Conn            *rsyncwire.Conn
 	Seed            int32
@@ -49,6 +153,47 @@ type Transfer struct {
 	Users           map[int32]mapping
 	Groups          map[int32]mapping
 	retouchDirPerms bool
+	retouchDirTimes bool
+	rdevMajor       uint32                 // last received device major number (protocol >= 28)
+	checksum        rsyncchecksum.Checksum // set by initChecksum
+	tokens          rsynccompress.Decoder  // set by Do
+	lastFile        *File                  // last received file list entry
+	inDelHier       bool                   // below a top directory (protocol < 30)
+	dirs            []*File                // all received directories (incremental recursion)
+	hlinkDev        int64                  // last received device number (-H, protocol < 30)
+	hlinkGroups     map[idev]int32         // hard link group by device and inode (-H, protocol < 30)
+	xferError       atomic.Bool            // a file failed verification twice (see XferError)
+	batch           smallFileBatch         // see TransferOpts.BatchSmallFiles
+	deleted         deleteStats            // counted by remove
+
+	// toGenerator carries received file lists and indices of received files
+	// from the receiver to the generator goroutine, set by Do.
+	toGenerator *genQueue
+
+	// generator goroutine state, fed by toGenerator
+	segments    []*fileSegment // received file lists, not yet generated
+	flistEOF    bool           // whether the sender sent all file lists
+	phasesDone  int            // receiver phases ended, not yet waited for
+	inProgress  int            // requested files, not yet received
+	redo        []genMsg       // files which failed verification, to request again
+	redoing     bool           // whether redo files are being requested
+	pendingSums []*sumJob      // requests being checksummed, see queueSums
+	keepalive   keepalive
+	clock       func() time.Time // time.Now if nil (for tests)
 }
 
 func (rt *Transfer) listOnly() bool { return rt.Dest == "" }
+
+// initChecksum sets up the strong checksum negotiated on rt.Conn, unless
+// already done.
+func (rt *Transfer) initChecksum() error {
+	if rt.checksum != nil {
+		return nil
+	}
+	checksum, err := rsynccommon.NewChecksum(rt.Conn, rt.Seed)
+	if err != nil {
+		return err
+	}
+	rt.checksum = checksum
+	return nil
+}
@@ -13,10 +13,78 @@ type mapping struct {
 	LocalId int32
 }
 
+// localUid maps a remote user to the local uid of the same name, if any.
+func localUid(remoteUid int32, remoteUsername string) int32 {
+	u, err := user.Lookup(remoteUsername)
+	if err != nil {
+		return remoteUid
+	}
+	uid, err := strconv.ParseInt(u.Uid, 0, 32)
+	if err != nil {
+		return remoteUid
+	}
+	return int32(uid)
+}
+
+// localGid maps a remote group to the local gid of the same name, if any.
+func localGid(remoteGid int32, remoteGroupname string) int32 {
+	g, err := user.LookupGroup(remoteGroupname)
+	if err != nil {
+		return remoteGid
+	}
+	gid, err := strconv.ParseInt(g.Gid, 0, 32)
+	if err != nil {
+		return remoteGid
+	}
+	return int32(gid)
+}
+
+// matchUid returns the local uid for the sender’s uid: the uid of the local
+// user with the same name or, if there is none (or with --numeric-ids), the
+// sender’s uid.
+//
+// rsync/uidlist.c:match_uid
+func (rt *Transfer) matchUid(uid int32) int32 {
+	if m, ok := rt.Users[uid]; ok {
+		return m.LocalId
+	}
+	return uid
+}
+
+// matchGid is like matchUid, but for groups.
+//
+// rsync/uidlist.c:match_gid
+func (rt *Transfer) matchGid(gid int32) int32 {
+	if m, ok := rt.Groups[gid]; ok {
+		return m.LocalId
+	}
+	return gid
+}
+
+// recvIdName reads the name of id, which follows a file list entry with
+// incremental recursion instead of the id list, and adds it to idMapping.
+//
+// rsync/uidlist.c:recv_user_name, recv_group_name
+func (rt *Transfer) recvIdName(idMapping map[int32]mapping, id int32, localId func(id int32, name string) int32) error {
+	length, err := rt.Conn.ReadByte()
+	if err != nil {
+		return err
+	}
+	name := make([]byte, length)
+	if _, err := io.ReadFull(rt.Conn.Reader, name); err != nil {
+		return err
+	}
+	idMapping[id] = mapping{
+		Name:    string(name),
+		LocalId: localId(id, string(name)),
+	}
+	return nil
+}
+
 func (rt *Transfer) recvIdMapping1(localId func(id int32, name string) int32) (map[int32]mapping, error) {
 	idMapping := make(map[int32]mapping)
 	for {
-		id, err := rt.Conn.ReadInt32()
+		id, err := rt.Conn.ReadVarint30()
 		if err != nil {
 			return nil, err
 		}
@@ -43,17 +111,7 @@ func (rt *Transfer) recvIdMapping1(localId func(id int32, name string) int32) (m
 func (rt *Transfer) RecvIdList() (users map[int32]mapping, groups map[int32]mapping, _ error) {
 	if rt.Opts.PreserveUid {
 		var err error
-		users, err = rt.recvIdMapping1(func(remoteUid int32, remoteUsername string) int32 {
-			u, err := user.Lookup(remoteUsername)
-			if err != nil {
-				return remoteUid
-			}
-			uid, err := strconv.ParseInt(u.Uid, 0, 32)
-			if err != nil {
-				return remoteUid
-			}
-			return int32(uid)
-		})
+		users, err = rt.recvIdMapping1(localUid)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -66,17 +124,7 @@ func (rt *Transfer) RecvIdList() (users map[int32]mapping, groups map[int32]mapp
 
 	if rt.Opts.PreserveGid {
 		var err error
-		groups, err = rt.recvIdMapping1(func(remoteGid int32, remoteGroupname string) int32 {
-			g, err := user.LookupGroup(remoteGroupname)
-			if err != nil {
-				return remoteGid
-			}
-			gid, err := strconv.ParseInt(g.Gid, 0, 32)
-			if err != nil {
-				return remoteGid
-			}
-			return int32(gid)
-		})
+		groups, err = rt.recvIdMapping1(localGid)
 		if err != nil {
 			return nil, nil, err
 		}
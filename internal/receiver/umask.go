@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// processUmask is read once at startup: umask(2) can only be read by setting
+// it, which must not race with other goroutines creating files.
+var processUmask = func() fs.FileMode {
+	umask := unix.Umask(0)
+	unix.Umask(umask)
+	return fs.FileMode(umask)
+}()
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package receiver
+
+import "io/fs"
+
+// processUmask is not applicable on this platform.
+var processUmask fs.FileMode
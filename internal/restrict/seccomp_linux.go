@@ -0,0 +1,120 @@
+package restrict
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// DontFilterSyscalls is set when testing: test binaries start other programs
+// (like tridge rsync) after restricting themselves, and those programs would
+// inherit the seccomp filter.
+var DontFilterSyscalls bool
+
+var (
+	seccompMu        sync.Mutex
+	seccompInstalled bool
+)
+
+// MaybeSyscalls restricts the process to the system calls which gokr-rsync
+// needs after MaybeFileSystem: file system access, networking and what the Go
+// runtime uses. All other system calls fail with EPERM.
+//
+// Like MaybeFileSystem, MaybeSyscalls is best effort: on architectures for
+// which we have no system call list, or when the kernel does not support
+// seccomp, the process continues unrestricted.
+func MaybeSyscalls() error {
+	if DontFilterSyscalls {
+		return nil
+	}
+	seccompMu.Lock()
+	defer seccompMu.Unlock()
+	if seccompInstalled {
+		// Filters stack, but our allowlist never changes.
+		return nil
+	}
+	syscalls := allowedSyscalls()
+	if len(syscalls) == 0 {
+		log.Printf("seccomp: no system call list for %s, not filtering system calls", runtime.GOARCH)
+		return nil
+	}
+	if err := installSeccomp(seccompFilter(auditArch, syscalls)); err != nil {
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) {
+			log.Printf("seccomp not supported, not filtering system calls: %v", err)
+			return nil
+		}
+		return fmt.Errorf("seccomp: %v", err)
+	}
+	seccompInstalled = true
+	log.Printf("seccomp filter installed (%d system calls allowed)", len(syscalls))
+	return nil
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// seccompFilter returns a BPF program which allows the specified system calls
+// of the specified architecture (AUDIT_ARCH_*) and denies everything else.
+func seccompFilter(arch uint32, syscalls []uintptr) []unix.SockFilter {
+	// Jump offsets are 8 bit wide.
+	if len(syscalls) > 254 {
+		panic("BUG: too many system calls for a single jump table")
+	}
+	const (
+		offsetNr   = 0 // struct seccomp_data.nr
+		offsetArch = 4 // struct seccomp_data.arch
+	)
+	deny := bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM))
+	allow := bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW)
+	filter := []unix.SockFilter{
+		// System call numbers differ between architectures (e.g. for 32-bit
+		// system calls on amd64).
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		deny,
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNr),
+	}
+	for i, nr := range syscalls {
+		// On a match, skip the remaining comparisons and the deny.
+		remaining := len(syscalls) - 1 - i
+		filter = append(filter, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), uint8(remaining+1), 0))
+	}
+	return append(filter, deny, allow)
+}
+
+// installSeccomp installs filter for all threads of the process.
+func installSeccomp(filter []unix.SockFilter) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// Required for unprivileged processes. SECCOMP_FILTER_FLAG_TSYNC sets
+	// no_new_privs on the other threads, too.
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", err)
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP,
+		unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errno
+	}
+	if tid != 0 {
+		return fmt.Errorf("could not synchronize thread %d", tid)
+	}
+	return nil
+}
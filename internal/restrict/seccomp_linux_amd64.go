@@ -0,0 +1,37 @@
+package restrict
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+func allowedSyscalls() []uintptr {
+	return append(commonSyscalls,
+		// legacy variants, still used by some libraries
+		unix.SYS_OPEN,
+		unix.SYS_STAT,
+		unix.SYS_LSTAT,
+		unix.SYS_ACCESS,
+		unix.SYS_READLINK,
+		unix.SYS_GETDENTS,
+		unix.SYS_MKDIR,
+		unix.SYS_RMDIR,
+		unix.SYS_UNLINK,
+		unix.SYS_RENAME,
+		unix.SYS_LINK,
+		unix.SYS_SYMLINK,
+		unix.SYS_MKNOD,
+		unix.SYS_CHMOD,
+		unix.SYS_CHOWN,
+		unix.SYS_LCHOWN,
+		unix.SYS_UTIMES,
+		unix.SYS_FUTIMESAT,
+		unix.SYS_PIPE,
+		unix.SYS_DUP2,
+		unix.SYS_POLL,
+		unix.SYS_SELECT,
+		unix.SYS_EPOLL_CREATE,
+		unix.SYS_EPOLL_WAIT,
+		unix.SYS_ARCH_PRCTL,
+		unix.SYS_TIME,
+	)
+}
@@ -0,0 +1,7 @@
+package restrict
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_AARCH64
+
+func allowedSyscalls() []uintptr { return commonSyscalls }
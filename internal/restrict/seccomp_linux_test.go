@@ -0,0 +1,182 @@
+//go:build linux && (amd64 || arm64)
+
+package restrict
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// exerciseFilteredProcess is run in a child process because seccomp filters
+// cannot be removed once installed.
+func exerciseFilteredProcess() error {
+	dir, err := os.MkdirTemp("", "restrict-seccomp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := MaybeSyscalls(); err != nil {
+		return err
+	}
+	if !seccompInstalled {
+		return errors.New("seccomp filter not installed")
+	}
+
+	// file system access, as done by the receiver
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	want := bytes.Repeat([]byte("gokr-rsync"), 1024)
+	if err := root.WriteFile("tmp", want, 0644); err != nil {
+		return err
+	}
+	if err := root.Chmod("tmp", 0600); err != nil {
+		return err
+	}
+	mtime := time.Unix(1e9, 0)
+	if err := root.Chtimes("tmp", mtime, mtime); err != nil {
+		return err
+	}
+	if err := root.Rename("tmp", "file"); err != nil {
+		return err
+	}
+	if err := root.Symlink("file", "link"); err != nil {
+		return err
+	}
+	if err := root.Mkdir("dir", 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 3 {
+		return errors.New("unexpected number of directory entries")
+	}
+	got, err := root.ReadFile("link")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return errors.New("file contents differ")
+	}
+
+	// networking and goroutines, as done by the daemon
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(want); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	conn.Close()
+	wg.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	// system calls which are not on the list
+	if _, err := unix.Getpriority(unix.PRIO_PROCESS, 0); err != unix.EPERM {
+		return errors.New("getpriority unexpectedly not denied")
+	}
+	if err := exec.Command("/bin/true").Run(); err == nil {
+		return errors.New("execve unexpectedly not denied")
+	}
+	return nil
+}
+
+func TestMaybeSyscalls(t *testing.T) {
+	if os.Getenv("RESTRICT_SECCOMP_CHILD") == "1" {
+		if err := exerciseFilteredProcess(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMaybeSyscalls$", "-test.v")
+	cmd.Env = append(os.Environ(), "RESTRICT_SECCOMP_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %v\n%s", cmd.Args, err, out)
+	}
+	if bytes.Contains(out, []byte("seccomp not supported")) {
+		t.Skipf("seccomp not supported:\n%s", out)
+	}
+}
+
+func TestSeccompFilterLength(t *testing.T) {
+	syscalls := allowedSyscalls()
+	filter := seccompFilter(auditArch, syscalls)
+	// arch check (3), load nr (1), one comparison per system call, deny, allow
+	if got, want := len(filter), 3+1+len(syscalls)+2; got != want {
+		t.Errorf("len(filter) = %d, want %d", got, want)
+	}
+	seen := make(map[uintptr]bool)
+	for _, nr := range syscalls {
+		if seen[nr] {
+			t.Errorf("system call %d listed twice", nr)
+		}
+		seen[nr] = true
+	}
+}
+
+// BenchmarkSyscallOverhead measures the cost of the filter for an allowed
+// system call. Because filters cannot be removed, the filtered sub-benchmark
+// leaves the filter installed for the remainder of the process.
+func BenchmarkSyscallOverhead(b *testing.B) {
+	fstat := func(b *testing.B) {
+		f, err := os.Open(b.TempDir())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		fd := int(f.Fd())
+		var st unix.Stat_t
+		for b.Loop() {
+			if err := unix.Fstat(fd, &st); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("unfiltered", func(b *testing.B) {
+		if seccompInstalled {
+			b.Skip("seccomp filter already installed")
+		}
+		fstat(b)
+	})
+	b.Run("filtered", func(b *testing.B) {
+		if err := MaybeSyscalls(); err != nil {
+			b.Fatal(err)
+		}
+		if !seccompInstalled {
+			b.Skip("seccomp not supported")
+		}
+		fstat(b)
+	})
+}
@@ -0,0 +1,163 @@
+//go:build linux && (amd64 || arm64)
+
+package restrict
+
+import "golang.org/x/sys/unix"
+
+// commonSyscalls are the system calls which gokr-rsync uses on all supported
+// architectures. Architecture-specific lists add legacy system calls.
+var commonSyscalls = []uintptr{
+	// file I/O
+	unix.SYS_READ,
+	unix.SYS_WRITE,
+	unix.SYS_READV,
+	unix.SYS_WRITEV,
+	unix.SYS_PREAD64,
+	unix.SYS_PWRITE64,
+	unix.SYS_LSEEK,
+	unix.SYS_CLOSE,
+	unix.SYS_CLOSE_RANGE,
+	unix.SYS_FCNTL,
+	unix.SYS_IOCTL,
+	unix.SYS_DUP,
+	unix.SYS_DUP3,
+	unix.SYS_PIPE2,
+	unix.SYS_FSYNC,
+	unix.SYS_FDATASYNC,
+	unix.SYS_SYNCFS,
+	unix.SYS_FTRUNCATE,
+	unix.SYS_FALLOCATE,
+	unix.SYS_FADVISE64,
+	unix.SYS_FLOCK,
+	unix.SYS_SENDFILE,
+	unix.SYS_SPLICE,
+	unix.SYS_COPY_FILE_RANGE,
+
+	// file system (os.Root uses the *at variants)
+	unix.SYS_OPENAT,
+	unix.SYS_OPENAT2,
+	unix.SYS_FSTAT,
+	unix.SYS_NEWFSTATAT,
+	unix.SYS_STATX,
+	unix.SYS_FSTATFS,
+	unix.SYS_STATFS,
+	unix.SYS_GETDENTS64,
+	unix.SYS_READLINKAT,
+	unix.SYS_FACCESSAT,
+	unix.SYS_FACCESSAT2,
+	unix.SYS_MKDIRAT,
+	unix.SYS_MKNODAT,
+	unix.SYS_SYMLINKAT,
+	unix.SYS_LINKAT,
+	unix.SYS_UNLINKAT,
+	unix.SYS_RENAMEAT,
+	unix.SYS_RENAMEAT2,
+	unix.SYS_FCHMOD,
+	unix.SYS_FCHMODAT,
+	unix.SYS_FCHMODAT2,
+	unix.SYS_FCHOWN,
+	unix.SYS_FCHOWNAT,
+	unix.SYS_UTIMENSAT,
+	unix.SYS_GETCWD,
+	unix.SYS_CHDIR,
+	unix.SYS_FCHDIR,
+	unix.SYS_UMASK,
+	unix.SYS_GETXATTR,
+	unix.SYS_LGETXATTR,
+	unix.SYS_FGETXATTR,
+	unix.SYS_LISTXATTR,
+	unix.SYS_LLISTXATTR,
+	unix.SYS_FLISTXATTR,
+	unix.SYS_SETXATTR,
+	unix.SYS_LSETXATTR,
+	unix.SYS_FSETXATTR,
+	unix.SYS_REMOVEXATTR,
+	unix.SYS_LREMOVEXATTR,
+	unix.SYS_FREMOVEXATTR,
+
+	// networking
+	unix.SYS_SOCKET,
+	unix.SYS_CONNECT,
+	unix.SYS_BIND,
+	unix.SYS_LISTEN,
+	unix.SYS_ACCEPT,
+	unix.SYS_ACCEPT4,
+	unix.SYS_GETSOCKNAME,
+	unix.SYS_GETPEERNAME,
+	unix.SYS_GETSOCKOPT,
+	unix.SYS_SETSOCKOPT,
+	unix.SYS_SENDTO,
+	unix.SYS_RECVFROM,
+	unix.SYS_SENDMSG,
+	unix.SYS_RECVMSG,
+	unix.SYS_SHUTDOWN,
+	unix.SYS_EPOLL_CREATE1,
+	unix.SYS_EPOLL_CTL,
+	unix.SYS_EPOLL_PWAIT,
+	unix.SYS_EPOLL_PWAIT2,
+	unix.SYS_EVENTFD2,
+	unix.SYS_PPOLL,
+	unix.SYS_PSELECT6,
+
+	// Go runtime: memory, threads, signals, timers
+	unix.SYS_MMAP,
+	unix.SYS_MUNMAP,
+	unix.SYS_MPROTECT,
+	unix.SYS_MADVISE,
+	unix.SYS_MREMAP,
+	unix.SYS_BRK,
+	unix.SYS_FUTEX,
+	unix.SYS_CLONE,
+	unix.SYS_CLONE3,
+	unix.SYS_EXIT,
+	unix.SYS_EXIT_GROUP,
+	unix.SYS_GETTID,
+	unix.SYS_GETPID,
+	unix.SYS_GETPPID,
+	unix.SYS_TGKILL,
+	unix.SYS_RT_SIGACTION,
+	unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_RT_SIGRETURN,
+	unix.SYS_SIGALTSTACK,
+	unix.SYS_RESTART_SYSCALL,
+	unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY,
+	unix.SYS_NANOSLEEP,
+	unix.SYS_CLOCK_GETTIME,
+	unix.SYS_GETTIMEOFDAY,
+	unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_SETITIMER,
+	unix.SYS_TIMER_CREATE,
+	unix.SYS_TIMER_SETTIME,
+	unix.SYS_TIMER_DELETE,
+	unix.SYS_GETRANDOM,
+	unix.SYS_PRLIMIT64,
+	unix.SYS_GETRUSAGE,
+	unix.SYS_UNAME,
+
+	// glibc threads (cgo, e.g. for user and group name lookups)
+	unix.SYS_SET_ROBUST_LIST,
+	unix.SYS_SET_TID_ADDRESS,
+	unix.SYS_RSEQ,
+	unix.SYS_MEMBARRIER,
+
+	// credentials
+	unix.SYS_GETUID,
+	unix.SYS_GETEUID,
+	unix.SYS_GETGID,
+	unix.SYS_GETEGID,
+	unix.SYS_GETGROUPS,
+
+	// child processes started before restricting (e.g. ssh)
+	unix.SYS_WAIT4,
+	unix.SYS_WAITID,
+	unix.SYS_KILL,
+	unix.SYS_PIDFD_OPEN,
+	unix.SYS_PIDFD_SEND_SIGNAL,
+
+	// Servers restrict file system access again for each connection.
+	unix.SYS_PRCTL,
+	unix.SYS_LANDLOCK_CREATE_RULESET,
+	unix.SYS_LANDLOCK_ADD_RULE,
+	unix.SYS_LANDLOCK_RESTRICT_SELF,
+}
@@ -2,11 +2,14 @@ package rsyncchecksum_test
 
 import (
 	"bytes"
+	"encoding/hex"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/mmcloughlin/md4"
 )
 
 func constructLargeDataFile(headPattern, bodyPattern, endPattern []byte) []byte {
@@ -71,3 +74,229 @@ func TestSyncExtended(t *testing.T) {
 		}
 	}
 }
+
+func TestStrongChecksums(t *testing.T) {
+	// The expected values follow rsync/checksum.c (get_checksum2, sum_init
+	// and file_checksum) and were computed with independent MD4 and MD5
+	// implementations.
+	const data = "hello, rsync"
+	const seed = 0x12345678
+	for _, tt := range []struct {
+		name      string
+		seed      int32
+		seedFirst bool
+		wantBlock string
+		wantFile  string // hash following the transferred data
+		wantList  string // --checksum file list checksum
+	}{
+		{
+			// md4(data || seed)
+			name:      rsyncchecksum.MD4,
+			seed:      seed,
+			wantBlock: "2da8111215993dadb9871e7a5464baf0",
+			wantFile:  "51bbb3063654466bc4569bd1db543863", // md4(seed || data)
+			wantList:  "4723c5df336246e65a87b7cc07cb9230", // md4(data)
+		},
+		{
+			// md5(data || seed)
+			name:      rsyncchecksum.MD5,
+			seed:      seed,
+			wantBlock: "36fbc0cce1427ade4034157d0cb2d8af",
+			wantFile:  "413c77441037091c189ffa377298a889", // md5(data)
+			wantList:  "413c77441037091c189ffa377298a889",
+		},
+		{
+			// md5(seed || data) with CF_CHKSUM_SEED_FIX
+			name:      rsyncchecksum.MD5,
+			seed:      seed,
+			seedFirst: true,
+			wantBlock: "76411611e980c2bae82387d0b43ac91d",
+			wantFile:  "413c77441037091c189ffa377298a889",
+			wantList:  "413c77441037091c189ffa377298a889",
+		},
+		{
+			// md5(data): a zero seed is not hashed
+			name:      rsyncchecksum.MD5,
+			seed:      0,
+			wantBlock: "413c77441037091c189ffa377298a889",
+			wantFile:  "413c77441037091c189ffa377298a889",
+			wantList:  "413c77441037091c189ffa377298a889",
+		},
+	} {
+		cs, err := rsyncchecksum.New(tt.name, tt.seed, tt.seedFirst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cs.Name(); got != tt.name {
+			t.Errorf("Name() = %q, want %q", got, tt.name)
+		}
+		if got := hex.EncodeToString(cs.Block([]byte(data))); got != tt.wantBlock {
+			t.Errorf("%s(seed=%#x, seedFirst=%v).Block() = %s, want %s", tt.name, tt.seed, tt.seedFirst, got, tt.wantBlock)
+		}
+		h := cs.NewFileHash()
+		h.Write([]byte(data))
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.wantFile {
+			t.Errorf("%s(seed=%#x).NewFileHash() = %s, want %s", tt.name, tt.seed, got, tt.wantFile)
+		}
+		list, err := cs.File(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(list); got != tt.wantList {
+			t.Errorf("%s.File() = %s, want %s", tt.name, got, tt.wantList)
+		}
+	}
+
+	if _, err := rsyncchecksum.New("sha1", 0, false); err == nil {
+		t.Errorf("New(sha1) unexpectedly succeeded")
+	}
+}
+
+func TestXXHashChecksums(t *testing.T) {
+	// Reference values from the xxHash test suite, stored little-endian like
+	// rsync does (xxh128: low half first).
+	for _, tt := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{rsyncchecksum.XXH64, "", "99e9d85137db46ef"},
+		{rsyncchecksum.XXH64, "abc", "990977adf52cbc44"},
+		{"xxhash", "abc", "990977adf52cbc44"},
+		{rsyncchecksum.XXH3, "", "c294d3380580062d"},
+		{rsyncchecksum.XXH128, "", "7f498d4624c30160d8984701d306aa99"},
+	} {
+		cs, err := rsyncchecksum.New(tt.name, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := cs.Size(), len(tt.want)/2; got != want {
+			t.Errorf("%s.Size() = %d, want %d", tt.name, got, want)
+		}
+		if got := hex.EncodeToString(cs.Block([]byte(tt.data))); got != tt.want {
+			t.Errorf("%s.Block(%q) = %s, want %s", tt.name, tt.data, got, tt.want)
+		}
+
+		// File checksums are never seeded.
+		seeded, err := rsyncchecksum.New(tt.name, 0x12345678, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(seeded.Block([]byte(tt.data))); got == tt.want {
+			t.Errorf("%s.Block(%q) with seed = %s, want a different sum", tt.name, tt.data, got)
+		}
+		h := seeded.NewFileHash()
+		h.Write([]byte(tt.data))
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("%s.NewFileHash(%q) = %s, want %s", tt.name, tt.data, got, tt.want)
+		}
+		list, err := seeded.File(strings.NewReader(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(list); got != tt.want {
+			t.Errorf("%s.File(%q) = %s, want %s", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkBlock measures the strong block checksum, which the sender computes
+// for every block whose rolling checksum matches.
+func BenchmarkBlock(b *testing.B) {
+	buf := bytes.Repeat([]byte{0xbb}, 8192)
+	for _, name := range []string{
+		rsyncchecksum.MD4,
+		rsyncchecksum.MD5,
+		rsyncchecksum.XXH64,
+		rsyncchecksum.XXH3,
+		rsyncchecksum.XXH128,
+	} {
+		b.Run(name, func(b *testing.B) {
+			cs, err := rsyncchecksum.New(name, 0x12345678, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(buf)))
+			for b.Loop() {
+				cs.Block(buf)
+			}
+		})
+	}
+}
+
+// BenchmarkFile measures the whole-file checksum, which the sender computes
+// over all transferred data.
+func BenchmarkFile(b *testing.B) {
+	content := constructLargeDataFile([]byte{0x11}, []byte{0xbb}, []byte{0xee})
+	for _, name := range []string{
+		rsyncchecksum.MD4,
+		rsyncchecksum.MD5,
+		rsyncchecksum.XXH64,
+		rsyncchecksum.XXH3,
+		rsyncchecksum.XXH128,
+	} {
+		b.Run(name, func(b *testing.B) {
+			cs, err := rsyncchecksum.New(name, 0x12345678, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(content)))
+			for b.Loop() {
+				if _, err := cs.File(bytes.NewReader(content)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMD4Busted(t *testing.T) {
+	cs, err := rsyncchecksum.New(rsyncchecksum.MD4Busted, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a multiple of 64 bytes, the checksum is regular MD4.
+	for _, n := range []int{1, 63, 65, 1000} {
+		data := bytes.Repeat([]byte{'x'}, n)
+		h := md4.New()
+		h.Write(data)
+		if got, want := hex.EncodeToString(cs.Block(data)), hex.EncodeToString(h.Sum(nil)); got != want {
+			t.Errorf("Block(%d bytes) = %s, want %s", n, got, want)
+		}
+	}
+	// Otherwise, the final padding is missing: for no data, the checksum is
+	// the MD4 initial state.
+	list, err := cs.File(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(list), "0123456789abcdeffedcba9876543210"; got != want {
+		t.Errorf("File(empty) = %s, want %s", got, want)
+	}
+	data := bytes.Repeat([]byte{'x'}, 128)
+	h := md4.New()
+	h.Write(data)
+	if got, regular := hex.EncodeToString(cs.Block(data)), hex.EncodeToString(h.Sum(nil)); got == regular {
+		t.Errorf("Block(128 bytes) = %s, unexpectedly equal to regular MD4", got)
+	}
+
+	// The seed counts towards the length: 4 bytes of seed plus 60 bytes of
+	// data skip the padding, too.
+	seeded, err := rsyncchecksum.New(rsyncchecksum.MD4Busted, 0x12345678, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := seeded.NewFileHash()
+	fh.Write(bytes.Repeat([]byte{'x'}, 60))
+	h = md4.New()
+	h.Write([]byte{0x78, 0x56, 0x34, 0x12})
+	h.Write(bytes.Repeat([]byte{'x'}, 60))
+	if got, regular := hex.EncodeToString(fh.Sum(nil)), hex.EncodeToString(h.Sum(nil)); got == regular {
+		t.Errorf("NewFileHash(60 bytes) = %s, unexpectedly equal to regular MD4", got)
+	}
+	fh.Write([]byte{'y'})
+	h.Write([]byte{'y'})
+	if got, want := hex.EncodeToString(fh.Sum(nil)), hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("NewFileHash(61 bytes) = %s, want %s", got, want)
+	}
+}
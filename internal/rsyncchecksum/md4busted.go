@@ -0,0 +1,142 @@
+package rsyncchecksum
+
+import (
+	"encoding/binary"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+// md4BustedChecksum is the strong checksum before protocol 27, which is MD4
+// as computed by rsync before it fixed a bug: when the data length is a
+// multiple of 64 bytes, rsync never calls mdfour_tail(), so the checksum is
+// the MD4 state without the final padding block.
+//
+// rsync/checksum.c:CSUM_MD4_BUSTED
+type md4BustedChecksum struct {
+	seed int32
+}
+
+func (md4BustedChecksum) Name() string { return MD4Busted }
+
+func (md4BustedChecksum) Size() int { return 16 }
+
+func (c md4BustedChecksum) Block(buf []byte) []byte {
+	h := newMD4Busted()
+	h.Write(buf)
+	if c.seed != 0 {
+		writeSeed(h, c.seed)
+	}
+	return h.Sum(nil)
+}
+
+func (c md4BustedChecksum) NewFileHash() hash.Hash {
+	h := newMD4Busted()
+	writeSeed(h, c.seed)
+	return h
+}
+
+func (md4BustedChecksum) File(r io.Reader) ([]byte, error) {
+	return fileChecksum(newMD4Busted(), r)
+}
+
+// md4Busted implements MD4 (RFC 1320) with the pre-protocol 27 bug of
+// rsync/lib/mdfour.c described at md4BustedChecksum.
+type md4Busted struct {
+	s   [4]uint32
+	x   [64]byte
+	nx  int
+	len uint64
+}
+
+func newMD4Busted() *md4Busted {
+	d := new(md4Busted)
+	d.Reset()
+	return d
+}
+
+func (d *md4Busted) Reset() {
+	d.s = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	d.nx = 0
+	d.len = 0
+}
+
+func (d *md4Busted) Size() int { return 16 }
+
+func (d *md4Busted) BlockSize() int { return 64 }
+
+func (d *md4Busted) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.nx > 0 {
+		c := copy(d.x[d.nx:], p)
+		d.nx += c
+		p = p[c:]
+		if d.nx == 64 {
+			d.block(d.x[:])
+			d.nx = 0
+		}
+	}
+	for len(p) >= 64 {
+		d.block(p[:64])
+		p = p[64:]
+	}
+	d.nx = copy(d.x[:], p)
+	return n, nil
+}
+
+func (d *md4Busted) Sum(b []byte) []byte {
+	d0 := *d // Sum must not change the state
+	if d0.len%64 != 0 {
+		d0.pad()
+	}
+	for _, s := range d0.s {
+		b = binary.LittleEndian.AppendUint32(b, s)
+	}
+	return b
+}
+
+// pad processes the final padding and the message length in bits.
+func (d *md4Busted) pad() {
+	length := d.len
+	var tmp [72]byte
+	tmp[0] = 0x80
+	padLen := 56 - int(length%64)
+	if padLen <= 0 {
+		padLen += 64
+	}
+	binary.LittleEndian.PutUint64(tmp[padLen:], length<<3)
+	d.Write(tmp[:padLen+8])
+}
+
+var (
+	md4Shift1 = [4]int{3, 7, 11, 19}
+	md4Shift2 = [4]int{3, 5, 9, 13}
+	md4Shift3 = [4]int{3, 9, 11, 15}
+	md4Order2 = [16]int{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15}
+	md4Order3 = [16]int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15}
+)
+
+func (d *md4Busted) block(p []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(p[4*i:])
+	}
+	a, b, c, dd := d.s[0], d.s[1], d.s[2], d.s[3]
+	for i := range 16 {
+		f := (b & c) | (^b & dd)
+		a, b, c, dd = dd, bits.RotateLeft32(a+f+x[i], md4Shift1[i%4]), b, c
+	}
+	for i := range 16 {
+		g := (b & c) | (b & dd) | (c & dd)
+		a, b, c, dd = dd, bits.RotateLeft32(a+g+x[md4Order2[i]]+0x5a827999, md4Shift2[i%4]), b, c
+	}
+	for i := range 16 {
+		h := b ^ c ^ dd
+		a, b, c, dd = dd, bits.RotateLeft32(a+h+x[md4Order3[i]]+0x6ed9eba1, md4Shift3[i%4]), b, c
+	}
+	d.s[0] += a
+	d.s[1] += b
+	d.s[2] += c
+	d.s[3] += dd
+}
@@ -1,11 +1,16 @@
 package rsyncchecksum
 
 import (
+	"crypto/md5"
 	"encoding/binary"
+	"fmt"
+	"hash"
 	"io"
 	"os"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/mmcloughlin/md4"
+	"github.com/zeebo/xxh3"
 )
 
 func Tag2(s1, s2 uint16) uint16 {
@@ -50,28 +55,272 @@ func Checksum1(buf []byte) uint32 {
 	return (s1 & 0xffff) + (s2 << 16)
 }
 
-func Checksum2(seed int32, buf []byte) []byte {
-	h := md4.New()
-	h.Write(buf)
+// Names of the strong checksums, as exchanged in the checksum negotiation of
+// protocol 31.
+const (
+	XXH128 = "xxh128" // XXH3, 128 bit
+	XXH3   = "xxh3"   // XXH3, 64 bit
+	XXH64  = "xxh64"
+	MD5    = "md5"
+	MD4    = "md4"
+
+	// MD4Busted is the MD4 variant before protocol 27 (see
+	// md4BustedChecksum). It cannot be negotiated.
+	MD4Busted = "md4-busted"
+)
+
+// Default returns the name of the strong checksum which peers use without
+// negotiating one: MD4 before protocol 30 (with a bug before protocol 27),
+// MD5 afterwards.
+func Default(protocolVersion int32) string {
+	if protocolVersion >= 30 {
+		return MD5
+	}
+	if protocolVersion >= 27 {
+		return MD4
+	}
+	return MD4Busted
+}
+
+// Checksum is a strong checksum algorithm, as chosen for a connection.
+type Checksum interface {
+	// Name returns the name of the checksum, e.g. MD5.
+	Name() string
+
+	// Size returns the length of the checksums in bytes.
+	Size() int
+
+	// Block returns the checksum of a block, which the generator sends and
+	// the sender compares against.
+	//
+	// rsync/checksum.c:get_checksum2
+	Block(buf []byte) []byte
+
+	// NewFileHash returns the hash for the checksum which follows the data
+	// of each transferred file.
+	//
+	// rsync/checksum.c:sum_init
+	NewFileHash() hash.Hash
+
+	// File returns the checksum which --checksum transmits in the file
+	// list.
+	//
+	// rsync/checksum.c:file_checksum
+	File(r io.Reader) ([]byte, error)
+}
+
+// New returns the strong checksum called name (see Default), using seed as
+// checksum seed. seedFirst (CF_CHKSUM_SEED_FIX) only affects MD5.
+func New(name string, seed int32, seedFirst bool) (Checksum, error) {
+	switch name {
+	case MD4:
+		return md4Checksum{seed: seed}, nil
+	case MD4Busted:
+		return md4BustedChecksum{seed: seed}, nil
+	case MD5:
+		return md5Checksum{seed: seed, seedFirst: seedFirst}, nil
+	case XXH64, "xxhash": // rsync accepts xxhash as an alias
+		return xxh64Checksum{seed: seed}, nil
+	case XXH3:
+		return xxh3Checksum{seed: seed}, nil
+	case XXH128:
+		return xxh128Checksum{seed: seed}, nil
+	}
+	return nil, fmt.Errorf("unsupported checksum %q", name)
+}
+
+func writeSeed(h hash.Hash, seed int32) {
 	binary.Write(h, binary.LittleEndian, seed)
-	return h.Sum(nil)
 }
 
-func ReaderChecksum(r io.Reader) ([]byte, error) {
-	h := md4.New()
+func fileChecksum(h hash.Hash, r io.Reader) ([]byte, error) {
 	if _, err := io.Copy(h, r); err != nil {
 		return nil, err
 	}
 	return h.Sum(nil), nil
 }
 
-func RootChecksum(root *os.Root, fn string) ([]byte, error) {
+// md4Checksum is the strong checksum before protocol 30. The seed follows the
+// block data (unless it is zero) and precedes the file data.
+type md4Checksum struct {
+	seed int32
+}
+
+func (md4Checksum) Name() string { return MD4 }
+
+func (md4Checksum) Size() int { return md4.Size }
+
+func (c md4Checksum) Block(buf []byte) []byte {
+	h := md4.New()
+	h.Write(buf)
+	if c.seed != 0 {
+		writeSeed(h, c.seed)
+	}
+	return h.Sum(nil)
+}
+
+func (c md4Checksum) NewFileHash() hash.Hash {
+	h := md4.New()
+	writeSeed(h, c.seed)
+	return h
+}
+
+func (md4Checksum) File(r io.Reader) ([]byte, error) {
+	return fileChecksum(md4.New(), r)
+}
+
+// md5Checksum is the strong checksum for protocol 30 and newer. Unlike with
+// MD4, the seed is only included in block checksums if it is non-zero, and it
+// precedes the data if both sides agreed on CF_CHKSUM_SEED_FIX. File
+// checksums are not seeded.
+type md5Checksum struct {
+	seed      int32
+	seedFirst bool
+}
+
+func (md5Checksum) Name() string { return MD5 }
+
+func (md5Checksum) Size() int { return md5.Size }
+
+func (c md5Checksum) Block(buf []byte) []byte {
+	h := md5.New()
+	if c.seed != 0 && c.seedFirst {
+		writeSeed(h, c.seed)
+	}
+	h.Write(buf)
+	if c.seed != 0 && !c.seedFirst {
+		writeSeed(h, c.seed)
+	}
+	return h.Sum(nil)
+}
+
+func (md5Checksum) NewFileHash() hash.Hash { return md5.New() }
+
+func (md5Checksum) File(r io.Reader) ([]byte, error) {
+	return fileChecksum(md5.New(), r)
+}
+
+// The xxhash checksums use the checksum seed as hash seed for block checksums
+// only; file checksums are not seeded. rsync passes the (signed) seed to the
+// 64-bit seed parameter, which sign-extends it. All sums are stored in
+// little-endian byte order.
+//
+// rsync/checksum.c:get_checksum2 (CSUM_XXH64, CSUM_XXH3_64, CSUM_XXH3_128)
+
+func xxhSeed(seed int32) uint64 { return uint64(int64(seed)) }
+
+// hasher64 is implemented by the xxhash and xxh3 streaming hashes.
+type hasher64 interface {
+	io.Writer
+	Reset()
+	Sum64() uint64
+}
+
+// leHash64 adapts a hasher64 to hash.Hash, producing a little-endian sum
+// (the libraries produce big-endian sums).
+type leHash64 struct {
+	hasher64
+	blockSize int
+}
+
+func (h leHash64) Sum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint64(b, h.Sum64())
+}
+
+func (leHash64) Size() int { return 8 }
+
+func (h leHash64) BlockSize() int { return h.blockSize }
+
+// leHash128 adapts an xxh3.Hasher to hash.Hash, producing the 128-bit sum
+// as rsync stores it: the low half first, both halves little-endian.
+type leHash128 struct {
+	*xxh3.Hasher
+}
+
+func (h leHash128) Sum(b []byte) []byte {
+	return appendUint128(b, h.Sum128())
+}
+
+func (leHash128) Size() int { return 16 }
+
+func appendUint128(b []byte, u xxh3.Uint128) []byte {
+	b = binary.LittleEndian.AppendUint64(b, u.Lo)
+	return binary.LittleEndian.AppendUint64(b, u.Hi)
+}
+
+type xxh64Checksum struct {
+	seed int32
+}
+
+func (xxh64Checksum) Name() string { return XXH64 }
+
+func (xxh64Checksum) Size() int { return 8 }
+
+func (c xxh64Checksum) Block(buf []byte) []byte {
+	d := xxhash.NewWithSeed(xxhSeed(c.seed))
+	d.Write(buf)
+	return binary.LittleEndian.AppendUint64(nil, d.Sum64())
+}
+
+func (xxh64Checksum) NewFileHash() hash.Hash {
+	d := xxhash.New()
+	return leHash64{hasher64: d, blockSize: d.BlockSize()}
+}
+
+func (c xxh64Checksum) File(r io.Reader) ([]byte, error) {
+	return fileChecksum(c.NewFileHash(), r)
+}
+
+type xxh3Checksum struct {
+	seed int32
+}
+
+func (xxh3Checksum) Name() string { return XXH3 }
+
+func (xxh3Checksum) Size() int { return 8 }
+
+func (c xxh3Checksum) Block(buf []byte) []byte {
+	return binary.LittleEndian.AppendUint64(nil, xxh3.HashSeed(buf, xxhSeed(c.seed)))
+}
+
+func (xxh3Checksum) NewFileHash() hash.Hash {
+	h := xxh3.New()
+	return leHash64{hasher64: h, blockSize: h.BlockSize()}
+}
+
+func (c xxh3Checksum) File(r io.Reader) ([]byte, error) {
+	return fileChecksum(c.NewFileHash(), r)
+}
+
+type xxh128Checksum struct {
+	seed int32
+}
+
+func (xxh128Checksum) Name() string { return XXH128 }
+
+func (xxh128Checksum) Size() int { return 16 }
+
+func (c xxh128Checksum) Block(buf []byte) []byte {
+	return appendUint128(nil, xxh3.Hash128Seed(buf, xxhSeed(c.seed)))
+}
+
+func (xxh128Checksum) NewFileHash() hash.Hash {
+	return leHash128{xxh3.New()}
+}
+
+func (c xxh128Checksum) File(r io.Reader) ([]byte, error) {
+	return fileChecksum(c.NewFileHash(), r)
+}
+
+// RootChecksum returns the --checksum file list checksum of fn in root.
+func RootChecksum(cs Checksum, root *os.Root, fn string) ([]byte, error) {
 	f, err := root.Open(fn)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return ReaderChecksum(f)
+	return cs.File(f)
 }
 
-const Size = md4.Size
+// MaxSize is the length of the longest strong checksum.
+const MaxSize = 16
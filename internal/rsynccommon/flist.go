@@ -0,0 +1,77 @@
+package rsynccommon
+
+import "strings"
+
+// CompareFileNames orders file list entries the same way rsync does, which is
+// required for both sides to agree on file indices.
+//
+// Before protocol 29, names are compared byte-wise. Starting with protocol 29,
+// directory names compare as if they had a trailing slash, a directory sorts
+// after all non-directories of the same depth, and “.” sorts first.
+//
+// Corresponds to rsync/flist.c:f_name_cmp
+func CompareFileNames(protocolVersion int32, a string, aIsDir bool, b string, bIsDir bool) int {
+	if protocolVersion < 29 {
+		return strings.Compare(a, b)
+	}
+	if a == "." || b == "." {
+		switch {
+		case a == b:
+			return 0
+		case a == ".":
+			return -1
+		default:
+			return 1
+		}
+	}
+	for {
+		aElem, aRest, aMore := strings.Cut(a, "/")
+		bElem, bRest, bMore := strings.Cut(b, "/")
+		aDir := aMore || aIsDir
+		bDir := bMore || bIsDir
+		if aDir != bDir {
+			if aDir {
+				return 1
+			}
+			return -1
+		}
+		if aElem != bElem {
+			if aDir {
+				return strings.Compare(aElem+"/", bElem+"/")
+			}
+			return strings.Compare(aElem, bElem)
+		}
+		if !aMore || !bMore {
+			switch {
+			case aMore == bMore:
+				return 0
+			case !aMore:
+				// a is the directory containing b
+				return -1
+			default:
+				return 1
+			}
+		}
+		a, b = aRest, bRest
+	}
+}
+
+// The rdev helpers below convert between major and minor numbers, which
+// protocol 28 and newer transmit separately, and the device number protocol 27
+// transmits: the Linux encoding, truncated to 32 bits, regardless of the
+// platform.
+
+// RdevMajor corresponds to glibc’s gnu_dev_major.
+func RdevMajor(rdev int32) uint32 {
+	return (uint32(rdev) >> 8) & 0xfff
+}
+
+// RdevMinor corresponds to glibc’s gnu_dev_minor.
+func RdevMinor(rdev int32) uint32 {
+	return (uint32(rdev) & 0xff) | ((uint32(rdev) >> 12) & 0xfff00)
+}
+
+// MakeRdev corresponds to glibc’s gnu_dev_makedev.
+func MakeRdev(major, minor uint32) int32 {
+	return int32((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12))
+}
@@ -0,0 +1,87 @@
+package rsynccommon
+
+import (
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// ItemAttrs are the attributes which accompany a file index on the wire
+// starting with protocol 29.
+type ItemAttrs struct {
+	Flags     uint16 // ITEM_* flags
+	BasisType byte   // only if Flags&ITEM_BASIS_TYPE_FOLLOWS
+	XName     string // only if Flags&ITEM_XNAME_FOLLOWS
+}
+
+// ReadNdxAndAttrs reads a file index and its attributes. Before protocol 29,
+// only the index is transmitted, which always requests a transfer. Negative
+// indices (NDX_DONE and the NDX_FLIST_* values) carry no attributes.
+//
+// Corresponds to rsync/rsync.c:read_ndx_and_attrs
+func ReadNdxAndAttrs(c *rsyncwire.Conn) (int32, ItemAttrs, error) {
+	ndx, err := c.ReadNdx()
+	if err != nil {
+		return 0, ItemAttrs{}, err
+	}
+	if ndx < 0 {
+		return ndx, ItemAttrs{}, nil
+	}
+	if c.ProtocolVersion < 29 {
+		return ndx, ItemAttrs{Flags: rsync.ITEM_TRANSFER}, nil
+	}
+	var attrs ItemAttrs
+	attrs.Flags, err = c.ReadShortInt()
+	if err != nil {
+		return 0, ItemAttrs{}, err
+	}
+	if attrs.Flags&rsync.ITEM_BASIS_TYPE_FOLLOWS != 0 {
+		attrs.BasisType, err = c.ReadByte()
+		if err != nil {
+			return 0, ItemAttrs{}, err
+		}
+	}
+	if attrs.Flags&rsync.ITEM_XNAME_FOLLOWS != 0 {
+		attrs.XName, err = c.ReadVString()
+		if err != nil {
+			return 0, ItemAttrs{}, err
+		}
+	}
+	return ndx, attrs, nil
+}
+
+// WriteNdxAndAttrs is the counterpart to ReadNdxAndAttrs.
+//
+// Corresponds to rsync/sender.c:write_ndx_and_attrs
+func WriteNdxAndAttrs(c *rsyncwire.Conn, ndx int32, attrs ItemAttrs) error {
+	if err := c.WriteNdx(ndx); err != nil {
+		return err
+	}
+	if c.ProtocolVersion < 29 {
+		return nil
+	}
+	if err := c.WriteShortInt(attrs.Flags); err != nil {
+		return err
+	}
+	if attrs.Flags&rsync.ITEM_BASIS_TYPE_FOLLOWS != 0 {
+		if err := c.WriteByte(attrs.BasisType); err != nil {
+			return err
+		}
+	}
+	if attrs.Flags&rsync.ITEM_XNAME_FOLLOWS != 0 {
+		if err := c.WriteVString(attrs.XName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsKeepalive reports whether a file index and its attributes are a protocol
+// 29 keepalive, which lacks MSG_NOOP: the index one past the last file
+// (numFiles) with only ITEM_IS_NEW set.
+//
+// Corresponds to rsync/io.c:maybe_send_keepalive
+func IsKeepalive(c *rsyncwire.Conn, ndx int32, attrs ItemAttrs, numFiles int) bool {
+	return c.ProtocolVersion == 29 &&
+		ndx == int32(numFiles) &&
+		attrs.Flags == rsync.ITEM_IS_NEW
+}
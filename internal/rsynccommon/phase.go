@@ -0,0 +1,50 @@
+package rsynccommon
+
+import "fmt"
+
+// Phase is a phase of the transfer. The generator ends each phase by sending
+// NDX_DONE, the sender echoes it and the receiver passes it on to the
+// generator, so that all three processes advance through the phases in
+// lockstep.
+//
+// Corresponds to the phase variable in rsync/sender.c:send_files,
+// rsync/receiver.c:recv_files and rsync/generator.c:generate_files
+type Phase int
+
+const (
+	// PhaseTransfer is the first phase, in which the generator requests
+	// all files which need updating.
+	PhaseTransfer Phase = iota
+
+	// PhaseRedo is the phase in which the generator requests the files
+	// which failed verification again, this time with full-length block
+	// checksums.
+	PhaseRedo
+
+	// PhaseFinish is the phase in which no more files are transferred and
+	// rsync finishes hard links and directory attributes (protocol >= 29).
+	PhaseFinish
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseTransfer:
+		return "transfer"
+	case PhaseRedo:
+		return "redo"
+	case PhaseFinish:
+		return "finish"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// MaxPhase returns the last phase for protocolVersion. Once the generator
+// ends the last phase, the sender and receiver leave their loops.
+//
+// Corresponds to max_phase in rsync/sender.c:send_files
+func MaxPhase(protocolVersion int32) Phase {
+	if protocolVersion >= 29 {
+		return PhaseFinish
+	}
+	return PhaseRedo
+}
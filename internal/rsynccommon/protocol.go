@@ -0,0 +1,326 @@
+package rsynccommon
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// NegotiateProtocol returns the protocol version to use for the session, which
+// is the smaller of the local and remote protocol versions.
+//
+// Corresponds to rsync/compat.c:setup_protocol
+func NegotiateProtocol(local, remote int32) (int32, error) {
+	if local > rsync.ProtocolVersion {
+		local = rsync.ProtocolVersion
+	}
+	if remote < rsync.MinProtocolVersion {
+		return 0, fmt.Errorf("protocol version mismatch -- is your shell clean? (remote protocol %d, minimum supported %d)", remote, rsync.MinProtocolVersion)
+	}
+	if local < rsync.MinProtocolVersion {
+		return 0, fmt.Errorf("--protocol must be between %d and %d, got %d", rsync.MinProtocolVersion, rsync.ProtocolVersion, local)
+	}
+	return min(local, remote), nil
+}
+
+// PeerFromGreeting returns the rsync implementation which sent greeting, the
+// remainder of an rsync daemon greeting line after “@RSYNCD: ”.
+//
+// Since rsync 3.0, tridge rsync always includes the sub-protocol version
+// (e.g. “31.0”), whereas openrsync greets with “27”. The tridge rsync
+// releases which spoke protocol 27 (2.6.0 to 2.6.2) are long gone.
+func PeerFromGreeting(greeting string) rsyncwire.Peer {
+	fields := strings.Fields(greeting)
+	if len(fields) > 0 && fields[0] == "27" {
+		return rsyncwire.PeerOpenrsync
+	}
+	return rsyncwire.PeerTridge
+}
+
+// PeerFromProtocol returns the rsync implementation which announced the
+// remote protocol version in the binary version exchange of a remote shell
+// connection. This is less reliable than PeerFromGreeting: tridge rsync
+// started with --protocol=27 looks just like openrsync.
+func PeerFromProtocol(remote int32) rsyncwire.Peer {
+	if remote == 27 {
+		return rsyncwire.PeerOpenrsync
+	}
+	return rsyncwire.PeerTridge
+}
+
+// ServerCompatFlags returns the CF_* flags which the server announces to the
+// client (protocol >= 30), based on the client info the client sent as
+// argument to -e (e.g. “.iLsfxCIvu” for rsync 3.2).
+//
+// We only enable capabilities which we implement, regardless of what the
+// client supports. Incremental recursion additionally depends on the
+// transfer options (see rsyncopts.Options.AllowIncRecurse).
+//
+// Corresponds to rsync/compat.c:setup_protocol
+func ServerCompatFlags(clientInfo string, allowIncRecurse bool) int32 {
+	var flags int32
+	if allowIncRecurse && strings.ContainsRune(clientInfo, 'i') {
+		flags |= rsync.CF_INC_RECURSE
+	}
+	// rsync announces symlink times whenever it can set them itself. We
+	// only do when the client can, too, so that both sides agree on
+	// whether the receiver sets them.
+	if canSetSymlinkTimes && strings.ContainsRune(clientInfo, 'L') {
+		flags |= rsync.CF_SYMLINK_TIMES
+	}
+	if strings.ContainsRune(clientInfo, 'f') {
+		flags |= rsync.CF_SAFE_FLIST
+	}
+	if strings.ContainsRune(clientInfo, 'C') {
+		flags |= rsync.CF_CHKSUM_SEED_FIX
+	}
+	if strings.ContainsRune(clientInfo, 'v') {
+		flags |= rsync.CF_VARINT_FLIST_FLAGS
+	}
+	return flags
+}
+
+// ClientInfo returns the value a client passes as argument to -e to announce
+// its capabilities to the server (see ServerCompatFlags).
+//
+// Corresponds to rsync/options.c:server_options
+func ClientInfo(allowIncRecurse bool) string {
+	info := "."
+	if allowIncRecurse {
+		info += "i"
+	}
+	if canSetSymlinkTimes {
+		info += "L"
+	}
+	return info + "fCv"
+}
+
+// canSetSymlinkTimes is true on platforms where the receiver can set the
+// modification time of symlinks themselves.
+//
+// Corresponds to rsync/rsync.h:CAN_SET_SYMLINK_TIMES
+const canSetSymlinkTimes = runtime.GOOS != "windows"
+
+// CheckCompatFlags returns an error if the server enabled a capability which
+// changes the wire format in a way we do not implement.
+func CheckCompatFlags(flags int32) error {
+	const unsupported = rsync.CF_ID0_NAMES
+	if flags&unsupported != 0 {
+		return fmt.Errorf("server enabled unsupported compatibility flags 0x%x", flags&unsupported)
+	}
+	return nil
+}
+
+// NewCapabilities returns the capabilities for a session with the specified
+// protocol version and CF_* flags, enabling only what we implement.
+//
+// Corresponds to rsync/compat.c:setup_protocol
+func NewCapabilities(protocol, flags int32) rsyncwire.Capabilities {
+	if protocol < 30 {
+		// Without compat flags, rsync assumes that the receiver can set
+		// symlink times if it can do so locally.
+		return rsyncwire.Capabilities{SymlinkTimes: canSetSymlinkTimes}
+	}
+	return rsyncwire.Capabilities{
+		CompatFlags:         flags,
+		SafeFileList:        flags&rsync.CF_SAFE_FLIST != 0 || protocol >= 31,
+		ChecksumSeedFix:     flags&rsync.CF_CHKSUM_SEED_FIX != 0,
+		VarintFileListFlags: flags&rsync.CF_VARINT_FLIST_FLAGS != 0,
+		IncRecurse:          flags&rsync.CF_INC_RECURSE != 0,
+		SymlinkTimes:        flags&rsync.CF_SYMLINK_TIMES != 0,
+	}
+}
+
+// ExchangeCapabilities sends (as server) or receives (as client) the compat
+// flags and negotiates the strings, storing the result in c.Capabilities.
+// clientInfo is the argument of -e the client passed to the server, and
+// allowIncRecurse whether the server’s options permit incremental recursion;
+// both are only used on the server side. Before protocol 30, nothing is
+// exchanged and all capabilities but SymlinkTimes are off.
+//
+// compress is the requested compression (see rsyncopts.Options.Compression):
+// empty if compression is off, "auto" to negotiate the algorithm, or the
+// algorithm selected with --compress-choice.
+//
+// The peer detected from the greeting (c.Capabilities.Peer) is retained.
+//
+// Corresponds to rsync/compat.c:setup_protocol
+func ExchangeCapabilities(c *rsyncwire.Conn, server bool, clientInfo string, allowIncRecurse bool, compress string) error {
+	peer := c.Capabilities.Peer
+	if c.ProtocolVersion < 30 {
+		c.Capabilities = NewCapabilities(c.ProtocolVersion, 0)
+		c.Capabilities.Peer = peer
+		return NegotiateStrings(c, server, compress)
+	}
+	var flags int32
+	if server {
+		flags = ServerCompatFlags(clientInfo, allowIncRecurse)
+		if err := c.WriteVarint(flags); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		flags, err = c.ReadVarint()
+		if err != nil {
+			return fmt.Errorf("reading compat flags: %v", err)
+		}
+		if err := CheckCompatFlags(flags); err != nil {
+			return err
+		}
+	}
+	c.Capabilities = NewCapabilities(c.ProtocolVersion, flags)
+	c.Capabilities.Peer = peer
+	return NegotiateStrings(c, server, compress)
+}
+
+// ChecksumName returns the name of the strong checksum to use on c.
+func ChecksumName(c *rsyncwire.Conn) string {
+	if c.Capabilities.Checksum != "" {
+		return c.Capabilities.Checksum
+	}
+	return rsyncchecksum.Default(c.ProtocolVersion)
+}
+
+// NewChecksum returns the strong checksum negotiated on c, seeded with the
+// session’s checksum seed.
+func NewChecksum(c *rsyncwire.Conn, seed int32) (rsyncchecksum.Checksum, error) {
+	return rsyncchecksum.New(ChecksumName(c), seed, c.Capabilities.ChecksumSeedFix)
+}
+
+// NewEncoder returns the token Encoder for the compression negotiated on c.
+func NewEncoder(c *rsyncwire.Conn, level int) (rsynccompress.Encoder, error) {
+	return rsynccompress.NewEncoder(compressionName(c), level)
+}
+
+// NewDecoder returns the token Decoder for the compression negotiated on c.
+func NewDecoder(c *rsyncwire.Conn) (rsynccompress.Decoder, error) {
+	return rsynccompress.NewDecoder(compressionName(c), c.ProtocolVersion)
+}
+
+func compressionName(c *rsyncwire.Conn) string {
+	if c.Capabilities.Compression == "" {
+		return rsynccompress.None
+	}
+	return c.Capabilities.Compression
+}
+
+// checksums are the strong checksums we support, in order of preference
+// (the same order as rsync/checksum.c:valid_checksums_items).
+var checksums = []string{
+	rsyncchecksum.XXH128,
+	rsyncchecksum.XXH3,
+	rsyncchecksum.XXH64,
+	rsyncchecksum.MD5,
+	rsyncchecksum.MD4,
+}
+
+// NegotiateStrings exchanges the lists of supported checksums (and, if
+// compression is to be negotiated, compression algorithms) with the peer (if
+// CF_VARINT_FLIST_FLAGS is set) and stores the choices in c.Capabilities.
+// Both sides choose the first entry of the client’s list which the server
+// supports.
+//
+// tridge rsync sends its lists before reading the peer’s, on both sides. We
+// only do that on the client side: the server reads the client’s lists first,
+// so that the exchange cannot deadlock on unbuffered transports like
+// io.Pipe, where a write blocks until the peer reads.
+//
+// Without the negotiation, compress “auto” selects zlib, like in older rsync
+// versions. An error is returned if the resulting compression algorithm is
+// not implemented, so that the transfer fails before any file data is sent.
+//
+// Corresponds to rsync/compat.c:negotiate_the_strings
+func NegotiateStrings(c *rsyncwire.Conn, server bool, compress string) error {
+	negotiate := c.Capabilities.VarintFileListFlags
+	local := [][]string{checksums}
+	if compress == "auto" && negotiate {
+		local = append(local, rsynccompress.Supported())
+	}
+	var remote [][]string
+	if negotiate {
+		var err error
+		remote, err = exchangeStrings(c, server, local)
+		if err != nil {
+			return err
+		}
+		for i, name := range remote[0] {
+			if name == "xxhash" { // alias used by rsync 3.2.x
+				remote[0][i] = rsyncchecksum.XXH64
+			}
+		}
+		checksum, err := chooseString(server, "checksum", local[0], remote[0])
+		if err != nil {
+			return err
+		}
+		c.Capabilities.Checksum = checksum
+	}
+
+	switch {
+	case compress == "auto" && negotiate:
+		compression, err := chooseString(server, "compression", local[1], remote[1])
+		if err != nil {
+			return err
+		}
+		c.Capabilities.Compression = compression
+	case compress == "auto":
+		c.Capabilities.Compression = rsynccompress.Zlib
+	default:
+		c.Capabilities.Compression = compress
+	}
+	if name := c.Capabilities.Compression; name != "" && !slices.Contains(rsynccompress.Supported(), name) {
+		return fmt.Errorf("compression algorithm %q is not supported (supported: %q)", name, rsynccompress.Supported())
+	}
+	return nil
+}
+
+// exchangeStrings sends the local lists of names and returns the peer’s.
+func exchangeStrings(c *rsyncwire.Conn, server bool, local [][]string) ([][]string, error) {
+	write := func() error {
+		for _, names := range local {
+			if err := c.WriteVString(strings.Join(names, " ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !server {
+		if err := write(); err != nil {
+			return nil, err
+		}
+	}
+	remote := make([][]string, len(local))
+	for i := range local {
+		list, err := c.ReadVString()
+		if err != nil {
+			return nil, err
+		}
+		remote[i] = strings.Fields(list)
+	}
+	if server {
+		if err := write(); err != nil {
+			return nil, err
+		}
+	}
+	return remote, nil
+}
+
+// chooseString returns the first entry of the client’s list which is also
+// contained in the server’s list.
+func chooseString(server bool, what string, local, remote []string) (string, error) {
+	client, srv := local, remote
+	if server {
+		client, srv = remote, local
+	}
+	for _, name := range client {
+		if slices.Contains(srv, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to negotiate a %s choice: we support %q, peer supports %q", what, local, remote)
+}
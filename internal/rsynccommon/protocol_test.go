@@ -0,0 +1,326 @@
+package rsynccommon_test
+
+import (
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		local, remote int32
+		want          int32
+	}{
+		{local: rsync.ProtocolVersion, remote: rsync.ProtocolVersion, want: rsync.ProtocolVersion},
+		// A newer peer (e.g. rsync 3.4 speaking protocol 32) is downgraded.
+		{local: rsync.ProtocolVersion, remote: rsync.ProtocolVersion + 1, want: rsync.ProtocolVersion},
+		// --protocol=27 forces an older version even if both sides support 31.
+		{local: 27, remote: rsync.ProtocolVersion, want: 27},
+		// rsync 2.5.x peers speak protocol 26.
+		{local: rsync.ProtocolVersion, remote: 26, want: 26},
+		// The local version is capped at what we implement.
+		{local: 99, remote: 99, want: rsync.ProtocolVersion},
+	} {
+		got, err := rsynccommon.NegotiateProtocol(tt.local, tt.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("NegotiateProtocol(%d, %d) = %d, want %d", tt.local, tt.remote, got, tt.want)
+		}
+	}
+
+	if _, err := rsynccommon.NegotiateProtocol(rsync.ProtocolVersion, rsync.MinProtocolVersion-1); err == nil {
+		t.Errorf("NegotiateProtocol(remote=%d) unexpectedly succeeded", rsync.MinProtocolVersion-1)
+	}
+}
+
+func TestPeerFromGreeting(t *testing.T) {
+	for _, tt := range []struct {
+		greeting string
+		want     rsyncwire.Peer
+	}{
+		{greeting: "27", want: rsyncwire.PeerOpenrsync},
+		{greeting: "27.0", want: rsyncwire.PeerTridge}, // rsync 3.x --protocol=27
+		{greeting: "29", want: rsyncwire.PeerTridge},   // rsync 2.6.x
+		{greeting: "31.0", want: rsyncwire.PeerTridge},
+		{greeting: "31.0 sha512 sha256 sha1 md5 md4", want: rsyncwire.PeerTridge},
+		{greeting: "", want: rsyncwire.PeerTridge},
+	} {
+		if got := rsynccommon.PeerFromGreeting(tt.greeting); got != tt.want {
+			t.Errorf("PeerFromGreeting(%q) = %v, want %v", tt.greeting, got, tt.want)
+		}
+	}
+}
+
+func TestExchangeCapabilitiesRetainsPeer(t *testing.T) {
+	c := &rsyncwire.Conn{
+		ProtocolVersion: 27,
+		Capabilities:    rsyncwire.Capabilities{Peer: rsyncwire.PeerOpenrsync},
+	}
+	if err := rsynccommon.ExchangeCapabilities(c, true /* server */, "", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Capabilities.Peer, rsyncwire.PeerOpenrsync; got != want {
+		t.Errorf("Capabilities.Peer = %v, want %v", got, want)
+	}
+}
+
+func TestNegotiateStrings(t *testing.T) {
+	// io.Pipe is unbuffered: each write blocks until the peer reads it.
+	clientRd, serverWr := io.Pipe()
+	serverRd, clientWr := io.Pipe()
+	client := &rsyncwire.Conn{
+		Reader:          clientRd,
+		Writer:          clientWr,
+		ProtocolVersion: rsync.ProtocolVersion,
+		Capabilities:    rsyncwire.Capabilities{VarintFileListFlags: true},
+	}
+	server := &rsyncwire.Conn{
+		Reader:          serverRd,
+		Writer:          serverWr,
+		ProtocolVersion: rsync.ProtocolVersion,
+		Capabilities:    rsyncwire.Capabilities{VarintFileListFlags: true},
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rsynccommon.NegotiateStrings(server, true /* server */, "")
+	}()
+	if err := rsynccommon.NegotiateStrings(client, false /* server */, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*rsyncwire.Conn{client, server} {
+		if got, want := rsynccommon.ChecksumName(c), rsyncchecksum.XXH128; got != want {
+			t.Errorf("ChecksumName() = %q, want %q", got, want)
+		}
+	}
+}
+
+// symlinkTimes is whether we can set symlink times on this platform.
+var symlinkTimes = runtime.GOOS != "windows"
+
+func TestNewCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		protocol int32
+		flags    int32
+		want     rsyncwire.Capabilities
+	}{
+		{
+			desc:     "protocol 27",
+			protocol: 27,
+			flags:    rsync.CF_SAFE_FLIST | rsync.CF_VARINT_FLIST_FLAGS,
+			want:     rsyncwire.Capabilities{SymlinkTimes: symlinkTimes},
+		},
+		{
+			desc:     "no flags",
+			protocol: 30,
+			want:     rsyncwire.Capabilities{},
+		},
+		{
+			desc:     "no flags, protocol 31",
+			protocol: 31,
+			want:     rsyncwire.Capabilities{SafeFileList: true},
+		},
+		{
+			desc:     "implemented flags",
+			protocol: 30,
+			flags:    rsync.CF_SAFE_FLIST | rsync.CF_CHKSUM_SEED_FIX | rsync.CF_VARINT_FLIST_FLAGS,
+			want: rsyncwire.Capabilities{
+				CompatFlags:         rsync.CF_SAFE_FLIST | rsync.CF_CHKSUM_SEED_FIX | rsync.CF_VARINT_FLIST_FLAGS,
+				SafeFileList:        true,
+				ChecksumSeedFix:     true,
+				VarintFileListFlags: true,
+			},
+		},
+		{
+			desc:     "incremental recursion",
+			protocol: 30,
+			flags:    rsync.CF_INC_RECURSE | rsync.CF_VARINT_FLIST_FLAGS,
+			want: rsyncwire.Capabilities{
+				CompatFlags:         rsync.CF_INC_RECURSE | rsync.CF_VARINT_FLIST_FLAGS,
+				VarintFileListFlags: true,
+				IncRecurse:          true,
+			},
+		},
+		{
+			desc:     "symlink times",
+			protocol: 30,
+			flags:    rsync.CF_SYMLINK_TIMES,
+			want: rsyncwire.Capabilities{
+				CompatFlags:  rsync.CF_SYMLINK_TIMES,
+				SymlinkTimes: true,
+			},
+		},
+		{
+			desc:     "unimplemented flags",
+			protocol: 30,
+			flags:    rsync.CF_SYMLINK_ICONV | rsync.CF_AVOID_XATTR_OPTIM | rsync.CF_INPLACE_PARTIAL_DIR | 1<<12,
+			want: rsyncwire.Capabilities{
+				CompatFlags: rsync.CF_SYMLINK_ICONV | rsync.CF_AVOID_XATTR_OPTIM | rsync.CF_INPLACE_PARTIAL_DIR | 1<<12,
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := rsynccommon.NewCapabilities(tt.protocol, tt.flags)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("NewCapabilities(%d, 0x%x): unexpected result: diff (-want +got):\n%s", tt.protocol, tt.flags, diff)
+			}
+		})
+	}
+}
+
+func TestExchangeCapabilities(t *testing.T) {
+	var symlinkTimesFlag int32
+	if symlinkTimes {
+		symlinkTimesFlag = rsync.CF_SYMLINK_TIMES
+	}
+	for _, tt := range []struct {
+		desc            string
+		protocol        int32
+		clientInfo      string
+		allowIncRecurse bool
+		compress        string
+		want            rsyncwire.Capabilities
+		wantErr         bool
+	}{
+		{
+			desc:       "protocol 27",
+			protocol:   27,
+			clientInfo: rsynccommon.ClientInfo(false),
+			want:       rsyncwire.Capabilities{SymlinkTimes: symlinkTimes},
+		},
+		{
+			desc:       "client advertises nothing",
+			protocol:   30,
+			clientInfo: ".",
+			want:       rsyncwire.Capabilities{},
+		},
+		{
+			// rsync 3.2 advertises symlink iconv (s) and more, which we
+			// must not enable.
+			desc:            "client advertises unimplemented capabilities",
+			protocol:        31,
+			clientInfo:      ".iLsfxCIvu",
+			allowIncRecurse: true,
+			want: rsyncwire.Capabilities{
+				CompatFlags:         rsync.CF_INC_RECURSE | rsync.CF_SAFE_FLIST | rsync.CF_CHKSUM_SEED_FIX | rsync.CF_VARINT_FLIST_FLAGS | symlinkTimesFlag,
+				SafeFileList:        true,
+				ChecksumSeedFix:     true,
+				VarintFileListFlags: true,
+				IncRecurse:          true,
+				SymlinkTimes:        symlinkTimes,
+				Checksum:            rsyncchecksum.XXH128,
+			},
+		},
+		{
+			// e.g. --no-inc-recursive or --delete-after on the server
+			desc:       "incremental recursion not allowed",
+			protocol:   31,
+			clientInfo: rsynccommon.ClientInfo(true),
+			want: rsyncwire.Capabilities{
+				CompatFlags:         rsync.CF_SAFE_FLIST | rsync.CF_CHKSUM_SEED_FIX | rsync.CF_VARINT_FLIST_FLAGS | symlinkTimesFlag,
+				SafeFileList:        true,
+				ChecksumSeedFix:     true,
+				VarintFileListFlags: true,
+				SymlinkTimes:        symlinkTimes,
+				Checksum:            rsyncchecksum.XXH128,
+			},
+		},
+		{
+			desc:       "negotiated compression",
+			protocol:   31,
+			clientInfo: rsynccommon.ClientInfo(false),
+			compress:   "auto",
+			want: rsyncwire.Capabilities{
+				CompatFlags:         rsync.CF_SAFE_FLIST | rsync.CF_CHKSUM_SEED_FIX | rsync.CF_VARINT_FLIST_FLAGS | symlinkTimesFlag,
+				SafeFileList:        true,
+				ChecksumSeedFix:     true,
+				VarintFileListFlags: true,
+				SymlinkTimes:        symlinkTimes,
+				Checksum:            rsyncchecksum.XXH128,
+				Compression:         rsynccompress.LZ4,
+			},
+		},
+		{
+			desc:       "unsupported compress choice",
+			protocol:   31,
+			clientInfo: rsynccommon.ClientInfo(false),
+			compress:   rsynccompress.Zstd,
+			wantErr:    true,
+		},
+		{
+			// Without the negotiation, rsync uses zlib.
+			desc:       "protocol 27 compression",
+			protocol:   27,
+			clientInfo: rsynccommon.ClientInfo(false),
+			compress:   "auto",
+			want: rsyncwire.Capabilities{
+				SymlinkTimes: symlinkTimes,
+				Compression:  rsynccompress.Zlib,
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			clientRd, serverWr := io.Pipe()
+			serverRd, clientWr := io.Pipe()
+			client := &rsyncwire.Conn{
+				Reader:          clientRd,
+				Writer:          clientWr,
+				ProtocolVersion: tt.protocol,
+			}
+			server := &rsyncwire.Conn{
+				Reader:          serverRd,
+				Writer:          serverWr,
+				ProtocolVersion: tt.protocol,
+			}
+			errc := make(chan error, 1)
+			go func() {
+				errc <- rsynccommon.ExchangeCapabilities(server, true /* server */, tt.clientInfo, tt.allowIncRecurse, tt.compress)
+			}()
+			err := rsynccommon.ExchangeCapabilities(client, false /* server */, "", false, tt.compress)
+			serverErr := <-errc
+			if tt.wantErr {
+				// Both sides must refuse before any file data is sent.
+				if err == nil || serverErr == nil {
+					t.Fatalf("ExchangeCapabilities(compress=%q) = %v (client), %v (server), want errors", tt.compress, err, serverErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serverErr != nil {
+				t.Fatal(serverErr)
+			}
+			for _, c := range []*rsyncwire.Conn{client, server} {
+				if diff := cmp.Diff(tt.want, c.Capabilities); diff != "" {
+					t.Errorf("unexpected capabilities: diff (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCompatFlags(t *testing.T) {
+	// A server sending names for id 0 would change the wire format.
+	if err := rsynccommon.CheckCompatFlags(rsync.CF_ID0_NAMES); err == nil {
+		t.Errorf("CheckCompatFlags(CF_ID0_NAMES) unexpectedly succeeded")
+	}
+	if err := rsynccommon.CheckCompatFlags(rsync.CF_INC_RECURSE); err != nil {
+		t.Errorf("CheckCompatFlags(CF_INC_RECURSE) = %v, want nil", err)
+	}
+	if err := rsynccommon.CheckCompatFlags(rsync.CF_SYMLINK_TIMES); err != nil {
+		t.Errorf("CheckCompatFlags(CF_SYMLINK_TIMES) = %v, want nil", err)
+	}
+}
@@ -3,35 +3,103 @@
 package rsynccommon
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/gokrazy/rsync"
 )
 
-const blockSize = 700 // rsync/rsync.h
+const (
+	blockSize       = 700     // rsync/rsync.h:BLOCK_SIZE
+	maxBlockSize    = 1 << 17 // rsync/rsync.h:MAX_BLOCK_SIZE
+	oldMaxBlockSize = 1 << 29 // rsync/rsync.h:OLD_MAX_BLOCK_SIZE
+	blockSumBias    = 10      // rsync/rsync.h:BLOCKSUM_BIAS
+)
 
+// SumSizesSqroot returns the sum head for a file of contentLen bytes: the
+// block length is the square root of the file length, rounded down to a
+// multiple of 8, but at least blockSize and at most the maximum block size of
+// the protocol. SumSizesSqroot returns an error if the file has more blocks
+// than the protocol can express.
+//
 // Corresponds to rsync/generator.c:sum_sizes_sqroot
-func SumSizesSqroot(contentLen int64) rsync.SumHead {
-	// * The block size is a rounded square root of file length.
-
-	// 	The block size algorithm plays a crucial role in the protocol efficiency. In general, the block size is the rounded square root of the total file size. The minimum block size, however, is 700 B. Otherwise, the square root computation is simply sqrt(3) followed by ceil(3)
-
-	// For reasons unknown, the square root result is rounded up to the nearest multiple of eight.
-
-	// TODO: round this
-	blockLength := max(int32(math.Sqrt(float64(contentLen))), blockSize)
-
-	// * The checksum size is determined according to:
-	// *     blocksum_bits = BLOCKSUM_EXP + 2*log2(file_len) - log2(block_len)
-	// * provided by Donovan Baarda which gives a probability of rsync
-	// * algorithm corrupting data and falling back using the whole md4
-	// * checksums.
-	const checksumLength = 16 // TODO?
+func SumSizesSqroot(protocolVersion int32, contentLen int64) (rsync.SumHead, error) {
+	if contentLen < 0 {
+		return rsync.SumHead{}, fmt.Errorf("invalid file length %d", contentLen)
+	}
+	var blockLength int32
+	if contentLen <= blockSize*blockSize {
+		blockLength = blockSize
+	} else {
+		maxBlockLength := int64(maxBlockSize)
+		if protocolVersion < 30 {
+			maxBlockLength = oldMaxBlockSize
+		}
+		// Start with the largest power of two whose square is at most
+		// contentLen, then add smaller powers of two (down to 8) as long as
+		// the square stays within contentLen.
+		c := int64(1)
+		for l := contentLen >> 2; l > 0; l >>= 2 {
+			c <<= 1
+		}
+		if c >= maxBlockLength {
+			blockLength = int32(maxBlockLength)
+		} else {
+			var b int64
+			for ; c >= 8; c >>= 1 {
+				b |= c
+				if contentLen < b*b {
+					b &^= c
+				}
+			}
+			blockLength = max(int32(b), blockSize)
+		}
+	}
 
+	remainder := contentLen % int64(blockLength)
+	count := contentLen / int64(blockLength)
+	if remainder != 0 {
+		count++
+	}
+	if count > math.MaxInt32 {
+		return rsync.SumHead{}, fmt.Errorf("file too large: %d bytes result in %d blocks of %d bytes", contentLen, count, blockLength)
+	}
 	return rsync.SumHead{
-		ChecksumCount:   int32((contentLen + (int64(blockLength) - 1)) / int64(blockLength)),
-		RemainderLength: int32(contentLen % int64(blockLength)),
+		ChecksumCount:   int32(count),
+		RemainderLength: int32(remainder),
 		BlockLength:     blockLength,
-		ChecksumLength:  checksumLength,
+		ChecksumLength:  StrongSumLength(protocolVersion, contentLen, blockLength, rsync.ShortSumLength),
+	}, nil
+}
+
+// StrongSumLength returns how many bytes of each strong block checksum to
+// transmit for a file of contentLen bytes, split into blocks of blockLength.
+// minLength is rsync.ShortSumLength, or rsync.SumLength to send full
+// checksums (e.g. when transferring a file again).
+//
+// The length is determined according to
+//
+//	blocksum_bits = BLOCKSUM_EXP + 2*log2(file_len) - log2(block_len)
+//
+// provided by Donovan Baarda, which gives a probability of the rsync algorithm
+// corrupting data and falling back to using the whole checksums. Before
+// protocol 27, the sum head does not carry the length (see
+// rsync.SumHead.ReadFrom), so minLength is used as-is.
+//
+// rsync/generator.c:sum_sizes_sqroot
+func StrongSumLength(protocolVersion int32, contentLen int64, blockLength, minLength int32) int32 {
+	if protocolVersion < 27 || minLength == rsync.SumLength {
+		return minLength
+	}
+	b := blockSumBias
+	for l := contentLen; l > 1; l >>= 1 {
+		b += 2
+	}
+	for c := blockLength; c > 1 && b > 0; c >>= 1 {
+		b--
 	}
+	// Add a bit, subtract the rolling checksum (32 bits) and round up. Like
+	// in C, the division truncates towards zero.
+	length := int32((b + 1 - 32 + 7) / 8)
+	return min(max(length, minLength), rsync.SumLength)
 }
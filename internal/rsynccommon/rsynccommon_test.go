@@ -0,0 +1,135 @@
+package rsynccommon_test
+
+import (
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+)
+
+func TestSumSizesSqroot(t *testing.T) {
+	// Block lengths as computed by rsync 3.x (rsync/generator.c:sum_sizes_sqroot).
+	for _, tt := range []struct {
+		protocol    int32
+		contentLen  int64
+		blockLength int32
+		count       int32
+		remainder   int32
+	}{
+		{protocol: 30, contentLen: 0, blockLength: 700, count: 0, remainder: 0},
+		{protocol: 30, contentLen: 1, blockLength: 700, count: 1, remainder: 1},
+		{protocol: 30, contentLen: 4096, blockLength: 700, count: 6, remainder: 596},
+		{protocol: 30, contentLen: 490000, blockLength: 700, count: 700, remainder: 0},
+		// The square root (700.0007) rounds down to 696, below the minimum.
+		{protocol: 30, contentLen: 490001, blockLength: 700, count: 701, remainder: 1},
+		{protocol: 30, contentLen: 1 << 20, blockLength: 1024, count: 1024, remainder: 0},
+		// The square root (3238.2) rounds down to a multiple of 8.
+		{protocol: 30, contentLen: 10 << 20, blockLength: 3232, count: 3245, remainder: 1152},
+		{protocol: 30, contentLen: 100 << 20, blockLength: 10240, count: 10240, remainder: 0},
+		{protocol: 30, contentLen: 1 << 30, blockLength: 32768, count: 32768, remainder: 0},
+		{protocol: 30, contentLen: 10 << 30, blockLength: 103616, count: 103628, remainder: 3008},
+		// Protocol 30 caps the block length at MAX_BLOCK_SIZE…
+		{protocol: 30, contentLen: 100 << 30, blockLength: 131072, count: 819200, remainder: 0},
+		{protocol: 31, contentLen: 1 << 40, blockLength: 131072, count: 8388608, remainder: 0},
+		// …whereas older protocols allow blocks up to OLD_MAX_BLOCK_SIZE.
+		{protocol: 29, contentLen: 100 << 30, blockLength: 327680, count: 327680, remainder: 0},
+		{protocol: 29, contentLen: 1 << 40, blockLength: 1 << 20, count: 1 << 20, remainder: 0},
+		{protocol: 27, contentLen: 1 << 59, blockLength: 1 << 29, count: 1 << 30, remainder: 0},
+	} {
+		got, err := rsynccommon.SumSizesSqroot(tt.protocol, tt.contentLen)
+		if err != nil {
+			t.Errorf("SumSizesSqroot(%d, %d): %v", tt.protocol, tt.contentLen, err)
+			continue
+		}
+		if got.BlockLength != tt.blockLength || got.ChecksumCount != tt.count || got.RemainderLength != tt.remainder {
+			t.Errorf("SumSizesSqroot(%d, %d) = (block length %d, count %d, remainder %d), want (%d, %d, %d)",
+				tt.protocol, tt.contentLen,
+				got.BlockLength, got.ChecksumCount, got.RemainderLength,
+				tt.blockLength, tt.count, tt.remainder)
+		}
+	}
+
+	// With blocks of at most 128 KiB, a petabyte file has too many blocks.
+	if _, err := rsynccommon.SumSizesSqroot(30, 1<<50); err == nil {
+		t.Errorf("SumSizesSqroot(30, 1<<50) unexpectedly succeeded")
+	}
+}
+
+func TestStrongSumLength(t *testing.T) {
+	// Block lengths and checksum lengths as computed by rsync 3.x
+	// (rsync/generator.c:sum_sizes_sqroot) for protocol 30.
+	for _, tt := range []struct {
+		contentLen  int64
+		blockLength int32
+		want        int32
+	}{
+		{contentLen: 0, blockLength: 700, want: 2},
+		{contentLen: 1, blockLength: 700, want: 2},
+		{contentLen: 4096, blockLength: 700, want: 2},
+		{contentLen: 490000, blockLength: 700, want: 2},
+		{contentLen: 1 << 20, blockLength: 1024, want: 2},
+		{contentLen: 10 << 20, blockLength: 3232, want: 2},
+		{contentLen: 100 << 20, blockLength: 10240, want: 3},
+		{contentLen: 1 << 30, blockLength: 32768, want: 3},
+		{contentLen: 10 << 30, blockLength: 103616, want: 4},
+		{contentLen: 100 << 30, blockLength: 131072, want: 5},
+		{contentLen: 1 << 40, blockLength: 131072, want: 6},
+		{contentLen: 1 << 50, blockLength: 131072, want: 8},
+	} {
+		if got := rsynccommon.StrongSumLength(30, tt.contentLen, tt.blockLength, rsync.ShortSumLength); got != tt.want {
+			t.Errorf("StrongSumLength(30, %d, %d) = %d, want %d", tt.contentLen, tt.blockLength, got, tt.want)
+		}
+	}
+
+	// Full checksums (e.g. redo) and protocols without a length in the sum
+	// head use the minimum length as-is.
+	if got := rsynccommon.StrongSumLength(30, 1<<20, 1024, rsync.SumLength); got != rsync.SumLength {
+		t.Errorf("StrongSumLength(full) = %d, want %d", got, rsync.SumLength)
+	}
+	if got := rsynccommon.StrongSumLength(26, 1<<50, 131072, rsync.ShortSumLength); got != rsync.ShortSumLength {
+		t.Errorf("StrongSumLength(protocol 26) = %d, want %d", got, rsync.ShortSumLength)
+	}
+}
+
+func TestMaxPhase(t *testing.T) {
+	for _, tt := range []struct {
+		protocol int32
+		want     rsynccommon.Phase
+	}{
+		{protocol: 27, want: rsynccommon.PhaseRedo},
+		{protocol: 28, want: rsynccommon.PhaseRedo},
+		{protocol: 29, want: rsynccommon.PhaseFinish},
+		{protocol: 31, want: rsynccommon.PhaseFinish},
+	} {
+		if got := rsynccommon.MaxPhase(tt.protocol); got != tt.want {
+			t.Errorf("MaxPhase(%d) = %v, want %v", tt.protocol, got, tt.want)
+		}
+	}
+}
+
+func TestUnsafeSymlink(t *testing.T) {
+	for _, tt := range []struct {
+		target string
+		name   string
+		want   bool
+	}{
+		{target: "", name: "link", want: true},
+		{target: "/etc/passwd", name: "dir/link", want: true},
+		{target: "file", name: "link", want: false},
+		{target: "sub/../file", name: "link", want: false},
+		{target: "../file", name: "link", want: true},
+		{target: "../file", name: "dir/link", want: false},
+		{target: "../../file", name: "dir/link", want: true},
+		{target: "..", name: "dir/link", want: false},
+		{target: "../..", name: "dir/link", want: true},
+		{target: "./../file", name: "./dir/link", want: false},
+		{target: "../dir/../../file", name: "dir/sub/link", want: false},
+		{target: "../../../file", name: "dir/sub/link", want: true},
+		// A .. element in name starts the count over.
+		{target: "../file", name: "dir/../link", want: true},
+	} {
+		if got := rsynccommon.UnsafeSymlink(tt.target, tt.name); got != tt.want {
+			t.Errorf("UnsafeSymlink(%q, %q) = %v, want %v", tt.target, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package rsynccommon
+
+import "strings"
+
+// UnsafeSymlink reports whether a symlink with the specified target, located
+// at name (relative to the top of the transfer), points outside of the
+// transfer: empty and absolute targets are unsafe, as are targets whose ..
+// elements climb above the top directory. The check is purely lexical, so a
+// safe symlink could still lead elsewhere via other symlinks.
+//
+// Corresponds to rsync/util1.c:unsafe_symlink
+func UnsafeSymlink(target, name string) bool {
+	if target == "" || strings.HasPrefix(target, "/") {
+		return true
+	}
+
+	// The number of directories name is located in is our safety margin.
+	depth := 0
+	dir, base := splitLast(name)
+	for elem := range strings.SplitSeq(dir, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth = 0 // starts the count over
+		default:
+			depth++
+		}
+	}
+	if base == ".." {
+		depth = 0
+	}
+
+	dir, base = splitLast(target)
+	for elem := range strings.SplitSeq(dir, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			// Going outside the top directory at any point is unsafe.
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	if base == ".." {
+		depth--
+	}
+	return depth < 0
+}
+
+// splitLast splits p at its last slash, unlike path.Split without keeping the
+// slash and without cleaning.
+func splitLast(p string) (dir, base string) {
+	idx := strings.LastIndexByte(p, '/')
+	if idx == -1 {
+		return "", p
+	}
+	return p[:idx], p[idx+1:]
+}
@@ -0,0 +1,275 @@
+package rsynccompress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rsync compresses each piece of literal data into an independent LZ4 block
+// (LZ4_compress_default), so we only need the LZ4 block format, not the
+// frame format: https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+
+const (
+	lz4MinMatch = 4
+	// The last 5 bytes of a block are always literals, and the last match
+	// must start at least 12 bytes before the end of the block.
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+
+	lz4HashLog     = 12
+	lz4SkipTrigger = 6
+)
+
+// lz4CompressBound returns the maximum size of an LZ4 block for n bytes of
+// input (LZ4_compressBound).
+func lz4CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4CompressBlock appends the LZ4 block for src to dst. src must be shorter
+// than 64 KiB, so that all match offsets fit.
+func lz4CompressBlock(dst, src []byte) []byte {
+	var table [1 << lz4HashLog]int32 // position+1, 0 means empty
+	anchor := 0
+	if len(src) >= lz4MFLimit+1 {
+		matchLimit := len(src) - lz4LastLiterals
+		misses := 0
+		for pos := 0; pos < len(src)-lz4MFLimit; {
+			seq := binary.LittleEndian.Uint32(src[pos:])
+			h := lz4Hash(seq)
+			cand := int(table[h]) - 1
+			table[h] = int32(pos + 1)
+			if cand < 0 || pos-cand > 65535 || binary.LittleEndian.Uint32(src[cand:]) != seq {
+				// Like LZ4, skip ahead faster the longer we find no match.
+				pos += 1 + misses>>lz4SkipTrigger
+				misses++
+				continue
+			}
+			misses = 0
+			// Extend the match backwards over pending literals.
+			for pos > anchor && cand > 0 && src[pos-1] == src[cand-1] {
+				pos--
+				cand--
+			}
+			matchLen := lz4MinMatch
+			for pos+matchLen < matchLimit && src[pos+matchLen] == src[cand+matchLen] {
+				matchLen++
+			}
+			dst = lz4AppendSequence(dst, src[anchor:pos], pos-cand, matchLen)
+			pos += matchLen
+			anchor = pos
+		}
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends literals followed by a match of matchLen bytes at
+// offset, or only literals for the last sequence (matchLen == 0).
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	var token byte
+	litLen := len(literals)
+	if litLen >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(litLen) << 4
+	}
+	ml := matchLen - lz4MinMatch
+	if matchLen > 0 {
+		if ml >= 15 {
+			token |= 15
+		} else {
+			token |= byte(ml)
+		}
+	}
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lz4AppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if ml >= 15 {
+		dst = lz4AppendLength(dst, ml-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+var errLZ4Corrupt = errors.New("lz4: corrupt input")
+
+// lz4DecompressBlock appends the decompressed contents of the LZ4 block src
+// to dst, failing if the output would exceed limit bytes
+// (LZ4_decompress_safe).
+func lz4DecompressBlock(dst, src []byte, limit int) ([]byte, error) {
+	start := len(dst)
+	readLength := func(i int) (int, int, error) {
+		n := 0
+		for {
+			if i >= len(src) {
+				return 0, 0, errLZ4Corrupt
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return n, i, nil
+			}
+		}
+	}
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, errLZ4Corrupt
+		}
+		token := src[i]
+		i++
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			n, next, err := readLength(i)
+			if err != nil {
+				return nil, err
+			}
+			litLen += n
+			i = next
+		}
+		if litLen > len(src)-i || len(dst)-start+litLen > limit {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			return dst, nil // the last sequence has no match
+		}
+		if i+2 > len(src) {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		matchLen := int(token&15) + lz4MinMatch
+		if token&15 == 15 {
+			n, next, err := readLength(i)
+			if err != nil {
+				return nil, err
+			}
+			matchLen += n
+			i = next
+		}
+		if offset == 0 || offset > len(dst)-start || len(dst)-start+matchLen > limit {
+			return nil, errLZ4Corrupt
+		}
+		// The match may overlap the bytes it produces, so copy byte-wise.
+		pos := len(dst) - offset
+		for j := range matchLen {
+			dst = append(dst, dst[pos+j])
+		}
+	}
+}
+
+// lz4Encoder sends each piece of literal data (at most maxDataCount bytes) as
+// an independent LZ4 block, whose compressed size must not exceed
+// maxDataCount either.
+//
+// rsync/token.c:send_compressed_token
+type lz4Encoder struct {
+	runs runWriter
+	buf  []byte
+}
+
+func (e *lz4Encoder) WriteData(w io.Writer, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.runs.flush(w); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), maxDataCount)
+		for {
+			// Reserve 2 bytes for the header.
+			e.buf = lz4CompressBlock(append(e.buf[:0], 0, 0), data[:n])
+			if len(e.buf)-2 <= maxDataCount {
+				break
+			}
+			// Incompressible data grows, so try again with less of it.
+			n /= 2
+		}
+		compressed := len(e.buf) - 2
+		e.buf[0] = deflatedData + byte(compressed>>8)
+		e.buf[1] = byte(compressed)
+		if _, err := w.Write(e.buf); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (e *lz4Encoder) WriteToken(w io.Writer, token int32) error {
+	return e.runs.writeToken(w, token)
+}
+
+// rsync/token.c:recv_compressed_token
+type lz4Decoder struct {
+	runs runReader
+	cbuf []byte
+	dbuf []byte
+}
+
+// lz4MaxBlockSize is the size of rsync’s decompression buffer, which bounds
+// the decompressed size of each block.
+var lz4MaxBlockSize = max(lz4CompressBound(32*1024), maxDataCount+2)
+
+// ReadToken returns data which is only valid until the next call.
+func (d *lz4Decoder) ReadToken(r io.Reader) (int32, []byte, error) {
+	for {
+		if token, ok := d.runs.next(); ok {
+			return token, nil, nil
+		}
+		flag, n, err := readFlag(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch flag {
+		case deflatedData:
+			if cap(d.cbuf) < n {
+				d.cbuf = make([]byte, n)
+			}
+			d.cbuf = d.cbuf[:n]
+			if _, err := io.ReadFull(r, d.cbuf); err != nil {
+				return 0, nil, err
+			}
+			d.dbuf, err = lz4DecompressBlock(d.dbuf[:0], d.cbuf, lz4MaxBlockSize)
+			if err != nil {
+				return 0, nil, fmt.Errorf("uncompress failed: %v", err)
+			}
+			if len(d.dbuf) == 0 {
+				continue // a token of 0 would mean the end of the file
+			}
+			return int32(len(d.dbuf)), d.dbuf, nil
+
+		case endFlag:
+			d.runs.reset()
+			return 0, nil, nil
+
+		default:
+			token, err := d.runs.readToken(r, flag)
+			return token, nil, err
+		}
+	}
+}
+
+func (d *lz4Decoder) SeeToken([]byte) {}
@@ -0,0 +1,100 @@
+package rsynccompress
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLZ4DecompressBlock(t *testing.T) {
+	// Hand-assembled following the block format specification: 3 literals,
+	// an overlapping match of 5 bytes at offset 3, and 5 final literals.
+	block := []byte{0x31, 'a', 'b', 'c', 0x03, 0x00, 0x50, 'x', 'y', 'z', 'z', 'y'}
+	got, err := lz4DecompressBlock(nil, block, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "abcabcabxyzzy"; string(got) != want {
+		t.Errorf("lz4DecompressBlock() = %q, want %q", got, want)
+	}
+	if _, err := lz4DecompressBlock(nil, block, 10); err == nil {
+		t.Errorf("lz4DecompressBlock(limit=10) unexpectedly succeeded")
+	}
+	// offset 9 points before the start of the output
+	if _, err := lz4DecompressBlock(nil, []byte{0x31, 'a', 'b', 'c', 0x09, 0x00, 0x00}, 100); err == nil {
+		t.Errorf("lz4DecompressBlock(bad offset) unexpectedly succeeded")
+	}
+}
+
+func TestLZ4CompressBlock(t *testing.T) {
+	random := make([]byte, maxDataCount)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, tt := range []struct {
+		desc string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"repetitive", bytes.Repeat([]byte{0xbb}, maxDataCount)},
+		{"text", bytes.Repeat([]byte("gokrazy rsync "), 1000)},
+		{"random", random},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			block := lz4CompressBlock(nil, tt.src)
+			if got, bound := len(block), lz4CompressBound(len(tt.src)); got > bound {
+				t.Errorf("compressed size %d exceeds bound %d", got, bound)
+			}
+			got, err := lz4DecompressBlock(nil, block, len(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.src) {
+				t.Errorf("round trip mismatch: got %d bytes, want %d", len(got), len(tt.src))
+			}
+		})
+	}
+}
+
+func TestRunWriter(t *testing.T) {
+	var rw runWriter
+	var buf bytes.Buffer
+	for _, token := range []int32{0, 1, 2, 100, 101, -1} {
+		if err := rw.writeToken(&buf, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []byte{
+		tokenRunRel + 0, 2, 0, // blocks 0-2
+		tokenRunLong, 100, 0, 0, 0, 1, 0, // blocks 100-101
+		endFlag,
+	}
+	if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+		t.Errorf("unexpected encoding: diff (-want +got):\n%s", diff)
+	}
+
+	var rr runReader
+	var got []int32
+	for {
+		if token, ok := rr.next(); ok {
+			got = append(got, token)
+			continue
+		}
+		flag, _, err := readFlag(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flag == endFlag {
+			break
+		}
+		token, err := rr.readToken(&buf, flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, token)
+	}
+	if diff := cmp.Diff([]int32{-1, -2, -3, -101, -102}, got); diff != "" {
+		t.Errorf("unexpected tokens: diff (-want +got):\n%s", diff)
+	}
+}
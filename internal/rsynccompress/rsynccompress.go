@@ -0,0 +1,174 @@
+// Package rsynccompress implements the token formats in which rsync sends
+// file data: literal data and references to blocks of the receiver’s basis
+// file, optionally compressed (-z).
+package rsynccompress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Names of the compression algorithms, as exchanged in the compression
+// negotiation of protocol 31.
+const (
+	Zstd  = "zstd"
+	LZ4   = "lz4"
+	Zlibx = "zlibx"
+	Zlib  = "zlib"
+	None  = "none"
+)
+
+// preference lists all compression algorithms in rsync’s order of preference
+// (rsync/compat.c:valid_compressions_items).
+var preference = []string{Zstd, LZ4, Zlibx, Zlib, None}
+
+// Encoder sends file data to the receiver. An Encoder keeps state across
+// files (e.g. the compression dictionary), so each transfer must use one
+// Encoder for all of its files.
+type Encoder interface {
+	// WriteData sends literal file data.
+	WriteData(w io.Writer, data []byte) error
+
+	// WriteToken sends a reference to block token of the receiver’s basis
+	// file, or, if token is -1, marks the end of the file.
+	WriteToken(w io.Writer, token int32) error
+}
+
+// Decoder reads file data sent by an Encoder of the same algorithm.
+type Decoder interface {
+	// ReadToken returns the next token of the current file: literal data
+	// (token > 0 is its length), a reference to block -(token+1) of the
+	// basis file (token < 0), or the end of the file (token == 0). The data
+	// is only valid until the next call.
+	ReadToken(r io.Reader) (token int32, data []byte, err error)
+
+	// SeeToken must be called with the data of each block reference
+	// returned by ReadToken, as some algorithms use it as history.
+	SeeToken(data []byte)
+}
+
+type codec struct {
+	newEncoder func(level int) Encoder
+	newDecoder func(protocol int32) Decoder
+}
+
+var codecs = map[string]codec{
+	LZ4: {
+		// LZ4 has no compression levels.
+		newEncoder: func(int) Encoder { return &lz4Encoder{} },
+		newDecoder: func(int32) Decoder { return &lz4Decoder{} },
+	},
+	Zlibx: {
+		newEncoder: func(level int) Encoder { return &zlibEncoder{level: level} },
+		newDecoder: func(protocol int32) Decoder { return &zlibDecoder{protocol: protocol} },
+	},
+	Zlib: {
+		newEncoder: func(level int) Encoder { return &zlibEncoder{insert: true, level: level} },
+		newDecoder: func(protocol int32) Decoder { return &zlibDecoder{insert: true, protocol: protocol} },
+	},
+	None: {
+		newEncoder: func(int) Encoder { return simpleEncoder{} },
+		newDecoder: func(int32) Decoder { return &simpleDecoder{} },
+	},
+}
+
+// Supported returns the names of the compression algorithms we implement, in
+// order of preference.
+func Supported() []string {
+	var names []string
+	for _, name := range preference {
+		if _, ok := codecs[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Valid reports whether name is a compression algorithm rsync knows about,
+// even if we do not implement it.
+func Valid(name string) bool {
+	return slices.Contains(preference, name)
+}
+
+func lookup(name string) (codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		if Valid(name) {
+			return codec{}, fmt.Errorf("compression algorithm %q is not supported", name)
+		}
+		return codec{}, fmt.Errorf("unknown compression algorithm %q", name)
+	}
+	return c, nil
+}
+
+// NewEncoder returns an Encoder for the named compression algorithm. level is
+// the --compress-level, or math.MinInt32 for the algorithm’s default level.
+func NewEncoder(name string, level int) (Encoder, error) {
+	c, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.newEncoder(level), nil
+}
+
+// NewDecoder returns a Decoder for the named compression algorithm. protocol
+// is the negotiated protocol version, as zlib behaves differently before
+// protocol 31.
+func NewDecoder(name string, protocol int32) (Decoder, error) {
+	c, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.newDecoder(protocol), nil
+}
+
+// simpleEncoder sends file data uncompressed: literal data is prefixed with
+// its length, block references are sent as -(token+1) and the end of the
+// file as 0.
+//
+// rsync/token.c:simple_send_token
+type simpleEncoder struct{}
+
+func (simpleEncoder) WriteData(w io.Writer, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := binary.Write(w, binary.LittleEndian, int32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (simpleEncoder) WriteToken(w io.Writer, token int32) error {
+	return binary.Write(w, binary.LittleEndian, -(token + 1))
+}
+
+// rsync/token.c:simple_recv_token
+type simpleDecoder struct {
+	hdr [4]byte
+	buf []byte // literal data, reused across tokens
+}
+
+// ReadToken returns data which is only valid until the next call.
+func (d *simpleDecoder) ReadToken(r io.Reader) (int32, []byte, error) {
+	if _, err := io.ReadFull(r, d.hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	token := int32(binary.LittleEndian.Uint32(d.hdr[:]))
+	if token <= 0 {
+		return token, nil, nil
+	}
+	if cap(d.buf) < int(token) {
+		d.buf = make([]byte, token)
+	}
+	data := d.buf[:token]
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return token, data, nil
+}
+
+func (*simpleDecoder) SeeToken([]byte) {}
@@ -0,0 +1,108 @@
+package rsynccompress_test
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynccompress"
+	"github.com/google/go-cmp/cmp"
+)
+
+type token struct {
+	Token int32
+	Data  []byte
+}
+
+// sendFile sends tokens like the sender does: literal data, followed by a
+// block reference (unless block is -2) or the end of file marker (-1).
+func sendFile(t *testing.T, enc rsynccompress.Encoder, w *bytes.Buffer, tokens []token) {
+	t.Helper()
+	for _, tok := range tokens {
+		if err := enc.WriteData(w, tok.Data); err != nil {
+			t.Fatal(err)
+		}
+		if tok.Token == -2 {
+			continue
+		}
+		if err := enc.WriteToken(w, tok.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// recvFile reads tokens until the end of the file, merging consecutive
+// literal data.
+func recvFile(t *testing.T, dec rsynccompress.Decoder, r *bytes.Buffer) (data []byte, blocks []int32) {
+	t.Helper()
+	for {
+		tok, b, err := dec.ReadToken(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok == 0 {
+			return data, blocks
+		}
+		if tok > 0 {
+			data = append(data, b...)
+			continue
+		}
+		blocks = append(blocks, -(tok + 1))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Compressible data, followed by incompressible data.
+	literal := bytes.Repeat([]byte("gokrazy rsync "), 1000)
+	random := make([]byte, 40000)
+	rand.New(rand.NewSource(1)).Read(random)
+	literal = append(literal, random...)
+	for _, name := range rsynccompress.Supported() {
+		t.Run(name, func(t *testing.T) {
+			enc, err := rsynccompress.NewEncoder(name, math.MinInt32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec, err := rsynccompress.NewDecoder(name, 31)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			// Encoder and Decoder keep their state across files.
+			for range 2 {
+				sendFile(t, enc, &buf, []token{
+					{Token: 0, Data: literal[:100]},
+					{Token: 1},
+					{Token: -2, Data: literal[100:5000]},
+					{Token: 7, Data: literal[5000:]},
+					{Token: 8},
+					{Token: -1},
+				})
+			}
+			for range 2 {
+				data, blocks := recvFile(t, dec, &buf)
+				if !bytes.Equal(data, literal) {
+					t.Errorf("received %d bytes of literal data, want %d", len(data), len(literal))
+				}
+				if diff := cmp.Diff([]int32{0, 1, 7, 8}, blocks); diff != "" {
+					t.Errorf("unexpected blocks: diff (-want +got):\n%s", diff)
+				}
+			}
+			if buf.Len() > 0 {
+				t.Errorf("%d bytes left after reading all files", buf.Len())
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := rsynccompress.NewEncoder("brotli", 0); err == nil {
+		t.Errorf("NewEncoder(brotli) unexpectedly succeeded")
+	}
+	for _, name := range []string{rsynccompress.Zstd, rsynccompress.LZ4, rsynccompress.Zlibx, rsynccompress.Zlib, rsynccompress.None} {
+		if !rsynccompress.Valid(name) {
+			t.Errorf("Valid(%q) = false, want true", name)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package rsynccompress
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Flags of the compressed token format, which all compression algorithms
+// share.
+//
+// rsync/token.c
+const (
+	endFlag      = 0x00  // that’s all folks
+	tokenLong    = 0x20  // followed by 32-bit token number
+	tokenRunLong = 0x21  // ditto with 16-bit run count
+	deflatedData = 0x40  // + 6-bit high len, then low len byte
+	tokenRel     = 0x80  // + 6-bit relative token number
+	tokenRunRel  = 0xc0  // ditto with 16-bit run count
+	maxDataCount = 16383 // fit 14 bit count into 2 bytes with flags
+)
+
+// runWriter sends block references in the compressed token format, which
+// combines consecutive blocks into runs and encodes block numbers relative to
+// the previous run where possible.
+//
+// rsync/token.c:send_deflated_token (and its siblings for lz4 and zstd)
+type runWriter struct {
+	lastRunStart int32
+	runStart     int32
+	lastToken    int32
+	pending      bool // whether runStart..lastToken is yet to be sent
+}
+
+// writeToken adds token to the current run, or sends the current run and
+// starts a new one. A token of -1 sends the current run and the end of file
+// marker.
+func (rw *runWriter) writeToken(w io.Writer, token int32) error {
+	if token == -1 {
+		if err := rw.flush(w); err != nil {
+			return err
+		}
+		*rw = runWriter{}
+		_, err := w.Write([]byte{endFlag})
+		return err
+	}
+	if rw.pending && token == rw.lastToken+1 && token < rw.runStart+65536 {
+		rw.lastToken = token
+		return nil
+	}
+	if err := rw.flush(w); err != nil {
+		return err
+	}
+	rw.runStart = token
+	rw.lastToken = token
+	rw.pending = true
+	return nil
+}
+
+// flush sends the current run, if any. It must be called before sending
+// literal data, which follows the blocks of the current run.
+func (rw *runWriter) flush(w io.Writer) error {
+	if !rw.pending {
+		return nil
+	}
+	rw.pending = false
+	r := rw.runStart - rw.lastRunStart
+	n := rw.lastToken - rw.runStart
+	var buf []byte
+	if r >= 0 && r <= 63 {
+		flag := byte(tokenRel)
+		if n != 0 {
+			flag = tokenRunRel
+		}
+		buf = append(buf, flag+byte(r))
+	} else {
+		flag := byte(tokenLong)
+		if n != 0 {
+			flag = tokenRunLong
+		}
+		buf = append(buf, flag)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(rw.runStart))
+	}
+	if n != 0 {
+		buf = append(buf, byte(n), byte(n>>8))
+	}
+	rw.lastRunStart = rw.lastToken
+	_, err := w.Write(buf)
+	return err
+}
+
+// writeDataHeader sends the header of n bytes of compressed data.
+func writeDataHeader(w io.Writer, n int) error {
+	_, err := w.Write([]byte{deflatedData + byte(n>>8), byte(n)})
+	return err
+}
+
+// runReader decodes block references sent by a runWriter.
+//
+// rsync/token.c:recv_deflated_token (and its siblings for lz4 and zstd)
+type runReader struct {
+	rxToken int32
+	rxRun   int
+}
+
+// next returns the next block reference of the current run, if any.
+func (rr *runReader) next() (token int32, ok bool) {
+	if rr.rxRun == 0 {
+		return 0, false
+	}
+	rr.rxToken++
+	rr.rxRun--
+	return -1 - rr.rxToken, true
+}
+
+// readToken decodes the block reference introduced by flag, which must
+// neither be endFlag nor deflatedData.
+func (rr *runReader) readToken(r io.Reader, flag byte) (int32, error) {
+	if flag&tokenRel != 0 {
+		rr.rxToken += int32(flag & 0x3f)
+		flag >>= 6
+	} else {
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		rr.rxToken = int32(binary.LittleEndian.Uint32(buf[:]))
+	}
+	if flag&1 != 0 {
+		var buf [2]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		rr.rxRun = int(buf[0]) | int(buf[1])<<8
+	}
+	return -1 - rr.rxToken, nil
+}
+
+// reset prepares for the next file.
+func (rr *runReader) reset() {
+	*rr = runReader{}
+}
+
+// readFlag reads the flag byte which starts each element of the compressed
+// token format. For deflatedData, it also returns the length of the data.
+func readFlag(r io.Reader) (flag byte, n int, _ error) {
+	var buf [2]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return 0, 0, err
+	}
+	flag = buf[0]
+	if flag&0xc0 != deflatedData {
+		return flag, 0, nil
+	}
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return 0, 0, err
+	}
+	return deflatedData, int(flag&0x3f)<<8 | int(buf[1]), nil
+}
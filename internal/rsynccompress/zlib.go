@@ -0,0 +1,290 @@
+package rsynccompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rsync compresses all literal data of a file into one raw deflate stream,
+// which it flushes (Z_SYNC_FLUSH) before each block reference and at the end
+// of the file. The deflate stream starts over with each file.
+//
+// With zlib (--old-compress), both sides additionally add the data of each
+// matched block to their compression history (Z_INSERT_ONLY), so that literal
+// data can refer back to it. zlibx (--new-compress) skips that step.
+
+// windowSize is the size of the deflate history.
+const windowSize = 32 * 1024
+
+// syncMarker ends each flushed piece of the deflate stream: the LEN and NLEN
+// fields of an empty stored block. rsync does not send it, the receiver
+// supplies it instead.
+var syncMarker = []byte{0, 0, 0xff, 0xff}
+
+func zlibLevel(level int) int {
+	if level < flate.NoCompression || level > flate.BestCompression {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// rsync/token.c:send_deflated_token
+type zlibEncoder struct {
+	// insert is true for zlib, false for zlibx.
+	insert bool
+	level  int
+	runs   runWriter
+	fw     *flate.Writer
+	out    bytes.Buffer // compressed data yet to be sent
+	// restart is true when the deflate stream must start over before more
+	// data is compressed.
+	restart bool
+	pending bool // whether data was compressed since the last flush
+}
+
+func (e *zlibEncoder) WriteData(w io.Writer, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.runs.flush(w); err != nil {
+		return err
+	}
+	if e.fw == nil {
+		fw, err := flate.NewWriter(&e.out, zlibLevel(e.level))
+		if err != nil {
+			return err
+		}
+		e.fw = fw
+	} else if e.restart {
+		e.fw.Reset(&e.out)
+	}
+	e.restart = false
+	if _, err := e.fw.Write(data); err != nil {
+		return err
+	}
+	e.pending = true
+	return e.writeChunks(w, false)
+}
+
+func (e *zlibEncoder) WriteToken(w io.Writer, token int32) error {
+	if e.pending {
+		e.pending = false
+		if err := e.fw.Flush(); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(e.out.Bytes(), syncMarker) {
+			return errors.New("BUG: deflate flush did not end in a sync marker")
+		}
+		e.out.Truncate(e.out.Len() - len(syncMarker))
+		if err := e.writeChunks(w, true); err != nil {
+			return err
+		}
+	}
+	// We cannot add matched blocks to the history of a flate.Writer like
+	// rsync does for zlib. Instead, we start a new deflate stream (on a
+	// block boundary, thanks to the flush), whose data never refers back
+	// beyond the block. The receiver’s additional history does not matter.
+	if token == -1 || e.insert {
+		e.restart = true
+	}
+	return e.runs.writeToken(w, token)
+}
+
+// writeChunks sends the compressed data in pieces of maxDataCount bytes. If
+// all is false, a shorter last piece is held back.
+func (e *zlibEncoder) writeChunks(w io.Writer, all bool) error {
+	for e.out.Len() >= maxDataCount || (all && e.out.Len() > 0) {
+		chunk := e.out.Next(maxDataCount)
+		if err := writeDataHeader(w, len(chunk)); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	e.out.Reset()
+	return nil
+}
+
+// chunkSource feeds the compressed data of consecutive deflatedData elements
+// to a flate reader. At the next element, which follows a flush, it supplies
+// the sync marker and then reports io.EOF.
+type chunkSource struct {
+	r    io.Reader
+	buf  []byte
+	pos  int
+	flag byte // the element following the compressed data
+	done bool // whether buf holds the sync marker
+}
+
+func (s *chunkSource) start(r io.Reader, n int) error {
+	s.r = r
+	s.done = false
+	return s.read(n)
+}
+
+func (s *chunkSource) read(n int) error {
+	if cap(s.buf) < n {
+		s.buf = make([]byte, n)
+	}
+	s.buf = s.buf[:n]
+	s.pos = 0
+	_, err := io.ReadFull(s.r, s.buf)
+	return err
+}
+
+func (s *chunkSource) fill() error {
+	for s.pos == len(s.buf) {
+		if s.done {
+			return io.EOF
+		}
+		flag, n, err := readFlag(s.r)
+		if err != nil {
+			return err
+		}
+		if flag != deflatedData {
+			s.flag = flag
+			s.done = true
+			s.buf = append(s.buf[:0], syncMarker...)
+			s.pos = 0
+			return nil
+		}
+		if err := s.read(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *chunkSource) ReadByte() (byte, error) {
+	if err := s.fill(); err != nil {
+		return 0, err
+	}
+	b := s.buf[s.pos]
+	s.pos++
+	return b, nil
+}
+
+func (s *chunkSource) Read(p []byte) (int, error) {
+	if err := s.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, s.buf[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+// rsync/token.c:recv_deflated_token
+type zlibDecoder struct {
+	// insert is true for zlib, false for zlibx.
+	insert   bool
+	protocol int32
+	runs     runReader
+	src      chunkSource
+	fr       io.ReadCloser
+	// inflating is true while fr returns the data of the current piece of
+	// the deflate stream.
+	inflating bool
+	hist      []byte // the last windowSize bytes of the current file
+	dbuf      []byte
+}
+
+// ReadToken returns data which is only valid until the next call.
+func (d *zlibDecoder) ReadToken(r io.Reader) (int32, []byte, error) {
+	for {
+		if token, ok := d.runs.next(); ok {
+			return token, nil, nil
+		}
+		var flag byte
+		if d.inflating {
+			if d.dbuf == nil {
+				d.dbuf = make([]byte, windowSize)
+			}
+			n, err := d.fr.Read(d.dbuf)
+			if n > 0 {
+				d.see(d.dbuf[:n])
+				return int32(n), d.dbuf[:n], nil
+			}
+			if err == io.ErrUnexpectedEOF && d.src.done && d.src.pos == len(d.src.buf) {
+				// The deflate stream is flushed, continue with the
+				// element following it.
+				d.inflating = false
+				flag = d.src.flag
+			} else if err != nil {
+				return 0, nil, fmt.Errorf("inflate failed: %v", err)
+			} else {
+				continue
+			}
+		} else {
+			var n int
+			var err error
+			flag, n, err = readFlag(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			if flag == deflatedData {
+				if err := d.src.start(r, n); err != nil {
+					return 0, nil, err
+				}
+				// Each piece of the deflate stream starts on a block
+				// boundary, so a fresh flate reader can pick up where
+				// the last one stopped, given the history.
+				if d.fr == nil {
+					d.fr = flate.NewReaderDict(&d.src, d.hist)
+				} else if err := d.fr.(flate.Resetter).Reset(&d.src, d.hist); err != nil {
+					return 0, nil, err
+				}
+				d.inflating = true
+				continue
+			}
+		}
+		switch flag {
+		case endFlag:
+			d.runs.reset()
+			d.hist = d.hist[:0]
+			return 0, nil, nil
+
+		case deflatedData:
+			return 0, nil, errors.New("BUG: deflated data after a flush")
+
+		default:
+			token, err := d.runs.readToken(r, flag)
+			return token, nil, err
+		}
+	}
+}
+
+// SeeToken adds the data of a matched block to the history (zlib only).
+//
+// rsync/token.c:see_deflate_token
+func (d *zlibDecoder) SeeToken(data []byte) {
+	if !d.insert {
+		return
+	}
+	// rsync inserts the data in pieces of at most 0xffff bytes. Before
+	// protocol 31, it repeated the first piece instead of advancing.
+	buf := data
+	for len(data) > 0 {
+		n := min(len(data), 0xffff)
+		d.see(buf[:n])
+		if d.protocol >= 31 {
+			buf = buf[n:]
+		}
+		data = data[n:]
+	}
+}
+
+// see appends p to the history, keeping its last windowSize bytes.
+func (d *zlibDecoder) see(p []byte) {
+	if len(p) >= windowSize {
+		d.hist = append(d.hist[:0], p[len(p)-windowSize:]...)
+		return
+	}
+	if len(d.hist)+len(p) > 2*windowSize {
+		d.hist = append(d.hist[:0], d.hist[len(d.hist)-(windowSize-len(p)):]...)
+	}
+	d.hist = append(d.hist, p...)
+}
@@ -0,0 +1,72 @@
+package rsynccompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+// deflatePiece compresses data like rsync does before a block reference:
+// flushed, without the sync marker, in deflatedData elements.
+func deflatePiece(t *testing.T, out *bytes.Buffer, dict, data []byte) {
+	t.Helper()
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriterDict(&compressed, flate.DefaultCompression, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.TrimSuffix(compressed.Bytes(), syncMarker)
+	if err := writeDataHeader(out, len(b)); err != nil {
+		t.Fatal(err)
+	}
+	out.Write(b)
+}
+
+// TestZlibSeeToken verifies that the zlib Decoder resolves references to
+// matched blocks, which rsync adds to the history of the deflate stream.
+func TestZlibSeeToken(t *testing.T) {
+	literal := []byte("some literal data preceding block 0\n")
+	block := bytes.Repeat([]byte("block 0 contents "), 100)
+
+	var buf bytes.Buffer
+	deflatePiece(t, &buf, nil, literal)
+	buf.WriteByte(tokenRel + 0)
+	// rsync’s deflate stream continues with literal data and block 0 as
+	// history, so repeating block 0 compresses to almost nothing.
+	deflatePiece(t, &buf, append(append([]byte(nil), literal...), block...), block)
+	buf.WriteByte(endFlag)
+	if got, limit := buf.Len(), len(block)/10; got > limit {
+		t.Fatalf("test setup: compressed to %d bytes, want at most %d", got, limit)
+	}
+
+	d := &zlibDecoder{insert: true, protocol: 31}
+	var got []byte
+	for {
+		token, data, err := d.ReadToken(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token == 0 {
+			break
+		}
+		if token < 0 {
+			if token != -1 {
+				t.Fatalf("unexpected token %d", token)
+			}
+			d.SeeToken(block)
+			got = append(got, block...)
+			continue
+		}
+		got = append(got, data...)
+	}
+	want := append(append(append([]byte(nil), literal...), block...), block...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
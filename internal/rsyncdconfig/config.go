@@ -1,6 +1,9 @@
 package rsyncdconfig
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -13,15 +16,77 @@ type SSHListener struct {
 	AuthorizedKeys string `toml:"authorized_keys"`
 }
 
+// TLSConfig wraps a listener (rsyncd or SSH) in TLS if CertFile is set.
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// ClientCAFile (if non-empty) makes the listener require client
+	// certificates signed by one of the CAs in this PEM file.
+	ClientCAFile string `toml:"client_ca_file"`
+
+	// MinVersion is the minimum TLS version to accept, e.g. "1.3". If
+	// empty, crypto/tls chooses.
+	MinVersion string `toml:"min_version"`
+}
+
 type Listener struct {
 	HostKeyPath    string      `toml:"host_key_path"`
 	Rsyncd         string      `toml:"rsyncd"`
 	HTTPMonitoring string      `toml:"http_monitoring"`
 	AnonSSH        string      `toml:"anon_ssh"`
 	AuthorizedSSH  SSHListener `toml:"authorized_ssh"`
+	TLS            TLSConfig   `toml:"tls"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ServerConfig loads the certificates and returns the server-side TLS
+// configuration, or nil if TLS is not configured.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS min_version %q, expected one of 1.0, 1.1, 1.2, 1.3", c.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
 }
 
+// Global is the [global] section of the config file: server-wide settings,
+// some of which modules can override.
+type Global = rsyncd.Global
+
 type Config struct {
+	Global        Global          `toml:"global"`
 	Listeners     []Listener      `toml:"listener"`
 	Modules       []rsyncd.Module `toml:"module"`
 	DontNamespace bool            `toml:"dont_namespace"`
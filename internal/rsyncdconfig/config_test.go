@@ -1,7 +1,19 @@
 package rsyncdconfig_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/rsyncdconfig"
 	"github.com/gokrazy/rsync/rsyncd"
@@ -52,3 +64,174 @@ path = "/non/existant/path"
 		}
 	}
 }
+
+func TestGlobalConfig(t *testing.T) {
+	cfg, err := rsyncdconfig.FromString(`
+[global]
+max_connections = 4
+bwlimit = "1m"
+log_level = "quiet"
+timeout = "5m"
+connect_timeout = "30s"
+
+[[module]]
+name = "interop"
+path = "/non/existant/path"
+max_connections = 1
+timeout = "10s"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	{
+		want := rsyncdconfig.Global{
+			MaxConnections: 4,
+			BandwidthLimit: "1m",
+			LogLevel:       "quiet",
+			IOTimeout:      5 * time.Minute,
+			ConnectTimeout: 30 * time.Second,
+		}
+		if diff := cmp.Diff(want, cfg.Global); diff != "" {
+			t.Fatalf("unexpected global config: diff (-want +got):\n%s", diff)
+		}
+	}
+
+	{
+		want := []rsyncd.Module{
+			{
+				Name:           "interop",
+				Path:           "/non/existant/path",
+				MaxConnections: 1,
+				IOTimeout:      10 * time.Second,
+			},
+		}
+		if diff := cmp.Diff(want, cfg.Modules); diff != "" {
+			t.Fatalf("unexpected module config: diff (-want +got):\n%s", diff)
+		}
+	}
+}
+
+// writeCert writes a certificate for name (signed by parent, or self-signed if
+// parent is nil) and its key as PEM files to dir.
+func writeCert(t *testing.T, dir, name string, parent *tls.Certificate) (certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestTLSConfig(t *testing.T) {
+	tmp := t.TempDir()
+	caFile, _, ca := writeCert(t, tmp, "ca", nil)
+	certFile, keyFile, _ := writeCert(t, tmp, "localhost", &ca)
+	_, _, client := writeCert(t, tmp, "client", &ca)
+
+	cfg, err := rsyncdconfig.FromString(`
+[[listener]]
+rsyncd = "localhost:8730"
+
+[listener.tls]
+cert_file = "` + certFile + `"
+key_file = "` + keyFile + `"
+client_ca_file = "` + caFile + `"
+min_version = "1.3"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rsyncdconfig.TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		MinVersion:   "1.3",
+	}
+	if diff := cmp.Diff(want, cfg.Listeners[0].TLS); diff != "" {
+		t.Fatalf("unexpected TLS config: diff (-want +got):\n%s", diff)
+	}
+
+	serverConfig, err := cfg.Listeners[0].TLS.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serverConfig.MinVersion, uint16(tls.VersionTLS13); got != want {
+		t.Errorf("MinVersion = %x, want %x", got, want)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	handshake := func(clientCerts []tls.Certificate) error {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		srv := tls.Server(c1, serverConfig)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- srv.Handshake()
+			// Unblock the client if the server rejected it.
+			c1.Close()
+		}()
+		cl := tls.Client(c2, &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      roots,
+			Certificates: clientCerts,
+		})
+		// With TLS 1.3, the client only learns about a rejected
+		// certificate when reading.
+		cl.Handshake()
+		cl.Read(make([]byte, 1))
+		return <-errc
+	}
+	if err := handshake([]tls.Certificate{client}); err != nil {
+		t.Errorf("handshake with client certificate: %v", err)
+	}
+	if err := handshake(nil); err == nil {
+		t.Errorf("handshake without client certificate unexpectedly succeeded")
+	}
+
+	if cfg, err := (rsyncdconfig.TLSConfig{}).ServerConfig(); cfg != nil || err != nil {
+		t.Errorf("ServerConfig() without cert_file = %v, %v, want nil, nil", cfg, err)
+	}
+	invalid := want
+	invalid.MinVersion = "1.4"
+	if _, err := invalid.ServerConfig(); err == nil {
+		t.Errorf("ServerConfig() with min_version 1.4 unexpectedly succeeded")
+	}
+}
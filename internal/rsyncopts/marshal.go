@@ -0,0 +1,152 @@
+package rsyncopts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// counters returns the fields which the special case code in ParseArguments
+// sets or increments for the table entries without arg, keyed by val.
+func (o *Options) counters() map[int]*int {
+	return map[int]*int{
+		OPT_SERVER:   &o.am_server,
+		OPT_SENDER:   &o.am_sender,
+		OPT_OLD_ARGS: &o.old_style_args,
+		'v':          &o.verbose,
+		'q':          &o.quiet,
+		'h':          &o.human_readable,
+		'H':          &o.preserve_hard_links,
+		'i':          &o.itemize_changes,
+		'U':          &o.preserve_atimes,
+		'x':          &o.one_file_system,
+		'z':          &o.do_compression,
+		'X':          &o.preserve_xattrs,
+	}
+}
+
+// MarshalArgs serializes the options back into command-line flags (without
+// any paths), such that parsing them with a fresh Options of the same flavor
+// (NewOptions or NewOptionsWithGokrazyDefaults) results in the same options.
+// Only options which differ from their defaults are emitted, using their long
+// names where available.
+//
+// This walks the same option table as ParseArguments, so every option that
+// can be parsed can also be marshaled.
+func (o *Options) MarshalArgs() ([]string, error) {
+	var args []string
+	// -a is the only flag which sets recurse to 1 (instead of 2), which
+	// matters for --files-from, so start with --archive and marshal the
+	// remaining options relative to it.
+	if o.recurse == 1 {
+		args = append(args, "--archive")
+	}
+	base, err := o.parseDefaults(args)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := NewContext(o).table
+	def := NewContext(base).table
+	counters := o.counters()
+	baseCounters := base.counters()
+	done := make(map[any]bool)
+	for idx, opt := range cur {
+		name := opt.name()
+		if opt.arg == nil {
+			ptr, ok := counters[opt.val]
+			if !ok || done[ptr] {
+				continue
+			}
+			// Values below the default are left to the --no-* entries.
+			for range *ptr - max(*baseCounters[opt.val], 0) {
+				done[ptr] = true
+				args = append(args, name)
+			}
+			continue
+		}
+		switch opt.argInfo & POPT_ARG_MASK {
+		case POPT_ARG_NONE, POPT_ARG_VAL:
+			ptr := opt.arg.(*int)
+			val, baseVal := *ptr, *def[idx].arg.(*int)
+			want := 1
+			if opt.argInfo&POPT_ARG_MASK == POPT_ARG_VAL {
+				want = opt.val
+			}
+			if opt.argInfo&POPT_ARGFLAG_OR != 0 {
+				if val&want != 0 && baseVal&want == 0 {
+					args = append(args, name)
+				}
+				continue
+			}
+			if done[ptr] || val == baseVal || val != want {
+				continue
+			}
+			done[ptr] = true
+			args = append(args, name)
+
+		case POPT_ARG_INT:
+			ptr := opt.arg.(*int)
+			// Even --modify-window=0 is passed on to the server.
+			set := opt.val == OPT_MODIFY_WINDOW && o.modify_window_set != 0
+			if done[ptr] || *ptr == *def[idx].arg.(*int) && !set {
+				continue
+			}
+			done[ptr] = true
+			args = append(args, name+"="+strconv.Itoa(*ptr))
+
+		case POPT_ARG_STRING:
+			ptr := opt.arg.(*string)
+			if done[ptr] || *ptr == *def[idx].arg.(*string) {
+				continue
+			}
+			done[ptr] = true
+			// Not --name=value: popt takes the next argument for an
+			// empty value.
+			args = append(args, name, *ptr)
+
+		default:
+			return nil, fmt.Errorf("BUG: %s: unexpected argInfo %d", name, opt.argInfo)
+		}
+	}
+	for _, rule := range o.filterRules {
+		args = append(args, "--filter", rule)
+	}
+
+	// The --info and --debug levels mostly follow from the other flags (like
+	// --verbose or --progress), so only emit the levels which differ from
+	// what parsing args results in.
+	parsed, err := o.parseDefaults(args)
+	if err != nil {
+		return nil, err
+	}
+	if words := outputWordsDiff(infoWords[:], o.info[:], parsed.info[:]); words != "" {
+		args = append(args, "--info="+words)
+	}
+	if words := outputWordsDiff(debugWords[:], o.debug[:], parsed.debug[:]); words != "" {
+		args = append(args, "--debug="+words)
+	}
+	return args, nil
+}
+
+// parseDefaults returns fresh options of the same flavor as o, parsed from
+// args.
+func (o *Options) parseDefaults(args []string) (*Options, error) {
+	opts := o.newOptions(o.osenv)
+	if err := NewContext(opts).ParseArguments(o.osenv, args, ParseModeLibrary); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// outputWordsDiff returns the --info or --debug value which sets the levels
+// in want that differ from got.
+func outputWordsDiff(words []output, want, got []uint16) string {
+	var diff []string
+	for idx, level := range want {
+		if level != got[idx] {
+			diff = append(diff, strings.ToLower(words[idx].name)+strconv.Itoa(int(level)))
+		}
+	}
+	return strings.Join(diff, ",")
+}
@@ -53,8 +53,12 @@ const (
 	POPT_BIT_SET = POPT_ARG_VAL | POPT_ARGFLAG_OR
 )
 
+// PoptError is the error which ParseArguments returns for all invalid command
+// lines. Errno tells the kind of error apart (e.g. POPT_ERROR_BADOPT for an
+// unknown option), Err describes it for humans.
 type PoptError struct {
 	Errno      int32
+	Opt        string // the offending option (e.g. --delete or -Q), if any
 	Err        error
 	DaemonMode bool
 }
@@ -85,12 +89,20 @@ const (
 	POPT_ERROR_BADCONFIG    = -22 // config file failed sanity test
 )
 
+// Error codes specific to gokrazy/rsync, outside of the range popt uses.
+const (
+	GOKR_ERROR_BADVALUE       = -100 // invalid value for an option
+	GOKR_ERROR_NOTIMPLEMENTED = -101 // option not (yet) implemented
+)
+
 type Context struct {
 	// state
 	table       []poptOption
 	args        []string
 	nextCharArg string
 	nextArg     string
+	lastOpt     string // name of the option poptGetNextOpt returned last
+	daemonMode  bool   // parsing with the daemon options table
 
 	// output
 	Options       *Options
@@ -109,6 +121,60 @@ func (pc *Context) findOption(longName, shortName string) *poptOption {
 	return nil
 }
 
+// takesArg reports whether opt consumes an argument.
+func (opt *poptOption) takesArg() bool {
+	argType := opt.argInfo & POPT_ARG_MASK
+	return argType != POPT_ARG_NONE && argType != POPT_ARG_VAL
+}
+
+// PeekRemainingArgs returns the non-option arguments in args, i.e. what
+// ParseArguments would leave in RemainingArgs, without parsing the options.
+// This allows callers to look at the operands (e.g. to tell whether a
+// destination was given) before committing to a configuration. Unknown options
+// are skipped, their errors are left to ParseArguments.
+func (pc *Context) PeekRemainingArgs(args []string) []string {
+	var remaining []string
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		if arg == "" {
+			continue
+		}
+		if arg[0] != '-' || arg == "-" {
+			remaining = append(remaining, arg)
+			continue
+		}
+		before, _, hasValue := strings.Cut(arg, "=")
+		if long, ok := strings.CutPrefix(before, "--"); ok {
+			if opt := pc.findOption(long, ""); opt != nil && opt.takesArg() && !hasValue && len(args) > 0 {
+				args = args[1:] // skip the option’s argument
+			}
+			continue
+		}
+		// Like popt, try a long option with one dash before short options.
+		if opt := pc.findOption(before[1:], ""); opt != nil {
+			if opt.takesArg() && !hasValue && len(args) > 0 {
+				args = args[1:]
+			}
+			continue
+		}
+		// A group of short options, of which the first one taking an
+		// argument ends the group: the argument is either the rest of the
+		// group or the next argument.
+		for i, short := range arg[1:] {
+			opt := pc.findOption("", string(short))
+			if opt == nil || !opt.takesArg() {
+				continue
+			}
+			if i+2 == len(arg) && len(args) > 0 {
+				args = args[1:]
+			}
+			break
+		}
+	}
+	return remaining
+}
+
 func (pc *Context) poptSaveInt(opt *poptOption, val int) bool {
 	intPtr := opt.arg.(*int)
 	if intPtr == nil {
@@ -186,6 +252,7 @@ func (pc *Context) poptGetNextOpt() (int32, error) {
 			if opt == nil && !oneDash {
 				return -1, &PoptError{
 					Errno: POPT_ERROR_BADOPT,
+					Opt:   "--" + before,
 					Err:   fmt.Errorf("%s: unknown option", origOptString),
 				}
 			}
@@ -201,6 +268,7 @@ func (pc *Context) poptGetNextOpt() (int32, error) {
 			if opt == nil {
 				return -1, &PoptError{
 					Errno: POPT_ERROR_BADOPT,
+					Opt:   "-" + pc.nextCharArg[:1],
 					Err:   fmt.Errorf("-%s: unknown option", pc.nextCharArg[:1]),
 				}
 			}
@@ -219,6 +287,7 @@ func (pc *Context) poptGetNextOpt() (int32, error) {
 			if longArg != "" || strings.HasPrefix(pc.nextCharArg, "=") {
 				return -1, &PoptError{
 					Errno: POPT_ERROR_UNWANTEDARG,
+					Opt:   opt.name(),
 					Err:   fmt.Errorf("option %s does not take an argument", opt.name()),
 				}
 			}
@@ -230,6 +299,7 @@ func (pc *Context) poptGetNextOpt() (int32, error) {
 				if !pc.poptSaveInt(opt, val) {
 					return -1, &PoptError{
 						Errno: POPT_ERROR_BADOPERATION,
+						Opt:   opt.name(),
 						Err:   fmt.Errorf("poptSaveInt"),
 					}
 				}
@@ -244,6 +314,7 @@ func (pc *Context) poptGetNextOpt() (int32, error) {
 				if len(pc.args) == 0 {
 					return -1, &PoptError{
 						Errno: POPT_ERROR_NOARG,
+						Opt:   opt.name(),
 						Err:   fmt.Errorf("missing argument for option %s", opt.name()),
 					}
 				}
@@ -255,17 +326,43 @@ func (pc *Context) poptGetNextOpt() (int32, error) {
 				if errno := pc.poptSaveArg(opt, nextArg); errno != 0 {
 					return -1, &PoptError{
 						Errno: errno,
-						Err:   fmt.Errorf("poptSaveArg errno %d", errno),
+						Opt:   opt.name(),
+						Err:   fmt.Errorf("%s (option %s): %q", poptStrerror(errno), opt.name(), nextArg),
 					}
 				}
 			}
 		}
 		if opt.val != 0 && argType != POPT_ARG_VAL {
+			pc.lastOpt = opt.name()
 			return int32(opt.val), nil
 		}
 	}
 }
 
+// poptError returns a *PoptError for the option which poptGetNextOpt
+// returned last, for errors found by the special case code.
+func (pc *Context) poptError(errno int32, err error) *PoptError {
+	return &PoptError{
+		Errno:      errno,
+		Opt:        pc.lastOpt,
+		Err:        err,
+		DaemonMode: pc.daemonMode,
+	}
+}
+
+// poptStrerror describes errno like popt does.
+func poptStrerror(errno int32) string {
+	switch errno {
+	case POPT_ERROR_BADNUMBER:
+		return "invalid numeric value"
+	case POPT_ERROR_OVERFLOW:
+		return "number too large or too small"
+	case POPT_ERROR_BADOPERATION:
+		return "mutually exclusive logical operations requested"
+	}
+	return fmt.Sprintf("popt error %d", errno)
+}
+
 func (pc *Context) poptGetOptArg() string {
 	ret := pc.nextArg
 	pc.nextArg = ""
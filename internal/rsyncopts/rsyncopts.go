@@ -12,13 +12,17 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"unicode"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
 	"github.com/gokrazy/rsync/internal/rsyncos"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"github.com/gokrazy/rsync/internal/version"
 )
 
@@ -125,7 +129,8 @@ var tridgeDefaults = Options{
 	rsync_path:           "rsync",
 	default_af_hint:      syscall.AF_INET6,
 	blocking_io:          -1,
-	protocol_version:     27,
+	old_style_args:       -1,
+	protocol_version:     rsync.ProtocolVersion,
 }
 
 // NewOptions returns an Options struct with all options initialized to their
@@ -137,16 +142,15 @@ func NewOptions(osenv *rsyncos.Env) *Options {
 	opts.table = func() []poptOption {
 		return opts.tridgeTable()
 	}
+	opts.newOptions = NewOptions
 	return &opts
 }
 
 var gokrazyDefaults = Options{
-	msgs2stderr:    2, // Default: send errors to stderr for local & remote-shell transfers
-	output_motd:    1,
-	human_readable: 1,
-	// TODO: if/when allow_inc_recurse gets implemented,
-	// default to 1 to match tridge rsync
-	allow_inc_recurse:    0,
+	msgs2stderr:          2, // Default: send errors to stderr for local & remote-shell transfers
+	output_motd:          1,
+	human_readable:       1,
+	allow_inc_recurse:    1,
 	xfer_dirs:            -1,
 	relative_paths:       -1,
 	implied_dirs:         1,
@@ -156,7 +160,8 @@ var gokrazyDefaults = Options{
 	rsync_path:           "rsync",
 	default_af_hint:      syscall.AF_INET6,
 	blocking_io:          -1,
-	protocol_version:     27,
+	old_style_args:       -1,
+	protocol_version:     rsync.ProtocolVersion,
 }
 
 // NewOptions returns an Options struct with all options initialized to their
@@ -168,19 +173,24 @@ func NewOptionsWithGokrazyDefaults(osenv *rsyncos.Env) *Options {
 	opts.table = func() []poptOption {
 		return opts.gokrazyTable()
 	}
+	opts.newOptions = NewOptionsWithGokrazyDefaults
 	return &opts
 }
 
 // GokrazyClientOptions contains additional command-line flags, prefixed with
 // gokr. (like --gokr.dont_restrict) to not clash with rsync flag names.
 type GokrazyClientOptions struct {
-	DontRestrict int
+	DontRestrict    int
+	SpaceCheck      string
+	BatchSmallFiles int
 }
 
 func (o *GokrazyClientOptions) table() []poptOption {
 	return []poptOption{
 		/* longName, shortName, argInfo, arg, val */
 		{"gokr.dont_restrict", "", POPT_ARG_NONE, &o.DontRestrict, 0},
+		{"gokr.space_check", "", POPT_ARG_STRING, &o.SpaceCheck, 0},
+		{"gokr.batch_small_files", "", POPT_ARG_NONE, &o.BatchSmallFiles, 0},
 	}
 }
 
@@ -192,6 +202,8 @@ type GokrazyDaemonOptions struct {
 	MonitoringListen string
 	AnonSSHListen    string
 	ModuleMap        string
+
+	NoNetworkNamespace int
 }
 
 func (o *GokrazyDaemonOptions) table() []poptOption {
@@ -202,12 +214,14 @@ func (o *GokrazyDaemonOptions) table() []poptOption {
 		{"gokr.monitoring_listen", "", POPT_ARG_STRING, &o.MonitoringListen, 0},
 		{"gokr.anonssh_listen", "", POPT_ARG_STRING, &o.AnonSSHListen, 0},
 		{"gokr.modulemap", "", POPT_ARG_STRING, &o.ModuleMap, 0},
+		{"gokr.no_network_namespace", "", POPT_ARG_NONE, &o.NoNetworkNamespace, 0},
 	}
 }
 
 type Options struct {
-	osenv *rsyncos.Env
-	table func() []poptOption
+	osenv      *rsyncos.Env
+	table      func() []poptOption
+	newOptions func(*rsyncos.Env) *Options // for MarshalArgs
 
 	GokrazyClient GokrazyClientOptions
 	GokrazyDaemon GokrazyDaemonOptions
@@ -218,6 +232,8 @@ type Options struct {
 	debug          [COUNT_DEBUG]uint16
 	local_server   int
 	filterRules    []string
+	dparams        []string
+	peer           rsyncwire.Peer // detected from the daemon greeting
 
 	// order matches long_options order
 	verbose                int
@@ -241,6 +257,7 @@ type Options struct {
 	omit_dir_times         int
 	omit_link_times        int
 	modify_window          int
+	modify_window_set      int
 	am_root                int // 0 = normal, 1 = root, 2 = --super, -1 = --fake-super
 	preserve_uid           int
 	preserve_gid           int
@@ -311,7 +328,7 @@ type Options struct {
 	batch_name           string
 	files_from           string
 	eol_nulls            int
-	old_style_args       int // intentionally set to 0; unsupported
+	old_style_args       int
 	protect_args         int // intentionally set to 0; currently unsupported
 	trust_sender         int
 	numeric_ids          int
@@ -387,8 +404,8 @@ var infoWords = [...]output{
 var debugWords = [...]output{
 	{"ACL", W_SND | W_REC, "Debug extra ACL info"},
 	{"BACKUP", W_REC, "Debug backup actions (levels 1-2)"},
-	{"CHDIR", W_CLI | W_SRV, "Debug when the current directory changes"},
 	{"BIND", W_CLI, "Debug socket bind actions"},
+	{"CHDIR", W_CLI | W_SRV, "Debug when the current directory changes"},
 	{"CONNECT", W_CLI, "Debug connection events (levels 1-2)"},
 	{"CMD", W_CLI, "Debug commands+options that are issued (levels 1-2)"},
 	{"DEL", W_REC, "Debug delete actions (levels 1-3)"},
@@ -430,8 +447,7 @@ Level:
 		all := false
 		switch trimmed {
 		case "help":
-			osenv.Logf("TODO: print --info/--debug help and exit")
-			os.Exit(0)
+			return errOutputWordsHelp
 		case "none":
 			lev = 0
 		case "all":
@@ -453,8 +469,14 @@ Level:
 	return nil
 }
 
-func (o *Options) setOutputVerbosity(prio priority) error {
-	debugVerbosity := [...]string{
+// infoVerbosity and debugVerbosity list the output words each -v adds.
+var (
+	infoVerbosity = [...]string{
+		"NONREG",
+		"COPY,DEL,FLIST,MISC,NAME,STATS,SYMSAFE",
+		"BACKUP,MISC2,MOUNT,NAME2,REMOVE,SKIP",
+	}
+	debugVerbosity = [...]string{
 		"",
 		"",
 		"BIND,CMD,CONNECT,DEL,DELTASUM,DUP,FILTER,FLIST,ICONV",
@@ -462,11 +484,56 @@ func (o *Options) setOutputVerbosity(prio priority) error {
 		"CMD2,DELTASUM3,DEL3,EXIT2,FLIST3,ICONV2,OWN2,PROTO,TIME2",
 		"CHDIR,DELTASUM4,FLIST4,FUZZY2,HASH,HLINK",
 	}
-	infoVerbosity := [...]string{
-		"NONREG",
-		"COPY,DEL,FLIST,MISC,NAME,STATS,SYMSAFE",
-		"BACKUP,MISC2,MOUNT,NAME2,REMOVE,SKIP",
+)
+
+// maxOutLevel is the highest level of any output word.
+//
+// rsync/rsync.h:MAX_OUT_LEVEL
+const maxOutLevel = 4
+
+// outputWordsHelp returns the text which --info=help (kind "INFO") or
+// --debug=help (kind "DEBUG") prints.
+//
+// rsync/options.c:output_item_help
+func outputWordsHelp(words []output, kind string, verbosity []string) string {
+	const format = "%-10s %s\n"
+	var b strings.Builder
+	b.WriteString("Use OPT or OPT1 for level 1 output, OPT2 for level 2, etc.; OPT0 silences.\n")
+	b.WriteString("\n")
+	for _, word := range words {
+		fmt.Fprintf(&b, format, word.name, word.help)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, format, "ALL", fmt.Sprintf("Set all %s options (e.g. all%d)", kind, maxOutLevel))
+	fmt.Fprintf(&b, format, "NONE", fmt.Sprintf("Silence all %s options (same as all0)", kind))
+	fmt.Fprintf(&b, format, "HELP", "Output this help message")
+	b.WriteString("\n")
+	b.WriteString("Options added at each level of verbosity:")
+	for j, added := range verbosity {
+		levels := make([]uint16, len(words))
+		if err := parseOutputWords(nil, words, levels, added, HELP_PRIORITY); err != nil {
+			panic(fmt.Sprintf("BUG: invalid verbosity words %q: %v", added, err))
+		}
+		// Like rsync/options.c:make_output_option, list the words in table
+		// order, with their level unless it is 1.
+		var opts []string
+		for i, word := range words {
+			switch levels[i] {
+			case 0:
+			case 1:
+				opts = append(opts, word.name)
+			default:
+				opts = append(opts, fmt.Sprintf("%s%d", word.name, levels[i]))
+			}
+		}
+		if len(opts) > 0 {
+			fmt.Fprintf(&b, "\n%d) %s", j, strings.Join(opts, ","))
+		}
 	}
+	return b.String()
+}
+
+func (o *Options) setOutputVerbosity(prio priority) error {
 	for j := 0; j <= o.verbose; j++ {
 		if j < len(infoVerbosity) {
 			if err := parseOutputWords(o.osenv, infoWords[:], o.info[:], infoVerbosity[j], prio); err != nil {
@@ -516,6 +583,9 @@ In addition, the following gokrazy-specific flags are supported:
                            the rsync daemon protocol via anonymous SSH
   --gokr.modulemap         <modulename>=<path> pairs for quick setup of the server,
                            without a config file
+  --gokr.no_network_namespace
+                           do not isolate writable modules from the network
+                           (when running as root on Linux)
 
 See https://github.com/gokrazy/rsync for updates, bug reports, and answers
 `
@@ -698,6 +768,11 @@ In addition, the following gokrazy-specific flags are supported:
 
   --gokr.dont_restrict     do not restrict file system access to source/dest
                            where available (e.g. with Landlock on Linux)
+  --gokr.space_check=MODE  when receiving, compare the size of the files against
+                           the free space of the destination: error (default),
+                           warn or off
+  --gokr.batch_small_files when receiving, sync files smaller than 1 MiB to
+                           disk in batches instead of one by one
 
 See https://github.com/gokrazy/rsync for updates, bug reports, and answers
 `
@@ -707,16 +782,29 @@ func (o *Options) ShellCommand() string       { return o.shell_cmd }
 func (o *Options) UpdateOnly() bool           { return o.update_only != 0 }
 func (o *Options) DryRun() bool               { return o.dry_run != 0 }
 func (o *Options) PreserveLinks() bool        { return o.preserve_links != 0 }
+func (o *Options) CopyLinks() bool            { return o.copy_links != 0 }
+func (o *Options) CopyUnsafeLinks() bool      { return o.copy_unsafe_links != 0 }
+func (o *Options) SafeLinks() bool            { return o.safe_symlinks != 0 }
+func (o *Options) MungeLinks() bool           { return o.munge_symlinks != 0 }
+func (o *Options) CopyDirlinks() bool         { return o.copy_dirlinks != 0 }
+func (o *Options) KeepDirlinks() bool         { return o.keep_dirlinks != 0 }
 func (o *Options) PreserveUid() bool          { return o.preserve_uid != 0 }
 func (o *Options) PreserveGid() bool          { return o.preserve_gid != 0 }
+func (o *Options) NumericIds() bool           { return o.numeric_ids != 0 }
 func (o *Options) PreserveDevices() bool      { return o.preserve_devices != 0 }
+func (o *Options) WriteDevices() bool         { return o.write_devices != 0 }
 func (o *Options) PreserveMTimes() bool       { return o.preserve_mtimes != 0 }
+func (o *Options) OmitLinkTimes() bool        { return o.omit_link_times != 0 }
 func (o *Options) PreservePerms() bool        { return o.preserve_perms != 0 }
 func (o *Options) PreserveSpecials() bool     { return o.preserve_specials != 0 }
 func (o *Options) PreserveHardLinks() bool    { return o.preserve_hard_links != 0 }
 func (o *Options) Recurse() bool              { return o.recurse != 0 }
 func (o *Options) Verbose() bool              { return o.verbose != 0 }
 func (o *Options) DeleteMode() bool           { return o.delete_mode != 0 }
+func (o *Options) DeleteExcluded() bool       { return o.delete_excluded != 0 }
+func (o *Options) ForceDelete() bool          { return o.force_delete != 0 }
+func (o *Options) IgnoreErrors() bool         { return o.ignore_errors != 0 }
+func (o *Options) RemoveSourceFiles() bool    { return o.remove_source_files != 0 }
 func (o *Options) Sender() bool               { return o.am_sender != 0 }
 func (o *Options) SetSender()                 { o.am_sender = 1 }
 func (o *Options) LocalServer() bool          { return o.local_server != 0 }
@@ -724,12 +812,69 @@ func (o *Options) SetLocalServer()            { o.local_server = 1 }
 func (o *Options) Server() bool               { return o.am_server != 0 }
 func (o *Options) Daemon() bool               { return o.am_daemon != 0 }
 func (o *Options) ConnectTimeoutSeconds() int { return o.connect_timeout }
+func (o *Options) IOTimeoutSeconds() int      { return o.io_timeout }
+func (o *Options) SetIOTimeoutSeconds(v int)  { o.io_timeout = v }
 func (o *Options) AlwaysChecksum() bool       { return o.always_checksum != 0 }
 func (o *Options) IgnoreTimes() bool          { return o.ignore_times != 0 }
+func (o *Options) ModifyWindow() int          { return o.modify_window }
+func (o *Options) KeepPartial() bool          { return o.keep_partial != 0 }
+func (o *Options) PartialDir() string         { return o.partial_dir }
 func (o *Options) OutputMOTD() bool           { return o.output_motd != 0 }
 func (o *Options) RsyncPort() int             { return o.rsync_port }
 func (o *Options) XferDirs() int              { return o.xfer_dirs }
 func (o *Options) FilterRules() []string      { return o.filterRules }
+func (o *Options) DParams() []string          { return o.dparams }
+func (o *Options) PasswordFile() string       { return o.password_file }
+func (o *Options) OutbufMode() string         { return o.outbuf_mode }
+func (o *Options) ProtocolVersion() int32     { return int32(o.protocol_version) }
+func (o *Options) CompressionLevel() int      { return o.do_compression_level }
+func (o *Options) SetProtocolVersion(v int32) { o.protocol_version = int(v) }
+
+// Peer returns the rsync implementation detected from the daemon greeting,
+// which (like the protocol version) is known before the transfer starts.
+func (o *Options) Peer() rsyncwire.Peer     { return o.peer }
+func (o *Options) SetPeer(p rsyncwire.Peer) { o.peer = p }
+
+// Compression returns the compression algorithm requested with --compress
+// and --compress-choice: "" if compression is off, "auto" if the algorithm is
+// to be negotiated with the peer.
+func (o *Options) Compression() string {
+	if o.do_compression == 0 {
+		return ""
+	}
+	if o.compress_choice == "" {
+		return "auto"
+	}
+	return o.compress_choice
+}
+
+// AllowIncRecurse reports whether the file list may be transferred
+// incrementally, one directory at a time. The peers only use incremental
+// recursion if both of them allow it.
+//
+// rsync/compat.c:set_allow_inc_recurse
+func (o *Options) AllowIncRecurse() bool {
+	if o.allow_inc_recurse == 0 || o.recurse == 0 || o.use_qsort != 0 {
+		return false
+	}
+	if o.am_sender == 0 &&
+		(o.delete_before != 0 || o.delete_after != 0 ||
+			o.delay_updates != 0 || o.prune_empty_dirs != 0) {
+		return false
+	}
+	return true
+}
+
+// ReceiverWantsFilterList reports whether the receiver needs the filter rules:
+// to protect excluded files from deletion, or to prune empty directories. The
+// client sends them to a receiving server, which reads them.
+//
+// rsync/exclude.c:send_filter_list (receiver_wants_list)
+func (o *Options) ReceiverWantsFilterList(protocolVersion int32) bool {
+	return o.prune_empty_dirs != 0 ||
+		(o.delete_mode != 0 && (o.delete_excluded == 0 || protocolVersion >= 29))
+}
+
 func (o *Options) Progress() bool {
 	return o.info[INFO_PROGRESS] > 0
 }
@@ -802,10 +947,10 @@ func (o *Options) gokrazyTable() []poptOption {
 		{"recursive", "r", POPT_ARG_VAL, &o.recurse, 2},
 		{"no-recursive", "", POPT_ARG_VAL, &o.recurse, 0},
 		{"no-r", "", POPT_ARG_VAL, &o.recurse, 0},
-		//{"inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
-		//{"no-inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
-		//{"i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
-		//{"no-i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
+		{"inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
+		{"no-inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
+		{"i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
+		{"no-i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
 		{"dirs", "d", POPT_ARG_VAL, &o.xfer_dirs, 2},
 		{"no-dirs", "", POPT_ARG_VAL, &o.xfer_dirs, 0},
 		{"no-d", "", POPT_ARG_VAL, &o.xfer_dirs, 0},
@@ -835,10 +980,10 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"omit-dir-times", "O", POPT_ARG_VAL, &o.omit_dir_times, 1},
 		//{"no-omit-dir-times", "", POPT_ARG_VAL, &o.omit_dir_times, 0},
 		//{"no-O", "", POPT_ARG_VAL, &o.omit_dir_times, 0},
-		//{"omit-link-times", "J", POPT_ARG_VAL, &o.omit_link_times, 1},
-		//{"no-omit-link-times", "", POPT_ARG_VAL, &o.omit_link_times, 0},
-		//{"no-J", "", POPT_ARG_VAL, &o.omit_link_times, 0},
-		//{"modify-window", "@", POPT_ARG_INT, &o.modify_window, OPT_MODIFY_WINDOW},
+		{"omit-link-times", "J", POPT_ARG_VAL, &o.omit_link_times, 1},
+		{"no-omit-link-times", "", POPT_ARG_VAL, &o.omit_link_times, 0},
+		{"no-J", "", POPT_ARG_VAL, &o.omit_link_times, 0},
+		{"modify-window", "@", POPT_ARG_INT, &o.modify_window, OPT_MODIFY_WINDOW},
 		//{"super", "", POPT_ARG_VAL, &o.am_root, 2},
 		//{"no-super", "", POPT_ARG_VAL, &o.am_root, 0},
 		//{"fake-super", "", POPT_ARG_VAL, &o.am_root, -1},
@@ -853,20 +998,20 @@ func (o *Options) gokrazyTable() []poptOption {
 		{"devices", "", POPT_ARG_VAL, &o.preserve_devices, 1},
 		{"no-devices", "", POPT_ARG_VAL, &o.preserve_devices, 0},
 		//{"copy-devices", "", POPT_ARG_NONE, &o.copy_devices, 0},
-		//{"write-devices", "", POPT_ARG_VAL, &o.write_devices, 1},
-		//{"no-write-devices", "", POPT_ARG_VAL, &o.write_devices, 0},
+		{"write-devices", "", POPT_ARG_VAL, &o.write_devices, 1},
+		{"no-write-devices", "", POPT_ARG_VAL, &o.write_devices, 0},
 		{"specials", "", POPT_ARG_VAL, &o.preserve_specials, 1},
 		{"no-specials", "", POPT_ARG_VAL, &o.preserve_specials, 0},
 		{"links", "l", POPT_ARG_VAL, &o.preserve_links, 1},
 		{"no-links", "", POPT_ARG_VAL, &o.preserve_links, 0},
 		{"no-l", "", POPT_ARG_VAL, &o.preserve_links, 0},
-		//{"copy-links", "L", POPT_ARG_NONE, &o.copy_links, 0},
-		//{"copy-unsafe-links", "", POPT_ARG_NONE, &o.copy_unsafe_links, 0},
-		//{"safe-links", "", POPT_ARG_NONE, &o.safe_symlinks, 0},
-		//{"munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 1},
-		//{"no-munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 0},
-		//{"copy-dirlinks", "k", POPT_ARG_NONE, &o.copy_dirlinks, 0},
-		//{"keep-dirlinks", "K", POPT_ARG_NONE, &o.keep_dirlinks, 0},
+		{"copy-links", "L", POPT_ARG_NONE, &o.copy_links, 0},
+		{"copy-unsafe-links", "", POPT_ARG_NONE, &o.copy_unsafe_links, 0},
+		{"safe-links", "", POPT_ARG_NONE, &o.safe_symlinks, 0},
+		{"munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 1},
+		{"no-munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 0},
+		{"copy-dirlinks", "k", POPT_ARG_NONE, &o.copy_dirlinks, 0},
+		{"keep-dirlinks", "K", POPT_ARG_NONE, &o.keep_dirlinks, 0},
 		{"hard-links", "H", POPT_ARG_NONE, nil, 'H'},
 		{"no-hard-links", "", POPT_ARG_VAL, &o.preserve_hard_links, 0},
 		{"no-H", "", POPT_ARG_VAL, &o.preserve_hard_links, 0},
@@ -908,12 +1053,12 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"delete-excluded", "", POPT_ARG_NONE, &o.delete_excluded, 0},
 		//{"delete-missing-args", "", POPT_BIT_SET, &o.missing_args, 2},
 		//{"ignore-missing-args", "", POPT_BIT_SET, &o.missing_args, 1},
-		//{"remove-sent-files", "", POPT_ARG_VAL, &o.remove_source_files, 2}, /* deprecated */
-		//{"remove-source-files", "", POPT_ARG_VAL, &o.remove_source_files, 1},
-		//{"force", "", POPT_ARG_VAL, &o.force_delete, 1},
-		//{"no-force", "", POPT_ARG_VAL, &o.force_delete, 0},
-		//{"ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 1},
-		//{"no-ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 0},
+		{"remove-sent-files", "", POPT_ARG_VAL, &o.remove_source_files, 2}, /* deprecated */
+		{"remove-source-files", "", POPT_ARG_VAL, &o.remove_source_files, 1},
+		{"force", "", POPT_ARG_VAL, &o.force_delete, 1},
+		{"no-force", "", POPT_ARG_VAL, &o.force_delete, 0},
+		{"ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 1},
+		{"no-ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 0},
 		//{"max-delete", "", POPT_ARG_INT, &o.max_delete, 0},
 		//{"", "F", POPT_ARG_NONE, nil, 'F'},
 		{"filter", "f", POPT_ARG_STRING, nil, OPT_FILTER},
@@ -941,23 +1086,25 @@ func (o *Options) gokrazyTable() []poptOption {
 		// Regarding compression support, see:
 		// https://github.com/gokrazy/rsync/issues/35#issuecomment-2988582190
 		//
-		//{"compress", "z", POPT_ARG_NONE, nil, 'z'},
-		//{"old-compress", "", POPT_ARG_NONE, nil, OPT_OLD_COMPRESS},
-		//{"new-compress", "", POPT_ARG_NONE, nil, OPT_NEW_COMPRESS},
-		//{"no-compress", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
-		//{"no-z", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
-		//{"compress-choice", "", POPT_ARG_STRING, &o.compress_choice, 0},
-		//{"zc", "", POPT_ARG_STRING, &o.compress_choice, 0},
+		// The algorithm is negotiated with the peer, see
+		// rsynccommon.NegotiateStrings and rsynccompress.Supported.
+		{"compress", "z", POPT_ARG_NONE, nil, 'z'},
+		{"old-compress", "", POPT_ARG_NONE, nil, OPT_OLD_COMPRESS},
+		{"new-compress", "", POPT_ARG_NONE, nil, OPT_NEW_COMPRESS},
+		{"no-compress", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
+		{"no-z", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
+		{"compress-choice", "", POPT_ARG_STRING, &o.compress_choice, 0},
+		{"zc", "", POPT_ARG_STRING, &o.compress_choice, 0},
 		//{"skip-compress", "", POPT_ARG_STRING, &o.skip_compress, 0},
-		//{"compress-level", "", POPT_ARG_INT, &o.do_compression_level, 0},
-		//{"zl", "", POPT_ARG_INT, &o.do_compression_level, 0},
+		{"compress-level", "", POPT_ARG_INT, &o.do_compression_level, 0},
+		{"zl", "", POPT_ARG_INT, &o.do_compression_level, 0},
 
 		//{"", "P", POPT_ARG_NONE, nil, 'P'},
 		{"progress", "", POPT_ARG_VAL, &o.do_progress, 1},
 		{"no-progress", "", POPT_ARG_VAL, &o.do_progress, 0},
-		//{"partial", "", POPT_ARG_VAL, &o.keep_partial, 1},
-		//{"no-partial", "", POPT_ARG_VAL, &o.keep_partial, 0},
-		//{"partial-dir", "", POPT_ARG_STRING, &o.partial_dir, 0},
+		{"partial", "", POPT_ARG_VAL, &o.keep_partial, 1},
+		{"no-partial", "", POPT_ARG_VAL, &o.keep_partial, 0},
+		{"partial-dir", "", POPT_ARG_STRING, &o.partial_dir, 0},
 		//{"delay-updates", "", POPT_ARG_VAL, &o.delay_updates, 1},
 		//{"no-delay-updates", "", POPT_ARG_VAL, &o.delay_updates, 0},
 		//{"prune-empty-dirs", "m", POPT_ARG_VAL, &o.prune_empty_dirs, 1},
@@ -983,21 +1130,21 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"files-from", "", POPT_ARG_STRING, &o.files_from, 0},
 		//{"from0", "0", POPT_ARG_VAL, &o.eol_nulls, 1},
 		//{"no-from0", "", POPT_ARG_VAL, &o.eol_nulls, 0},
-		//{"old-args", "", POPT_ARG_NONE, nil, OPT_OLD_ARGS},
-		//{"no-old-args", "", POPT_ARG_VAL, &o.old_style_args, 0},
+		{"old-args", "", POPT_ARG_NONE, nil, OPT_OLD_ARGS},
+		{"no-old-args", "", POPT_ARG_VAL, &o.old_style_args, 0},
 		//{"secluded-args", "s", POPT_ARG_VAL, &o.protect_args, 1},
 		//{"no-secluded-args", "", POPT_ARG_VAL, &o.protect_args, 0},
 		//{"protect-args", "", POPT_ARG_VAL, &o.protect_args, 1},
 		//{"no-protect-args", "", POPT_ARG_VAL, &o.protect_args, 0},
 		//{"no-s", "", POPT_ARG_VAL, &o.protect_args, 0},
 		//{"trust-sender", "", POPT_ARG_VAL, &o.trust_sender, 1},
-		//{"numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 1},
-		//{"no-numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 0},
+		{"numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 1},
+		{"no-numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 0},
 		//{"usermap", "", POPT_ARG_STRING, nil, OPT_USERMAP},
 		//{"groupmap", "", POPT_ARG_STRING, nil, OPT_GROUPMAP},
 		//{"chown", "", POPT_ARG_STRING, nil, OPT_CHOWN},
-		//{"timeout", "", POPT_ARG_INT, &o.io_timeout, 0},
-		//{"no-timeout", "", POPT_ARG_VAL, &o.io_timeout, 0},
+		{"timeout", "", POPT_ARG_INT, &o.io_timeout, 0},
+		{"no-timeout", "", POPT_ARG_VAL, &o.io_timeout, 0},
 		{"contimeout", "", POPT_ARG_INT, &o.connect_timeout, 0},
 		{"no-contimeout", "", POPT_ARG_VAL, &o.connect_timeout, 0},
 		//{"fsync", "", POPT_ARG_NONE, &o.do_fsync, 0},
@@ -1021,13 +1168,13 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"address", "", POPT_ARG_STRING, &o.bind_address, 0},
 		{"port", "", POPT_ARG_INT, &o.rsync_port, 0},
 		//{"sockopts", "", POPT_ARG_STRING, &o.sockopts, 0},
-		//{"password-file", "", POPT_ARG_STRING, &o.password_file, 0},
+		{"password-file", "", POPT_ARG_STRING, &o.password_file, 0},
 		//{"early-input", "", POPT_ARG_STRING, &o.early_input_file, 0},
 		//{"blocking-io", "", POPT_ARG_VAL, &o.blocking_io, 1},
 		//{"no-blocking-io", "", POPT_ARG_VAL, &o.blocking_io, 0},
-		//{"outbuf", "", POPT_ARG_STRING, &o.outbuf_mode, 0},
+		{"outbuf", "", POPT_ARG_STRING, &o.outbuf_mode, 0},
 		//{"remote-option", "M", POPT_ARG_STRING, nil, 'M'},
-		//{"protocol", "", POPT_ARG_INT, &o.protocol_version, 0},
+		{"protocol", "", POPT_ARG_INT, &o.protocol_version, 0},
 		//{"checksum-seed", "", POPT_ARG_INT, &o.checksum_seed, 0},
 		{"server", "", POPT_ARG_NONE, nil, OPT_SERVER},
 		{"sender", "", POPT_ARG_NONE, nil, OPT_SENDER},
@@ -1300,6 +1447,50 @@ func (o *Options) tridgeTable() []poptOption {
 
 var errNotYetImplemented = errors.New("option not yet implemented in gokrazy/rsync")
 
+func (pc *Context) notYetImplemented() error {
+	return pc.poptError(GOKR_ERROR_NOTIMPLEMENTED, fmt.Errorf("%s: %w", pc.lastOpt, errNotYetImplemented))
+}
+
+// errOutputWordsHelp is returned by parseOutputWords for --info=help and
+// --debug=help, which print outputWordsHelp instead.
+var errOutputWordsHelp = errors.New("output words help requested")
+
+// ParseMode controls what ParseArguments does when an option like --help or
+// --version asks for a text to be printed instead of a transfer.
+type ParseMode int
+
+const (
+	// ParseModeExecutable prints the text to stdout and exits the process
+	// with code 0, for compatibility with tridge rsync.
+	ParseModeExecutable ParseMode = iota
+
+	// ParseModeLibrary makes ParseArguments return a *HelpRequested error
+	// carrying the text, leaving it to the caller to display it.
+	ParseModeLibrary
+)
+
+// HelpRequested is returned by ParseArguments in ParseModeLibrary when the
+// arguments ask for help or version information.
+type HelpRequested struct {
+	// Text is what tridge rsync would print to stdout.
+	Text string
+}
+
+func (hr *HelpRequested) Error() string {
+	return "help requested"
+}
+
+// helpRequested prints text and exits (ParseModeExecutable) or returns a
+// *HelpRequested error (ParseModeLibrary).
+func helpRequested(mode ParseMode, text string) error {
+	if mode == ParseModeLibrary {
+		return &HelpRequested{Text: text}
+	}
+	fmt.Println(text) // tridge rsync prints help to stdout
+	os.Exit(0)        // exit with code 0 for compatibility with tridge rsync
+	return nil
+}
+
 func NewContext(opts *Options) *Context {
 	table := opts.table()
 	table = slices.Concat(opts.GokrazyClient.table(), table)
@@ -1309,8 +1500,12 @@ func NewContext(opts *Options) *Context {
 	}
 }
 
+// ParseArguments parses the command-line arguments args (without the program
+// name) into pc.Options and pc.RemainingArgs. See ParseMode for how --help and
+// --version are handled. Invalid command lines result in a *PoptError.
+//
 // rsync/options.c:parse_arguments
-func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
+func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string, mode ParseMode) error {
 	// NOTE: We do not implement support for refusing options per rsyncd.conf
 	// here, as we have our own configuration file.
 
@@ -1338,7 +1533,7 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 
 		case OPT_SENDER:
 			if opts.am_server == 0 {
-				return fmt.Errorf("--sender only allowed with --server")
+				return pc.poptError(POPT_ERROR_BADOPERATION, fmt.Errorf("--sender only allowed with --server"))
 			}
 			opts.am_sender = 1
 
@@ -1347,9 +1542,10 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			table := opts.daemonTable()
 			table = slices.Concat(opts.GokrazyDaemon.table(), table)
 			pc := Context{
-				Options: opts,
-				table:   table,
-				args:    args,
+				Options:    opts,
+				table:      table,
+				args:       args,
+				daemonMode: true,
 			}
 
 			for {
@@ -1365,16 +1561,19 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 				// are returned and handled here.
 				switch opt {
 				case 'h':
-					fmt.Println(opts.DaemonHelp()) // tridge rsync prints help to stdout
-					os.Exit(0)                     // exit with code 0 for compatibility with tridge rsync
+					return helpRequested(mode, opts.DaemonHelp())
 				case 'M':
-					return errNotYetImplemented
+					arg := pc.poptGetOptArg()
+					if !strings.Contains(arg, "=") {
+						return pc.poptError(GOKR_ERROR_BADVALUE, fmt.Errorf("--dparam value is missing an '=': %s", arg))
+					}
+					opts.dparams = append(opts.dparams, arg)
 
 				case 'v':
 					opts.verbose++
 
 				default:
-					return fmt.Errorf("unhandled special case opt: %v", opt)
+					return pc.poptError(POPT_ERROR_BADOPT, fmt.Errorf("unhandled special case opt: %v", opt))
 				}
 			}
 
@@ -1391,7 +1590,7 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 
 		case OPT_INCLUDE_FROM,
 			OPT_EXCLUDE_FROM:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case 'a':
 			if opts.recurse == 0 {
@@ -1432,7 +1631,7 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			opts.verbose++
 
 		case 'y':
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case 'q':
 			opts.quiet++
@@ -1441,7 +1640,7 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			opts.one_file_system++
 
 		case 'F':
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case 'P':
 			opts.do_progress = 1
@@ -1461,52 +1660,72 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			opts.compress_choice = ""
 
 		case OPT_OLD_ARGS:
-			return errNotYetImplemented
+			if opts.old_style_args <= 0 {
+				opts.old_style_args = 1
+			} else {
+				opts.old_style_args++
+			}
 
 		case 'M': // --remote-option
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_WRITE_BATCH,
 			OPT_ONLY_WRITE_BATCH,
 			OPT_READ_BATCH:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_BLOCK_SIZE:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
+
+		case OPT_MODIFY_WINDOW:
+			// The value has already been set by popt, but we need to
+			// remember that we’re using a non-default setting.
+			opts.modify_window_set = 1
 
 		case OPT_MAX_SIZE, // (needs parse_size_arg)
 			OPT_MIN_SIZE,
 			OPT_BWLIMIT:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_APPEND:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_LINK_DEST,
 			OPT_COPY_DEST,
 			OPT_COMPARE_DEST:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_CHMOD: // (needs parse_chmod):
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_INFO:
-			parseOutputWords(osenv, infoWords[:], opts.info[:], pc.poptGetOptArg(), USER_PRIORITY)
+			err := parseOutputWords(osenv, infoWords[:], opts.info[:], pc.poptGetOptArg(), USER_PRIORITY)
+			if err == errOutputWordsHelp {
+				return helpRequested(mode, outputWordsHelp(infoWords[:], "INFO", infoVerbosity[:]))
+			}
+			if err != nil {
+				return pc.poptError(GOKR_ERROR_BADVALUE, err)
+			}
 
 		case OPT_DEBUG:
-			parseOutputWords(osenv, debugWords[:], opts.debug[:], pc.poptGetOptArg(), USER_PRIORITY)
+			err := parseOutputWords(osenv, debugWords[:], opts.debug[:], pc.poptGetOptArg(), USER_PRIORITY)
+			if err == errOutputWordsHelp {
+				return helpRequested(mode, outputWordsHelp(debugWords[:], "DEBUG", debugVerbosity[:]))
+			}
+			if err != nil {
+				return pc.poptError(GOKR_ERROR_BADVALUE, err)
+			}
 
 		case OPT_USERMAP,
 			OPT_GROUPMAP,
 			OPT_CHOWN:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		case OPT_HELP:
-			fmt.Println(opts.Help()) // tridge rsync prints help to stdout
-			os.Exit(0)               // exit with code 0 for compatibility with tridge rsync
+			return helpRequested(mode, opts.Help())
 
 		case 'A':
-			return fmt.Errorf("ACLs are not supported by gokrazy/rsync")
+			return pc.poptError(GOKR_ERROR_NOTIMPLEMENTED, fmt.Errorf("ACLs are not supported by gokrazy/rsync"))
 
 		case 'X':
 			opts.preserve_xattrs++
@@ -1514,10 +1733,10 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 		case OPT_STOP_AFTER,
 			OPT_STOP_AT,
 			OPT_STDERR:
-			return errNotYetImplemented
+			return pc.notYetImplemented()
 
 		default:
-			return fmt.Errorf("unhandled special case opt: %v", opt)
+			return pc.poptError(POPT_ERROR_BADOPT, fmt.Errorf("unhandled special case opt: %v", opt))
 		}
 	}
 
@@ -1525,19 +1744,15 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 	// other options
 
 	if version_opt_cnt > 0 {
-		fmt.Println(version.Read())
-		os.Exit(0)
+		return helpRequested(mode, version.Read())
 	}
 
 	if opts.human_readable > 1 && len(args) == 1 /* && !am_server */ {
-		fmt.Println(opts.Help()) // tridge rsync prints help to stdout
-		os.Exit(0)               // exit with code 0 for compatibility with tridge rsync
+		return helpRequested(mode, opts.Help())
 	}
 
 	if err := opts.setOutputVerbosity(DEFAULT_PRIORITY); err != nil {
-		// TODO: plumb error
-		fmt.Println(err.Error())
-		os.Exit(1)
+		return &PoptError{Errno: GOKR_ERROR_BADVALUE, Err: err}
 	}
 
 	if opts.recurse != 0 {
@@ -1551,6 +1766,24 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 		}
 	}
 
+	if opts.old_style_args < 0 {
+		if arg := osenv.Getenv("RSYNC_OLD_ARGS"); opts.am_server == 0 && opts.protect_args <= 0 && arg != "" {
+			opts.protect_args = 0
+			opts.old_style_args, _ = strconv.Atoi(arg)
+		} else {
+			opts.old_style_args = 0
+		}
+	} else if opts.old_style_args != 0 {
+		if opts.protect_args > 0 {
+			return &PoptError{
+				Errno: POPT_ERROR_BADOPERATION,
+				Opt:   "--old-args",
+				Err:   fmt.Errorf("--secluded-args conflicts with --old-args"),
+			}
+		}
+		opts.protect_args = 0
+	}
+
 	if opts.relative_paths < 0 {
 		if opts.files_from != "" {
 			opts.relative_paths = 1
@@ -1571,6 +1804,42 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 		opts.missing_args = 2
 	}
 
+	// --partial-dir implies --partial, unless it names the current directory.
+	//
+	// rsync/options.c:parse_arguments
+	if opts.partial_dir != "" {
+		opts.partial_dir = filepath.Clean(opts.partial_dir)
+		if opts.partial_dir == "." {
+			opts.partial_dir = ""
+		} else {
+			opts.keep_partial = 1
+		}
+	}
+
+	// rsync/options.c:parse_arguments and rsync/compat.c:parse_compress_choice
+	if opts.compress_choice == "" && opts.do_compression > 1 {
+		opts.compress_choice = rsynccompress.Zlibx // -zz
+	}
+	if opts.compress_choice == "auto" {
+		opts.compress_choice = ""
+	}
+	if opts.compress_choice != "" {
+		if !rsynccompress.Valid(opts.compress_choice) {
+			return &PoptError{
+				Errno: GOKR_ERROR_BADVALUE,
+				Opt:   "--compress-choice",
+				Err:   fmt.Errorf("invalid compress choice: %s", opts.compress_choice),
+			}
+		}
+		// --compress-choice implies --compress, unless it disables it.
+		if opts.compress_choice == rsynccompress.None {
+			opts.do_compression = 0
+			opts.compress_choice = ""
+		} else {
+			opts.do_compression = 1
+		}
+	}
+
 	if opts.backup_suffix == "" && opts.backup_dir == "" {
 		opts.backup_suffix = "~"
 	}
@@ -7,8 +7,10 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncostest"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 // See testdata/_tridge_rsync_dump_table.patch for the corresponding
@@ -62,7 +64,7 @@ func discardKnownDifferences(lines []string) []string {
 		// TODO: document why ipv4/ipv6 have different values
 		ignore := strings.HasPrefix(line, "long=ipv4 ") ||
 			strings.HasPrefix(line, "long=ipv6 ") ||
-			// We implement protocol version 27 currently,
+			// We implement protocol version 31 currently,
 			// tridge rsync implements newer versions.
 			strings.HasPrefix(line, "long=protocol ") ||
 			// gokrazy-specific flags
@@ -155,7 +157,7 @@ func TestParseArguments(t *testing.T) {
 
 			osenv := rsyncostest.New(t)
 			pc := NewContext(NewOptions(osenv))
-			if err := pc.ParseArguments(osenv, tt.args); err != nil {
+			if err := pc.ParseArguments(osenv, tt.args, ParseModeLibrary); err != nil {
 				t.Fatalf("ParseArguments: %v", err)
 			}
 
@@ -174,33 +176,92 @@ func TestParseArgumentsError(t *testing.T) {
 	for _, tt := range []struct {
 		args        []string
 		want        int32
+		wantOpt     string
 		wantMessage string
 	}{
 		{
-			args: []string{"--delete=thoroughly"},
-			want: POPT_ERROR_UNWANTEDARG,
+			args:    []string{"--delete=thoroughly"},
+			want:    POPT_ERROR_UNWANTEDARG,
+			wantOpt: "--delete",
 		},
 		{
 			args:        []string{"--does-not-exist"},
 			want:        POPT_ERROR_BADOPT,
+			wantOpt:     "--does-not-exist",
 			wantMessage: "--does-not-exist: unknown option",
 		},
 		{
 			args:        []string{"-Q"},
 			want:        POPT_ERROR_BADOPT,
+			wantOpt:     "-Q",
 			wantMessage: "-Q: unknown option",
 		},
+		{
+			args:    []string{"-av", "--rsh"},
+			want:    POPT_ERROR_NOARG,
+			wantOpt: "--rsh",
+		},
+		{
+			args:        []string{"--port=ssh"},
+			want:        POPT_ERROR_BADNUMBER,
+			wantOpt:     "--port",
+			wantMessage: "invalid numeric value",
+		},
+		{
+			args:    []string{"--port=99999999999"},
+			want:    POPT_ERROR_OVERFLOW,
+			wantOpt: "--port",
+		},
+		{
+			args:    []string{"--sender"},
+			want:    POPT_ERROR_BADOPERATION,
+			wantOpt: "--sender",
+		},
+		{
+			args:    []string{"--compress-choice=lzma"},
+			want:    GOKR_ERROR_BADVALUE,
+			wantOpt: "--compress-choice",
+		},
+		{
+			args:        []string{"--info=colors"},
+			want:        GOKR_ERROR_BADVALUE,
+			wantOpt:     "--info",
+			wantMessage: "colors",
+		},
+		{
+			args:        []string{"--daemon", "--dparam=motd"},
+			want:        GOKR_ERROR_BADVALUE,
+			wantOpt:     "--dparam",
+			wantMessage: "(in daemon mode)",
+		},
+		{
+			args:    []string{"-A"},
+			want:    GOKR_ERROR_NOTIMPLEMENTED,
+			wantOpt: "--acls",
+		},
+		{
+			args:        []string{"--chmod=u+x"},
+			want:        GOKR_ERROR_NOTIMPLEMENTED,
+			wantOpt:     "--chmod",
+			wantMessage: "--chmod: option not yet implemented",
+		},
 	} {
 		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
 			osenv := rsyncostest.New(t)
 			pc := NewContext(NewOptions(osenv))
-			err := pc.ParseArguments(osenv, tt.args)
+			err := pc.ParseArguments(osenv, tt.args, ParseModeLibrary)
 			if err == nil {
 				t.Fatalf("ParseArguments unexpectedly did not fail!")
 			}
-			got := err.(*PoptError).Errno
-			if got != tt.want {
-				t.Errorf("unexpected error: got %q, want %q", got, tt.want)
+			pe, ok := err.(*PoptError)
+			if !ok {
+				t.Fatalf("ParseArguments = %v (%T), want *PoptError", err, err)
+			}
+			if pe.Errno != tt.want {
+				t.Errorf("unexpected error: got %d, want %d", pe.Errno, tt.want)
+			}
+			if pe.Opt != tt.wantOpt {
+				t.Errorf("unexpected option: got %q, want %q", pe.Opt, tt.wantOpt)
 			}
 			if tt.wantMessage != "" && !strings.Contains(err.Error(), tt.wantMessage) {
 				t.Errorf("unexpected error: got %q, want something containing %q", err.Error(), tt.wantMessage)
@@ -209,6 +270,80 @@ func TestParseArgumentsError(t *testing.T) {
 	}
 }
 
+func TestParseArgumentsHelpRequested(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		wantText string
+	}{
+		{args: []string{"--help"}, wantText: "--archive"},
+		{args: []string{"-h"}, wantText: "--archive"}, // -h alone means --help
+		{args: []string{"--version"}, wantText: "rsync"},
+		{args: []string{"--daemon", "--help"}, wantText: "--config"},
+		{args: []string{"--info=help"}, wantText: "SYMSAFE    Mention symlinks that are unsafe"},
+		{args: []string{"--debug=help"}, wantText: "5) CHDIR,DELTASUM4,FLIST4,FUZZY2,HASH,HLINK"},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := NewContext(NewOptions(osenv))
+			err := pc.ParseArguments(osenv, tt.args, ParseModeLibrary)
+			hr, ok := err.(*HelpRequested)
+			if !ok {
+				t.Fatalf("ParseArguments = %v, want *HelpRequested", err)
+			}
+			if !strings.Contains(hr.Text, tt.wantText) {
+				t.Errorf("help text %q does not contain %q", hr.Text, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestOutputWordsHelp(t *testing.T) {
+	got := outputWordsHelp(infoWords[:], "INFO", infoVerbosity[:])
+	// as printed by rsync/options.c:output_item_help
+	want := `Use OPT or OPT1 for level 1 output, OPT2 for level 2, etc.; OPT0 silences.
+
+BACKUP     Mention files backed up
+COPY       Mention files copied locally on the receiving side
+DEL        Mention deletions on the receiving side
+FLIST      Mention file-list receiving/sending (levels 1-2)
+MISC       Mention miscellaneous information (levels 1-2)
+MOUNT      Mention mounts that were found or skipped
+NAME       Mention 1) updated file/dir names, 2) unchanged names
+NONREG     Mention skipped non-regular files (default 1, 0 disables)
+PROGRESS   Mention 1) per-file progress or 2) total transfer progress
+REMOVE     Mention files removed on the sending side
+SKIP       Mention files skipped due to transfer overrides (levels 1-2)
+STATS      Mention statistics at end of run (levels 1-3)
+SYMSAFE    Mention symlinks that are unsafe
+
+ALL        Set all INFO options (e.g. all4)
+NONE       Silence all INFO options (same as all0)
+HELP       Output this help message
+
+Options added at each level of verbosity:
+0) NONREG
+1) COPY,DEL,FLIST,MISC,NAME,STATS,SYMSAFE
+2) BACKUP,MISC2,MOUNT,NAME2,REMOVE,SKIP`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("--info=help: unexpected output: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDebugWordLevels(t *testing.T) {
+	osenv := rsyncostest.New(t)
+	pc := NewContext(NewOptions(osenv))
+	if err := pc.ParseArguments(osenv, []string{"--debug=bind,chdir2"}, ParseModeLibrary); err != nil {
+		t.Fatal(err)
+	}
+	opts := pc.Options
+	if !opts.DebugGTE(DEBUG_BIND, 1) || opts.DebugGTE(DEBUG_BIND, 2) {
+		t.Errorf("--debug=bind did not set DEBUG_BIND to 1")
+	}
+	if !opts.DebugGTE(DEBUG_CHDIR, 2) {
+		t.Errorf("--debug=chdir2 did not set DEBUG_CHDIR to 2")
+	}
+}
+
 func TestParseArgumentsRemaining(t *testing.T) {
 	for _, tt := range []struct {
 		args []string
@@ -218,11 +353,27 @@ func TestParseArgumentsRemaining(t *testing.T) {
 			args: []string{"-aH", "-e", "./rsync.test", "localhost:/tmp/src/", "/tmp/dst"},
 			want: []string{"localhost:/tmp/src/", "/tmp/dst"},
 		},
+		{
+			args: []string{"-ave./rsync.test", "--exclude", "*.o", "--filter=- /build", "src/"},
+			want: []string{"src/"},
+		},
+		{
+			args: []string{"-av", "-rsh", "ssh", "--port=2222", "-T", "/tmp", "host::module/", "-", "dst"},
+			want: []string{"host::module/", "-", "dst"},
+		},
+		{
+			args: []string{"--server", "--sender", "-logDtpre.iLsfxCIvu", ".", "src/"},
+			want: []string{".", "src/"},
+		},
 	} {
 		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
 			osenv := rsyncostest.New(t)
 			pc := NewContext(NewOptions(osenv))
-			if err := pc.ParseArguments(osenv, tt.args); err != nil {
+			peeked := pc.PeekRemainingArgs(tt.args)
+			if diff := cmp.Diff(tt.want, peeked); diff != "" {
+				t.Errorf("PeekRemainingArgs: unexpected diff (-want +got):\n%s", diff)
+			}
+			if err := pc.ParseArguments(osenv, tt.args, ParseModeLibrary); err != nil {
 				t.Fatalf("ParseArguments: %v", err)
 			}
 			got := pc.RemainingArgs
@@ -232,3 +383,212 @@ func TestParseArgumentsRemaining(t *testing.T) {
 		})
 	}
 }
+
+func TestCompression(t *testing.T) {
+	for _, tt := range []struct {
+		args       []string
+		want       string
+		wantServer []string
+	}{
+		{
+			args: []string{"-r"},
+			want: "",
+		},
+		{
+			args:       []string{"-z"},
+			want:       "auto",
+			wantServer: []string{"-rz"},
+		},
+		{
+			args:       []string{"-zz"},
+			want:       "zlibx",
+			wantServer: []string{"-rz", "--new-compress"},
+		},
+		{
+			args:       []string{"--new-compress"},
+			want:       "zlibx",
+			wantServer: []string{"-rz", "--new-compress"},
+		},
+		{
+			args:       []string{"--old-compress"},
+			want:       "zlib",
+			wantServer: []string{"-rz", "--old-compress"},
+		},
+		{
+			args: []string{"--zc=auto"},
+			want: "",
+		},
+		{
+			args:       []string{"-z", "--zc=auto", "--zl=3"},
+			want:       "auto",
+			wantServer: []string{"-rz", "--compress-level=3"},
+		},
+		{
+			args:       []string{"--compress-choice=zstd"},
+			want:       "zstd",
+			wantServer: []string{"-rz", "--compress-choice=zstd"},
+		},
+		{
+			args: []string{"-z", "--compress-choice=none"},
+			want: "",
+		},
+		{
+			args: []string{"-z", "--no-compress"},
+			want: "",
+		},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := NewContext(NewOptionsWithGokrazyDefaults(osenv))
+			if err := pc.ParseArguments(osenv, append([]string{"-r"}, tt.args...), ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			opts := pc.Options
+			if got := opts.Compression(); got != tt.want {
+				t.Errorf("Compression() = %q, want %q", got, tt.want)
+			}
+			sargv := strings.Join(opts.ServerOptions(), " ")
+			for _, want := range tt.wantServer {
+				if !strings.Contains(sargv, want) {
+					t.Errorf("ServerOptions() = %q, want it to contain %q", sargv, want)
+				}
+			}
+		})
+	}
+
+	osenv := rsyncostest.New(t)
+	pc := NewContext(NewOptionsWithGokrazyDefaults(osenv))
+	if err := pc.ParseArguments(osenv, []string{"--zc=brotli"}, ParseModeLibrary); err == nil {
+		t.Errorf("ParseArguments(--zc=brotli) unexpectedly succeeded")
+	}
+}
+
+func TestSafeArg(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		env  string // RSYNC_OLD_ARGS
+		opt  string
+		arg  string
+		want string
+	}{
+		{arg: "dir/file", want: "dir/file"},
+		{arg: "my file's name", want: `my\ file\'s\ name`},
+		{arg: "*.txt", want: "*.txt"},
+		{arg: `\*.txt`, want: `\*.txt`},
+		{arg: "-file", want: "./-file"},
+		{arg: "~/file", want: "~/file"},
+		{arg: "~file", want: `\~file`},
+		{opt: "--backup-dir", arg: "a*b c", want: `--backup-dir=a\*b\ c`},
+		{args: []string{"--old-args"}, arg: "my file", want: "my file"},
+		{args: []string{"--old-args"}, arg: "-file", want: "./-file"},
+		{args: []string{"--old-args"}, opt: "--backup-dir", arg: "a b", want: `--backup-dir=a\ b`},
+		{args: []string{"--old-args", "--old-args"}, opt: "--backup-dir", arg: "a b", want: "--backup-dir=a b"},
+		{args: []string{"--old-args", "--no-old-args"}, arg: "my file", want: `my\ file`},
+		{env: "1", arg: "my file", want: "my file"},
+		{env: "1", args: []string{"--no-old-args"}, arg: "my file", want: `my\ file`},
+	} {
+		t.Run(fmt.Sprintf("%s %s=%s", strings.Join(tt.args, " "), tt.opt, tt.arg), func(t *testing.T) {
+			osenv := rsyncos.WithEnvironment(map[string]string{
+				"RSYNC_OLD_ARGS": tt.env,
+			}, rsyncostest.New(t))
+			pc := NewContext(NewOptionsWithGokrazyDefaults(osenv))
+			if err := pc.ParseArguments(osenv, tt.args, ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			if got := pc.Options.SafeArg(tt.opt, tt.arg); got != tt.want {
+				t.Errorf("SafeArg(%q, %q) = %q, want %q", tt.opt, tt.arg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSizeArg(t *testing.T) {
+	for _, tt := range []struct {
+		arg       string
+		defSuffix byte
+		want      int64
+	}{
+		{arg: "100", defSuffix: 'K', want: 100 * 1024},
+		{arg: "100", defSuffix: 'B', want: 100},
+		{arg: "1.5m", defSuffix: 'K', want: 1536 * 1024},
+		{arg: "10KB", defSuffix: 'K', want: 10000},
+		{arg: "1GiB", defSuffix: 'K', want: 1 << 30},
+		{arg: "1g-1", defSuffix: 'K', want: 1<<30 - 1},
+		{arg: "1kb+1", defSuffix: 'K', want: 1001},
+		{arg: "0", defSuffix: 'K', want: 0},
+	} {
+		got, err := ParseSizeArg(tt.arg, tt.defSuffix)
+		if err != nil {
+			t.Errorf("ParseSizeArg(%q): %v", tt.arg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSizeArg(%q) = %d, want %d", tt.arg, got, tt.want)
+		}
+	}
+
+	for _, arg := range []string{"", "k", "1x", "1kx", "1+2", "1.2.3"} {
+		if _, err := ParseSizeArg(arg, 'K'); err == nil {
+			t.Errorf("ParseSizeArg(%q) unexpectedly succeeded", arg)
+		}
+	}
+}
+
+func TestMarshalArgs(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		newOptions func(*rsyncos.Env) *Options
+		args       []string
+	}{
+		{name: "defaults", newOptions: NewOptions},
+		{name: "archive", newOptions: NewOptions, args: []string{"-av", "--delete", "--no-perms"}},
+		{name: "recursive", newOptions: NewOptions, args: []string{"-rlt", "-vv", "--no-human-readable"}},
+		{
+			name:       "server",
+			newOptions: NewOptions,
+			args:       []string{"--server", "--sender", "-logDtpre.iLsfxCIvu", "--ignore-missing-args", "--delete-missing-args"},
+		},
+		{
+			name:       "values",
+			newOptions: NewOptions,
+			args: []string{
+				"--zc=zstd",
+				"--protocol=29",
+				"--modify-window=0",
+				"--exclude=*.o",
+				"--include", "keep/",
+				"--filter=- /build",
+				"--rsync-path", "",
+				"--info=stats2,del",
+				"--progress",
+				"--gokr.dont_restrict",
+			},
+		},
+		{name: "gokrazy", newOptions: NewOptionsWithGokrazyDefaults, args: []string{"-a", "--checksum", "-zz"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			parse := func(args []string) *Options {
+				t.Helper()
+				pc := NewContext(tt.newOptions(osenv))
+				if err := pc.ParseArguments(osenv, args, ParseModeLibrary); err != nil {
+					t.Fatalf("ParseArguments(%q): %v", args, err)
+				}
+				return pc.Options
+			}
+			want := parse(tt.args)
+			args, err := want.MarshalArgs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := parse(args)
+			opts := []cmp.Option{
+				cmp.AllowUnexported(Options{}),
+				cmpopts.IgnoreFields(Options{}, "osenv", "table", "newOptions"),
+			}
+			if diff := cmp.Diff(want, got, opts...); diff != "" {
+				t.Errorf("MarshalArgs() = %q, which parses differently: diff (-want +got):\n%s", args, diff)
+			}
+		})
+	}
+}
@@ -1,5 +1,14 @@
 package rsyncopts
 
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
+)
+
 func (o *Options) CommandOptions(path string, paths ...string) []string {
 	return append(o.ServerOptions(), append([]string{".", path}, paths...)...)
 }
@@ -43,8 +52,15 @@ func (o *Options) ServerOptions() []string {
 	if o.PreserveLinks() {
 		argstr += "l"
 	}
-	// if (copy_links)
-	// 	argstr[x++] = 'L';
+	if o.CopyLinks() {
+		argstr += "L"
+	}
+	if o.CopyDirlinks() && !o.Sender() {
+		argstr += "k"
+	}
+	if o.KeepDirlinks() && o.Sender() {
+		argstr += "K"
+	}
 
 	// if (whole_file > 0)
 	// 	argstr[x++] = 'W';
@@ -52,8 +68,9 @@ func (o *Options) ServerOptions() []string {
 	//  * default for remote transfers, and in any case old versions
 	//  * of rsync will not understand it. */
 
-	// if (preserve_hard_links)
-	// 	argstr[x++] = 'H';
+	if o.PreserveHardLinks() {
+		argstr += "H"
+	}
 	if o.PreserveUid() {
 		argstr += "o"
 	}
@@ -66,6 +83,11 @@ func (o *Options) ServerOptions() []string {
 	if o.PreserveMTimes() {
 		argstr += "t"
 	}
+	// if (omit_dir_times)
+	// 	argstr[x++] = 'O';
+	if o.OmitLinkTimes() {
+		argstr += "J"
+	}
 	if o.PreservePerms() {
 		argstr += "p"
 	}
@@ -86,8 +108,9 @@ func (o *Options) ServerOptions() []string {
 	// 	argstr[x++] = 'x';
 	// if (sparse_files)
 	// 	argstr[x++] = 'S';
-	// if (do_compression)
-	// 	argstr[x++] = 'z';
+	if o.do_compression != 0 {
+		argstr += "z"
+	}
 
 	// /* this is a complete hack - blame Rusty
 
@@ -96,6 +119,12 @@ func (o *Options) ServerOptions() []string {
 	// if (list_only && !recurse)
 	// 	argstr[x++] = 'r';
 
+	if o.protocol_version >= 30 {
+		// The “client info” is transmitted as the argument of -e, which
+		// only rsh connections use otherwise.
+		argstr += "e" + rsynccommon.ClientInfo(o.AllowIncRecurse())
+	}
+
 	// argstr[x] = 0;
 
 	if argstr != "-" {
@@ -121,11 +150,27 @@ func (o *Options) ServerOptions() []string {
 	// 	args[ac++] = arg;
 	// }
 
-	// if (io_timeout) {
-	// 	if (asprintf(&arg, "--timeout=%d", io_timeout) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.do_compression != 0 && o.do_compression_level != math.MinInt32 {
+		sargv = append(sargv, fmt.Sprintf("--compress-level=%d", o.do_compression_level))
+	}
+
+	// Older rsync versions (3.1.x) only understand --new-compress and
+	// --old-compress, so prefer those where possible.
+	if o.do_compression != 0 {
+		switch o.compress_choice {
+		case "":
+		case rsynccompress.Zlibx:
+			sargv = append(sargv, "--new-compress")
+		case rsynccompress.Zlib:
+			sargv = append(sargv, "--old-compress")
+		default:
+			sargv = append(sargv, "--compress-choice="+o.compress_choice)
+		}
+	}
+
+	if o.io_timeout != 0 {
+		sargv = append(sargv, fmt.Sprintf("--timeout=%d", o.io_timeout))
+	}
 
 	// if (bwlimit) {
 	// 	if (asprintf(&arg, "--bwlimit=%d", bwlimit) < 0)
@@ -150,36 +195,58 @@ func (o *Options) ServerOptions() []string {
 	// 	args[ac++] = "--delete-excluded";
 	// else if (delete_mode)
 	// 	args[ac++] = "--delete";
+	if o.Sender() && o.delete_mode != 0 {
+		// Only the receiver deletes files.
+		sargv = append(sargv, "--delete")
+	}
 
 	// if (size_only)
 	// 	args[ac++] = "--size-only";
 
-	// if (modify_window_set) {
-	// 	if (asprintf(&arg, "--modify-window=%d", modify_window) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.remove_source_files == 1 {
+		sargv = append(sargv, "--remove-source-files")
+	} else if o.remove_source_files != 0 {
+		sargv = append(sargv, "--remove-sent-files")
+	}
 
-	// if (keep_partial)
-	// 	args[ac++] = "--partial";
+	if o.modify_window_set != 0 {
+		sargv = append(sargv, fmt.Sprintf("--modify-window=%d", o.modify_window))
+	}
+
+	if o.partial_dir != "" && o.Sender() {
+		sargv = append(sargv, "--partial-dir", o.partial_dir)
+	} else if o.keep_partial != 0 && o.Sender() {
+		sargv = append(sargv, "--partial")
+	}
 
-	// if (force_delete)
-	// 	args[ac++] = "--force";
+	if o.force_delete != 0 {
+		sargv = append(sargv, "--force")
+	}
 
 	// if (delete_after)
 	// 	args[ac++] = "--delete-after";
 
-	// if (ignore_errors)
-	// 	args[ac++] = "--ignore-errors";
+	if o.ignore_errors != 0 {
+		sargv = append(sargv, "--ignore-errors")
+	}
 
 	// if (copy_unsafe_links)
 	// 	args[ac++] = "--copy-unsafe-links";
+	if o.copy_unsafe_links != 0 {
+		sargv = append(sargv, "--copy-unsafe-links")
+	}
 
 	// if (safe_symlinks)
 	// 	args[ac++] = "--safe-links";
+	if o.safe_symlinks != 0 {
+		sargv = append(sargv, "--safe-links")
+	}
 
 	// if (numeric_ids)
 	// 	args[ac++] = "--numeric-ids";
+	if o.numeric_ids != 0 {
+		sargv = append(sargv, "--numeric-ids")
+	}
 
 	// if (only_existing && am_sender)
 	// 	args[ac++] = "--existing";
@@ -187,6 +254,12 @@ func (o *Options) ServerOptions() []string {
 	// if (opt_ignore_existing && am_sender)
 	// 	args[ac++] = "--ignore-existing";
 
+	// if (write_devices && am_sender)
+	// 	args[ac++] = "--write-devices";
+	if o.WriteDevices() && o.Sender() {
+		sargv = append(sargv, "--write-devices")
+	}
+
 	// if (tmpdir) {
 	// 	args[ac++] = "--temp-dir";
 	// 	args[ac++] = tmpdir;
@@ -215,3 +288,51 @@ func (o *Options) ServerOptions() []string {
 
 	return sargv
 }
+
+// SafeArg escapes shell-special characters in arg, which is passed to the
+// remote shell, unless --old-args disables escaping. An empty opt denotes a
+// file name argument (NULL in rsync), otherwise opt is prepended as
+// opt=arg. File names starting with a dash are prefixed with ./ so that
+// they are not parsed as options.
+//
+// rsync/options.c:safe_arg
+func (o *Options) SafeArg(opt, arg string) string {
+	const (
+		shellChars = "!#$&;|<>(){}\"' \t\\"
+		wildChars  = "*?[]" // ~ is escaped by the remote side
+	)
+	isFilenameArg := opt == ""
+	escapes := wildChars + shellChars
+	if isFilenameArg {
+		escapes = shellChars
+	}
+	var ret strings.Builder
+	if opt != "" {
+		ret.WriteString(opt + "=")
+	}
+	if isFilenameArg && strings.HasPrefix(arg, "-") {
+		ret.WriteString("./")
+	}
+	if o.protect_args != 0 || o.old_style_args >= 2 || (o.old_style_args != 0 && isFilenameArg) {
+		ret.WriteString(arg)
+		return ret.String()
+	}
+	if strings.HasPrefix(arg, "~") && isFilenameArg && o.am_sender == 0 && o.trust_sender == 0 &&
+		((o.relative_paths != 0 && !strings.Contains(arg, "/./")) || !strings.Contains(arg, "/")) {
+		ret.WriteByte('\\')
+	}
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		if c == '\\' {
+			// Like rsync, keep a trailing backslash and backslashes
+			// escaping wildcards in file names as-is.
+			if !isFilenameArg || (i+1 < len(arg) && strings.IndexByte(wildChars, arg[i+1]) == -1) {
+				ret.WriteByte('\\')
+			}
+		} else if strings.IndexByte(escapes, c) > -1 {
+			ret.WriteByte('\\')
+		}
+		ret.WriteByte(c)
+	}
+	return ret.String()
+}
@@ -0,0 +1,93 @@
+package rsyncopts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSizeArg parses a size like 100, 1.5m, 10KB or 1GiB-1. Suffixes are
+// case-insensitive; K, M, G, T and P (optionally followed by iB) are powers of
+// 1024, KB, MB etc. are powers of 1000. defSuffix is used when the number has
+// no suffix, e.g. 'K' for --bwlimit and 'B' for --max-size. A trailing +1 or -1
+// adjusts the result by one byte.
+//
+// rsync/options.c:parse_size_arg
+func ParseSizeArg(arg string, defSuffix byte) (int64, error) {
+	invalid := fmt.Errorf("invalid size: %q", arg)
+
+	// The number: digits, optionally followed by a fraction.
+	i := 0
+	for i < len(arg) && arg[i] >= '0' && arg[i] <= '9' {
+		i++
+	}
+	if i < len(arg) && arg[i] == '.' {
+		i++
+		for i < len(arg) && arg[i] >= '0' && arg[i] <= '9' {
+			i++
+		}
+	}
+	number, rest := arg[:i], arg[i:]
+	if number == "" || number == "." {
+		return 0, invalid
+	}
+
+	suffix := defSuffix
+	if rest != "" && rest[0] != '+' && rest[0] != '-' {
+		suffix, rest = rest[0], rest[1:]
+	}
+	var reps int
+	switch suffix {
+	case 'b', 'B':
+		reps = 0
+	case 'k', 'K':
+		reps = 1
+	case 'm', 'M':
+		reps = 2
+	case 'g', 'G':
+		reps = 3
+	case 't', 'T':
+		reps = 4
+	case 'p', 'P':
+		reps = 5
+	default:
+		return 0, invalid
+	}
+	var mult float64
+	switch {
+	case rest != "" && (rest[0] == 'b' || rest[0] == 'B'):
+		mult = 1000
+		rest = rest[1:]
+	case rest == "" || rest[0] == '+' || rest[0] == '-':
+		mult = 1024
+	case len(rest) >= 2 && strings.EqualFold(rest[:2], "ib"):
+		mult = 1024
+		rest = rest[2:]
+	default:
+		return 0, invalid
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, invalid
+	}
+	for range reps {
+		f *= mult
+	}
+	size := int64(f)
+	switch rest {
+	case "+1":
+		size++
+		rest = ""
+	case "-1":
+		size--
+		rest = ""
+	}
+	if rest != "" {
+		return 0, invalid
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("size too large: %q", arg)
+	}
+	return size, nil
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"io"
 	"net"
+	"os"
 
 	"github.com/gokrazy/rsync/internal/log"
+	"golang.org/x/term"
 )
 
 type Env struct {
@@ -17,7 +19,58 @@ type Env struct {
 
 	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
-	logger log.Logger
+	logger  log.Logger
+	ctx     context.Context
+	environ map[string]string // nil means the process environment
+}
+
+// WithContext returns a copy of env which carries ctx, so that functions
+// taking an *Env can check for cancellation without a separate context
+// parameter.
+func WithContext(ctx context.Context, env *Env) *Env {
+	cpy := *env
+	cpy.ctx = ctx
+	return &cpy
+}
+
+// WithEnvironment returns a copy of env which looks up environment variables
+// (like RSYNC_RSH or RSYNC_PASSWORD) in environ instead of the process
+// environment. A nil environ selects the process environment.
+func WithEnvironment(environ map[string]string, env *Env) *Env {
+	cpy := *env
+	cpy.environ = environ
+	return &cpy
+}
+
+// LookupEnv is like os.LookupEnv, but uses the environment set by
+// WithEnvironment, if any.
+func (s *Env) LookupEnv(key string) (string, bool) {
+	if s == nil || s.environ == nil {
+		return os.LookupEnv(key)
+	}
+	val, ok := s.environ[key]
+	return val, ok
+}
+
+// Getenv is like os.Getenv, but uses the environment set by WithEnvironment,
+// if any.
+func (s *Env) Getenv(key string) string {
+	val, _ := s.LookupEnv(key)
+	return val
+}
+
+// Context returns the context set by WithContext, or context.Background().
+func (s *Env) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Done returns a channel which is closed when the context set by WithContext
+// is done. Without a context, Done returns nil (never closed).
+func (s *Env) Done() <-chan struct{} {
+	return s.Context().Done()
 }
 
 func (s *Env) initLogger() {
@@ -37,3 +90,14 @@ func (s *Env) Logf(format string, v ...any) {
 }
 
 func (s *Env) Restrict() bool { return !s.DontRestrict }
+
+// IsTerminal reports whether Stdout is a terminal (as opposed to e.g. a pipe
+// or a file), which is only the case for an *os.File (or another writer with
+// a file descriptor) referring to a terminal.
+func (s *Env) IsTerminal() bool {
+	f, ok := s.Stdout.(interface{ Fd() uintptr })
+	if !ok {
+		return false
+	}
+	return term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,73 @@
+package rsyncos_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncos"
+)
+
+func TestWithContext(t *testing.T) {
+	env := &rsyncos.Env{Stderr: io.Discard}
+	if env.Done() != nil {
+		t.Errorf("Done() without a context unexpectedly returned a channel")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	withCtx := rsyncos.WithContext(ctx, env)
+	if withCtx == env {
+		t.Fatalf("WithContext did not return a copy")
+	}
+	if withCtx.Stderr != env.Stderr {
+		t.Errorf("WithContext did not retain Stderr")
+	}
+	select {
+	case <-withCtx.Done():
+		t.Fatalf("Done() closed before cancellation")
+	default:
+	}
+	cancel()
+	<-withCtx.Done()
+	if err := withCtx.Context().Err(); err != context.Canceled {
+		t.Errorf("Context().Err() = %v, want %v", err, context.Canceled)
+	}
+	if env.Context().Err() != nil {
+		t.Errorf("cancellation unexpectedly affected the original Env")
+	}
+}
+
+func TestWithEnvironment(t *testing.T) {
+	t.Setenv("RSYNC_RSH", "ssh -p 2222")
+	env := &rsyncos.Env{Stderr: io.Discard}
+	if got, want := env.Getenv("RSYNC_RSH"), "ssh -p 2222"; got != want {
+		t.Errorf("Getenv(RSYNC_RSH) = %q, want %q (from the process environment)", got, want)
+	}
+
+	withEnv := rsyncos.WithEnvironment(map[string]string{"RSYNC_PASSWORD": "secret"}, env)
+	if got, want := withEnv.Getenv("RSYNC_PASSWORD"), "secret"; got != want {
+		t.Errorf("Getenv(RSYNC_PASSWORD) = %q, want %q", got, want)
+	}
+	if val, ok := withEnv.LookupEnv("RSYNC_RSH"); ok {
+		t.Errorf("LookupEnv(RSYNC_RSH) = %q, but the process environment should not be consulted", val)
+	}
+	if _, ok := env.LookupEnv("RSYNC_PASSWORD"); ok {
+		t.Errorf("WithEnvironment unexpectedly affected the original Env")
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	if (&rsyncos.Env{Stdout: io.Discard}).IsTerminal() {
+		t.Errorf("IsTerminal() = true for a writer without file descriptor")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if (&rsyncos.Env{Stdout: w}).IsTerminal() {
+		t.Errorf("IsTerminal() = true for a pipe")
+	}
+}
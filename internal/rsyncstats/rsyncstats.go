@@ -4,4 +4,14 @@ type TransferStats struct {
 	Read    int64 // total bytes read (from network connection)
 	Written int64 // total bytes written (to network connection)
 	Size    int64 // total size of files
+
+	// Deletions by the receiver (--delete, or to replace a file with one of
+	// a different type). Counted in dry-run mode, too.
+	DeletedFiles int64 // deleted non-directories
+	DeletedDirs  int64 // deleted directories
+	DeletedBytes int64 // total size of the deleted non-directories
+
+	// Compression is the compression algorithm used for file data, or empty
+	// if compression was off.
+	Compression string
 }
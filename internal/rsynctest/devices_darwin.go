@@ -0,0 +1,35 @@
+package rsynctest
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// macOS device numbers only have an 8 bit major (and a 24 bit minor) number,
+// so there is no equivalent to the nvme device of the Linux tests.
+var platformDummyDevices []dummyDevice
+
+// createSocket creates a unix domain socket at path. Socket addresses are
+// limited to 104 bytes on macOS, which paths below $TMPDIR (in /var/folders)
+// easily exceed, so the socket is created in a short directory and then
+// moved into place.
+func createSocket(t *testing.T, path string) {
+	short, err := os.MkdirTemp("/tmp", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(short)
+	tmp := filepath.Join(short, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the listener would remove the socket at its old path.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	t.Cleanup(func() { ln.Close() })
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
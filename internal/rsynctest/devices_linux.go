@@ -0,0 +1,20 @@
+package rsynctest
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// Linux device numbers have a 12 bit major and a 20 bit minor number.
+var platformDummyDevices = []dummyDevice{
+	{"nvme", syscall.S_IFBLK, 259, 65537},
+}
+
+func createSocket(t *testing.T, path string) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+}
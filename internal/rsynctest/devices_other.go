@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package rsynctest
+
+import "testing"
+
+func CreateDummyDeviceFiles(t *testing.T, dir string) {
+	t.Skipf("creating device files is not implemented on this platform")
+}
+
+func VerifyDummyDeviceFiles(t *testing.T, source, dest string) {
+	t.Skipf("verifying device files is not implemented on this platform")
+}
+
+func CreateDummySpecialFiles(t *testing.T, dir string) {
+	t.Skipf("creating special files is not implemented on this platform")
+}
+
+func VerifyDummySpecialFiles(t *testing.T, source, dest string) {
+	t.Skipf("verifying special files is not implemented on this platform")
+}
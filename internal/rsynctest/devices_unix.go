@@ -0,0 +1,137 @@
+//go:build linux || darwin
+
+package rsynctest
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// dummyDevice is a device file created by CreateDummyDeviceFiles.
+type dummyDevice struct {
+	name         string
+	mode         uint32 // syscall.S_IFCHR or syscall.S_IFBLK
+	major, minor uint32
+}
+
+// dummyDevices covers device numbers which do not fit into the traditional
+// 8 bit major and minor numbers, and thereby the different rdev encodings of
+// the file list.
+var dummyDevices = append([]dummyDevice{
+	{"char", syscall.S_IFCHR, 1, 5},      // like /dev/zero
+	{"block", syscall.S_IFBLK, 242, 9},   // like /dev/nvme0
+	{"loop300", syscall.S_IFBLK, 7, 300}, // like /dev/loop300
+	// Sorts right after loop300 in the file list, so the sender omits
+	// the (same) major number.
+	{"loop42", syscall.S_IFBLK, 7, 42},
+	{"tty", syscall.S_IFCHR, 136, 70000}, // like /dev/pts/70000
+}, platformDummyDevices...)
+
+// CreateDummyDeviceFiles creates device files, a FIFO and a socket in dir.
+// Creating device files requires root privileges.
+func CreateDummyDeviceFiles(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dev := range dummyDevices {
+		fn := filepath.Join(dir, dev.name)
+		if err := unix.Mknod(fn, 0600|dev.mode, int(unix.Mkdev(dev.major, dev.minor))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	CreateDummySpecialFiles(t, dir)
+}
+
+// CreateDummySpecialFiles creates a FIFO and a socket in dir, which (unlike
+// device files) does not require root privileges.
+func CreateDummySpecialFiles(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Not subject to the umask, unlike the mode passed to mkfifo(2).
+	if err := os.Chmod(fifo, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	createSocket(t, filepath.Join(dir, "sock"))
+}
+
+// VerifyDummyDeviceFiles verifies that dest contains the files which
+// CreateDummyDeviceFiles created in source.
+func VerifyDummyDeviceFiles(t *testing.T, source, dest string) {
+	for _, dev := range dummyDevices {
+		sourcest, err := os.Stat(filepath.Join(source, dev.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		destst, err := os.Stat(filepath.Join(dest, dev.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.mode == syscall.S_IFCHR {
+			if destst.Mode().Type()&os.ModeCharDevice == 0 {
+				t.Fatalf("%s: unexpected type: got %v, want character device", dev.name, destst.Mode())
+			}
+		} else {
+			if destst.Mode().Type()&os.ModeDevice == 0 ||
+				destst.Mode().Type()&os.ModeCharDevice != 0 {
+				t.Fatalf("%s: unexpected type: got %v, want block device", dev.name, destst.Mode())
+			}
+		}
+		destsys, ok := destst.Sys().(*syscall.Stat_t)
+		if !ok {
+			t.Fatal("stat does not contain rdev")
+		}
+		sourcesys, ok := sourcest.Sys().(*syscall.Stat_t)
+		if !ok {
+			t.Fatal("stat does not contain rdev")
+		}
+		if got, want := destsys.Rdev, sourcesys.Rdev; got != want {
+			t.Fatalf("%s: unexpected rdev: got %v, want %v", dev.name, got, want)
+		}
+	}
+
+	VerifyDummySpecialFiles(t, source, dest)
+}
+
+// VerifyDummySpecialFiles verifies that dest contains the files which
+// CreateDummySpecialFiles created in source.
+func VerifyDummySpecialFiles(t *testing.T, source, dest string) {
+	{
+		sourcest, err := os.Stat(filepath.Join(source, "fifo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := os.Stat(filepath.Join(dest, "fifo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Type()&os.ModeNamedPipe == 0 {
+			t.Fatalf("unexpected type: got %v, want fifo", st.Mode())
+		}
+		if got, want := st.Mode().Perm(), sourcest.Mode().Perm(); got != want {
+			t.Fatalf("fifo: unexpected permissions: got %v, want %v", got, want)
+		}
+	}
+
+	{
+		st, err := os.Stat(filepath.Join(dest, "sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Type()&os.ModeSocket == 0 {
+			t.Fatalf("unexpected type: got %v, want socket", st.Mode())
+		}
+	}
+}
@@ -8,6 +8,9 @@ import (
 )
 
 func init() {
+	// Tests start tridge rsync after restricting the test process.
+	restrict.DontFilterSyscalls = true
+
 	restrict.ExtraHook = func() []landlock.Rule {
 		return []landlock.Rule{
 			// contains /usr/bin/rsync (and library deps)
@@ -14,14 +14,12 @@ import (
 	"runtime"
 	"strings"
 	"sync"
-	"syscall"
 	"testing"
 	"time"
 
 	"github.com/gokrazy/rsync/internal/anonssh"
 	"github.com/gokrazy/rsync/internal/maincmd"
 	"github.com/gokrazy/rsync/internal/rsyncdconfig"
-	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncostest"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
@@ -30,7 +28,6 @@ import (
 	"github.com/gokrazy/rsync/rsynccmd"
 	"github.com/gokrazy/rsync/rsyncd"
 	"github.com/google/go-cmp/cmp"
-	"golang.org/x/sys/unix"
 )
 
 // GosPublicRelease is the time when Go was publicly released:
@@ -60,23 +57,47 @@ type TestServer struct {
 	Port string
 }
 
+// ModuleOption customizes the module returned by InteropModule.
+type ModuleOption func(mod *rsyncd.Module)
+
+// WithComment sets the comment shown in the module listing.
+func WithComment(comment string) ModuleOption {
+	return func(mod *rsyncd.Module) {
+		mod.Comment = comment
+	}
+}
+
+// WithACL restricts which clients may use the module, e.g. "deny all".
+func WithACL(acl []string) ModuleOption {
+	return func(mod *rsyncd.Module) {
+		mod.ACL = acl
+	}
+}
+
+// WithWritable marks the module as writable (not read-only).
+func WithWritable(writable bool) ModuleOption {
+	return func(mod *rsyncd.Module) {
+		mod.Writable = writable
+	}
+}
+
 // InteropModule is a convenience function to define an rsync module named
 // “interop” with the specified path.
-func InteropModule(path string) []rsyncd.Module {
-	return []rsyncd.Module{
-		{
-			Name: "interop",
-			Path: path,
-		},
+func InteropModule(path string, opts ...ModuleOption) []rsyncd.Module {
+	mod := rsyncd.Module{
+		Name: "interop",
+		Path: path,
 	}
+	for _, opt := range opts {
+		opt(&mod)
+	}
+	return []rsyncd.Module{mod}
 }
 
 // WritableInteropModule is a wrapper around InteropModule that marks the module
 // as writable (not read-only).
-func WritableInteropModule(path string) []rsyncd.Module {
-	mods := InteropModule(path)
-	mods[0].Writable = true
-	return mods
+func WritableInteropModule(path string, opts ...ModuleOption) []rsyncd.Module {
+	return InteropModule(path, append([]ModuleOption{WithWritable(true)}, opts...)...)
 }
 
 type Option func(ts *TestServer)
@@ -142,7 +163,7 @@ func New(t *testing.T, modules []rsyncd.Module, opts ...Option) *TestServer {
 			Modules: modules,
 		}
 		go func() {
-			err := anonssh.Serve(ctx, osenv, ts.listener, sshListener, cfg, func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			err := anonssh.Serve(ctx, osenv, ts.listener, sshListener, cfg, func(cfg *rsyncdconfig.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 				osenv := &rsyncos.Env{
 					Stdin:  stdin,
 					Stdout: stdout,
@@ -169,7 +190,7 @@ func New(t *testing.T, modules []rsyncd.Module, opts ...Option) *TestServer {
 			Modules: modules,
 		}
 		go func() {
-			err := anonssh.Serve(ctx, osenv, ts.listener, sshListener, cfg, func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+			err := anonssh.Serve(ctx, osenv, ts.listener, sshListener, cfg, func(cfg *rsyncdconfig.Config, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 				osenv := &rsyncos.Env{
 					Stdin:  stdin,
 					Stdout: stdout,
@@ -250,53 +271,38 @@ func NewInMemory(t *testing.T, module rsyncd.Module, opts ...Option) *TestServer
 	return ts
 }
 
-type readWriter struct {
-	io.Reader
-	io.Writer
+// NewInMemoryInterop is a convenience wrapper around NewInMemory, serving
+// InteropModule(path, opts...) without landlock: each in-process server
+// would otherwise stack another landlock ruleset onto the test process, of
+// which only a limited number can be stacked.
+func NewInMemoryInterop(t *testing.T, path string, opts ...ModuleOption) *TestServer {
+	return NewInMemory(t, InteropModule(path, opts...)[0], DontRestrict())
 }
 
-func (ts *TestServer) pipe(t *testing.T, args []string) (*sync.WaitGroup, io.ReadWriter) {
-	// stdin from the view of the rsync server
-	stdinrd, stdinwr := io.Pipe()
-	stdoutrd, stdoutwr := io.Pipe()
-	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
-	osenv := rsyncostest.New(t)
-	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(osenv))
-	if err := pc.ParseArguments(osenv, args); err != nil {
-		t.Fatalf("parsing server args: %v", err)
-	}
-	t.Logf("pc.RemainingArgs=%q", pc.RemainingArgs)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := ts.srv.InternalHandleConn(t.Context(), conn, &ts.module, pc)
-		if err != nil {
-			t.Error(err)
-		}
-	}()
-
-	rw := &readWriter{
-		Reader: stdoutrd,
-		Writer: stdinwr,
+func (ts *TestServer) RunClient(t *testing.T, args []string, remaining []string) *rsyncstats.TransferStats {
+	stats, err := ts.RunClientErr(t, args, remaining)
+	if err != nil {
+		t.Fatal(err)
 	}
-	return &wg, rw
+	return stats
 }
 
-func (ts *TestServer) RunClient(t *testing.T, args []string, remaining []string) *rsyncstats.TransferStats {
+// RunClientErr is like RunClient, but returns the error of the transfer
+// instead of failing the test.
+func (ts *TestServer) RunClientErr(t *testing.T, args []string, remaining []string) (*rsyncstats.TransferStats, error) {
 	stderr := testlogger.New(t)
-	cl, err := rsyncclient.New(args, rsyncclient.WithStderr(stderr), rsyncclient.DontRestrict())
+	cl, err := rsyncclient.New(args,
+		rsyncclient.WithStderr(stderr),
+		rsyncclient.DontRestrict(),
+		rsyncclient.WithServer(ts.srv, &ts.module))
 	if err != nil {
 		t.Fatal(err)
 	}
-	wg, rw := ts.pipe(t, cl.ServerCommandOptions("./"))
-	res, err := cl.Run(t.Context(), rw, remaining)
+	res, err := cl.Run(t.Context(), nil, remaining)
 	if err != nil {
-		t.Fatal(err)
+		return nil, err
 	}
-	// Ensure an error would be displayed, if any.
-	wg.Wait()
-	return res.Stats
+	return res.Stats, nil
 }
 
 func CommandMain(m *testing.M) error {
@@ -318,112 +324,17 @@ func CommandMain(m *testing.M) error {
 			return err
 		}
 	} else {
-		os.Exit(m.Run())
-	}
-	return nil
-}
-
-func CreateDummyDeviceFiles(t *testing.T, dir string) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		t.Fatal(err)
-	}
-
-	char := filepath.Join(dir, "char")
-	// major 1, minor 5, like /dev/zero
-	if err := unix.Mknod(char, 0600|syscall.S_IFCHR, int(unix.Mkdev(1, 5))); err != nil {
-		t.Fatal(err)
-	}
-
-	block := filepath.Join(dir, "block")
-	// major 242, minor 9, like /dev/nvme0
-	if err := unix.Mknod(block, 0600|syscall.S_IFBLK, int(unix.Mkdev(242, 9))); err != nil {
-		t.Fatal(err)
-	}
-
-	fifo := filepath.Join(dir, "fifo")
-	if err := unix.Mkfifo(fifo, 0600); err != nil {
-		t.Fatal(err)
-	}
-
-	sock := filepath.Join(dir, "sock")
-	ln, err := net.Listen("unix", sock)
-	if err != nil {
-		t.Fatal(err)
-	}
-	t.Cleanup(func() { ln.Close() })
-}
-
-func VerifyDummyDeviceFiles(t *testing.T, source, dest string) {
-	{
-		sourcest, err := os.Stat(filepath.Join(source, "char"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		destst, err := os.Stat(filepath.Join(dest, "char"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if destst.Mode().Type()&os.ModeCharDevice == 0 {
-			t.Fatalf("unexpected type: got %v, want character device", destst.Mode())
-		}
-		destsys, ok := destst.Sys().(*syscall.Stat_t)
-		if !ok {
-			t.Fatal("stat does not contain rdev")
-		}
-		sourcesys, ok := sourcest.Sys().(*syscall.Stat_t)
-		if !ok {
-			t.Fatal("stat does not contain rdev")
-		}
-		if got, want := destsys.Rdev, sourcesys.Rdev; got != want {
-			t.Fatalf("unexpected rdev: got %v, want %v", got, want)
-		}
-	}
-
-	{
-		sourcest, err := os.Stat(filepath.Join(source, "block"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		destst, err := os.Stat(filepath.Join(dest, "block"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if destst.Mode().Type()&os.ModeDevice == 0 ||
-			destst.Mode().Type()&os.ModeCharDevice != 0 {
-			t.Fatalf("unexpected type: got %v, want block device", destst.Mode())
-		}
-		destsys, ok := destst.Sys().(*syscall.Stat_t)
-		if !ok {
-			t.Fatal("stat does not contain rdev")
-		}
-		sourcesys, ok := sourcest.Sys().(*syscall.Stat_t)
-		if !ok {
-			t.Fatal("stat does not contain rdev")
-		}
-		if got, want := destsys.Rdev, sourcesys.Rdev; got != want {
-			t.Fatalf("unexpected rdev: got %v, want %v", got, want)
-		}
-	}
-
-	{
-		st, err := os.Stat(filepath.Join(dest, "fifo"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if st.Mode().Type()&os.ModeNamedPipe == 0 {
-			t.Fatalf("unexpected type: got %v, want fifo", st.Mode())
+		// Build the AnyRsync fallback before any test restricts the process.
+		if discoverOnce().anyRsync() == "" {
+			gokrRsyncBin, gokrRsyncErr = buildGokrRsync()
 		}
-	}
-
-	{
-		st, err := os.Stat(filepath.Join(dest, "sock"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if st.Mode().Type()&os.ModeSocket == 0 {
-			t.Fatalf("unexpected type: got %v, want socket", st.Mode())
+		code := m.Run()
+		if gokrRsyncDir != "" {
+			os.RemoveAll(gokrRsyncDir)
 		}
+		os.Exit(code)
 	}
+	return nil
 }
 
 func ConstructLargeDataFile(headPattern, bodyPattern, endPattern []byte) []byte {
@@ -465,8 +376,9 @@ func DataFileMatches(fn string, headPattern, bodyPattern, endPattern []byte) err
 }
 
 type discovered struct {
-	rsync       string // path to any rsync, typically "rsync"
+	rsync       string // path to any rsync, typically "rsync" or "openrsync"
 	tridgeRsync string // path to tridge rsync if discovered
+	openrsync   string // path to openrsync if discovered
 }
 
 func (d discovered) anyRsync() string {
@@ -477,6 +389,30 @@ func (d discovered) anyRsync() string {
 }
 
 var discoverOnce = sync.OnceValue(func() discovered {
+	d := discover()
+	if d.openrsync == "" {
+		d.openrsync = discoverOpenrsync()
+	}
+	return d
+})
+
+// discoverOpenrsync returns the path to openrsync if it is installed next to
+// another rsync, or an empty string.
+func discoverOpenrsync() string {
+	if openrsync, err := exec.LookPath("openrsync"); err == nil {
+		return openrsync
+	}
+	if runtime.GOOS == "darwin" {
+		// See the comment about the macOS 15 wrapper in discover.
+		const loc = "/usr/libexec/rsync/rsync.openrsync"
+		if _, err := os.Stat(loc); err == nil {
+			return loc
+		}
+	}
+	return ""
+}
+
+func discover() discovered {
 	// For tests that need tridge rsync, explicitly check
 	// a few well-known locations.
 	locations := []string{
@@ -499,36 +435,84 @@ var discoverOnce = sync.OnceValue(func() discovered {
 	}
 	version, err := exec.Command("rsync", "--version").Output()
 	if err != nil {
+		// Some systems (e.g. OpenBSD) install openrsync under its own name.
+		if openrsync, err := exec.LookPath("openrsync"); err == nil {
+			return discovered{rsync: openrsync, openrsync: openrsync}
+		}
 		return discovered{}
 	}
 	if strings.Contains(string(version), "openrsync:") {
-		return discovered{rsync: "rsync"}
+		return discovered{rsync: "rsync", openrsync: "rsync"}
 	}
 	return discovered{tridgeRsync: "rsync"}
-})
+}
 
 func TridgeOrGTFO(t *testing.T, reason string) string {
 	discovered := discoverOnce()
-	if discovered.anyRsync() == "" {
-		// Gotta set some boundaries.
-		// We need *some* rsync.
-		t.Fatalf("no rsync installed")
-	}
 	if discovered.tridgeRsync == "" {
-		// we did not find tridge rsync and the default rsync is openrsync
+		// we did not find tridge rsync: the default rsync is openrsync, or
+		// there is no rsync at all (see AnyRsync)
 		t.Skipf("tridge rsync not found, cannot run this test: %v", reason)
 	}
 	return discovered.tridgeRsync
 }
 
+// OpenrsyncOrSkip returns the path to openrsync, skipping the test if
+// openrsync is not installed.
+func OpenrsyncOrSkip(t *testing.T) string {
+	openrsync := discoverOnce().openrsync
+	if openrsync == "" {
+		t.Skipf("openrsync not found, cannot run this test")
+	}
+	return openrsync
+}
+
+// AnyRsync returns the path to an rsync binary: tridge rsync if installed,
+// then rsync or openrsync from $PATH. As a last resort, AnyRsync returns
+// gokr-rsync, which CommandMain builds from this source tree, so that the
+// tests can run in minimal CI environments which only have the Go toolchain.
 func AnyRsync(t *testing.T) string {
-	any := discoverOnce().anyRsync()
-	if any == "" {
+	if any := discoverOnce().anyRsync(); any != "" {
+		return any
+	}
+	if gokrRsyncErr != nil {
 		// Gotta set some boundaries.
 		// We need *some* rsync.
-		t.Fatalf("no rsync installed")
+		t.Fatalf("no rsync installed, and building gokr-rsync failed: %v", gokrRsyncErr)
+	}
+	if gokrRsyncBin == "" {
+		t.Fatalf("no rsync installed, and gokr-rsync was not built: TestMain must call rsynctest.CommandMain")
+	}
+	return gokrRsyncBin
+}
+
+// gokrRsyncDir is the temporary directory into which buildGokrRsync builds
+// gokr-rsync, removed by CommandMain.
+var gokrRsyncDir string
+
+// gokrRsyncBin and gokrRsyncErr are the result of buildGokrRsync, which
+// CommandMain calls before running the tests: once a test restricted the
+// process (e.g. with landlock), go build no longer works.
+var (
+	gokrRsyncBin string
+	gokrRsyncErr error
+)
+
+func buildGokrRsync() (string, error) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		return "", err
+	}
+	gokrRsyncDir, err = os.MkdirTemp("", "rsynctest-gokr-rsync")
+	if err != nil {
+		return "", err
+	}
+	bin := filepath.Join(gokrRsyncDir, "gokr-rsync")
+	build := exec.Command(goTool, "build", "-o", bin, "github.com/gokrazy/rsync/cmd/gokr-rsync")
+	if out, err := build.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%v: %v\n%s", build.Args, err, out)
 	}
-	return any
+	return bin, nil
 }
 
 var rsyncVersionRe = regexp.MustCompile(`rsync\s*version ([v0-9.]+)`)
@@ -0,0 +1,325 @@
+package rsyncwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// intByteExtra maps the first byte of a varint/varlong (divided by 4) to the
+// number of bytes which follow it.
+//
+// rsync/io.c:int_byte_extra
+var intByteExtra = [64]byte{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, /* (00 - 3F)/4 */
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, /* (40 - 7F)/4 */
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, /* (80 - BF)/4 */
+	2, 2, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 5, 6, /* (C0 - FF)/4 */
+}
+
+// rsync/io.c:write_varint
+func appendVarint(dst []byte, x int32) []byte {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[1:], uint32(x))
+	cnt := 4
+	for cnt > 1 && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + 1)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > 1 {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	return append(dst, b[:cnt]...)
+}
+
+// rsync/io.c:write_varlong
+func appendVarlong(dst []byte, x int64, minBytes int) []byte {
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[1:], uint64(x))
+	cnt := 8
+	for cnt > minBytes && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + minBytes)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > minBytes {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	return append(dst, b[:cnt]...)
+}
+
+func (b *Buffer) WriteShortInt(data uint16) {
+	binary.Write(&b.buf, binary.LittleEndian, data)
+}
+
+func (b *Buffer) WriteVarint(data int32) {
+	b.buf.Write(appendVarint(nil, data))
+}
+
+func (b *Buffer) WriteVarlong(data int64, minBytes int) {
+	b.buf.Write(appendVarlong(nil, data, minBytes))
+}
+
+func (c *Conn) WriteShortInt(data uint16) error {
+	return binary.Write(c.Writer, binary.LittleEndian, data)
+}
+
+// WriteVarint writes data in the variable-length encoding of protocol >= 30.
+func (c *Conn) WriteVarint(data int32) error {
+	_, err := c.Writer.Write(appendVarint(nil, data))
+	return err
+}
+
+// WriteVarlong writes data in the variable-length encoding of protocol >= 30,
+// using at least minBytes bytes.
+func (c *Conn) WriteVarlong(data int64, minBytes int) error {
+	_, err := c.Writer.Write(appendVarlong(nil, data, minBytes))
+	return err
+}
+
+// rsync/io.c:write_varint30
+func (c *Conn) WriteVarint30(data int32) error {
+	if c.ProtocolVersion < 30 {
+		return c.WriteInt32(data)
+	}
+	return c.WriteVarint(data)
+}
+
+// rsync/io.c:write_varlong30
+func (c *Conn) WriteVarlong30(data int64, minBytes int) error {
+	if c.ProtocolVersion < 30 {
+		return c.WriteInt64(data)
+	}
+	return c.WriteVarlong(data, minBytes)
+}
+
+func (c *Conn) ReadShortInt() (uint16, error) {
+	var buf [2]byte
+	if _, err := io.ReadFull(c.Reader, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(buf[:]), nil
+}
+
+// rsync/io.c:read_varint
+func (c *Conn) ReadVarint() (int32, error) {
+	ch, err := c.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var u [5]byte
+	extra := int(intByteExtra[ch/4])
+	if extra == 0 {
+		u[0] = ch
+		return int32(binary.LittleEndian.Uint32(u[:4])), nil
+	}
+	if extra >= len(u) {
+		return 0, fmt.Errorf("overflow in ReadVarint (first byte 0x%02x)", ch)
+	}
+	if _, err := io.ReadFull(c.Reader, u[:extra]); err != nil {
+		return 0, err
+	}
+	bit := byte(1) << (8 - extra)
+	u[extra] = ch & (bit - 1)
+	return int32(binary.LittleEndian.Uint32(u[:4])), nil
+}
+
+// rsync/io.c:read_varlong
+func (c *Conn) ReadVarlong(minBytes int) (int64, error) {
+	if minBytes < 1 || minBytes > 8 {
+		return 0, fmt.Errorf("invalid minBytes %d in ReadVarlong", minBytes)
+	}
+	var b2 [8]byte
+	if _, err := io.ReadFull(c.Reader, b2[:minBytes]); err != nil {
+		return 0, err
+	}
+	var u [9]byte
+	copy(u[:], b2[1:minBytes])
+	extra := int(intByteExtra[b2[0]/4])
+	if extra == 0 {
+		u[minBytes-1] = b2[0]
+		return int64(binary.LittleEndian.Uint64(u[:8])), nil
+	}
+	if minBytes+extra > len(u) {
+		return 0, fmt.Errorf("overflow in ReadVarlong (first byte 0x%02x)", b2[0])
+	}
+	if _, err := io.ReadFull(c.Reader, u[minBytes-1:minBytes-1+extra]); err != nil {
+		return 0, err
+	}
+	bit := byte(1) << (8 - extra)
+	u[minBytes+extra-1] = b2[0] & (bit - 1)
+	return int64(binary.LittleEndian.Uint64(u[:8])), nil
+}
+
+// rsync/io.c:read_varint30
+func (c *Conn) ReadVarint30() (int32, error) {
+	if c.ProtocolVersion < 30 {
+		return c.ReadInt32()
+	}
+	return c.ReadVarint()
+}
+
+// rsync/io.c:read_varlong30
+func (c *Conn) ReadVarlong30(minBytes int) (int64, error) {
+	if c.ProtocolVersion < 30 {
+		return c.ReadInt64()
+	}
+	return c.ReadVarlong(minBytes)
+}
+
+// ndxState holds the previous file index per direction, which the protocol
+// 30 file index encoding transmits differences against.
+type ndxState struct {
+	initialized  bool
+	prevPositive int32
+	prevNegative int32
+}
+
+func (s *ndxState) init() {
+	if s.initialized {
+		return
+	}
+	s.initialized = true
+	s.prevPositive = -1
+	s.prevNegative = 1
+}
+
+// WriteNdx writes a file index (or NDX_DONE, i.e. -1). Starting with protocol
+// 30, indices are transmitted as differences to the previous index.
+//
+// rsync/io.c:write_ndx
+func (c *Conn) WriteNdx(ndx int32) error {
+	if c.ProtocolVersion < 30 {
+		return c.WriteInt32(ndx)
+	}
+	c.writeNdx.init()
+	var b [6]byte
+	cnt := 0
+	var diff int32
+	if ndx >= 0 {
+		diff = ndx - c.writeNdx.prevPositive
+		c.writeNdx.prevPositive = ndx
+	} else if ndx == -1 {
+		// NDX_DONE is sent as a single 0 byte with no side effects.
+		_, err := c.Writer.Write([]byte{0})
+		return err
+	} else {
+		// Negative numbers are sent as positive numbers after a leading 0xFF.
+		b[cnt] = 0xFF
+		cnt++
+		ndx = -ndx
+		diff = ndx - c.writeNdx.prevNegative
+		c.writeNdx.prevNegative = ndx
+	}
+	switch {
+	case diff > 0 && diff < 0xFE:
+		b[cnt] = byte(diff)
+		cnt++
+	case diff < 0 || diff > 0x7FFF:
+		b[cnt] = 0xFE
+		b[cnt+1] = byte(ndx>>24) | 0x80
+		b[cnt+2] = byte(ndx)
+		b[cnt+3] = byte(ndx >> 8)
+		b[cnt+4] = byte(ndx >> 16)
+		cnt += 5
+	default:
+		b[cnt] = 0xFE
+		b[cnt+1] = byte(diff >> 8)
+		b[cnt+2] = byte(diff)
+		cnt += 3
+	}
+	_, err := c.Writer.Write(b[:cnt])
+	return err
+}
+
+// ReadNdx reads a file index as written by WriteNdx.
+//
+// rsync/io.c:read_ndx
+func (c *Conn) ReadNdx() (int32, error) {
+	if c.ProtocolVersion < 30 {
+		return c.ReadInt32()
+	}
+	c.readNdx.init()
+	var b [4]byte
+	if _, err := io.ReadFull(c.Reader, b[:1]); err != nil {
+		return 0, err
+	}
+	prev := &c.readNdx.prevPositive
+	switch b[0] {
+	case 0:
+		return -1, nil // NDX_DONE
+	case 0xFF:
+		if _, err := io.ReadFull(c.Reader, b[:1]); err != nil {
+			return 0, err
+		}
+		prev = &c.readNdx.prevNegative
+	}
+	var num int32
+	if b[0] == 0xFE {
+		if _, err := io.ReadFull(c.Reader, b[:2]); err != nil {
+			return 0, err
+		}
+		if b[0]&0x80 != 0 {
+			b[3] = b[0] &^ 0x80
+			b[0] = b[1]
+			if _, err := io.ReadFull(c.Reader, b[1:3]); err != nil {
+				return 0, err
+			}
+			num = int32(binary.LittleEndian.Uint32(b[:]))
+		} else {
+			num = int32(b[0])<<8 + int32(b[1]) + *prev
+		}
+	} else {
+		num = int32(b[0]) + *prev
+	}
+	*prev = num
+	if prev == &c.readNdx.prevNegative {
+		num = -num
+	}
+	return num, nil
+}
+
+// rsync/io.c:write_vstring
+func (c *Conn) WriteVString(s string) error {
+	if len(s) > 0x7FFF {
+		return fmt.Errorf("string too long for vstring: %d bytes", len(s))
+	}
+	var buf []byte
+	if len(s) > 0x7F {
+		buf = append(buf, byte(len(s)>>8)|0x80)
+	}
+	buf = append(buf, byte(len(s)))
+	buf = append(buf, s...)
+	_, err := c.Writer.Write(buf)
+	return err
+}
+
+// rsync/io.c:read_vstring
+func (c *Conn) ReadVString() (string, error) {
+	l, err := c.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	length := int(l)
+	if length&0x80 != 0 {
+		l2, err := c.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		length = (length&^0x80)*0x100 + int(l2)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.Reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,335 @@
+package rsyncwire_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newConn(protocolVersion int32) (*rsyncwire.Conn, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return &rsyncwire.Conn{
+		Writer:          &buf,
+		Reader:          &buf,
+		ProtocolVersion: protocolVersion,
+	}, &buf
+}
+
+func TestVarint(t *testing.T) {
+	for _, tt := range []struct {
+		x    int32
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x80, 0x80}},
+		{0x1234, []byte{0x92, 0x34}},
+		{0x123456, []byte{0xd2, 0x56, 0x34}},
+		{0x12345678, []byte{0xf0, 0x78, 0x56, 0x34, 0x12}},
+		{-1, []byte{0xf0, 0xff, 0xff, 0xff, 0xff}},
+		{math.MinInt32, []byte{0xf0, 0x00, 0x00, 0x00, 0x80}},
+	} {
+		c, buf := newConn(30)
+		if err := c.WriteVarint(tt.x); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, buf.Bytes()); diff != "" {
+			t.Errorf("WriteVarint(%#x): unexpected bytes: diff (-want +got):\n%s", tt.x, diff)
+		}
+		got, err := c.ReadVarint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.x {
+			t.Errorf("ReadVarint() = %#x, want %#x", got, tt.x)
+		}
+		if buf.Len() > 0 {
+			t.Errorf("ReadVarint(%#x) left %d bytes unread", tt.x, buf.Len())
+		}
+	}
+}
+
+func TestVarlong(t *testing.T) {
+	for _, tt := range []struct {
+		x        int64
+		minBytes int
+		want     []byte
+	}{
+		{0, 3, []byte{0x00, 0x00, 0x00}},
+		{0x123456, 3, []byte{0x12, 0x56, 0x34}},
+		{0xd23456, 3, []byte{0x80, 0x56, 0x34, 0xd2}},
+		// 64-bit file sizes (protocol 30 transmits sizes with minBytes=3)
+		{1 << 32, 3, []byte{0xc1, 0x00, 0x00, 0x00, 0x00}},
+		{5 << 40, 3, []byte{0xe5, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{math.MaxInt64, 3, []byte{0xfc, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		// modification times are transmitted with minBytes=4
+		{1700000000, 4, []byte{0x65, 0x00, 0xf1, 0x53}},
+		{0, 4, []byte{0x00, 0x00, 0x00, 0x00}},
+		{4102444800, 4, []byte{0x80, 0x00, 0x57, 0x86, 0xf4}},                         // 2100-01-01
+		{-315619200, 4, []byte{0xf8, 0x80, 0x08, 0x30, 0xed, 0xff, 0xff, 0xff, 0xff}}, // 1960-01-01
+	} {
+		c, buf := newConn(30)
+		if err := c.WriteVarlong(tt.x, tt.minBytes); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, buf.Bytes()); diff != "" {
+			t.Errorf("WriteVarlong(%#x, %d): unexpected bytes: diff (-want +got):\n%s", tt.x, tt.minBytes, diff)
+		}
+		got, err := c.ReadVarlong(tt.minBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.x {
+			t.Errorf("ReadVarlong(%d) = %#x, want %#x", tt.minBytes, got, tt.x)
+		}
+		if buf.Len() > 0 {
+			t.Errorf("ReadVarlong(%#x) left %d bytes unread", tt.x, buf.Len())
+		}
+	}
+}
+
+func TestVarintErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc  string
+		input []byte
+		want  error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated", []byte{0xc0, 0x01}, io.ErrUnexpectedEOF},
+		// 0xf8 announces 5 more bytes, which do not fit into an int32
+		{"overflow", []byte{0xf8, 0, 0, 0, 0, 0}, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			c, buf := newConn(30)
+			buf.Write(tt.input)
+			_, err := c.ReadVarint()
+			if err == nil {
+				t.Fatalf("ReadVarint(% x) unexpectedly succeeded", tt.input)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("ReadVarint(% x) = %v, want %v", tt.input, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarlongErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		input    []byte
+		minBytes int
+		want     error
+	}{
+		{"truncated minimum", []byte{0x00, 0x00}, 3, io.ErrUnexpectedEOF},
+		{"truncated extra", []byte{0xc1, 0x00, 0x00, 0x00}, 3, io.ErrUnexpectedEOF},
+		// 0xfc announces 6 more bytes, which with minBytes=4 exceed an int64
+		{"overflow", []byte{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 4, nil},
+		{"minBytes too small", []byte{0x00}, 0, nil},
+		{"minBytes too large", []byte{0x00}, 9, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			c, buf := newConn(30)
+			buf.Write(tt.input)
+			_, err := c.ReadVarlong(tt.minBytes)
+			if err == nil {
+				t.Fatalf("ReadVarlong(% x, %d) unexpectedly succeeded", tt.input, tt.minBytes)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("ReadVarlong(% x, %d) = %v, want %v", tt.input, tt.minBytes, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferVarint(t *testing.T) {
+	// Buffer (used to assemble messages) must produce the same encoding as
+	// Conn.
+	for _, x := range []int64{0, 0x7f, 0x80, 0xd23456, 1 << 32, math.MaxInt64} {
+		var b rsyncwire.Buffer
+		b.WriteVarint(int32(x))
+		b.WriteVarlong(x, 3)
+		c, buf := newConn(30)
+		if err := c.WriteVarint(int32(x)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteVarlong(x, 3); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(buf.String(), b.String()); diff != "" {
+			t.Errorf("Buffer encoding of %#x differs from Conn: diff (-conn +buffer):\n%s", x, diff)
+		}
+	}
+}
+
+func TestVarintRoundTrip(t *testing.T) {
+	c, _ := newConn(30)
+	for shift := 0; shift < 32; shift++ {
+		for _, x := range []int32{1 << shift, 1<<shift - 1, -(1 << shift)} {
+			if err := c.WriteVarint(x); err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.ReadVarint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != x {
+				t.Errorf("varint round trip: got %#x, want %#x", got, x)
+			}
+		}
+	}
+	for shift := 0; shift < 63; shift++ {
+		for _, x := range []int64{1 << shift, 1<<shift - 1} {
+			for _, minBytes := range []int{3, 4} {
+				if err := c.WriteVarlong(x, minBytes); err != nil {
+					t.Fatal(err)
+				}
+				got, err := c.ReadVarlong(minBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != x {
+					t.Errorf("varlong(minBytes=%d) round trip: got %#x, want %#x", minBytes, got, x)
+				}
+			}
+		}
+	}
+}
+
+func TestVarint30(t *testing.T) {
+	// Before protocol 30, varint30 and varlong30 fall back to little-endian
+	// int32 and longint (an int32 for values which fit) encodings.
+	c, buf := newConn(29)
+	if err := c.WriteVarint30(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteVarlong30(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteVarlong30(1<<32, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x01, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+	}
+	if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+		t.Errorf("unexpected bytes: diff (-want +got):\n%s", diff)
+	}
+	if got, err := c.ReadVarint30(); err != nil || got != 1 {
+		t.Errorf("ReadVarint30() = %d, %v, want 1, nil", got, err)
+	}
+	if got, err := c.ReadVarlong30(3); err != nil || got != 1 {
+		t.Errorf("ReadVarlong30() = %d, %v, want 1, nil", got, err)
+	}
+	if got, err := c.ReadVarlong30(3); err != nil || got != 1<<32 {
+		t.Errorf("ReadVarlong30() = %d, %v, want %d, nil", got, err, int64(1<<32))
+	}
+}
+
+func TestNdx(t *testing.T) {
+	// Write and read all indices on the same connection, because the encoding
+	// depends on the previously transmitted index.
+	c, buf := newConn(30)
+	for _, tt := range []struct {
+		ndx  int32
+		want []byte
+	}{
+		// differences to the previous index (initially -1) fit in one byte
+		{0, []byte{0x01}},
+		{1, []byte{0x01}},
+		{0xfe, []byte{0xfd}},
+		// a difference of 0xfe or larger is sent as two bytes after 0xfe
+		{0x1fc, []byte{0xfe, 0x00, 0xfe}},
+		{0x1fc + 0x7fff, []byte{0xfe, 0x7f, 0xff}},
+		// a difference of 0 is sent in the two-byte form, too
+		{0x1fc + 0x7fff, []byte{0xfe, 0x00, 0x00}},
+		// going backwards: the full index is sent in four bytes
+		{5, []byte{0xfe, 0x80, 0x05, 0x00, 0x00}},
+		// so are large jumps
+		{0x12345678, []byte{0xfe, 0x92, 0x78, 0x56, 0x34}},
+		// NDX_DONE is a single 0 byte
+		{-1, []byte{0x00}},
+		// other negative numbers are prefixed with 0xff and track their own
+		// previous value (initially 1)
+		{-2, []byte{0xff, 0x01}},
+		{-3, []byte{0xff, 0x01}},
+		{-0x203, []byte{0xff, 0xfe, 0x02, 0x00}},
+		{-2, []byte{0xff, 0xfe, 0x80, 0x02, 0x00, 0x00}},
+		// the positive state was not affected by negative numbers
+		{0x12345679, []byte{0x01}},
+	} {
+		buf.Reset()
+		if err := c.WriteNdx(tt.ndx); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, buf.Bytes()); diff != "" {
+			t.Errorf("WriteNdx(%#x): unexpected bytes: diff (-want +got):\n%s", tt.ndx, diff)
+		}
+		got, err := c.ReadNdx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.ndx {
+			t.Errorf("ReadNdx() = %#x, want %#x", got, tt.ndx)
+		}
+	}
+}
+
+func TestNdxBeforeProtocol30(t *testing.T) {
+	c, buf := newConn(29)
+	for _, ndx := range []int32{3, 1, -1, -101} {
+		buf.Reset()
+		if err := c.WriteNdx(ndx); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf.Len(), 4; got != want {
+			t.Errorf("WriteNdx(%d) wrote %d bytes, want %d", ndx, got, want)
+		}
+		got, err := c.ReadNdx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != ndx {
+			t.Errorf("ReadNdx() = %d, want %d", got, ndx)
+		}
+	}
+}
+
+func TestVString(t *testing.T) {
+	long := strings.Repeat("x", 0x1234)
+	for _, tt := range []struct {
+		s    string
+		want []byte
+	}{
+		{"", []byte{0x00}},
+		{"md5 md4", append([]byte{0x07}, "md5 md4"...)},
+		{long, append([]byte{0x92, 0x34}, long...)},
+	} {
+		c, buf := newConn(30)
+		if err := c.WriteVString(tt.s); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, buf.Bytes()); diff != "" {
+			t.Errorf("WriteVString(%q): unexpected bytes: diff (-want +got):\n%s", tt.s, diff)
+		}
+		got, err := c.ReadVString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.s {
+			t.Errorf("ReadVString() = %q, want %q", got, tt.s)
+		}
+	}
+
+	c, _ := newConn(30)
+	if err := c.WriteVString(strings.Repeat("x", 0x8000)); err == nil {
+		t.Errorf("WriteVString(<0x8000 bytes>) unexpectedly succeeded")
+	}
+}
@@ -3,41 +3,223 @@ package rsyncwire
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/rsyncos"
 )
 
+// MsgType is the tag of a multiplexed message, which tells data (MsgData)
+// apart from the other messages the peer interleaves with it.
+//
+// rsync/rsync.h:enum msgcode
+type MsgType uint8
+
 const (
-	MsgData  uint8 = 0
-	MsgInfo  uint8 = 2
-	MsgError uint8 = 1
+	MsgData        MsgType = 0
+	MsgError       MsgType = 1 // MSG_ERROR_XFER
+	MsgInfo        MsgType = 2
+	MsgErrorFatal  MsgType = 3 // MSG_ERROR
+	MsgWarning     MsgType = 4
+	MsgErrorSocket MsgType = 5
+	MsgLog         MsgType = 6
+	MsgClient      MsgType = 7
+	MsgErrorUTF8   MsgType = 8
+	MsgRedo        MsgType = 9
+	MsgStats       MsgType = 10
+	MsgIOError     MsgType = 22
+	MsgIOTimeout   MsgType = 33
+	MsgNoop        MsgType = 42
+	MsgErrorExit   MsgType = 86
+	MsgSuccess     MsgType = 100
+	MsgDeleted     MsgType = 101
+	MsgNoSend      MsgType = 102
 )
 
+var msgNames = map[MsgType]string{
+	MsgData:        "MSG_DATA",
+	MsgError:       "MSG_ERROR_XFER",
+	MsgInfo:        "MSG_INFO",
+	MsgErrorFatal:  "MSG_ERROR",
+	MsgWarning:     "MSG_WARNING",
+	MsgErrorSocket: "MSG_ERROR_SOCKET",
+	MsgLog:         "MSG_LOG",
+	MsgClient:      "MSG_CLIENT",
+	MsgErrorUTF8:   "MSG_ERROR_UTF8",
+	MsgRedo:        "MSG_REDO",
+	MsgStats:       "MSG_STATS",
+	MsgIOError:     "MSG_IO_ERROR",
+	MsgIOTimeout:   "MSG_IO_TIMEOUT",
+	MsgNoop:        "MSG_NOOP",
+	MsgErrorExit:   "MSG_ERROR_EXIT",
+	MsgSuccess:     "MSG_SUCCESS",
+	MsgDeleted:     "MSG_DELETED",
+	MsgNoSend:      "MSG_NO_SEND",
+}
+
+// String returns the name rsync uses for t, e.g. MSG_INFO.
+func (t MsgType) String() string {
+	if name, ok := msgNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MSG_%d", uint8(t))
+}
+
 const mplexBase = 7
 
 type MultiplexWriter struct {
 	Writer io.Writer
+
+	// mu ensures messages are not interleaved when multiple goroutines write
+	// (e.g. the receiver sending MSG_SUCCESS while the generator writes data).
+	mu sync.Mutex
 }
 
 func (w *MultiplexWriter) Write(p []byte) (n int, err error) {
 	return w.WriteMsg(MsgData, p)
 }
 
-func (w *MultiplexWriter) WriteMsg(tag uint8, p []byte) (n int, err error) {
+func (w *MultiplexWriter) WriteMsg(tag MsgType, p []byte) (n int, err error) {
 	header := uint32(mplexBase+tag)<<24 | uint32(len(p))
 	// log.Printf("len %d (hex %x)", len(p), uint32(len(p)))
 	// log.Printf("header=%v (%x)", header, header)
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if err := binary.Write(w.Writer, binary.LittleEndian, header); err != nil {
 		return 0, err
 	}
 	return w.Writer.Write(p)
 }
 
+// Flush flushes the underlying writer, if it is buffered.
+func (w *MultiplexWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return flush(w.Writer)
+}
+
+// FramedConn is the transport of a command mode connection, i.e. rsync --server
+// started over a remote shell (or locally) without --daemon: the peer’s data
+// arrives on stdin and our data goes to stdout, both without multiplexing
+// headers, while diagnostics go to a separate stderr pipe which the remote
+// shell forwards.
+//
+// Once the protocol switches to multiplexing, a MultiplexWriter wraps the
+// FramedConn as usual. Until then, FramedConn.WriteMsg writes text messages
+// (errors, warnings, info) to Stderr, like tridge rsync does before
+// multiplexing starts (rsync/log.c:rwrite).
+type FramedConn struct {
+	Reader io.Reader // stdin
+	Writer io.Writer // stdout
+	Stderr io.Writer
+}
+
+func (c *FramedConn) Read(p []byte) (n int, err error) { return c.Reader.Read(p) }
+
+func (c *FramedConn) Write(p []byte) (n int, err error) { return c.Writer.Write(p) }
+
+// WriteMsg writes the text of message p to Stderr. Messages which carry
+// protocol data (e.g. MsgSuccess) cannot be sent without multiplexing.
+func (c *FramedConn) WriteMsg(tag MsgType, p []byte) (n int, err error) {
+	switch tag {
+	case MsgError, MsgErrorFatal, MsgErrorSocket, MsgErrorUTF8,
+		MsgInfo, MsgWarning, MsgLog, MsgClient:
+		return c.Stderr.Write(p)
+	}
+	return 0, fmt.Errorf("cannot send message %d: connection is not multiplexed", tag)
+}
+
+// Flush flushes stdout, if it is buffered.
+func (c *FramedConn) Flush() error {
+	return flush(c.Writer)
+}
+
+// SetReadDeadline sets the read deadline on stdin, if it supports deadlines
+// (e.g. a pipe *os.File). Otherwise, it returns os.ErrNoDeadline.
+func (c *FramedConn) SetReadDeadline(t time.Time) error {
+	dl, ok := c.Reader.(ReadDeadliner)
+	if !ok {
+		return os.ErrNoDeadline
+	}
+	return dl.SetReadDeadline(t)
+}
+
 type MultiplexReader struct {
 	Env    *rsyncos.Env
 	Reader io.Reader
+
+	// Success, if non-nil, is called with the file index of each MSG_SUCCESS
+	// message, which the receiver sends for every file it has received
+	// successfully when --remove-source-files is active.
+	Success func(ndx int32) error
+
+	// NoSend, if non-nil, is called with the file index of each MSG_NO_SEND
+	// message, which the sender sends for every file it could not open.
+	NoSend func(ndx int32) error
+
+	// Output, if non-nil, is called with each text message from the peer
+	// (MsgInfo, MsgError, MsgWarning and the like) instead of writing it to
+	// Env, e.g. to end a progress line first. [WriteOutput] writes a
+	// message like the default does.
+	Output func(tag MsgType, payload []byte)
+
+	// pending is the not yet consumed remainder of the last MsgData payload.
+	pending []byte
+
+	ioError   atomic.Int32
+	xferError atomic.Bool
+
+	// fatal is the text of the last MSG_ERROR (and similar) message, which
+	// explains why the peer is about to hang up.
+	fatal []byte
+}
+
+// IOError returns the I/O error flags the peer sent via MSG_IO_ERROR messages
+// (protocol >= 30), combined with bitwise OR like rsync does.
+func (w *MultiplexReader) IOError() int32 {
+	return w.ioError.Load()
+}
+
+// XferError reports whether the peer sent a MSG_ERROR_XFER message, i.e. some
+// files or attributes were not transferred.
+func (w *MultiplexReader) XferError() bool {
+	return w.xferError.Load()
+}
+
+func (w *MultiplexReader) output(tag MsgType, payload []byte) {
+	if w.Output != nil {
+		w.Output(tag, payload)
+		return
+	}
+	WriteOutput(w.Env, tag, payload)
+}
+
+// WriteOutput writes the text of a message from the peer verbatim: info to
+// stdout, errors and warnings to stderr.
+//
+// rsync/log.c:rwrite
+func WriteOutput(env *rsyncos.Env, tag MsgType, payload []byte) {
+	var out io.Writer
+	switch tag {
+	case MsgInfo, MsgClient:
+		out = env.Stdout
+	case MsgLog:
+		// Meant for the log file of the peer, which we do not have.
+		env.Logf("%s", bytes.TrimSuffix(payload, []byte("\n")))
+		return
+	default:
+		out = env.Stderr
+	}
+	if out == nil {
+		env.Logf("%s", bytes.TrimSuffix(payload, []byte("\n")))
+		return
+	}
+	out.Write(payload)
 }
 
 // rsync.h defines IO_BUFFER_SIZE as 32 * 1024, but gokr-rsyncd increases it to
@@ -46,13 +228,13 @@ type MultiplexReader struct {
 const ioBufferSize = 256 * 1024
 const maxMessageSize = ioBufferSize
 
-func (w *MultiplexReader) ReadMsg() (tag uint8, p []byte, err error) {
+func (w *MultiplexReader) ReadMsg() (tag MsgType, p []byte, err error) {
 	var header uint32
 	if err := binary.Read(w.Reader, binary.LittleEndian, &header); err != nil {
 		return 0, nil, err
 	}
 
-	tag = uint8(header>>24) - mplexBase
+	tag = MsgType(header>>24) - mplexBase
 	length := header & 0x00FFFFFF
 	if length > maxMessageSize {
 		// NOTE: if you run into this error, one alternative to bumping
@@ -69,27 +251,84 @@ func (w *MultiplexReader) ReadMsg() (tag uint8, p []byte, err error) {
 	return tag, p, nil
 }
 
+// Read returns the data the peer sends, and handles all other messages in
+// between: text messages are written to w.Env, protocol messages are passed
+// to the callbacks.
+//
+// rsync/io.c:read_a_msg
 func (w *MultiplexReader) Read(p []byte) (n int, err error) {
-	tag, payload, err := w.ReadMsg()
-	if err != nil {
-		return 0, err
-	}
-	switch tag {
-	case MsgError:
-		return 0, fmt.Errorf("%s", payload)
-	case MsgInfo:
-		w.Env.Logf("info: %s", payload)
-		// io.ReadFull will call Read again
-		return 0, nil
-	case MsgData:
-		// continues below
-	default:
-		return 0, fmt.Errorf("unexpected tag: got %v, want %v", tag, MsgData)
-	}
-	if len(p) < len(payload) {
-		panic(fmt.Sprintf("not enough buffer space! %d < %d", len(p), len(payload)))
+	for len(w.pending) == 0 {
+		tag, payload, err := w.ReadMsg()
+		if err != nil {
+			if w.fatal != nil {
+				// The connection broke because the peer gave up. Its
+				// message is more useful than our read error.
+				return 0, fmt.Errorf("%s", bytes.TrimSpace(w.fatal))
+			}
+			return 0, err
+		}
+		switch tag {
+		case MsgData:
+			w.pending = payload
+		case MsgError, MsgErrorUTF8:
+			// A file or its attributes could not be transferred, the
+			// transfer continues.
+			w.xferError.Store(true)
+			w.output(tag, payload)
+		case MsgErrorFatal, MsgErrorSocket:
+			w.fatal = payload
+			w.output(tag, payload)
+		case MsgInfo, MsgWarning, MsgLog, MsgClient:
+			w.output(tag, payload)
+		case MsgIOError:
+			if len(payload) != 4 {
+				return 0, fmt.Errorf("invalid MSG_IO_ERROR length %d", len(payload))
+			}
+			w.ioError.Or(int32(binary.LittleEndian.Uint32(payload)))
+		case MsgSuccess:
+			if len(payload) != 4 {
+				return 0, fmt.Errorf("invalid MSG_SUCCESS length %d", len(payload))
+			}
+			if w.Success != nil {
+				if err := w.Success(int32(binary.LittleEndian.Uint32(payload))); err != nil {
+					return 0, err
+				}
+			}
+		case MsgNoSend:
+			if len(payload) != 4 {
+				return 0, fmt.Errorf("invalid MSG_NO_SEND length %d", len(payload))
+			}
+			if w.NoSend != nil {
+				if err := w.NoSend(int32(binary.LittleEndian.Uint32(payload))); err != nil {
+					return 0, err
+				}
+			}
+		case MsgNoop:
+			// Keep-alive.
+		case MsgIOTimeout:
+			// protocol >= 31: a daemon announces its --timeout setting, which
+			// we do not need to adopt.
+			if len(payload) != 4 {
+				return 0, fmt.Errorf("invalid MSG_IO_TIMEOUT length %d", len(payload))
+			}
+		case MsgErrorExit:
+			// protocol >= 31: the peer is exiting with an error.
+			var code int32
+			switch len(payload) {
+			case 0:
+			case 4:
+				code = int32(binary.LittleEndian.Uint32(payload))
+			default:
+				return 0, fmt.Errorf("invalid MSG_ERROR_EXIT length %d", len(payload))
+			}
+			return 0, fmt.Errorf("remote rsync exited with code %d", code)
+		default:
+			return 0, fmt.Errorf("unexpected tag: got %v, want %v", tag, MsgData)
+		}
 	}
-	return copy(p, payload), nil
+	n = copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
 }
 
 type Buffer struct {
@@ -128,9 +367,153 @@ func (b *Buffer) Reset() {
 	b.buf.Reset()
 }
 
+// Capabilities describes the optional protocol features of a session. The
+// zero value disables all of them, which is correct for protocols < 30.
+//
+// See rsync/compat.c:setup_protocol
+type Capabilities struct {
+	// CompatFlags are the CF_* flags the server announced (protocol >= 30).
+	// Only those we implement are reflected in the fields below.
+	CompatFlags int32
+
+	// SafeFileList means the end of the file list carries the I/O error
+	// flag (CF_SAFE_FLIST, implied by protocol 31).
+	SafeFileList bool
+
+	// ChecksumSeedFix means the checksum seed is hashed before (instead of
+	// after) the data (CF_CHKSUM_SEED_FIX).
+	ChecksumSeedFix bool
+
+	// VarintFileListFlags means file list entry flags are sent as a varint
+	// (CF_VARINT_FLIST_FLAGS), which also enables the checksum negotiation.
+	VarintFileListFlags bool
+
+	// IncRecurse means the sender transmits the file list in segments, one
+	// per directory, while the transfer is running (CF_INC_RECURSE).
+	IncRecurse bool
+
+	// SymlinkTimes means the receiver sets the modification time of
+	// symlinks (CF_SYMLINK_TIMES, implied before protocol 30).
+	SymlinkTimes bool
+
+	// Compression is the name of the compression algorithm both sides
+	// agreed on (see rsynccompress), or empty if compression is off.
+	Compression string
+
+	// Checksum is the name of the strong checksum both sides negotiated. If
+	// empty, the protocol version implies the checksum, see
+	// rsyncchecksum.Default.
+	Checksum string
+
+	// Peer is the rsync implementation on the other end, as detected from
+	// its greeting (the @RSYNCD line in daemon mode, the protocol version
+	// otherwise). The detection is a heuristic: it is only used to work
+	// around peculiarities of the peer, never to enable protocol features.
+	Peer Peer
+}
+
+// Peer identifies an rsync implementation.
+type Peer int
+
+const (
+	// PeerTridge is tridge rsync (from the samba project), or any
+	// implementation which greets like it, including gokrazy rsync. This is
+	// the zero value, i.e. the default when nothing else was detected.
+	PeerTridge Peer = iota
+
+	// PeerOpenrsync is openrsync (used on OpenBSD and macOS 15+), which
+	// only speaks protocol 27 and announces it without a sub-protocol
+	// version. Unlike tridge rsync, openrsync never multiplexes the data it
+	// sends as a client and may exit without sending the final goodbye.
+	PeerOpenrsync
+)
+
+func (p Peer) String() string {
+	switch p {
+	case PeerTridge:
+		return "tridge"
+	case PeerOpenrsync:
+		return "openrsync"
+	}
+	return fmt.Sprintf("Peer(%d)", int(p))
+}
+
 type Conn struct {
 	Writer io.Writer
 	Reader io.Reader
+
+	// ProtocolVersion is the protocol version negotiated for this session
+	// (the smaller of both sides’ versions). The sender and receiver consult
+	// it when deciding which wire format to use.
+	ProtocolVersion int32
+
+	// Capabilities are the optional protocol features both sides agreed on
+	// after protocol version negotiation.
+	Capabilities Capabilities
+
+	// ReadDeadliner is the underlying transport (e.g. a net.Conn or a pipe
+	// *os.File), if it supports read deadlines. May be nil.
+	ReadDeadliner ReadDeadliner
+
+	// state of the protocol 30 file index encoding, see WriteNdx and ReadNdx
+	writeNdx ndxState
+	readNdx  ndxState
+}
+
+// msgWriter is implemented by MultiplexWriter (and a CountingWriter wrapping
+// one).
+type msgWriter interface {
+	WriteMsg(tag MsgType, p []byte) (n int, err error)
+}
+
+// WriteMsg sends an out-of-band message (e.g. MsgIOError) to the peer. It
+// returns an error if the connection is not multiplexed.
+func (c *Conn) WriteMsg(tag MsgType, p []byte) error {
+	mw, ok := c.Writer.(msgWriter)
+	if !ok {
+		return fmt.Errorf("cannot send message %d: connection is not multiplexed", tag)
+	}
+	_, err := mw.WriteMsg(tag, p)
+	return err
+}
+
+// flusher is implemented by buffered writers like *bufio.Writer, and by
+// writers wrapping them (MultiplexWriter, CountingWriter).
+type flusher interface {
+	Flush() error
+}
+
+func flush(w io.Writer) error {
+	if f, ok := w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Flush sends any data buffered in c.Writer to the peer. It is a no-op if
+// c.Writer is not buffered.
+//
+// Senders call Flush at protocol boundaries (e.g. after the file list) where
+// the peer waits for data before it responds.
+func (c *Conn) Flush() error {
+	return flush(c.Writer)
+}
+
+// ReadDeadliner is implemented by net.Conn and *os.File, among others.
+type ReadDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// SetReadDeadline sets the read deadline on the underlying transport. It is a
+// no-op if the transport does not support deadlines.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.ReadDeadliner == nil {
+		return nil
+	}
+	if err := c.ReadDeadliner.SetReadDeadline(t); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return err
+	}
+	return nil
 }
 
 func (c *Conn) WriteByte(data byte) error {
@@ -174,24 +557,23 @@ func (c *Conn) ReadInt32() (int32, error) {
 	return int32(binary.LittleEndian.Uint32(buf[:])), nil
 }
 
+// ReadInt64 reads an int64 sent by WriteInt64: values which fit into a
+// non-negative int32 are sent as such, all others as -1 followed by the int64.
+//
+// rsync/io.c:read_longint
 func (c *Conn) ReadInt64() (int64, error) {
-	{
-		data, err := c.ReadInt32()
-		if err != nil {
-			return 0, err
-		}
-		if data != -1 {
-			// The value was small enough to fit into a 32 bit int, so it was
-			// transferred directly.
-			return int64(data), nil
-		}
-		// Otherwise, -1 was transmitted, followed by the int64.
+	data, err := c.ReadInt32()
+	if err != nil {
+		return 0, err
+	}
+	if data != -1 {
+		return int64(data), nil
 	}
-	var data int64
-	if err := binary.Read(c.Reader, binary.LittleEndian, &data); err != nil {
+	var buf [8]byte
+	if _, err := io.ReadFull(c.Reader, buf[:]); err != nil {
 		return 0, err
 	}
-	return data, nil
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
 }
 
 type CountingReader struct {
@@ -201,7 +583,8 @@ type CountingReader struct {
 
 func (r *CountingReader) Read(p []byte) (n int, err error) {
 	n, err = r.R.Read(p)
-	r.BytesRead += int64(n)
+	// Updated atomically so that monitoring can observe transfers in progress.
+	atomic.AddInt64(&r.BytesRead, int64(n))
 	return n, err
 }
 
@@ -212,10 +595,28 @@ type CountingWriter struct {
 
 func (w *CountingWriter) Write(p []byte) (n int, err error) {
 	n, err = w.W.Write(p)
-	w.BytesWritten += int64(n)
+	atomic.AddInt64(&w.BytesWritten, int64(n))
 	return n, err
 }
 
+// WriteMsg forwards to the underlying writer if it is a MultiplexWriter (or
+// another writer supporting messages), so that messages can be sent through a
+// CountingWriter.
+func (w *CountingWriter) WriteMsg(tag MsgType, p []byte) (n int, err error) {
+	mw, ok := w.W.(msgWriter)
+	if !ok {
+		return 0, fmt.Errorf("cannot send message %d: writer is not multiplexed", tag)
+	}
+	n, err = mw.WriteMsg(tag, p)
+	atomic.AddInt64(&w.BytesWritten, int64(n))
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it is buffered.
+func (w *CountingWriter) Flush() error {
+	return flush(w.W)
+}
+
 func CounterPair(r io.Reader, w io.Writer) (*CountingReader, *CountingWriter) {
 	crd := &CountingReader{R: r}
 	cwr := &CountingWriter{W: w}
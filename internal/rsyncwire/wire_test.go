@@ -0,0 +1,239 @@
+package rsyncwire_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsyncos"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConnFlush(t *testing.T) {
+	t.Run("Unbuffered", func(t *testing.T) {
+		var out bytes.Buffer
+		c := &rsyncwire.Conn{Writer: &out}
+		if err := c.WriteInt32(42); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.Len(), 4; got != want {
+			t.Errorf("wrote %d bytes, want %d", got, want)
+		}
+	})
+
+	// The buffered writer is wrapped the way clients and servers set up a
+	// multiplexed connection.
+	t.Run("Buffered", func(t *testing.T) {
+		var out bytes.Buffer
+		bw := bufio.NewWriter(&out)
+		mpx := &rsyncwire.MultiplexWriter{Writer: bw}
+		_, cwr := rsyncwire.CounterPair(nil, mpx)
+		c := &rsyncwire.Conn{Writer: cwr}
+		if err := c.WriteInt32(42); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.Len(); got != 0 {
+			t.Fatalf("wrote %d bytes before Flush, want 0", got)
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		// 4 bytes multiplexing header, 4 bytes payload
+		if got, want := out.Len(), 8; got != want {
+			t.Errorf("wrote %d bytes after Flush, want %d", got, want)
+		}
+	})
+}
+
+func TestFramedConn(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	fc := &rsyncwire.FramedConn{
+		Reader: strings.NewReader("\x2a\x00\x00\x00"),
+		Writer: &stdout,
+		Stderr: &stderr,
+	}
+	c := &rsyncwire.Conn{Reader: fc, Writer: fc, ReadDeadliner: fc}
+	got, err := c.ReadInt32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int32(42); got != want {
+		t.Errorf("ReadInt32() = %d, want %d", got, want)
+	}
+
+	// Data is written without multiplexing headers.
+	if err := c.WriteInt32(42); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "\x2a\x00\x00\x00"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+
+	// Text messages go to stderr.
+	if err := c.WriteMsg(rsyncwire.MsgError, []byte("rsync: oops\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stderr.String(), "rsync: oops\n"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+	if got, want := stdout.Len(), 4; got != want {
+		t.Errorf("stdout has %d bytes after WriteMsg, want %d", got, want)
+	}
+
+	// Protocol messages need multiplexing.
+	if err := c.WriteMsg(rsyncwire.MsgSuccess, []byte{0, 0, 0, 0}); err == nil {
+		t.Errorf("WriteMsg(MsgSuccess) unexpectedly succeeded")
+	}
+
+	// strings.Reader does not support deadlines, which Conn ignores.
+	if err := c.SetReadDeadline(time.Now()); err != nil {
+		t.Errorf("SetReadDeadline() = %v, want nil", err)
+	}
+}
+
+func TestInt64(t *testing.T) {
+	for _, tt := range []struct {
+		x    int64
+		want int // encoded length
+	}{
+		{0, 4},
+		{0x7FFFFFFF, 4},
+		{0x80000000, 12},
+		{-1, 12},
+		{math.MinInt64, 12},
+		{math.MaxInt64, 12},
+	} {
+		var buf rsyncwire.Buffer
+		buf.WriteInt64(tt.x)
+		c, out := newConn(27)
+		if err := c.WriteInt64(tt.x); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != buf.String() {
+			t.Errorf("Conn.WriteInt64(%#x) = % x, Buffer.WriteInt64 = % x", tt.x, out.String(), buf.String())
+		}
+		if got := out.Len(); got != tt.want {
+			t.Errorf("WriteInt64(%#x) wrote %d bytes, want %d", tt.x, got, tt.want)
+		}
+		got, err := c.ReadInt64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.x {
+			t.Errorf("ReadInt64() = %#x, want %#x", got, tt.x)
+		}
+		if out.Len() > 0 {
+			t.Errorf("ReadInt64(%#x) left %d bytes unread", tt.x, out.Len())
+		}
+	}
+
+	// A truncated int64 must be reported as such.
+	c, out := newConn(27)
+	out.Write([]byte{0xff, 0xff, 0xff, 0xff, 0x01, 0x02})
+	if _, err := c.ReadInt64(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadInt64(truncated) = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestMultiplexReaderMessages(t *testing.T) {
+	var stream bytes.Buffer
+	mpx := &rsyncwire.MultiplexWriter{Writer: &stream}
+	for _, msg := range []struct {
+		tag  rsyncwire.MsgType
+		text string
+	}{
+		{rsyncwire.MsgInfo, "sending incremental file list\n"},
+		{rsyncwire.MsgError, "rsync: [sender] send_files failed to open \"/srv/secret\": Permission denied (13)\n"},
+		{rsyncwire.MsgData, "\x2a\x00\x00\x00"},
+		{rsyncwire.MsgErrorFatal, "rsync error: error in file IO (code 11)\n"},
+	} {
+		if _, err := mpx.WriteMsg(msg.tag, []byte(msg.text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	mrd := &rsyncwire.MultiplexReader{
+		Env:    &rsyncos.Env{Stdout: &stdout, Stderr: &stderr},
+		Reader: &stream,
+	}
+	c := &rsyncwire.Conn{Reader: mrd}
+	got, err := c.ReadInt32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int32(42); got != want {
+		t.Errorf("ReadInt32() = %d, want %d", got, want)
+	}
+	if got, want := stdout.String(), "sending incremental file list\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "rsync: [sender] send_files failed to open \"/srv/secret\": Permission denied (13)\n"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+	if !mrd.XferError() {
+		t.Errorf("XferError() = false after MSG_ERROR_XFER, want true")
+	}
+
+	// The peer hangs up after its fatal error, which explains the EOF.
+	_, err = c.ReadInt32()
+	if err == nil {
+		t.Fatalf("ReadInt32() after MSG_ERROR unexpectedly succeeded")
+	}
+	if got, want := err.Error(), "rsync error: error in file IO (code 11)"; got != want {
+		t.Errorf("ReadInt32() error = %q, want %q", got, want)
+	}
+	if !strings.HasSuffix(stderr.String(), "rsync error: error in file IO (code 11)\n") {
+		t.Errorf("stderr = %q, want the fatal error at the end", stderr.String())
+	}
+}
+
+func TestMultiplexReaderOutput(t *testing.T) {
+	var stream bytes.Buffer
+	mpx := &rsyncwire.MultiplexWriter{Writer: &stream}
+	for _, msg := range []struct {
+		tag  rsyncwire.MsgType
+		text string
+	}{
+		{rsyncwire.MsgInfo, "sending incremental file list\n"},
+		{rsyncwire.MsgWarning, "file has vanished: \"/srv/tmp\"\n"},
+		{rsyncwire.MsgError, "rsync: read errors mapping \"/srv/disk\"\n"},
+		{rsyncwire.MsgData, "\x2a\x00\x00\x00"},
+	} {
+		if _, err := mpx.WriteMsg(msg.tag, []byte(msg.text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	mrd := &rsyncwire.MultiplexReader{
+		Env:    &rsyncos.Env{}, // must not be written to
+		Reader: &stream,
+		Output: func(tag rsyncwire.MsgType, payload []byte) {
+			got = append(got, tag.String()+": "+string(payload))
+		},
+	}
+	c := &rsyncwire.Conn{Reader: mrd}
+	if _, err := c.ReadInt32(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"MSG_INFO: sending incremental file list\n",
+		"MSG_WARNING: file has vanished: \"/srv/tmp\"\n",
+		"MSG_ERROR_XFER: rsync: read errors mapping \"/srv/disk\"\n",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Output: unexpected messages: diff (-want +got):\n%s", diff)
+	}
+	if !mrd.XferError() {
+		t.Errorf("XferError() = false after MSG_ERROR_XFER, want true")
+	}
+}
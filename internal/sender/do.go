@@ -2,32 +2,46 @@ package sender
 
 import (
 	"fmt"
-	"sort"
+	"io"
+	"time"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
 // rsync/main.c:handle_stats
-func (st *Transfer) handleStats(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, fileList *fileList) error {
+func (st *Transfer) handleStats(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, flistBuildTime time.Duration) error {
 	if !st.Opts.Server() || !st.Opts.Sender() {
 		return nil
 	}
 
 	// send statistics:
 	// total bytes read (from network connection)
-	if err := st.Conn.WriteInt64(crd.BytesRead); err != nil {
+	if err := st.Conn.WriteVarlong30(crd.BytesRead, 3); err != nil {
 		return err
 	}
 	// total bytes written (to network connection)
-	if err := st.Conn.WriteInt64(cwr.BytesWritten); err != nil {
+	if err := st.Conn.WriteVarlong30(cwr.BytesWritten, 3); err != nil {
 		return err
 	}
 	// total size of files
-	if err := st.Conn.WriteInt64(fileList.TotalSize); err != nil {
+	if err := st.Conn.WriteVarlong30(st.totalSize, 3); err != nil {
 		return err
 	}
+	if st.Conn.ProtocolVersion >= 29 {
+		// file list build time and transfer time (in milliseconds). We
+		// transmit the file list while building it, so the transfer time is
+		// included in the build time.
+		if err := st.Conn.WriteVarlong30(flistBuildTime.Milliseconds(), 3); err != nil {
+			return err
+		}
+		if err := st.Conn.WriteVarlong30(0, 3); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -37,15 +51,29 @@ func (st *Transfer) Do(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWri
 		exclusionList = &filterRuleList{}
 	}
 
+	checksum, err := rsynccommon.NewChecksum(st.Conn, st.Seed)
+	if err != nil {
+		return nil, err
+	}
+	st.checksum = checksum
+
+	tokens, err := rsynccommon.NewEncoder(st.Conn, st.Opts.CompressionLevel())
+	if err != nil {
+		return nil, err
+	}
+	st.tokens = tokens
+
 	// “Update exchange” as per
 	// https://github.com/kristapsdz/openrsync/blob/master/rsync.5
 
 	// send file list
 	st.Logger.Printf("SendFileList(modPath=%q, paths=%q)", modPath, paths)
+	flistStart := time.Now()
 	fileList, err := st.SendFileList(modPath, paths, exclusionList)
 	if err != nil {
 		return nil, err
 	}
+	flistBuildTime := time.Since(flistStart)
 	defer fileList.Close()
 
 	if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 3) {
@@ -55,33 +83,46 @@ func (st *Transfer) Do(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWri
 	// Sort the file list. The client sorts, so we need to sort, too (in the
 	// same way!), otherwise our indices do not match what the client will
 	// request.
-	sort.Slice(fileList.Files, func(i, j int) bool {
-		return fileList.Files[i].Wpath < fileList.Files[j].Wpath
-	})
+	sortFileList(st.Conn.ProtocolVersion, fileList.Files)
+	st.startFileLists(fileList)
 
-	if err := st.SendFiles(fileList); err != nil {
+	if err := st.SendFiles(); err != nil {
 		return nil, err
 	}
 
-	if err := st.handleStats(crd, cwr, fileList); err != nil {
+	if err := st.handleStats(crd, cwr, flistBuildTime); err != nil {
 		return nil, err
 	}
 
 	if st.Opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
-		st.Logger.Printf("reading final int32")
+		st.Logger.Printf("reading final goodbye")
 	}
 
-	finish, err := st.Conn.ReadInt32()
+	// rsync/main.c:read_final_goodbye
+	finish, _, err := rsynccommon.ReadNdxAndAttrs(st.Conn)
+	if err == io.EOF && st.Conn.Capabilities.Peer == rsyncwire.PeerOpenrsync {
+		// openrsync may exit right after its last phase instead of sending
+		// the goodbye. All files were transferred by now.
+		finish, err = rsync.NDX_DONE, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if finish != -1 {
-		return nil, fmt.Errorf("protocol error: expected final -1, got %d", finish)
+	if finish != rsync.NDX_DONE {
+		return nil, fmt.Errorf("protocol error: expected final NDX_DONE, got %d", finish)
+	}
+	if st.Conn.ProtocolVersion >= 31 {
+		// acknowledge the goodbye message
+		if err := st.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
+			return nil, err
+		}
 	}
 
 	return &rsyncstats.TransferStats{
 		Read:    crd.BytesRead,
 		Written: cwr.BytesWritten,
-		Size:    fileList.TotalSize,
+		Size:    st.totalSize,
+
+		Compression: st.Conn.Capabilities.Compression,
 	}, nil
 }
@@ -2,7 +2,7 @@ package sender
 
 import (
 	"io"
-	"path/filepath"
+	"path"
 	"strings"
 
 	"github.com/gokrazy/rsync/internal/rsyncwire"
@@ -14,6 +14,10 @@ type filterRuleList struct {
 
 // exclude.c:add_rule
 func (l *filterRuleList) addRule(fr *filterRule) {
+	if fr.flag&filtruleClearList != 0 {
+		l.Filters = nil
+		return
+	}
 	if strings.HasSuffix(fr.pattern, "/") {
 		fr.flag |= filtruleDirectory
 		fr.pattern = strings.TrimSuffix(fr.pattern, "/")
@@ -26,16 +30,58 @@ func (l *filterRuleList) addRule(fr *filterRule) {
 	l.Filters = append(l.Filters, fr)
 }
 
+// Excluded reports whether the file name (relative to the transfer root) is
+// excluded. The first matching rule decides, names which no rule matches are
+// included. Rules with a trailing slash only match directories.
+//
 // exclude.c:check_filter
-func (l *filterRuleList) matches(name string) bool {
+func (l *filterRuleList) Excluded(name string, isDir bool) bool {
 	for _, fr := range l.Filters {
+		if fr.flag&filtruleDirectory != 0 && !isDir {
+			continue
+		}
 		if fr.matches(name) {
-			return true
+			return fr.flag&filtruleInclude == 0
 		}
 	}
 	return false
 }
 
+// ParseFilterRules parses rules as specified with --filter, --exclude and
+// --include (see rsyncopts.Options.FilterRules).
+func ParseFilterRules(rules []string) (*filterRuleList, error) {
+	var l filterRuleList
+	for _, rule := range rules {
+		fr, err := parseFilter(rule)
+		if err != nil {
+			return nil, err
+		}
+		l.addRule(fr)
+	}
+	return &l, nil
+}
+
+// SendFilterList sends rules (see ParseFilterRules) in the protocol 27 wire
+// format: each rule is a length-prefixed string with a “- ” or “+ ” prefix,
+// and a zero length ends the list.
+//
+// exclude.c:send_filter_list
+func SendFilterList(c *rsyncwire.Conn, rules []string) error {
+	l, err := ParseFilterRules(rules)
+	if err != nil {
+		return err
+	}
+	var buf rsyncwire.Buffer
+	for _, fr := range l.Filters {
+		line := fr.String()
+		buf.WriteInt32(int32(len(line)))
+		buf.WriteString(line)
+	}
+	const exclusionListEnd = 0
+	buf.WriteInt32(exclusionListEnd)
+	return c.WriteString(buf.String())
+}
+
 // exclude.c:recv_filter_list
 func RecvFilterList(c *rsyncwire.Conn) (*filterRuleList, error) {
 	var l filterRuleList
@@ -73,16 +119,46 @@ type filterRule struct {
 	pattern string
 }
 
+// String returns the rule as sent on the wire.
+//
+// exclude.c:get_rule_prefix
+func (fr *filterRule) String() string {
+	if fr.flag&filtruleClearList != 0 {
+		return "!"
+	}
+	prefix := "- "
+	if fr.flag&filtruleInclude != 0 {
+		prefix = "+ "
+	}
+	pattern := fr.pattern
+	if fr.flag&filtruleDirectory != 0 {
+		pattern += "/"
+	}
+	return prefix + pattern
+}
+
 // exclude.c:rule_matches
 func (fr *filterRule) matches(name string) bool {
-	if fr.flag&filtruleWild != 0 {
-		panic("wildcard filter rules not yet implemented")
+	pattern := fr.pattern
+	if strings.HasPrefix(pattern, "/") {
+		// anchored to the root of the transfer
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		// Match against as many trailing path components as the pattern
+		// has, e.g. foo/bar matches x/foo/bar.
+		components := strings.Split(name, "/")
+		n := strings.Count(pattern, "/") + 1
+		if len(components) > n {
+			name = strings.Join(components[len(components)-n:], "/")
+		}
 	}
-	if !strings.ContainsRune(fr.pattern, '/') &&
-		fr.flag&filtruleWild == 0 {
-		name = filepath.Base(name)
+	if fr.flag&filtruleWild != 0 {
+		// path.Match covers the wildcards of rsync’s wildmatch, except for
+		// “**”, which matches across slashes.
+		matched, _ := path.Match(pattern, name)
+		return matched
 	}
-	return fr.pattern == name
+	return pattern == name
 }
 
 // exclude.c:parse_filter_str / exclude.c:parse_rule_tok
@@ -0,0 +1,74 @@
+package sender
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+func TestFilterListRoundTrip(t *testing.T) {
+	rules := []string{"- *.o", "+ keep/", "- /build", "- cache/"}
+	var buf bytes.Buffer
+	if err := SendFilterList(&rsyncwire.Conn{Writer: &buf}, rules); err != nil {
+		t.Fatal(err)
+	}
+	l, err := RecvFilterList(&rsyncwire.Conn{Reader: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fr := range l.Filters {
+		got = append(got, fr.String())
+	}
+	if !slices.Equal(got, rules) {
+		t.Errorf("received rules %q, want %q", got, rules)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("%d bytes left after the filter list", buf.Len())
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	l, err := ParseFilterRules([]string{
+		"+ important.o",
+		"- *.o",
+		"- /build",
+		"- cache/",
+		"- dir/file",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{name: "main.o", want: true},
+		{name: "src/main.o", want: true},
+		{name: "src/important.o", want: false}, // first matching rule decides
+		{name: "main.go", want: false},
+		{name: "build", isDir: true, want: true},
+		{name: "src/build", isDir: true, want: false}, // anchored rule
+		{name: "cache", isDir: true, want: true},
+		{name: "cache", isDir: false, want: false}, // directory rule
+		{name: "dir/file", want: true},
+		{name: "other/dir/file", want: true}, // trailing components
+		{name: "otherdir/file", want: false},
+	} {
+		if got := l.Excluded(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%q, isDir=%v) = %v, want %v", tt.name, tt.isDir, got, tt.want)
+		}
+	}
+
+	// A “!” rule clears the rules before it.
+	l, err = ParseFilterRules([]string{"- *.o", "!", "- *.a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Excluded("main.o", false) || !l.Excluded("lib.a", false) {
+		t.Errorf("“!” did not clear the filter list: %q", l.Filters)
+	}
+}
@@ -3,16 +3,20 @@ package sender
 import (
 	"fmt"
 	"io/fs"
+	"math"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gokrazy/rsync"
-	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
@@ -22,6 +26,7 @@ type file struct {
 	path    string
 	Wpath   string
 	regular bool
+	isDir   bool
 
 	// fields below are used by the receiver (TODO: unify)
 	Name       string
@@ -34,10 +39,22 @@ type file struct {
 	Rdev       int32
 }
 
+// An idev identifies a file by device and inode number, so that files which
+// are hard-linked to each other can be recognized.
+type idev struct {
+	dev int64
+	ino int64
+}
+
 type fileList struct {
 	TotalSize int64
 	Files     []file
 	Sources   []FileSource
+	ndxStart  int32 // the file index of Files[0]
+
+	// sent records the names sent so far (true for directories), see
+	// scopedWalker.walkFn.
+	sent map[string]bool
 }
 
 // A fileList must not be used after calling Close().
@@ -58,6 +75,9 @@ func (fl *fileList) Close() {
 // with "file has changed mid-transfer" (issue #53).
 const chunkSize = 32 * 1024
 
+// maxPathLen is the longest file name rsync handles (MAXPATHLEN on Linux).
+const maxPathLen = 4096
+
 var (
 	lookupOnce      sync.Once
 	lookupGroupOnce sync.Once
@@ -86,6 +106,7 @@ type scopedWalker struct {
 	source    FileSource
 	localDir  string
 	requested string
+	root      string // cleaned requested path, set by walk
 	strip     string
 }
 
@@ -106,12 +127,26 @@ func (s *scopedWalker) walk() error {
 	if strings.HasPrefix(rootname, "/") {
 		rootname = "." + rootname
 	}
-	if err := fs.WalkDir(s.source.FS(), filepath.Clean(rootname), s.walkFn); err != nil {
+	s.root = filepath.Clean(rootname)
+	if err := fs.WalkDir(s.source.FS(), s.root, s.walkFn); err != nil {
 		return err
 	}
 	return nil
 }
 
+// walkFn transmits one file list entry per visited path. Each entry starts
+// with a status byte, which may consist of the following bits and determines
+// which of the optional fields are transmitted:
+//
+//	0x01    A top-level directory.  (Only applies to directory files.)  If specified, the matching local directory is for deletions.
+//	0x02    Do not send the file mode: it is a repeat of the last file's mode.
+//	0x08    Like 0x02, but for the user id.
+//	0x10    Like 0x02, but for the group id.
+//	0x20    Inherit some of the prior file name.  Enables the inherited filename length transmission.
+//	0x40    Use full integer length for file name.  Otherwise, use only the byte length.
+//	0x80    Do not send the file modification time: it is a repeat of the last file's.
+//
+// If the status byte is zero, the file-list has terminated.
 func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 	logger := s.st.Logger // for convenience
 	opts := s.st.Opts     // for convenience
@@ -128,6 +163,26 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 		return nil
 	}
 
+	name := path
+	if s.strip != "" {
+		if path+"/" == s.strip {
+			// The requested directory itself (e.g. tr/), whose contents
+			// are transferred.
+			name = "."
+		} else {
+			name = strings.TrimPrefix(name, s.strip)
+		}
+	}
+	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
+		logger.Printf("Trim(path=%q) = %q", path, name)
+	}
+
+	if info.Mode().Type()&os.ModeSymlink != 0 && (opts.CopyLinks() || opts.CopyUnsafeLinks() || opts.CopyDirlinks()) {
+		if w := s.symlinkWalker(path, name); w != nil {
+			return w.followSymlink(path)
+		}
+	}
+
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		logger.Printf("isDir=%v, xferDirs=%v", info.Mode().IsDir(), opts.XferDirs())
 	}
@@ -136,45 +191,243 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 		return filepath.SkipDir
 	}
 
+	protocol := s.conn.ProtocolVersion // for convenience
+
 	// Only ever transmit long names, like openrsync
-	flags := byte(rsync.XMIT_LONG_NAME)
+	flags := uint16(rsync.XMIT_LONG_NAME)
 
-	name := path
-	if s.strip != "" {
-		name = strings.TrimPrefix(name, s.strip)
-	}
-	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
-		logger.Printf("Trim(path=%q) = %q", path, name)
-	}
-	if path == "." {
-		flags |= rsync.XMIT_TOP_DIR
+	if info.IsDir() {
+		// The receiver deletes in the requested directories and, as we
+		// only list the contents of directories when recursing, in all
+		// directories below them. Without --recursive, no directory is
+		// listed with its contents (not even with --dirs).
+		//
+		// rsync/flist.c:send_file_list and send_file_entry
+		if opts.Recurse() && (path == s.root || name == ".") {
+			flags |= rsync.XMIT_TOP_DIR
+		}
+		if !opts.Recurse() && protocol >= 30 {
+			flags |= rsync.XMIT_NO_CONTENT_DIR
+		}
 	}
 	// st.logger.Printf("flags for %q: %v", name, flags)
 
-	if s.excl.matches(name) {
-		return filepath.SkipDir
+	if s.excl.Excluded(name, d.IsDir()) {
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	// Overlapping source arguments (e.g. src1/ and src2/ both containing x)
+	// produce the same name more than once. We only send the first entry of
+	// each name, so that both sides agree on file indices without relying on
+	// the receiver to drop duplicates. A directory is sent even after a
+	// non-directory, because its contents follow: the receiver keeps the
+	// directory, like tridge rsync.
+	//
+	// rsync/flist.c:flist_sort_and_clean
+	if wasDir, ok := s.fileList.sent[name]; ok && (wasDir || !info.IsDir()) {
+		if opts.DebugGTE(rsyncopts.DEBUG_DUP, 1) {
+			logger.Printf("not sending duplicate name %s", name)
+		}
+		return nil
 	}
+	if s.fileList.sent == nil {
+		s.fileList.sent = make(map[string]bool)
+	}
+	s.fileList.sent[name] = info.IsDir()
 
 	s.fileList.Files = append(s.fileList.Files, file{
 		source:  s.source,
 		path:    path,
 		regular: info.Mode().IsRegular(),
+		isDir:   info.IsDir(),
 		Wpath:   name,
 		Length:  info.Size(),
+		ModTime: info.ModTime(),
 	})
 
+	// With incremental recursion, the names of users and groups follow the
+	// first entry which refers to them, instead of the id lists after the
+	// file list. Each id is looked up only once: ids without a name are
+	// recorded with an empty name, which is not transmitted. With
+	// --numeric-ids, no names are transmitted at all.
+	//
+	// rsync/uidlist.c:add_uid, add_gid
+	var uid, gid int32
+	var userName, groupName string
+	if opts.PreserveUid() {
+		var ok bool
+		uid, ok = uidFromFileInfo(info)
+		if ok && !opts.NumericIds() {
+			if _, ok := s.uidMap[uid]; !ok && uid != 0 {
+				u, err := user.LookupId(strconv.Itoa(int(uid)))
+				if err != nil {
+					s.uidMap[uid] = ""
+					lookupOnce.Do(func() {
+						logger.Printf("lookup(%d) = %v", uid, err)
+					})
+				} else {
+					s.uidMap[uid] = u.Username
+					if s.conn.Capabilities.IncRecurse {
+						flags |= rsync.XMIT_USER_NAME_FOLLOWS
+						userName = u.Username
+					}
+				}
+			}
+		}
+	}
+	if opts.PreserveGid() {
+		var ok bool
+		gid, ok = gidFromFileInfo(info)
+		if ok && !opts.NumericIds() {
+			if _, ok := s.gidMap[gid]; !ok && gid != 0 {
+				g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
+				if err != nil {
+					s.gidMap[gid] = ""
+					lookupGroupOnce.Do(func() {
+						logger.Printf("lookupgroup(%d) = %v", gid, err)
+					})
+				} else {
+					s.gidMap[gid] = g.Name
+					if s.conn.Capabilities.IncRecurse {
+						flags |= rsync.XMIT_GROUP_NAME_FOLLOWS
+						groupName = g.Name
+					}
+				}
+			}
+		}
+	}
+
+	// With -H, the receiver learns which files are hard-linked to each other:
+	// starting with protocol 30, by the index of the first file of each
+	// group, before that, by device and inode number.
+	//
+	// rsync/flist.c:make_file (tmp_dev), send_file_entry
+	firstHlinkNdx := int32(-1)
+	var hlink *idev
+	if opts.PreserveHardLinks() {
+		id, nlink, ok := idevFromFileInfo(info)
+		if ok && (protocol >= 28 && !info.IsDir() && nlink > 1 ||
+			protocol < 28 && info.Mode().IsRegular()) {
+			flags |= rsync.XMIT_HLINKED // XMIT_HAS_IDEV_DATA before protocol 30
+			if protocol >= 30 {
+				ndx := s.fileList.ndxStart + int32(len(s.fileList.Files)) - 1
+				if first, ok := s.st.hlinks[id]; ok {
+					firstHlinkNdx = first
+				} else {
+					s.st.hlinks[id] = ndx
+					flags |= rsync.XMIT_HLINK_FIRST
+				}
+			} else {
+				// Like rsync, offset the device number so that it is never 0.
+				id.dev++
+				if id.dev == s.st.hlinkDev {
+					if protocol >= 28 {
+						flags |= rsync.XMIT_SAME_DEV
+					}
+				} else {
+					s.st.hlinkDev = id.dev
+				}
+				hlink = &id
+			}
+		}
+	}
+
+	// Since protocol 31, the nanoseconds of the modification time (if any)
+	// follow the seconds.
+	//
+	// rsync/flist.c:send_file_entry (XMIT_MOD_NSEC)
+	if protocol >= 31 && info.ModTime().Nanosecond() != 0 {
+		flags |= rsync.XMIT_MOD_NSEC
+	}
+
+	// Devices transmit their major and minor numbers, which rsync omits when
+	// they can be derived from the previous device.
+	//
+	// rsync/flist.c:send_file_entry
+	isDev := info.Mode().Type()&os.ModeDevice != 0
+	isSpecial := info.Mode().Type()&(os.ModeNamedPipe|os.ModeSocket) != 0
+	var rdevMajor, rdevMinor uint32
+	switch {
+	case firstHlinkNdx >= s.fileList.ndxStart:
+		// The receiver copies the device number from the first file of the
+		// hard link group, leaving its state untouched.
+
+	case opts.PreserveDevices() && isDev:
+		rdevMajor, rdevMinor, _ = rdevFromFileInfo(info)
+		if protocol < 28 {
+			if rdev := rsynccommon.MakeRdev(rdevMajor, rdevMinor); rdev == s.st.rdev {
+				flags |= rsync.XMIT_SAME_RDEV_pre28
+			} else {
+				s.st.rdev = rdev
+			}
+		} else {
+			if rdevMajor == s.st.rdevMajor {
+				flags |= rsync.XMIT_SAME_RDEV_MAJOR
+			} else {
+				s.st.rdevMajor = rdevMajor
+			}
+			if protocol < 30 && rdevMinor <= 0xff {
+				flags |= rsync.XMIT_RDEV_MINOR_8_pre30
+			}
+		}
+
+	case opts.PreserveSpecials() && isSpecial && protocol < 31:
+		// Special files do not need an rdev number, so make its
+		// (historical) transmission as small as possible.
+		if protocol < 28 {
+			flags |= rsync.XMIT_SAME_RDEV_pre28
+		} else {
+			rdevMajor = s.st.rdevMajor
+			flags |= rsync.XMIT_SAME_RDEV_MAJOR
+			if protocol < 30 {
+				flags |= rsync.XMIT_RDEV_MINOR_8_pre30
+			}
+		}
+
+	case protocol < 28:
+		s.st.rdev = 0
+	}
+
 	s.fec.Reset()
 
 	// 1.   status byte (integer)
-	s.fec.WriteByte(flags)
+	if s.conn.Capabilities.VarintFileListFlags {
+		if flags == 0 {
+			// 0 would end the file list
+			flags = rsync.XMIT_EXTENDED_FLAGS
+		}
+		s.fec.WriteVarint(int32(flags))
+	} else if protocol >= 28 && (flags&0xff00 != 0 || flags == 0) {
+		flags |= rsync.XMIT_EXTENDED_FLAGS
+		s.fec.WriteShortInt(flags)
+	} else {
+		s.fec.WriteByte(byte(flags))
+	}
 
 	// 2.   inherited filename length (optional, byte)
 	// 3.   filename length (integer or byte)
-	s.fec.WriteInt32(int32(len(name)))
+	if protocol >= 30 {
+		s.fec.WriteVarint(int32(len(name)))
+	} else {
+		s.fec.WriteInt32(int32(len(name)))
+	}
 
 	// 4.   file (byte array)
 	s.fec.WriteString(name)
 
+	if firstHlinkNdx >= 0 {
+		s.fec.WriteVarint(firstHlinkNdx)
+		if firstHlinkNdx >= s.fileList.ndxStart {
+			// The receiver copies the remaining fields from the first file
+			// of the group, which is part of the same file list.
+			s.fileList.TotalSize += info.Size()
+			return s.conn.WriteString(s.fec.String())
+		}
+	}
+
 	// 5.   file length (long)
 	size := info.Size()
 	if info.Mode().IsDir() {
@@ -183,18 +436,38 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 		// system type.
 		size = 4096
 	}
-	s.fec.WriteInt64(size)
+	if protocol >= 30 {
+		s.fec.WriteVarlong(size, 3)
+	} else {
+		s.fec.WriteInt64(size)
+	}
 
 	s.fileList.TotalSize += size
 
 	// 6.   file modification time (optional, integer)
-	// TODO: this will overflow in 2038! :(
-	s.fec.WriteInt32(int32(info.ModTime().Unix()))
+	if protocol >= 30 {
+		s.fec.WriteVarlong(info.ModTime().Unix(), 4)
+	} else {
+		// Older protocols transmit 32 bits, which tridge rsync reads as
+		// unsigned (covering 1970 until 2106), so clamp instead of letting
+		// far-future or pre-1970 times wrap around.
+		mtime := info.ModTime().Unix()
+		if clamped := min(max(mtime, 0), math.MaxUint32); clamped != mtime {
+			msg := fmt.Sprintf("%s: modification time %v cannot be represented in protocol %d, sending %v instead",
+				path, info.ModTime().UTC(), protocol, time.Unix(clamped, 0).UTC())
+			if err := s.st.warn(msg); err != nil {
+				return err
+			}
+			mtime = clamped
+		}
+		s.fec.WriteInt32(int32(uint32(mtime)))
+	}
+	if flags&rsync.XMIT_MOD_NSEC != 0 {
+		s.fec.WriteVarint(int32(info.ModTime().Nanosecond()))
+	}
 
 	// 7.   file mode (optional, mode_t, integer)
 	mode := int32(info.Mode() & os.ModePerm)
-	isDev := false
-	isSpecial := false
 	if info.Mode().IsDir() {
 		mode |= rsync.S_IFDIR
 	} else if info.Mode().IsRegular() {
@@ -206,65 +479,74 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 
 	if info.Mode().Type()&os.ModeCharDevice != 0 {
 		mode |= rsync.S_IFCHR
-		isDev = true
 	} else if info.Mode().Type()&os.ModeDevice != 0 {
 		mode |= rsync.S_IFBLK
-		isDev = true
 	}
 
 	if info.Mode().Type()&os.ModeNamedPipe != 0 {
 		mode |= rsync.S_IFIFO
-		isSpecial = true
 	}
 
 	if info.Mode().Type()&os.ModeSocket != 0 {
 		mode |= rsync.S_IFSOCK
-		isSpecial = true
 	}
 
 	s.fec.WriteInt32(mode)
 
 	if opts.PreserveUid() {
-		uid, ok := uidFromFileInfo(info)
-		if ok {
-			if _, ok := s.uidMap[uid]; !ok && uid != 0 {
-				u, err := user.LookupId(strconv.Itoa(int(uid)))
-				if err != nil {
-					lookupOnce.Do(func() {
-						logger.Printf("lookup(%d) = %v", uid, err)
-					})
-				} else {
-					s.uidMap[uid] = u.Username
-				}
-			}
-		}
 		// 8.   if -o, the user id (integer)
-		s.fec.WriteInt32(uid)
+		if protocol >= 30 {
+			s.fec.WriteVarint(uid)
+		} else {
+			s.fec.WriteInt32(uid)
+		}
+		if userName != "" {
+			s.fec.WriteByte(byte(len(userName)))
+			s.fec.WriteString(userName)
+		}
 	}
 
 	if opts.PreserveGid() {
-		gid, ok := gidFromFileInfo(info)
-		if ok {
-			if _, ok := s.gidMap[gid]; !ok && gid != 0 {
-				g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
-				if err != nil {
-					lookupGroupOnce.Do(func() {
-						logger.Printf("lookupgroup(%d) = %v", gid, err)
-					})
-				} else {
-					s.gidMap[gid] = g.Name
-				}
-			}
-		}
 		// 9.   if -g, the group id (integer)
-		s.fec.WriteInt32(gid)
+		if protocol >= 30 {
+			s.fec.WriteVarint(gid)
+		} else {
+			s.fec.WriteInt32(gid)
+		}
+		if groupName != "" {
+			s.fec.WriteByte(byte(len(groupName)))
+			s.fec.WriteString(groupName)
+		}
 	}
 
+	// Starting with protocol 31, special files (FIFOs and sockets) no longer
+	// transmit an rdev number.
 	if (opts.PreserveDevices() && isDev) ||
-		(opts.PreserveSpecials() && isSpecial) {
+		(opts.PreserveSpecials() && isSpecial && protocol < 31) {
 		// 10.  if a special file and -D, the device “rdev” type (integer)
-		rdev, _ := rdevFromFileInfo(info)
-		s.fec.WriteInt32(rdev)
+		if protocol < 28 {
+			if flags&rsync.XMIT_SAME_RDEV_pre28 == 0 {
+				s.fec.WriteInt32(s.st.rdev)
+			}
+		} else {
+			// Starting with protocol 28, major and minor are transmitted
+			// separately.
+			if flags&rsync.XMIT_SAME_RDEV_MAJOR == 0 {
+				if protocol >= 30 {
+					s.fec.WriteVarint(int32(rdevMajor))
+				} else {
+					s.fec.WriteInt32(int32(rdevMajor))
+				}
+			}
+			switch {
+			case protocol >= 30:
+				s.fec.WriteVarint(int32(rdevMinor))
+			case flags&rsync.XMIT_RDEV_MINOR_8_pre30 != 0:
+				s.fec.WriteByte(byte(rdevMinor))
+			default:
+				s.fec.WriteInt32(int32(rdevMinor))
+			}
+		}
 	}
 
 	if opts.PreserveLinks() && info.Mode().Type()&os.ModeSymlink != 0 {
@@ -275,19 +557,36 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err // TODO
 		}
-		s.fec.WriteInt32(int32(len(target)))
+		if opts.MungeLinks() && len(target) > len(rsync.SYMLINK_PREFIX) {
+			// Restore the symlinks a --munge-links receiver stored.
+			//
+			// rsync/syscall.c:do_readlink
+			target = strings.TrimPrefix(target, rsync.SYMLINK_PREFIX)
+		}
+		if protocol >= 30 {
+			s.fec.WriteVarint(int32(len(target)))
+		} else {
+			s.fec.WriteInt32(int32(len(target)))
+		}
 		s.fec.WriteString(target)
 	}
 
-	if opts.AlwaysChecksum() {
-		var emptyChecksum [rsyncchecksum.Size]byte
-		checksum := emptyChecksum[:]
+	if hlink != nil {
+		if flags&rsync.XMIT_SAME_DEV == 0 {
+			s.fec.WriteInt64(hlink.dev)
+		}
+		s.fec.WriteInt64(hlink.ino)
+	}
+
+	// Starting with protocol 28, only regular files have a checksum.
+	if opts.AlwaysChecksum() && (info.Mode().IsRegular() || protocol < 28) {
+		checksum := make([]byte, s.st.checksum.Size())
 		if info.Mode().IsRegular() {
 			f, err := s.source.Open(path)
 			if err != nil {
 				return err
 			}
-			checksum, err = rsyncchecksum.ReaderChecksum(f)
+			checksum, err = s.st.checksum.File(f)
 			f.Close()
 			if err != nil {
 				return err
@@ -300,32 +599,135 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 
 	s.conn.WriteString(s.fec.String())
 
-	// The status byte may consist of the following bits and determines which of the optional fields are transmitted.
-
-	// 0x01    A top-level directory.  (Only applies to directory files.)  If specified, the matching local directory is for deletions.
-	// 0x02    Do not send the file mode: it is a repeat of the last file's mode.
-	// 0x08    Like 0x02, but for the user id.
-	// 0x10    Like 0x02, but for the group id.
-	// 0x20    Inherit some of the prior file name.  Enables the inherited filename length transmission.
-	// 0x40    Use full integer length for file name.  Otherwise, use only the byte length.
-	// 0x80    Do not send the file modification time: it is a repeat of the last file's.
-
-	// If the status byte is zero, the file-list has terminated.
-
 	if info.Mode().IsDir() && !opts.Recurse() {
 		return filepath.SkipDir
 	}
 
+	if info.Mode().IsDir() && name != "." && s.conn.Capabilities.IncRecurse {
+		// The directory’s contents follow in a file list of their own.
+		return filepath.SkipDir
+	}
+
+	return nil
+}
+
+// symlinkWalker returns the walker to follow the symlink at path with if
+// --copy-links is given, if --copy-unsafe-links is given and the symlink
+// points outside of the transfer, or if --copy-dirlinks is given and the
+// symlink points to a directory. Otherwise, it returns nil and the symlink is
+// sent as a symlink.
+//
+// rsync/flist.c:readlink_stat
+func (s *scopedWalker) symlinkWalker(path, name string) *scopedWalker {
+	opts := s.st.Opts // for convenience
+	unsafe := false
+	if target, err := s.source.Readlink(path); err == nil {
+		unsafe = rsynccommon.UnsafeSymlink(target, name)
+	}
+	w := s
+	if unsafe && !s.st.Confined {
+		w = s.unconfinedWalker()
+	}
+	switch {
+	case opts.CopyLinks(), opts.CopyUnsafeLinks() && unsafe:
+		return w
+	case opts.CopyDirlinks():
+		if st, err := fs.Stat(w.source.FS(), path); err == nil && st.IsDir() {
+			return w
+		}
+	}
 	return nil
 }
 
+// unconfinedWalker returns a copy of the walker which can follow symlinks
+// pointing outside of the source directory. The os.Root refuses to leave the
+// source directory, as it should for all other file operations.
+func (s *scopedWalker) unconfinedWalker() *scopedWalker {
+	u, ok := s.source.(unconfinedSource)
+	if !ok {
+		return s
+	}
+	source, err := u.unconfined()
+	if err != nil {
+		s.ioError(err)
+		return s
+	}
+	sub := *s
+	sub.source = source
+	return &sub
+}
+
+// followSymlink sends the referent of the symlink at path in its place: a file
+// is sent like a file of that name, a directory including its contents.
+func (s *scopedWalker) followSymlink(path string) error {
+	linked, err := fs.Stat(s.source.FS(), path)
+	if err != nil {
+		s.ioError(fmt.Errorf("symlink has no referent: %q", path))
+		return nil
+	}
+	if linked.IsDir() {
+		if s.linksToParent(path, linked) {
+			s.ioError(fmt.Errorf("symlink %q refers to a parent directory, not following", path))
+			return nil
+		}
+		// fs.WalkDir only descends into directories, not into symlinks,
+		// but follows a symlink given as its root.
+		return fs.WalkDir(s.source.FS(), path, s.walkFn)
+	}
+	return s.walkFn(path, fs.FileInfoToDirEntry(linked), nil)
+}
+
+// linksToParent reports whether dir, the directory which the symlink at name
+// refers to, is one of the directories containing name: following the symlink
+// would then never end. Directories are identified by device and inode number,
+// so that the check works regardless of how name was reached. Where those are
+// not available, the walk stops once name exceeds the maximum path length.
+func (s *scopedWalker) linksToParent(name string, dir fs.FileInfo) bool {
+	id, _, ok := idevFromFileInfo(dir)
+	if !ok {
+		return len(name) > maxPathLen
+	}
+	visited := make(map[idev]bool)
+	for parent := path.Dir(name); ; parent = path.Dir(parent) {
+		if info, err := fs.Stat(s.source.FS(), parent); err == nil {
+			if pid, _, ok := idevFromFileInfo(info); ok {
+				visited[pid] = true
+			}
+		}
+		if parent == "." || parent == "/" {
+			break
+		}
+	}
+	return visited[id]
+}
+
+// ioError sets the I/O error flag, which the receiver checks before deleting
+// files, and logs err.
+func (st *Transfer) ioError(err error) {
+	if os.IsNotExist(err) {
+		st.Logger.Printf("file vanished: %v", err)
+	} else {
+		st.Logger.Printf("lstat: %v", err)
+	}
+	st.ioErrors |= rsync.IOERR_GENERAL
+}
+
 // rsync/flist.c:send_file_list
 func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRuleList) (*fileList, error) {
 	var fileList fileList
 	fec := &rsyncwire.Buffer{}
 
-	uidMap := make(map[int32]string)
-	gidMap := make(map[int32]string)
+	if excl == nil {
+		excl = &filterRuleList{}
+	}
+	st.excl = excl
+	st.uidMap = make(map[int32]string)
+	st.gidMap = make(map[int32]string)
+	st.hlinks = make(map[idev]int32)
+	if st.Conn.Capabilities.IncRecurse {
+		// File index 0 is reserved, see startFileLists.
+		fileList.ndxStart = 1
+	}
 
 	// TODO: flush in between to keep the pipes filled when traversal takes long
 
@@ -336,16 +738,6 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 	if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		st.Logger.Printf("sendFileList()")
 	}
-	ioErrors := int32(0)
-
-	ioError := func(err error) {
-		if os.IsNotExist(err) {
-			st.Logger.Printf("file vanished: %v", err)
-		} else {
-			st.Logger.Printf("lstat: %v", err)
-		}
-		ioErrors = 1
-	}
 
 	for _, requested := range paths {
 		local := localDir
@@ -376,11 +768,11 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 			conn:      st.Conn,
 			fec:       fec,
 			excl:      excl,
-			uidMap:    uidMap,
-			gidMap:    gidMap,
+			uidMap:    st.uidMap,
+			gidMap:    st.gidMap,
 			fileList:  &fileList,
 			source:    st.Source,
-			ioError:   ioError,
+			ioError:   st.ioError,
 			localDir:  local,
 			requested: requested,
 			strip:     strip,
@@ -395,33 +787,307 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 	}
 
 	fec.Reset()
+	st.writeEndOfFileList(fec)
 
-	const endOfFileList = 0
-	fec.WriteByte(endOfFileList)
-
+	// rsync/uidlist.c:send_id_list
+	protocol := st.Conn.ProtocolVersion
+	writeID := fec.WriteInt32
+	if protocol >= 30 {
+		writeID = fec.WriteVarint
+	}
 	const endOfSet = 0
-	if st.Opts.PreserveUid() {
-		for uid, name := range uidMap {
-			fec.WriteInt32(uid)
+	// With incremental recursion, the names were sent with the entries. With
+	// --numeric-ids, neither side expects the id lists.
+	sendIdLists := !st.Conn.Capabilities.IncRecurse && !st.Opts.NumericIds()
+	if st.Opts.PreserveUid() && sendIdLists {
+		for uid, name := range st.uidMap {
+			if name == "" {
+				continue
+			}
+			writeID(uid)
 			fec.WriteByte(byte(len(name)))
 			fec.WriteString(name)
 		}
-		fec.WriteInt32(endOfSet)
+		writeID(endOfSet)
 	}
-	if st.Opts.PreserveGid() {
-		for gid, name := range gidMap {
-			fec.WriteInt32(gid)
+	if st.Opts.PreserveGid() && sendIdLists {
+		for gid, name := range st.gidMap {
+			if name == "" {
+				continue
+			}
+			writeID(gid)
 			fec.WriteByte(byte(len(name)))
 			fec.WriteString(name)
 		}
-		fec.WriteInt32(endOfSet)
+		writeID(endOfSet)
 	}
 
-	fec.WriteInt32(ioErrors)
+	if protocol < 30 {
+		fec.WriteInt32(st.ioErrors)
+	}
 
 	if err := st.Conn.WriteString(fec.String()); err != nil {
 		return nil, err
 	}
 
+	if err := st.reportIOErrors(); err != nil {
+		return nil, err
+	}
+
+	// The receiver cannot start generating before it has the file list.
+	if err := st.Conn.Flush(); err != nil {
+		return nil, err
+	}
+
 	return &fileList, nil
 }
+
+// writeEndOfFileList appends the end of file list marker to fec.
+//
+// rsync/flist.c:write_end_of_flist
+func (st *Transfer) writeEndOfFileList(fec *rsyncwire.Buffer) {
+	safeFileList := st.Conn.Capabilities.SafeFileList
+	if st.Conn.Capabilities.VarintFileListFlags {
+		fec.WriteVarint(0)
+		if safeFileList {
+			fec.WriteVarint(st.ioErrors)
+		} else {
+			fec.WriteVarint(0)
+		}
+	} else if st.ioErrors != 0 && safeFileList {
+		// The end marker carries the I/O error flag.
+		fec.WriteShortInt(rsync.XMIT_EXTENDED_FLAGS | rsync.XMIT_IO_ERROR_ENDLIST)
+		fec.WriteVarint(st.ioErrors)
+	} else {
+		const endOfFileList = 0
+		fec.WriteByte(endOfFileList)
+	}
+}
+
+// reportIOErrors sends the I/O error flag in a MSG_IO_ERROR message if the end
+// of file list marker could not carry it (protocol 30 without a safe file
+// list), once.
+func (st *Transfer) reportIOErrors() error {
+	if st.ioErrors == 0 || st.ioErrorsReported ||
+		st.Conn.ProtocolVersion < 30 || st.Conn.Capabilities.SafeFileList {
+		return nil
+	}
+	st.ioErrorsReported = true
+	var buf rsyncwire.Buffer
+	buf.WriteInt32(st.ioErrors)
+	return st.Conn.WriteMsg(rsyncwire.MsgIOError, []byte(buf.String()))
+}
+
+// sortFileList sorts files like the receiver does, so that file indices refer
+// to the same files on both sides.
+//
+// rsync/flist.c:flist_sort_and_clean
+func sortFileList(protocol int32, files []file) {
+	slices.SortFunc(files, func(a, b file) int {
+		return rsynccommon.CompareFileNames(protocol, a.Wpath, a.isDir, b.Wpath, b.isDir)
+	})
+}
+
+// minFileCntLookahead is the number of files the sender keeps sending file
+// lists ahead of the oldest file list the receiver works on (incremental
+// recursion).
+//
+// rsync/rsync.h:MIN_FILECNT_LOOKAHEAD
+const minFileCntLookahead = 1000
+
+// A dirNode is a directory whose contents the sender sends (or sent) in a
+// file list of their own (incremental recursion). The receiver refers to
+// directories by their index in the list of all directories. The nodes form
+// a tree of the directories still to be sent.
+//
+// rsync/flist.c:dir_flist, DIR_PARENT, DIR_FIRST_CHILD, DIR_NEXT_SIBLING
+type dirNode struct {
+	f           file
+	parent      int32
+	firstChild  int32
+	nextSibling int32
+}
+
+// strip returns the prefix to remove from paths below the directory to get
+// file list names (see getStrip).
+func (d *dirNode) strip() string {
+	if d.f.Wpath == "." {
+		return d.f.path + "/"
+	}
+	return strings.TrimSuffix(d.f.path, d.f.Wpath)
+}
+
+// addDirsToTree appends the directories of the sorted file list fl to the
+// list of all directories, as children of the directory with index parent
+// (-1 for the initial file list).
+//
+// rsync/flist.c:add_dirs_to_tree
+func (st *Transfer) addDirsToTree(parent int32, fl *fileList) {
+	prev := int32(-1)
+	for _, f := range fl.Files {
+		if !f.isDir {
+			continue
+		}
+		st.dirs = append(st.dirs, dirNode{
+			f:           f,
+			parent:      parent,
+			firstChild:  -1,
+			nextSibling: -1,
+		})
+		ndx := int32(len(st.dirs) - 1)
+		if f.Wpath == "." {
+			// The contents of the top directory are part of the initial
+			// file list.
+			continue
+		}
+		switch {
+		case prev >= 0:
+			st.dirs[prev].nextSibling = ndx
+		case parent >= 0:
+			st.dirs[parent].firstChild = ndx
+		case st.sendDirNdx < 0:
+			st.sendDirNdx = ndx
+		}
+		prev = ndx
+	}
+}
+
+// startFileLists sets up the sorted initial file list as the first of the
+// file lists the receiver works on.
+func (st *Transfer) startFileLists(fl *fileList) {
+	st.flists = []*fileList{fl}
+	st.lastList = fl
+	st.totalSize = fl.TotalSize
+	if !st.Conn.Capabilities.IncRecurse {
+		st.flistEOF = true
+		return
+	}
+	// With incremental recursion, file index 0 is reserved.
+	fl.ndxStart = 1
+	st.sendDirNdx = -1
+	st.addDirsToTree(-1, fl)
+}
+
+// needFileList reports whether the sender should send another file list
+// before reading the next request: the receiver must always have the file
+// list following the one it works on, so that it can finish that one.
+func (st *Transfer) needFileList() bool {
+	if st.flistEOF {
+		return false
+	}
+	if len(st.flists) < 2 {
+		return true
+	}
+	ahead := st.lastList.ndxStart + int32(len(st.lastList.Files)) - st.flists[1].ndxStart
+	return ahead < minFileCntLookahead
+}
+
+// sendExtraFileLists sends the contents of further directories, depth-first,
+// as long as the receiver needs more file lists (incremental recursion).
+// Once all directories are sent, it sends NDX_FLIST_EOF.
+//
+// rsync/flist.c:send_extra_file_list
+func (st *Transfer) sendExtraFileLists() error {
+	if !st.needFileList() {
+		return nil
+	}
+	for st.needFileList() {
+		if st.sendDirNdx < 0 {
+			if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
+				st.Logger.Printf("sending NDX_FLIST_EOF")
+			}
+			if err := st.Conn.WriteNdx(rsync.NDX_FLIST_EOF); err != nil {
+				return err
+			}
+			st.flistEOF = true
+			break
+		}
+		ndx := st.sendDirNdx
+		if err := st.Conn.WriteNdx(rsync.NDX_FLIST_OFFSET - ndx); err != nil {
+			return err
+		}
+		fl, err := st.sendDirectory(&st.dirs[ndx])
+		if err != nil {
+			return err
+		}
+		sortFileList(st.Conn.ProtocolVersion, fl.Files)
+		st.flists = append(st.flists, fl)
+		st.lastList = fl
+		st.totalSize += fl.TotalSize
+		st.addDirsToTree(ndx, fl)
+
+		// Continue with the first subdirectory or, if there is none, with
+		// the next sibling of the closest directory which has one.
+		if child := st.dirs[ndx].firstChild; child >= 0 {
+			st.sendDirNdx = child
+			continue
+		}
+		for st.sendDirNdx = -1; ndx >= 0; ndx = st.dirs[ndx].parent {
+			if next := st.dirs[ndx].nextSibling; next >= 0 {
+				st.sendDirNdx = next
+				break
+			}
+		}
+	}
+	return st.Conn.Flush()
+}
+
+// sendDirectory sends the contents of dir as a file list, without descending
+// into subdirectories.
+//
+// rsync/flist.c:send_directory
+func (st *Transfer) sendDirectory(dir *dirNode) (*fileList, error) {
+	fl := fileList{
+		ndxStart: st.lastList.ndxStart + int32(len(st.lastList.Files)) + 1,
+	}
+	fec := &rsyncwire.Buffer{}
+	sw := &scopedWalker{
+		st:       st,
+		conn:     st.Conn,
+		fec:      fec,
+		excl:     st.excl,
+		uidMap:   st.uidMap,
+		gidMap:   st.gidMap,
+		fileList: &fl,
+		source:   dir.f.source,
+		ioError:  st.ioError,
+		strip:    dir.strip(),
+	}
+	entries, err := fs.ReadDir(dir.f.source.FS(), dir.f.path)
+	if err != nil {
+		// set the I/O error flag, but send the entries we got
+		st.ioError(err)
+	}
+	for _, entry := range entries {
+		err := sw.walkFn(path.Join(dir.f.path, entry.Name()), entry, nil)
+		if err != nil && err != filepath.SkipDir {
+			return nil, err
+		}
+	}
+	fec.Reset()
+	st.writeEndOfFileList(fec)
+	if err := st.Conn.WriteString(fec.String()); err != nil {
+		return nil, err
+	}
+	if err := st.reportIOErrors(); err != nil {
+		return nil, err
+	}
+	if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
+		st.Logger.Printf("sent file list for %s: %d files", dir.f.Wpath, len(fl.Files))
+	}
+	return &fl, nil
+}
+
+// fileForNdx returns the file with index ndx from the file lists the receiver
+// works on, or nil if ndx is not part of any.
+//
+// rsync/flist.c:flist_for_ndx
+func (st *Transfer) fileForNdx(ndx int32) *file {
+	i := sort.Search(len(st.flists), func(i int) bool {
+		return st.flists[i].ndxStart+int32(len(st.flists[i].Files)) > ndx
+	})
+	if i == len(st.flists) || ndx < st.flists[i].ndxStart {
+		return nil
+	}
+	return &st.flists[i].Files[ndx-st.flists[i].ndxStart]
+}
@@ -2,14 +2,13 @@ package sender
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"hash"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
-	"github.com/mmcloughlin/md4"
 )
 
 type target struct {
@@ -18,14 +17,8 @@ type target struct {
 }
 
 // rsync/match.c:hash_search
-func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head rsync.SumHead, fileIndex int32, fl file) error {
+func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head rsync.SumHead, fileIndex int32, attrs rsynccommon.ItemAttrs, fl file, f File) error {
 	st.Logger.Printf("hashSearch(path=%s, len(sums)=%d)", fl.path, len(head.Sums))
-	f, err := fl.source.Open(fl.path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
 	fi, err := f.Stat()
 	if err != nil {
 		return err
@@ -34,7 +27,7 @@ func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head r
 	readSize := max(3*head.BlockLength, 256*1024)
 	ms := mapFile(f, fi.Size(), readSize, head.BlockLength)
 
-	if err := st.Conn.WriteInt32(fileIndex); err != nil {
+	if err := rsynccommon.WriteNdxAndAttrs(st.Conn, fileIndex, attrs); err != nil {
 		return err
 	}
 
@@ -49,8 +42,7 @@ func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head r
 	}
 
 	// sum_init()
-	h := md4.New()
-	binary.Write(h, binary.LittleEndian, st.Seed)
+	h := st.checksum.NewFileHash()
 
 	// The following quotes are citations from
 	// https://www.samba.org/~tridge/phd_thesis.pdf, section 3.2.6 The
@@ -71,9 +63,11 @@ func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head r
 	st.Logger.Printf("last block len=%d, end=%d", head.Sums[len(head.Sums)-1].Len, end)
 
 	readChunk := func() error {
+		// Compare in int64: on 32-bit platforms, int cannot hold the
+		// remaining length of files larger than 2 GiB.
 		k = int(head.BlockLength)
-		if remaining := int(fi.Size() - offset); remaining < k {
-			k = remaining
+		if remaining := fi.Size() - offset; remaining < int64(k) {
+			k = int(remaining)
 		}
 
 		chunk, err := ms.ptr(offset, int32(k))
@@ -126,7 +120,7 @@ Outer:
 					if err != nil {
 						return err
 					}
-					sum2 = rsyncchecksum.Checksum2(st.Seed, buf[:])
+					sum2 = st.checksum.Block(buf[:])
 					doneCsum2 = true
 				}
 
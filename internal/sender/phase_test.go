@@ -0,0 +1,230 @@
+package sender
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// genMsg is a message from the generator to the sender: a request for the
+// file at ndx (with an empty sum head, i.e. the whole file), or NDX_DONE.
+type genMsg struct {
+	ndx   int32
+	flags uint16 // ITEM_* flags (protocol >= 29)
+}
+
+var done = genMsg{ndx: rsync.NDX_DONE}
+
+func transfer(ndx int32) genMsg { return genMsg{ndx: ndx, flags: rsync.ITEM_TRANSFER} }
+
+func (m genMsg) String() string {
+	if m.ndx == rsync.NDX_DONE {
+		return "DONE"
+	}
+	if m.flags&rsync.ITEM_TRANSFER != 0 {
+		return fmt.Sprintf("transfer(%d)", m.ndx)
+	}
+	return fmt.Sprintf("item(%d)", m.ndx)
+}
+
+// encodeGenerator encodes msgs the way tridge rsync’s generator sends them.
+func encodeGenerator(t *testing.T, protocol int32, msgs []genMsg) []byte {
+	var buf bytes.Buffer
+	c := &rsyncwire.Conn{Writer: &buf, ProtocolVersion: protocol}
+	for _, m := range msgs {
+		if m.ndx == rsync.NDX_DONE {
+			if err := c.WriteNdx(m.ndx); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := rsynccommon.WriteNdxAndAttrs(c, m.ndx, rsynccommon.ItemAttrs{Flags: m.flags}); err != nil {
+			t.Fatal(err)
+		}
+		if m.flags&rsync.ITEM_TRANSFER == 0 {
+			continue
+		}
+		var head rsync.SumHead
+		if err := head.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodeSender decodes the messages the sender sent, skipping over file data.
+func decodeSender(t *testing.T, st *Transfer, wire []byte) []genMsg {
+	c := &rsyncwire.Conn{Reader: bytes.NewReader(wire), ProtocolVersion: st.Conn.ProtocolVersion}
+	dec, err := rsynccommon.NewDecoder(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []genMsg
+	for {
+		ndx, attrs, err := rsynccommon.ReadNdxAndAttrs(c)
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, genMsg{ndx: ndx, flags: attrs.Flags})
+		if ndx < 0 || attrs.Flags&rsync.ITEM_TRANSFER == 0 {
+			continue
+		}
+		var head rsync.SumHead
+		if err := head.ReadFrom(c); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			token, _, err := dec.ReadToken(c.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == 0 {
+				break
+			}
+		}
+		sum := make([]byte, st.checksum.Size())
+		if _, err := io.ReadFull(c.Reader, sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestPhases replays the messages which tridge rsync’s generator sends for a
+// transfer and verifies that the sender answers each phase like tridge
+// rsync’s sender would.
+func TestPhases(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		protocol int32
+		gen      []genMsg
+		want     []genMsg
+		wantErr  string
+	}{
+		{
+			name:     "zero files",
+			protocol: 27,
+			gen:      []genMsg{done, done},
+			want:     []genMsg{done, done},
+		},
+		{
+			name:     "zero files",
+			protocol: 31,
+			gen:      []genMsg{done, done, done},
+			want:     []genMsg{done, done, done},
+		},
+		{
+			// Before protocol 29, the generator does not mention
+			// up-to-date files at all.
+			name:     "up to date",
+			protocol: 27,
+			gen:      []genMsg{done, done},
+			want:     []genMsg{done, done},
+		},
+		{
+			// With -ii, the generator reports up-to-date files, which
+			// the sender echoes.
+			name:     "up to date",
+			protocol: 31,
+			gen:      []genMsg{{ndx: 0}, done, done, done},
+			want:     []genMsg{{ndx: 0}, done, done, done},
+		},
+		{
+			name:     "retransmission",
+			protocol: 27,
+			gen:      []genMsg{transfer(0), done, transfer(0), done},
+			want:     []genMsg{transfer(0), done, transfer(0), done},
+		},
+		{
+			name:     "retransmission",
+			protocol: 31,
+			gen:      []genMsg{transfer(0), done, transfer(0), done, done},
+			want:     []genMsg{transfer(0), done, transfer(0), done, done},
+		},
+		{
+			name:     "transfer in finish phase",
+			protocol: 31,
+			gen:      []genMsg{done, done, transfer(0)},
+			wantErr:  "in finish phase",
+		},
+	} {
+		t.Run(fmt.Sprintf("%s/protocol=%d", tt.name, tt.protocol), func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "data"), []byte("gokr-rsync"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			root, err := os.OpenRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, []string{"--server", "--sender"}, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			var wire bytes.Buffer
+			st := &Transfer{
+				Logger:   log.New(io.Discard),
+				Opts:     pc.Options,
+				Progress: progress.NewPrinter(io.Discard, time.Now),
+				Conn: &rsyncwire.Conn{
+					Reader:          bytes.NewReader(encodeGenerator(t, tt.protocol, tt.gen)),
+					Writer:          &wire,
+					ProtocolVersion: tt.protocol,
+				},
+			}
+			if st.checksum, err = rsynccommon.NewChecksum(st.Conn, 0); err != nil {
+				t.Fatal(err)
+			}
+			if st.tokens, err = rsynccommon.NewEncoder(st.Conn, 0); err != nil {
+				t.Fatal(err)
+			}
+			var files []file
+			if tt.name != "zero files" {
+				files = append(files, file{
+					source:  newOSRootSource(root),
+					path:    "data",
+					Wpath:   "data",
+					regular: true,
+					Name:    "data",
+					Length:  int64(len("gokr-rsync")),
+					Mode:    rsync.S_IFREG | 0644,
+				})
+			}
+			st.startFileLists(&fileList{Files: files})
+
+			err = st.SendFiles()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SendFiles() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := decodeSender(t, st, wire.Bytes())
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sender sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
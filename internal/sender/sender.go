@@ -1,58 +1,107 @@
 package sender
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"sort"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
 	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
-	"github.com/mmcloughlin/md4"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"golang.org/x/sync/errgroup"
 )
 
 // rsync/sender.c:send_files()
-func (st *Transfer) SendFiles(fileList *fileList) error {
-	phase := 0
+func (st *Transfer) SendFiles() error {
+	maxPhase := rsynccommon.MaxPhase(st.Conn.ProtocolVersion)
+	phase := rsynccommon.PhaseTransfer
+	incRecurse := st.Conn.Capabilities.IncRecurse
+	saveIOErrors := st.ioErrors
 	for {
+		if err := st.sendExtraFileLists(); err != nil {
+			return err
+		}
+
 		// receive data about receiver’s copy of the file list contents (not
 		// ordered)
 		// see (*rsync.Receiver).Generator()
-		fileIndex, err := st.Conn.ReadInt32()
+		fileIndex, attrs, err := rsynccommon.ReadNdxAndAttrs(st.Conn)
 		if err != nil {
 			return err
 		}
-		if fileIndex == -1 {
-			if phase == 0 {
-				phase++
-				// acknowledge phase change by sending -1
-				if err := st.Conn.WriteInt32(-1); err != nil {
-					return err
+		if fileIndex == rsync.NDX_DONE {
+			if incRecurse && len(st.flists) > 0 {
+				// The receiver is done with the oldest file list. The
+				// phase only ends with the last file list.
+				st.flists = st.flists[1:]
+				if len(st.flists) > 0 {
+					if err := st.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
+						return err
+					}
+					continue
 				}
+			}
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			// acknowledge phase change by sending NDX_DONE
+			if err := st.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
+				return err
+			}
+			continue
+		}
+		fl := st.fileForNdx(fileIndex)
+		if fl == nil {
+			if !incRecurse && rsynccommon.IsKeepalive(st.Conn, fileIndex, attrs, len(st.flists[0].Files)) {
 				continue
 			}
-			break
+			return fmt.Errorf("protocol error: invalid file index %d", fileIndex)
+		}
+
+		if attrs.Flags&rsync.ITEM_TRANSFER == 0 {
+			// The receiver only reports an item (e.g. a created directory),
+			// which we echo back (protocol >= 29).
+			if err := rsynccommon.WriteNdxAndAttrs(st.Conn, fileIndex, attrs); err != nil {
+				return err
+			}
+			continue
+		}
+		if phase == rsynccommon.PhaseFinish {
+			return fmt.Errorf("protocol error: got transfer request for index %d in %v phase", fileIndex, phase)
 		}
 
 		if st.Opts.DryRun() {
-			if err := st.Conn.WriteInt32(fileIndex); err != nil {
+			if err := rsynccommon.WriteNdxAndAttrs(st.Conn, fileIndex, attrs); err != nil {
 				return err
 			}
 			continue
 		}
 
-		fl := fileList.Files[fileIndex]
 		st.Progress.Reset(uint64(fl.Length))
+		if st.FileStarted != nil {
+			st.FileStarted(fl.Wpath)
+		}
 
-		head, err := st.receiveSums()
+		head, err := st.receiveSums(phase)
 		if err != nil {
 			return err
 		}
 
+		f, err := fl.source.Open(fl.path)
+		if err != nil {
+			// The file was removed (or became inaccessible) after we built
+			// the file list. Skip it instead of aborting the whole transfer.
+			if err := st.skipFile(fileIndex, *fl, err); err != nil {
+				return err
+			}
+			continue
+		}
+
 		// The following quotes are citations from
 		// https://www.samba.org/~tridge/phd_thesis.pdf, section 3.2.6 The
 		// signature search algorithm (PDF page 64).
@@ -85,41 +134,113 @@ func (st *Transfer) SendFiles(fileList *fileList) error {
 		st.lastMatch = 0
 		if len(head.Sums) == 0 {
 			// fast path: send the whole file
-			err = st.sendFile(fileIndex, fl)
+			err = st.sendFile(fileIndex, attrs, *fl, f)
 		} else {
-			err = st.hashSearch(targets, tagTable, head, fileIndex, fl)
+			err = st.hashSearch(targets, tagTable, head, fileIndex, attrs, *fl, f)
 		}
+		f.Close()
 		if err != nil {
-			if _, ok := err.(*os.PathError); ok {
-				// OpenFile() failed. Log the error (server side only) and
-				// proceed. Only starting with protocol 30, an I/O error flag is
-				// sent after the file transfer phase.
-				if os.IsNotExist(err) {
-					st.Logger.Printf("file has vanished: %s", fl.path)
-				} else {
-					st.Logger.Printf("sendFiles: %v", err)
-				}
-				continue
-			} else {
-				return err
-			}
+			return err
+		}
+		// Ensure the receiver sees the file’s last tokens and checksum
+		// without waiting for the next file.
+		if err := st.Conn.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// Tell the receiver about files which vanished (or could not be opened)
+	// during the transfer, which determines the exit code.
+	if st.ioErrors != saveIOErrors && st.Conn.ProtocolVersion >= 30 {
+		var buf rsyncwire.Buffer
+		buf.WriteInt32(st.ioErrors)
+		if err := st.Conn.WriteMsg(rsyncwire.MsgIOError, []byte(buf.String())); err != nil {
+			return err
 		}
 	}
 
 	// phase done
-	if err := st.Conn.WriteInt32(-1); err != nil {
+	if err := st.Conn.WriteNdx(rsync.NDX_DONE); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// IOErrors returns the I/O error flags (rsync.IOERR_*) of the transfer so far,
+// e.g. rsync.IOERR_VANISHED once a file vanished before it could be sent.
+func (st *Transfer) IOErrors() int32 { return st.ioErrors }
+
+// warn logs msg and, when running as the server, displays it on the client
+// side, too.
+func (st *Transfer) warn(msg string) error {
+	st.Logger.Printf("%s", msg)
+	if !st.Opts.Server() {
+		return nil
+	}
+	// Clients speaking protocols older than 30 might not understand
+	// MSG_WARNING.
+	tag := rsyncwire.MsgInfo
+	if st.Conn.ProtocolVersion >= 30 {
+		tag = rsyncwire.MsgWarning
+	}
+	return st.Conn.WriteMsg(tag, []byte(msg+"\n"))
+}
+
+// skipFile is called when the file at fileIndex cannot be opened. Like tridge
+// rsync, we log a warning (or an error, for reasons other than the file having
+// vanished) and do not send the file at all: the receiver just never gets to
+// see its index. Starting with protocol 30, the receiver is told about the
+// skipped file with a MSG_NO_SEND message. The I/O error flags record the
+// skipped file for the exit code (24 for vanished files).
+//
+// rsync/sender.c:send_files (do_open failure)
+func (st *Transfer) skipFile(fileIndex int32, fl file, openErr error) error {
+	if errors.Is(openErr, fs.ErrNotExist) {
+		st.ioErrors |= rsync.IOERR_VANISHED
+		if err := st.warn(fmt.Sprintf("file has vanished: %s", fl.path)); err != nil {
+			return err
+		}
+	} else {
+		st.ioErrors |= rsync.IOERR_GENERAL
+		msg := fmt.Sprintf("send_files failed to open %s: %v", fl.path, openErr)
+		st.Logger.Printf("%s", msg)
+		if st.Opts.Server() {
+			// MSG_ERROR_XFER makes the client exit with code 23 once the
+			// transfer is done.
+			msg = "gokr-rsync [sender]: " + msg + "\n"
+			if err := st.Conn.WriteMsg(rsyncwire.MsgError, []byte(msg)); err != nil {
+				return err
+			}
+		}
+	}
+	if st.Conn.ProtocolVersion >= 30 {
+		var buf rsyncwire.Buffer
+		buf.WriteInt32(fileIndex)
+		if err := st.Conn.WriteMsg(rsyncwire.MsgNoSend, []byte(buf.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // rsync/sender.c:receive_sums()
-func (st *Transfer) receiveSums() (rsync.SumHead, error) {
+func (st *Transfer) receiveSums(phase rsynccommon.Phase) (rsync.SumHead, error) {
 	var head rsync.SumHead
 	if err := head.ReadFrom(st.Conn); err != nil {
 		return head, err
 	}
+	if phase != rsynccommon.PhaseTransfer && st.Conn.ProtocolVersion < 27 {
+		// Files requested again after failing verification come with full
+		// block checksums, whose length the sum head does not carry.
+		//
+		// rsync/sender.c:send_files (csum_length = SUM_LENGTH)
+		head.ChecksumLength = rsync.SumLength
+	}
+	// rsync/io.c:read_sum_head
+	if n := head.ChecksumLength; int(n) > st.checksum.Size() {
+		return head, fmt.Errorf("invalid checksum length %d for %s", n, st.checksum.Name())
+	}
 	var offset int64
 	head.Sums = make([]rsync.SumBuf, int(head.ChecksumCount))
 	for i := int32(0); i < head.ChecksumCount; i++ {
@@ -150,27 +271,33 @@ func (st *Transfer) receiveSums() (rsync.SumHead, error) {
 	return head, nil
 }
 
-func (st *Transfer) sendFile(fileIndex int32, fl file) error {
+func (st *Transfer) sendFile(fileIndex int32, attrs rsynccommon.ItemAttrs, fl file, f File) error {
 	// rsync/rsync.h defines chunkSize as 32 * 1024, but increasing it to 256K
 	// increases throughput with “tridge” rsync as client by 50 Mbit/s.
 	const chunkSize = 256 * 1024
 
-	f, err := fl.source.Open(fl.path)
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	fi, err := f.Stat()
+	// Open the file a second time (see the hash goroutine below) before
+	// sending anything, so that we do not leave a partial file transfer on the
+	// wire should the file vanish in the meantime.
+	hf, err := fl.source.Open(fl.path)
 	if err != nil {
-		return err
+		// Nothing was sent for this file yet, so we can still skip it.
+		return st.skipFile(fileIndex, fl, err)
 	}
 
-	if err := st.Conn.WriteInt32(fileIndex); err != nil {
+	if err := rsynccommon.WriteNdxAndAttrs(st.Conn, fileIndex, attrs); err != nil {
 		return err
 	}
 
-	sh := rsynccommon.SumSizesSqroot(fi.Size())
+	sh, err := rsynccommon.SumSizesSqroot(st.Conn.ProtocolVersion, fi.Size())
+	if err != nil {
+		return err
+	}
 	if err := sh.WriteTo(st.Conn); err != nil {
 		return err
 	}
@@ -181,10 +308,9 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 		fmt.Fprintln(st.Env.Stdout, fl.path)
 	}
 
-	h := md4.New()
-	binary.Write(h, binary.LittleEndian, st.Seed)
+	h := st.checksum.NewFileHash()
 
-	// Calculate the md4 hash in a goroutine.
+	// Calculate the file hash in a goroutine.
 	//
 	// This allows an rsync connection to benefit from more than 1 core!
 	//
@@ -193,13 +319,9 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 	// into the network socket as quickly as possible.
 	var eg errgroup.Group
 	eg.Go(func() error {
-		f, err := fl.source.Open(fl.path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
+		defer hf.Close()
 		var buf [chunkSize]byte
-		if _, err := io.CopyBuffer(h, f, buf[:]); err != nil {
+		if _, err := io.CopyBuffer(h, hf, buf[:]); err != nil {
 			return err
 		}
 		return nil
@@ -218,13 +340,7 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 			}
 			return err
 		}
-		chunk := buf[:n]
-		// chunk size (“rawtok” variable in openrsync)
-		if err := st.Conn.WriteInt32(int32(len(chunk))); err != nil {
-			return err
-		}
-		n, err = st.Conn.Writer.Write(chunk)
-		if err != nil {
+		if err := st.tokens.WriteData(st.Conn.Writer, buf[:n]); err != nil {
 			return err
 		}
 		offset += n
@@ -233,7 +349,7 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 		st.Progress.Show(uint64(offset), true)
 	}
 	// transfer finished:
-	if err := st.Conn.WriteInt32(0); err != nil {
+	if err := st.tokens.WriteToken(st.Conn.Writer, -1); err != nil {
 		return err
 	}
 
@@ -248,3 +364,70 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 	}
 	return nil
 }
+
+// RemoveSourceFile removes the source file with the specified file list index
+// (--remove-source-files). It must only be called once the receiver confirmed
+// (with a MSG_SUCCESS message) that it received the file successfully, so
+// that an incomplete transfer never results in data loss. Files which changed
+// after they were sent are kept, as are directories.
+//
+// Failing to remove a file does not abort the transfer, but is reported like
+// a failed file transfer (see RemoveFailures).
+//
+// rsync/sender.c:successful_send
+func (st *Transfer) RemoveSourceFile(ndx int32) error {
+	if !st.Opts.RemoveSourceFiles() {
+		return fmt.Errorf("protocol error: unexpected MSG_SUCCESS for file index %d", ndx)
+	}
+	fl := st.fileForNdx(ndx)
+	if fl == nil {
+		return fmt.Errorf("protocol error: invalid file index %d in MSG_SUCCESS", ndx)
+	}
+	if fl.isDir {
+		return nil
+	}
+	remover, ok := fl.source.(sourceRemover)
+	if !ok {
+		return st.removeFailed(fmt.Sprintf("sender failed to remove %s: file source does not support removing files", fl.path))
+	}
+	fi, err := remover.Lstat(fl.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			st.Logger.Printf("sender file already removed: %s", fl.path)
+			return nil
+		}
+		return st.removeFailed(fmt.Sprintf("sender failed to re-lstat %s: %v", fl.path, err))
+	}
+	if fi.Size() != fl.Length || !fi.ModTime().Equal(fl.ModTime) {
+		return st.removeFailed(fmt.Sprintf("ERROR: Skipping sender remove for changed file: %s", fl.path))
+	}
+	if err := remover.Remove(fl.path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			st.Logger.Printf("sender file already removed: %s", fl.path)
+			return nil
+		}
+		return st.removeFailed(fmt.Sprintf("sender failed to remove %s: %v", fl.path, err))
+	}
+	if st.Opts.InfoGTE(rsyncopts.INFO_REMOVE, 1) {
+		st.Logger.Printf("sender removed %s", fl.Wpath)
+	}
+	return nil
+}
+
+// removeFailed logs msg about a source file which could not be removed and,
+// when running as the server, sends it to the client, which then exits with
+// code 23 once the transfer is done.
+//
+// rsync/sender.c:successful_send (FERROR_XFER)
+func (st *Transfer) removeFailed(msg string) error {
+	st.removeFailures++
+	st.Logger.Printf("%s", msg)
+	if !st.Opts.Server() {
+		return nil
+	}
+	return st.Conn.WriteMsg(rsyncwire.MsgError, []byte("gokr-rsync [sender]: "+msg+"\n"))
+}
+
+// RemoveFailures returns how many source files --remove-source-files could
+// not remove so far.
+func (st *Transfer) RemoveFailures() int { return st.removeFailures }
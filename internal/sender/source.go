@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 )
 
 // FileSource is the interface which the gokrazy rsync sender uses
@@ -36,10 +37,35 @@ func newOSRootSource(root *os.Root) FileSource {
 	return &osRootSource{root: root}
 }
 
-func (s *osRootSource) FS() fs.FS                            { return s.root.FS() }
-func (s *osRootSource) Open(name string) (File, error)       { return s.root.Open(name) }
-func (s *osRootSource) Readlink(name string) (string, error) { return s.root.Readlink(name) }
-func (s *osRootSource) Close() error                         { return s.root.Close() }
+func (s *osRootSource) FS() fs.FS                              { return s.root.FS() }
+func (s *osRootSource) Open(name string) (File, error)         { return s.root.Open(name) }
+func (s *osRootSource) Readlink(name string) (string, error)   { return s.root.Readlink(name) }
+func (s *osRootSource) Close() error                           { return s.root.Close() }
+func (s *osRootSource) Lstat(name string) (fs.FileInfo, error) { return s.root.Lstat(name) }
+func (s *osRootSource) Remove(name string) error               { return s.root.Remove(name) }
+
+// unconfined returns a FileSource for the same directory which, unlike the
+// os.Root, follows symlinks pointing outside of it.
+func (s *osRootSource) unconfined() (FileSource, error) {
+	dir, err := filepath.Abs(s.root.Name())
+	if err != nil {
+		return nil, err
+	}
+	return NewFSSource(os.DirFS(dir)), nil
+}
+
+// unconfinedSource is implemented by FileSources which can follow symlinks
+// pointing outside of them, which --copy-unsafe-links requires.
+type unconfinedSource interface {
+	unconfined() (FileSource, error)
+}
+
+// sourceRemover is implemented by FileSources which can remove files, which
+// --remove-source-files requires.
+type sourceRemover interface {
+	Lstat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+}
 
 // fsSource wraps an fs.FS to implement FileSource.
 type fsSource struct {
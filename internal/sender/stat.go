@@ -12,6 +12,10 @@ func gidFromFileInfo(fs.FileInfo) (int32, bool) {
 	return 0, false
 }
 
-func rdevFromFileInfo(fs.FileInfo) (int32, bool) {
-	return 0, false
+func rdevFromFileInfo(fs.FileInfo) (major, minor uint32, ok bool) {
+	return 0, 0, false
+}
+
+func idevFromFileInfo(fs.FileInfo) (idev, uint64, bool) {
+	return idev{}, 0, false
 }
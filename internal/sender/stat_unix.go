@@ -5,6 +5,8 @@ package sender
 import (
 	"io/fs"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func uidFromFileInfo(info fs.FileInfo) (int32, bool) {
@@ -23,10 +25,19 @@ func gidFromFileInfo(info fs.FileInfo) (int32, bool) {
 	return int32(st.Gid), true
 }
 
-func rdevFromFileInfo(info fs.FileInfo) (int32, bool) {
+// rdevFromFileInfo splits the device number in the platform’s encoding.
+func rdevFromFileInfo(info fs.FileInfo) (major, minor uint32, ok bool) {
 	st, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
-		return 0, false
+		return 0, 0, false
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), true
+}
+
+func idevFromFileInfo(info fs.FileInfo) (id idev, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return idev{}, 0, false
 	}
-	return int32(st.Rdev), true
+	return idev{dev: int64(st.Dev), ino: int64(st.Ino)}, uint64(st.Nlink), true
 }
@@ -1,7 +1,7 @@
 package sender
 
-// rsync/token.c:simple_send_token
-func (st *Transfer) simpleSendToken(ms *mapStruct, token int32, offset int64, n int64) error {
+// rsync/token.c:send_token
+func (st *Transfer) sendToken(ms *mapStruct, token int32, offset int64, n int64) error {
 	if n > 0 {
 		st.Logger.Printf("sending unmatched chunks offset=%d, n=%d", offset, n)
 		l := int64(0)
@@ -13,11 +13,7 @@ func (st *Transfer) simpleSendToken(ms *mapStruct, token int32, offset int64, n
 				return err
 			}
 
-			if err := st.Conn.WriteInt32(int32(n1)); err != nil {
-				return err
-			}
-
-			if _, err := st.Conn.Writer.Write(chunk); err != nil {
+			if err := st.tokens.WriteData(st.Conn.Writer, chunk); err != nil {
 				return err
 			}
 
@@ -25,13 +21,7 @@ func (st *Transfer) simpleSendToken(ms *mapStruct, token int32, offset int64, n
 		}
 	}
 	if token != -2 {
-		return st.Conn.WriteInt32(-(token + 1))
+		return st.tokens.WriteToken(st.Conn.Writer, token)
 	}
 	return nil
 }
-
-// rsync/token.c:send_token
-func (st *Transfer) sendToken(ms *mapStruct, i int32, offset int64, n int64) error {
-	// TODO(compression): send deflated token
-	return st.simpleSendToken(ms, i, offset, n)
-}
@@ -0,0 +1,73 @@
+package sender
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+type countingDiscard struct{ n int64 }
+
+func (w *countingDiscard) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// BenchmarkSendToken measures sending a file as literal data with each
+// compression algorithm we support.
+func BenchmarkSendToken(b *testing.B) {
+	const size = 4 * 1024 * 1024
+	random := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, corpus := range []struct {
+		name    string
+		content []byte
+	}{
+		{"compressible", bytes.Repeat([]byte("gokrazy rsync sends files\n"), size/26)},
+		{"incompressible", random},
+	} {
+		fn := filepath.Join(b.TempDir(), corpus.name)
+		if err := os.WriteFile(fn, corpus.content, 0644); err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range rsynccompress.Supported() {
+			b.Run(corpus.name+"/"+name, func(b *testing.B) {
+				f, err := os.Open(fn)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer f.Close()
+				enc, err := rsynccompress.NewEncoder(name, math.MinInt32)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var out countingDiscard
+				st := &Transfer{
+					Logger: log.New(&countingDiscard{}),
+					Conn:   &rsyncwire.Conn{Writer: &out},
+					tokens: enc,
+				}
+				n := int64(len(corpus.content))
+				b.SetBytes(n)
+				for b.Loop() {
+					if _, err := f.Seek(0, io.SeekStart); err != nil {
+						b.Fatal(err)
+					}
+					ms := mapFile(f, n, chunkSize, 0)
+					if err := st.sendToken(ms, -1, 0, n); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(out.n)/float64(n*int64(b.N)), "ratio")
+			})
+		}
+	}
+}
@@ -1,50 +1,64 @@
 package sender
 
 import (
-	"io"
-
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccompress"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
-type Osenv struct {
-	Stdin  io.Reader
-	Stdout io.Writer
-	Stderr io.Writer
-}
-
-// TransferOpts is a subset of Opts which is required for implementing a receiver.
-type TransferOpts struct {
-	Verbose bool
-	DryRun  bool
-
-	DeleteMode        bool
-	PreserveGid       bool
-	PreserveUid       bool
-	PreserveLinks     bool
-	PreservePerms     bool
-	PreserveDevices   bool
-	PreserveSpecials  bool
-	PreserveTimes     bool
-	PreserveHardlinks bool
-}
-
 type Transfer struct {
 	// config
-	// Opts *Opts
 	Logger   log.Logger
 	Opts     *rsyncopts.Options
 	Env      *rsyncos.Env
 	Progress progress.Printer
 	Source   FileSource // for modules specifying a fs.FS
 
+	// Confined prevents following symlinks out of the source directory (with
+	// --copy-unsafe-links), which rsync modules must not do.
+	Confined bool
+
+	// FileStarted, if non-nil, is called with the name of each file before
+	// its data is sent.
+	FileStarted func(name string)
+
 	// state
 	Conn      *rsyncwire.Conn
 	Seed      int32
 	lastMatch int64
-}
+	checksum  rsyncchecksum.Checksum // set by Do
+	tokens    rsynccompress.Encoder  // set by Do
+
+	// file list state, set by SendFileList
+	excl             *filterRuleList
+	uidMap           map[int32]string
+	gidMap           map[int32]string
+	ioErrors         int32
+	ioErrorsReported bool // whether a MSG_IO_ERROR was sent
+
+	// removeFailures counts source files which --remove-source-files could
+	// not remove.
+	removeFailures int
 
-//func (rt *Transfer) listOnly() bool { return rt.Dest == "" }
+	// hard link state (-H): the file index of the first file of each group
+	// (protocol >= 30), or the last device number sent
+	hlinks   map[idev]int32
+	hlinkDev int64
+
+	// device state: the last rdev sent (protocol < 28), or the last major
+	// number sent (protocol >= 28)
+	rdev      int32
+	rdevMajor uint32
+
+	// file lists, set up by Do (see startFileLists)
+	flists     []*fileList // the file lists the receiver works on, oldest first
+	lastList   *fileList   // the most recently sent file list
+	totalSize  int64       // of all file lists sent
+	dirs       []dirNode   // all directories (incremental recursion)
+	sendDirNdx int32       // next directory to send, or -1
+	flistEOF   bool        // whether all file lists are sent
+}
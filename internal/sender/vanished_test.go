@@ -0,0 +1,129 @@
+package sender_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/receiver"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/gokrazy/rsync/internal/sender"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestVanishedFile(t *testing.T) {
+	for _, protocol := range []int32{27, 30} {
+		t.Run(fmt.Sprintf("protocol=%d", protocol), func(t *testing.T) {
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			for _, dir := range []string{source, dest} {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, fn := range []string{"a.txt", "gone.txt", "z.txt"} {
+				if err := os.WriteFile(filepath.Join(source, fn), []byte(fn), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			osenv := rsyncostest.New(t)
+			toReceiver, fromSender := io.Pipe()
+			toSender, fromReceiver := io.Pipe()
+			mrd := &rsyncwire.MultiplexReader{Env: osenv, Reader: toReceiver}
+
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, []string{"--server", "--sender", "-r"}, rsyncopts.ParseModeLibrary); err != nil {
+				t.Fatal(err)
+			}
+			crd := &rsyncwire.CountingReader{R: toSender}
+			cwr := &rsyncwire.CountingWriter{W: &rsyncwire.MultiplexWriter{Writer: fromSender}}
+			st := &sender.Transfer{
+				Logger:   log.New(io.Discard),
+				Opts:     pc.Options,
+				Progress: progress.NewPrinter(io.Discard, time.Now),
+				// The file list was sent, but the file is deleted before the
+				// sender opens it.
+				FileStarted: func(name string) {
+					if filepath.Base(name) == "gone.txt" {
+						if err := os.Remove(filepath.Join(source, "gone.txt")); err != nil {
+							t.Error(err)
+						}
+					}
+				},
+				Conn: &rsyncwire.Conn{
+					Reader:          crd,
+					Writer:          cwr,
+					ProtocolVersion: protocol,
+				},
+			}
+
+			root, err := os.OpenRoot(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+			rt := &receiver.Transfer{
+				Logger: log.New(io.Discard),
+				Opts: &receiver.TransferOpts{
+					InfoGTE:  func(rsyncopts.InfoLevel, uint16) bool { return false },
+					DebugGTE: func(rsyncopts.DebugLevel, uint16) bool { return false },
+				},
+				Dest:     dest,
+				DestRoot: root,
+				Progress: progress.NewPrinter(io.Discard, time.Now),
+				Conn: &rsyncwire.Conn{
+					Reader:          mrd,
+					Writer:          fromReceiver,
+					ProtocolVersion: protocol,
+				},
+			}
+			mrd.NoSend = rt.NoSend
+
+			var eg errgroup.Group
+			eg.Go(func() error {
+				defer fromSender.Close()
+				_, err := st.Do(crd, cwr, source, []string{"/"}, nil)
+				return err
+			})
+			eg.Go(func() error {
+				defer fromReceiver.Close()
+				fileList, err := rt.ReceiveFileList()
+				if err != nil {
+					return err
+				}
+				_, err = rt.Do(t.Context(), rt.Conn, fileList, false)
+				return err
+			})
+			if err := eg.Wait(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The transfer continues after the vanished file.
+			for _, fn := range []string{"a.txt", "z.txt"} {
+				if _, err := os.Stat(filepath.Join(dest, fn)); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dest, "gone.txt")); !os.IsNotExist(err) {
+				t.Errorf("gone.txt unexpectedly transferred (err=%v)", err)
+			}
+			if got := st.IOErrors(); got&rsync.IOERR_VANISHED == 0 {
+				t.Errorf("sender IOErrors() = %d, want IOERR_VANISHED", got)
+			}
+			// Before protocol 30, there is no MSG_IO_ERROR.
+			if got, want := mrd.IOError()&rsync.IOERR_VANISHED != 0, protocol >= 30; got != want {
+				t.Errorf("receiver learned about vanished file: %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -4,23 +4,37 @@ package testlogger
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"testing"
+
+	"github.com/gokrazy/rsync/internal/log"
 )
 
+// Logger is an io.Writer (and a log.Logger) which logs each line via
+// t.Log(). It also retains everything written, see Bytes.
 type Logger struct {
 	tb      testing.TB
 	writer  *io.PipeWriter
 	scanner *bufio.Scanner
+
+	mu  *sync.Mutex
+	buf *bytes.Buffer
 }
 
+var _ log.Logger = (*Logger)(nil)
+
 func New(tb testing.TB) *Logger {
 	r, w := io.Pipe()
 	tl := &Logger{
 		tb:      tb,
 		writer:  w,
 		scanner: bufio.NewScanner(r),
+		mu:      &sync.Mutex{},
+		buf:     &bytes.Buffer{},
 	}
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -47,5 +61,30 @@ func New(tb testing.TB) *Logger {
 
 // Write implements io.Writer.
 func (lw Logger) Write(p []byte) (n int, err error) {
+	lw.mu.Lock()
+	lw.buf.Write(p)
+	lw.mu.Unlock()
 	return lw.writer.Write(p)
 }
+
+// Printf implements log.Logger.
+func (lw Logger) Printf(msg string, a ...any) {
+	lw.Output(2, fmt.Sprintf(msg, a...))
+}
+
+// Output implements log.Logger.
+func (lw Logger) Output(calldepth int, s string) error {
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	_, err := lw.Write([]byte(s))
+	return err
+}
+
+// Bytes returns a copy of everything written to the logger so far, so that
+// tests can verify specific log messages.
+func (lw Logger) Bytes() []byte {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return bytes.Clone(lw.buf.Bytes())
+}
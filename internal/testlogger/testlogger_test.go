@@ -0,0 +1,17 @@
+package testlogger_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/testlogger"
+)
+
+func TestBytes(t *testing.T) {
+	tl := testlogger.New(t)
+	fmt.Fprintf(tl, "written directly\n")
+	tl.Printf("logged %d", 42)
+	if got, want := string(tl.Bytes()), "written directly\nlogged 42\n"; got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+}
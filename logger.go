@@ -1,7 +1,17 @@
 package rsync
 
-import "github.com/gokrazy/rsync/internal/log"
+import (
+	"log/slog"
+
+	"github.com/gokrazy/rsync/internal/log"
+)
 
 // Logger is an interface that allows specifying your own logger.
 // By default, the Go log package is used, which prints to stderr.
 type Logger = log.Logger
+
+// NewSlogLogger returns a Logger which routes log output through h, see
+// log/slog. Each message becomes a record at level Info.
+func NewSlogLogger(h slog.Handler) Logger {
+	return log.NewSlog(h)
+}
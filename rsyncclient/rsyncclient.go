@@ -9,11 +9,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/gokrazy/rsync/internal/maincmd"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
+	"github.com/gokrazy/rsync/rsyncd"
 )
 
 // Option specifies the client options.
@@ -35,13 +37,57 @@ func WithStderr(stderr io.Writer) Option {
 	})
 }
 
-// WithSender enables sender mode (receiver by default).
-func WithSender() Option {
+// Direction specifies whether a [Client] sends or receives files.
+type Direction int
+
+const (
+	// Receive makes the [Client] receive files from the server.
+	Receive Direction = iota + 1
+
+	// Send makes the [Client] send files to the server.
+	Send
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Receive:
+		return "receive"
+	case Send:
+		return "send"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// WithDirection sets the transfer direction. If unset, [New] infers the
+// direction from its args, see [InferDirection].
+func WithDirection(dir Direction) Option {
 	return clientOptionFunc(func(c *Client) {
-		c.sender = true
+		c.direction = dir
 	})
 }
 
+// InferDirection infers the transfer direction from rsync command line
+// operands (sources and destination), like rsync itself does: the client
+// receives if the (first) source is remote, and sends if the destination is
+// remote. Transfers between two local or two remote locations are rejected,
+// as they do not involve a server.
+func InferDirection(sources []string, dest string) (Direction, error) {
+	if len(sources) == 0 {
+		return 0, fmt.Errorf("no source specified")
+	}
+	srcRemote := maincmd.SourceIsRemote(sources[0])
+	destRemote := maincmd.DestIsRemote(dest)
+	switch {
+	case srcRemote && destRemote:
+		return 0, fmt.Errorf("the source and destination cannot both be remote")
+	case srcRemote:
+		return Receive, nil
+	case destRemote:
+		return Send, nil
+	}
+	return 0, fmt.Errorf("the source and destination are both local")
+}
+
 // WithoutNegotiate disables protocol version negotiation (enabled by default).
 func WithoutNegotiate() Option {
 	return clientOptionFunc(func(c *Client) {
@@ -49,6 +95,19 @@ func WithoutNegotiate() Option {
 	})
 }
 
+// WithServer connects the [Client] to srv in the same process, instead of to
+// a server reachable via the conn passed to [Client.Run]. Each run starts a
+// goroutine serving module via in-memory pipes. Use nil as conn when calling
+// [Client.Run].
+//
+// Transfers read from (or write to) the root of module.
+func WithServer(srv *rsyncd.Server, module *rsyncd.Module) Option {
+	return clientOptionFunc(func(c *Client) {
+		c.server = srv
+		c.module = module
+	})
+}
+
 func DontRestrict() Option {
 	return clientOptionFunc(func(c *Client) {
 		c.osenv.DontRestrict = true
@@ -59,11 +118,21 @@ type Client struct {
 	osenv     *rsyncos.Env
 	opts      *rsyncopts.Options
 	negotiate bool
-	sender    bool
+	direction Direction
+	server    *rsyncd.Server // set by WithServer
+	module    *rsyncd.Module // set by WithServer
+
+	mu      sync.Mutex
+	stats   *rsyncstats.TransferStats    // of the most recent run
+	cancels map[*context.CancelFunc]bool // of runs in progress
 }
 
 // New creates a new [Client]. You can call [Client.Run] one or more times with
 // the same [Client].
+//
+// args are rsync command line flags. Unless [WithDirection] is used, they may
+// end in source and destination operands, which are only used to infer the
+// direction: the paths to transfer are passed to [Client.Run].
 func New(args []string, opts ...Option) (*Client, error) {
 	c := &Client{
 		osenv: &rsyncos.Env{
@@ -78,15 +147,35 @@ func New(args []string, opts ...Option) (*Client, error) {
 	}
 
 	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(c.osenv))
-	if err := pc.ParseArguments(c.osenv, args); err != nil {
+	if err := pc.ParseArguments(c.osenv, args, rsyncopts.ParseModeLibrary); err != nil {
 		return nil, err
 	}
 	c.opts = pc.Options
+	if c.direction == 0 {
+		// Infer the direction from the operands of an rsync command line
+		// (e.g. “-av host:src/ dest/”), receiving by default.
+		c.direction = Receive
+		if remaining := pc.RemainingArgs; len(remaining) > 1 {
+			dir, err := InferDirection(remaining[:len(remaining)-1], remaining[len(remaining)-1])
+			if err != nil {
+				return nil, err
+			}
+			c.direction = dir
+			pc.RemainingArgs = nil
+		}
+	}
 	if len(pc.RemainingArgs) > 0 {
 		return nil, fmt.Errorf("remaining args %q not permitted; specify them in Client.Run()", pc.RemainingArgs)
 	}
-	if c.sender {
+	switch c.direction {
+	case Send:
 		c.opts.SetSender()
+	case Receive:
+	default:
+		return nil, fmt.Errorf("invalid direction %v", c.direction)
+	}
+	if c.server != nil && c.module == nil {
+		return nil, fmt.Errorf("WithServer: no module specified")
 	}
 
 	return c, nil
@@ -120,14 +209,98 @@ type Result struct {
 // custom RPC protocol. In that case, you will need to transport the
 // [Client.ServerCommandOptions] to the server and then arrange for two
 // [io.ReadWriter] connections between client and server.
+//
+// Run returns ctx.Err() when ctx is cancelled or [Client.Cancel] is called.
 func (c *Client) Run(ctx context.Context, conn io.ReadWriter, paths []string) (*Result, error) {
-	stats, err := maincmd.ClientRun(c.osenv, c.opts, conn, paths, c.negotiate)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.mu.Lock()
+	if c.cancels == nil {
+		c.cancels = make(map[*context.CancelFunc]bool)
+	}
+	c.cancels[&cancel] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.cancels, &cancel)
+	}()
+
+	var stats *rsyncstats.TransferStats
+	var err error
+	if c.server != nil {
+		if conn != nil {
+			return nil, fmt.Errorf("Run: conn must be nil when using WithServer")
+		}
+		stats, err = c.runWithServer(ctx, paths)
+	} else {
+		stats, err = maincmd.ClientRun(ctx, c.osenv, c.opts, conn, paths, c.negotiate)
+	}
 	if err != nil {
 		return nil, err
 	}
+	c.setStats(stats)
 	return &Result{Stats: stats}, nil
 }
 
+// runWithServer runs the client against the in-process server configured
+// with [WithServer], connected via a pair of [io.Pipe].
+func (c *Client) runWithServer(ctx context.Context, paths []string) (*rsyncstats.TransferStats, error) {
+	// stdin from the view of the rsync server
+	stdinrd, stdinwr := io.Pipe()
+	stdoutrd, stdoutwr := io.Pipe()
+	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
+	args := c.ServerCommandOptions("./")
+	serverErr := make(chan error, 1)
+	go func() {
+		err := c.server.HandleConnArgs(ctx, conn, c.module, args)
+		// Unblock the client in case the server returned early.
+		stdoutwr.CloseWithError(err)
+		serverErr <- err
+	}()
+
+	rw := &struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: stdoutrd, // The client reads from the server's stdout.
+		Writer: stdinwr,  // The client writes to the server's stdin.
+	}
+	stats, err := maincmd.ClientRun(ctx, c.osenv, c.opts, rw, paths, c.negotiate)
+	// Unblock the server in case the client returned early.
+	stdinwr.Close()
+	stdoutrd.Close()
+	if srvErr := <-serverErr; srvErr != nil && err == nil {
+		err = fmt.Errorf("server: %v", srvErr)
+	}
+	return stats, err
+}
+
+func (c *Client) setStats(stats *rsyncstats.TransferStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = stats
+}
+
+// Cancel aborts all runs of this [Client] which are in progress (from another
+// goroutine), making [Client.Run] return [context.Canceled]. Runs started
+// afterwards are not affected.
+func (c *Client) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cancel := range c.cancels {
+		(*cancel)()
+	}
+}
+
+// Stats returns the statistics of the most recent successful [Client.Run] (or
+// [Client.RunDaemon]), or nil if no run has completed yet.
+func (c *Client) Stats() *rsyncstats.TransferStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
 // RunDaemon starts one run of the rsync daemon protocol, meaning it performs
 // the daemon protocol inband exchange (to negotiate the protocol version and
 // select an rsync module) and then calls [Client.Run].
@@ -136,12 +309,17 @@ func (c *Client) Run(ctx context.Context, conn io.ReadWriter, paths []string) (*
 // establish the connection yourself, e.g. via the [golang.org/x/crypto/ssh]
 // package.
 func (c *Client) RunDaemon(ctx context.Context, conn io.ReadWriter, remotePath string, paths []string) (*Result, error) {
-	done, err := maincmd.StartInbandExchange(c.osenv, c.opts, conn, remotePath)
+	if c.server != nil {
+		return nil, fmt.Errorf("RunDaemon cannot be used with WithServer, use Run")
+	}
+	done, err := maincmd.StartInbandExchange(c.osenv, c.opts, conn, "", remotePath)
 	if err != nil {
 		return nil, err
 	}
 	if done { // Server sent EXIT
-		return &Result{Stats: &rsyncstats.TransferStats{}}, nil
+		stats := &rsyncstats.TransferStats{}
+		c.setStats(stats)
+		return &Result{Stats: stats}, nil
 	}
 	c.negotiate = false // done as part of the inband exchange
 	return c.Run(ctx, conn, paths)
@@ -3,13 +3,16 @@ package rsyncclient_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
@@ -21,6 +24,12 @@ import (
 	"github.com/google/go-cmp/cmp"
 )
 
+func TestMain(m *testing.M) {
+	if err := rsynctest.CommandMain(m); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func ExampleClient_Run_receiveFromSubprocess() {
 	args, src, dest := []string{"-av"}, "/usr/share/man", "/tmp/man"
 	client, err := rsyncclient.New(args)
@@ -59,7 +68,7 @@ func ExampleClient_Run_sendToGoroutine() {
 	ctx := context.Background()
 
 	args, src, dest := []string{"-av"}, "/usr/share/man", "/tmp/man"
-	client, err := rsyncclient.New(args, rsyncclient.WithSender())
+	client, err := rsyncclient.New(args, rsyncclient.WithDirection(rsyncclient.Send))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -77,7 +86,7 @@ func ExampleClient_Run_sendToGoroutine() {
 		conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
 		osenv := &rsyncos.Env{Stderr: os.Stderr}
 		pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
-		if err := pc.ParseArguments(osenv, client.ServerCommandOptions(dest)); err != nil {
+		if err := pc.ParseArguments(osenv, client.ServerCommandOptions(dest), rsyncopts.ParseModeLibrary); err != nil {
 			log.Fatalf("parsing server args: %v", err)
 		}
 		if err := rsync.InternalHandleConn(ctx, conn, nil, pc); err != nil {
@@ -99,6 +108,41 @@ func ExampleClient_Run_sendToGoroutine() {
 	}
 }
 
+func ExampleClient_Stats() {
+	args, src, dest := []string{"-av"}, "/usr/share/man", "/tmp/man"
+	client, err := rsyncclient.New(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rsync := exec.Command("rsync", client.ServerCommandOptions(src)...)
+	stdin, err := rsync.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stdout, err := rsync.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := rsync.Start(); err != nil {
+		log.Fatal(err)
+	}
+	rw := &struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: stdout,
+		Writer: stdin,
+	}
+
+	if _, err := client.Run(context.Background(), rw, []string{dest}); err != nil {
+		log.Fatal(err)
+	}
+	stats := client.Stats()
+	log.Printf("sent %d bytes, received %d bytes (total size %d bytes)",
+		stats.Written, stats.Read, stats.Size)
+}
+
 type readWriter struct {
 	io.Reader
 	io.Writer
@@ -153,12 +197,6 @@ func TestClientServerModule(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	args := []string{"-av"}
-	client, err := rsyncclient.New(args, rsyncclient.WithStderr(stderr))
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	mod := rsyncd.Module{
 		Name: "tmp",
 		Path: src,
@@ -167,33 +205,27 @@ func TestClientServerModule(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	// stdin from the view of the rsync server
-	stdinrd, stdinwr := io.Pipe()
-	stdoutrd, stdoutwr := io.Pipe()
-	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
-	osenv := rsyncostest.New(t)
-	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
-	if err := pc.ParseArguments(osenv, client.ServerCommandOptions("./")); err != nil {
-		t.Fatalf("parsing server args: %v", err)
-	}
-	t.Logf("pc.RemainingArgs=%q", pc.RemainingArgs)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := rsync.InternalHandleConn(t.Context(), conn, &mod, pc)
-		if err != nil {
-			t.Error(err)
-		}
-	}()
 
-	rw := &readWriter{
-		Reader: stdoutrd,
-		Writer: stdinwr,
+	args := []string{"-av"}
+	client, err := rsyncclient.New(args,
+		rsyncclient.WithStderr(stderr),
+		rsyncclient.WithServer(rsync, &mod))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := client.Run(t.Context(), rw, []string{dest}); err != nil {
+	if got := client.Stats(); got != nil {
+		t.Fatalf("Stats() before Run = %+v, want nil", got)
+	}
+	res, err := client.Run(t.Context(), nil, []string{dest})
+	if err != nil {
 		t.Fatal(err)
 	}
+	if got, want := client.Stats(), res.Stats; got != want {
+		t.Errorf("Stats() = %+v, want %+v (from Run)", got, want)
+	}
+	if got := client.Stats().Read; got == 0 {
+		t.Errorf("Stats().Read = 0, want > 0")
+	}
 
 	got, err := os.ReadFile(filepath.Join(dest, "hello"))
 	if err != nil {
@@ -202,9 +234,6 @@ func TestClientServerModule(t *testing.T) {
 	if !bytes.Equal(got, []byte(hello)) {
 		t.Errorf("hello: unexpected contents: diff (-want +got):\n%s", cmp.Diff([]byte(hello), got))
 	}
-
-	// Ensure an error would be displayed, if any.
-	wg.Wait()
 }
 
 // like TestClientServerModule, but without a module,
@@ -241,7 +270,7 @@ func TestClientServerCommand(t *testing.T) {
 	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
 	osenv := rsyncostest.New(t)
 	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
-	if err := pc.ParseArguments(osenv, client.ServerCommandOptions(src)); err != nil {
+	if err := pc.ParseArguments(osenv, client.ServerCommandOptions(src), rsyncopts.ParseModeLibrary); err != nil {
 		t.Fatalf("parsing server args: %v", err)
 	}
 	t.Logf("pc.RemainingArgs=%q", pc.RemainingArgs)
@@ -293,7 +322,7 @@ func TestClientServerCommandSender(t *testing.T) {
 	}
 
 	args := []string{"-av"}
-	client, err := rsyncclient.New(args, rsyncclient.WithSender())
+	client, err := rsyncclient.New(args, rsyncclient.WithDirection(rsyncclient.Send))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -308,7 +337,7 @@ func TestClientServerCommandSender(t *testing.T) {
 	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
 	osenv := rsyncostest.New(t)
 	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
-	if err := pc.ParseArguments(osenv, client.ServerCommandOptions(dest)); err != nil {
+	if err := pc.ParseArguments(osenv, client.ServerCommandOptions(dest), rsyncopts.ParseModeLibrary); err != nil {
 		t.Fatalf("parsing server args: %v", err)
 	}
 	t.Logf("pc.RemainingArgs=%q", pc.RemainingArgs)
@@ -341,3 +370,214 @@ func TestClientServerCommandSender(t *testing.T) {
 	// Ensure an error would be displayed, if any.
 	wg.Wait()
 }
+
+// like TestClientServerModule, but sending data to a writable module.
+func TestClientWithServerSender(t *testing.T) {
+	t.Parallel()
+
+	stderr := testlogger.New(t)
+	tmp := t.TempDir()
+
+	src := filepath.Join(tmp, "src") + "/"
+	dest := filepath.Join(tmp, "dest")
+	const hello = "world"
+	for _, dir := range []string{src, dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "hello"), []byte(hello), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mod := rsyncd.Module{
+		Name:     "tmp",
+		Path:     dest,
+		Writable: true,
+	}
+	rsync, err := rsyncd.NewServer([]rsyncd.Module{mod}, rsyncd.WithStderr(stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := rsyncclient.New([]string{"-av"},
+		rsyncclient.WithStderr(stderr),
+		rsyncclient.WithDirection(rsyncclient.Send),
+		rsyncclient.WithServer(rsync, &mod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run(t.Context(), nil, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(hello)) {
+		t.Errorf("hello: unexpected contents: diff (-want +got):\n%s", cmp.Diff([]byte(hello), got))
+	}
+
+	// A run via conn makes no sense with an in-process server.
+	if _, err := client.Run(t.Context(), &readWriter{}, []string{src}); err == nil {
+		t.Errorf("Run(conn) with WithServer unexpectedly succeeded")
+	}
+}
+
+func TestInferDirection(t *testing.T) {
+	for _, tt := range []struct {
+		sources []string
+		dest    string
+		want    rsyncclient.Direction
+		wantErr bool
+	}{
+		{sources: []string{"host:src/"}, dest: "dest/", want: rsyncclient.Receive},
+		{sources: []string{"host::module/"}, dest: "dest/", want: rsyncclient.Receive},
+		{sources: []string{"rsync://host/module/"}, dest: "dest/", want: rsyncclient.Receive},
+		{sources: []string{"src/"}, dest: "host:dest/", want: rsyncclient.Send},
+		{sources: []string{"a", "b"}, dest: "user@host:dest/", want: rsyncclient.Send},
+		{sources: []string{"src/"}, dest: "rsync://host/module/", want: rsyncclient.Send},
+		// A colon after a slash does not make a path remote.
+		{sources: []string{"./host:src/"}, dest: "host:dest/", want: rsyncclient.Send},
+		{sources: []string{"src/"}, dest: "dest/", wantErr: true},
+		{sources: []string{"host:src/"}, dest: "host:dest/", wantErr: true},
+		{sources: nil, dest: "host:dest/", wantErr: true},
+	} {
+		got, err := rsyncclient.InferDirection(tt.sources, tt.dest)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("InferDirection(%q, %q) = %v, want error=%v", tt.sources, tt.dest, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("InferDirection(%q, %q) = %v, want %v", tt.sources, tt.dest, got, tt.want)
+		}
+	}
+}
+
+func TestNewDirection(t *testing.T) {
+	for _, tt := range []struct {
+		args       []string
+		opts       []rsyncclient.Option
+		wantSender bool // whether the server is the sender
+	}{
+		{args: []string{"-av"}, wantSender: true},
+		{args: []string{"-av", "host:src/", "dest/"}, wantSender: true},
+		{args: []string{"-av", "src/", "host:dest/"}, wantSender: false},
+		{
+			args:       []string{"-av"},
+			opts:       []rsyncclient.Option{rsyncclient.WithDirection(rsyncclient.Send)},
+			wantSender: false,
+		},
+		{
+			args:       []string{"-av"},
+			opts:       []rsyncclient.Option{rsyncclient.WithDirection(rsyncclient.Receive)},
+			wantSender: true,
+		},
+	} {
+		client, err := rsyncclient.New(tt.args, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverArgs := client.ServerCommandOptions(".")
+		if got := slices.Contains(serverArgs, "--sender"); got != tt.wantSender {
+			t.Errorf("New(%q): server args %q: --sender = %v, want %v", tt.args, serverArgs, got, tt.wantSender)
+		}
+	}
+
+	// An explicit direction does not permit operands.
+	if _, err := rsyncclient.New([]string{"-av", "host:src/", "dest/"}, rsyncclient.WithDirection(rsyncclient.Receive)); err == nil {
+		t.Errorf("New(operands, WithDirection) unexpectedly succeeded")
+	}
+}
+
+// cancelReader calls cancel once more than n bytes were read, and then blocks
+// until unblock is closed, simulating a stalled transfer.
+type cancelReader struct {
+	r       io.Reader
+	n       int
+	cancel  func()
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	if cr.n <= 0 {
+		cr.once.Do(cr.cancel)
+		<-cr.unblock
+		return 0, io.ErrClosedPipe
+	}
+	n, err := cr.r.Read(p)
+	cr.n -= n
+	return n, err
+}
+
+func TestClientCancel(t *testing.T) {
+	t.Parallel()
+
+	stderr := testlogger.New(t)
+	tmp := t.TempDir()
+
+	src := filepath.Join(tmp, "src") + "/"
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte{0xbb}, 8*1024*1024)
+	if err := os.WriteFile(filepath.Join(src, "large"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := rsyncclient.New([]string{"-a"}, rsyncclient.WithStderr(stderr), rsyncclient.DontRestrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsync, err := rsyncd.NewServer(nil, rsyncd.WithStderr(stderr), rsyncd.DontRestrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stdin from the view of the rsync server
+	stdinrd, stdinwr := io.Pipe()
+	stdoutrd, stdoutwr := io.Pipe()
+	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
+	osenv := rsyncostest.New(t)
+	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+	if err := pc.ParseArguments(osenv, client.ServerCommandOptions(src), rsyncopts.ParseModeLibrary); err != nil {
+		t.Fatalf("parsing server args: %v", err)
+	}
+	go func() {
+		// The server fails once the pipes are closed at the end of the
+		// test, which is expected.
+		rsync.InternalHandleConn(t.Context(), conn, nil, pc)
+	}()
+
+	unblock := make(chan struct{})
+	defer func() {
+		close(unblock)
+		stdinrd.Close()
+		stdoutrd.Close()
+	}()
+	rw := &readWriter{
+		// Cancel in the middle of receiving the 8 MB data file.
+		Reader: &cancelReader{
+			r:       stdoutrd,
+			n:       1 * 1024 * 1024,
+			cancel:  client.Cancel,
+			unblock: unblock,
+		},
+		Writer: stdinwr,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Run(t.Context(), rw, []string{dest})
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Run() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run() did not return within 10s after Cancel()")
+	}
+}
@@ -0,0 +1,282 @@
+package rsyncclient_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/testlogger"
+	"github.com/gokrazy/rsync/rsyncclient"
+	"github.com/google/go-cmp/cmp"
+)
+
+// The transcript tests replay the bytes which tridge rsync sent as server,
+// recorded in testdata/transcripts, to our client. Unlike the rsyncwire and
+// rsyncchecksum unit tests, which check values computed by this
+// implementation, a replay fails when we encode or decode something (varints,
+// file list entries, checksums, ...) differently than tridge rsync does.
+//
+// Our client’s requests are deterministic for a given source tree and
+// destination state, so a replay reads the transcript in the same order as
+// the recording did. When the client changes what it sends (e.g. it
+// advertises a new capability), re-record the transcripts on a machine with
+// tridge rsync installed:
+//
+//	go test ./rsyncclient -run Transcript -record
+var record = flag.Bool("record", false, "record testdata/transcripts from tridge rsync instead of replaying them")
+
+var transcriptProtocols = []int{29, 30, 31}
+
+type transcriptFile struct {
+	name    string
+	mode    os.FileMode
+	mtime   time.Time
+	content []byte
+}
+
+// transcriptBig returns 64 KiB of incompressible but reproducible data, large
+// enough for a file to consist of many rsync blocks.
+func transcriptBig() []byte {
+	b := make([]byte, 64*1024)
+	x := uint32(2463534242)
+	for i := range b {
+		// xorshift32
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
+
+// transcriptTree is the source tree of all transcripts. The modification
+// times do not fit into 32 bits (2200) or are negative (1960) to cover the
+// varlong encoding of file list entries.
+func transcriptTree() []transcriptFile {
+	return []transcriptFile{
+		{name: "empty", mode: 0644, mtime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "hello", mode: 0644, mtime: time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC), content: []byte("world\n")},
+		{name: "future", mode: 0644, mtime: time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC), content: []byte("see you\n")},
+		{name: "past", mode: 0600, mtime: time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC), content: []byte("good old days\n")},
+		{name: "sub/big", mode: 0644, mtime: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC), content: transcriptBig()},
+		{name: "sub/exec", mode: 0755, mtime: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC), content: []byte("#!/bin/sh\n")},
+	}
+}
+
+var transcriptDirMtime = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func writeTranscriptTree(t *testing.T, dir string) {
+	t.Helper()
+	for _, f := range transcriptTree() {
+		fn := filepath.Join(dir, f.name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, f.content, f.mode); err != nil {
+			t.Fatal(err)
+		}
+		// not subject to the umask, unlike the mode passed to WriteFile
+		if err := os.Chmod(fn, f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{filepath.Join(dir, "sub"), dir} {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(d, transcriptDirMtime, transcriptDirMtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verifyTranscriptTree(t *testing.T, dir string, protocol int) {
+	t.Helper()
+	for _, f := range transcriptTree() {
+		fn := filepath.Join(dir, f.name)
+		got, err := os.ReadFile(fn)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got, f.content) {
+			t.Errorf("%s: unexpected contents: diff (-want +got):\n%s", f.name, cmp.Diff(f.content, got))
+		}
+		st, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := st.Mode().Perm(), f.mode; got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", f.name, got, want)
+		}
+		if protocol < 30 && (f.mtime.Unix() < 0 || f.mtime.Unix() > math.MaxInt32) {
+			// Before protocol 30, modification times are 32-bit integers on
+			// the wire, and implementations differ in how they truncate.
+			continue
+		}
+		if got, want := st.ModTime(), f.mtime; !got.Equal(want) {
+			t.Errorf("%s: unexpected mtime: got %v, want %v", f.name, got, want)
+		}
+	}
+}
+
+func transcriptPath(direction string, protocol int) string {
+	return filepath.Join("testdata", "transcripts", fmt.Sprintf("%s-proto%d.bin", direction, protocol))
+}
+
+// runTranscript runs client against tridge rsync (recording its output to
+// fn) or against the transcript in fn.
+func runTranscript(t *testing.T, client *rsyncclient.Client, fn, serverPath string, paths []string) {
+	t.Helper()
+
+	if !*record {
+		transcript, err := os.ReadFile(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Skipf("transcript not recorded yet, run go test -record with tridge rsync installed: %v", err)
+			}
+			t.Fatal(err)
+		}
+		rw := &readWriter{
+			Reader: bytes.NewReader(transcript),
+			Writer: io.Discard,
+		}
+		if _, err := client.Run(t.Context(), rw, paths); err != nil {
+			t.Fatalf("replaying %s: %v", fn, err)
+		}
+		return
+	}
+
+	rsyncBin := rsynctest.TridgeOrGTFO(t, "recording transcripts")
+	rsync := exec.Command(rsyncBin, client.ServerCommandOptions(serverPath)...)
+	rsync.Stderr = testlogger.New(t)
+	wc, err := rsync.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := rsync.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsync.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var transcript bytes.Buffer
+	rw := &readWriter{
+		Reader: io.TeeReader(rc, &transcript),
+		Writer: wc,
+	}
+	if _, err := client.Run(t.Context(), rw, paths); err != nil {
+		t.Fatal(err)
+	}
+	wc.Close()
+	// Drain the remaining output (if any) before Wait closes the pipe.
+	if _, err := io.Copy(&transcript, rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsync.Wait(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn, transcript.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("recorded %d bytes to %s", transcript.Len(), fn)
+}
+
+// TestTranscriptReceive replays tridge rsync sending the tree: file list
+// (varint/varlong encoding at protocol >= 30), file data and the whole-file
+// checksums (MD5 at protocol >= 30, seeded MD4 before), which our receiver
+// verifies.
+func TestTranscriptReceive(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range transcriptProtocols {
+		t.Run(fmt.Sprintf("protocol=%d", protocol), func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if *record {
+				if err := os.MkdirAll(source, 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeTranscriptTree(t, source)
+			}
+
+			client, err := rsyncclient.New([]string{"-rtp", fmt.Sprintf("--protocol=%d", protocol)},
+				rsyncclient.WithStderr(testlogger.New(t)),
+				rsyncclient.DontRestrict())
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTranscript(t, client, transcriptPath("receive", protocol), source+"/", []string{dest})
+
+			verifyTranscriptTree(t, dest, protocol)
+		})
+	}
+}
+
+// TestTranscriptSend replays tridge rsync receiving the tree while the
+// destination holds a modified copy of sub/big. Our sender finds matching
+// blocks only if it computes the block checksums like tridge rsync’s
+// generator (MD5 at protocol >= 30, seeded MD4 before).
+func TestTranscriptSend(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range transcriptProtocols {
+		t.Run(fmt.Sprintf("protocol=%d", protocol), func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if err := os.MkdirAll(source, 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTranscriptTree(t, source)
+			if *record {
+				basis := transcriptBig()
+				copy(basis[30000:], "modified in the destination")
+				if err := os.MkdirAll(filepath.Join(dest, "sub"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dest, "sub", "big"), basis, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			client, err := rsyncclient.New([]string{"-rtp", fmt.Sprintf("--protocol=%d", protocol)},
+				rsyncclient.WithDirection(rsyncclient.Send),
+				rsyncclient.WithStderr(testlogger.New(t)),
+				rsyncclient.DontRestrict())
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTranscript(t, client, transcriptPath("send", protocol), dest, []string{source + "/"})
+
+			if *record {
+				verifyTranscriptTree(t, dest, protocol)
+			}
+			// Without matching blocks, the sender would transmit all of
+			// sub/big as literal data.
+			if got, limit := client.Stats().Written, int64(len(transcriptBig())/4); got > limit {
+				t.Errorf("sender wrote %d bytes, want at most %d (block checksums did not match)", got, limit)
+			}
+		})
+	}
+}
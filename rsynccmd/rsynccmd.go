@@ -36,6 +36,10 @@ type Cmd struct {
 	Stderr       io.Writer
 	DontRestrict bool
 
+	// Env (if non-nil) is used instead of the process environment to look
+	// up environment variables like RSYNC_RSH or RSYNC_PASSWORD.
+	Env map[string]string
+
 	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
@@ -63,6 +67,9 @@ func (c *Cmd) Run(ctx context.Context) (*Result, error) {
 		DontRestrict: c.DontRestrict,
 		DialContext:  c.DialContext,
 	}
+	if c.Env != nil {
+		osenv = rsyncos.WithEnvironment(c.Env, osenv)
+	}
 	stats, err := maincmd.Main(ctx, osenv, c.Args, nil)
 	if err != nil {
 		return nil, err
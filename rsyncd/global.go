@@ -0,0 +1,154 @@
+package rsyncd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+)
+
+// Global contains server-wide settings. MaxConnections, BandwidthLimit and
+// IOTimeout are defaults which each Module can override.
+type Global struct {
+	// MaxConnections limits the number of simultaneous connections to each
+	// module. Zero means no limit.
+	MaxConnections int `toml:"max_connections"`
+
+	// BandwidthLimit limits the rate at which the server sends data to each
+	// client, using the syntax of rsync --bwlimit (e.g. "512" for 512 KiB/s,
+	// "1.5m" or "10MB"). Empty or "0" means no limit.
+	BandwidthLimit string `toml:"bwlimit"`
+
+	// LogLevel is either "info" (the default) or "quiet", which disables the
+	// server’s log messages (errors are still reported to clients).
+	LogLevel string `toml:"log_level"`
+
+	// IOTimeout is the I/O timeout for transfers (like rsync --timeout),
+	// which the server also tells clients about (protocol >= 31). Clients can
+	// request a shorter timeout.
+	IOTimeout time.Duration `toml:"timeout"`
+
+	// ConnectTimeout limits how long a client may take to select a module
+	// and send its arguments after connecting.
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+}
+
+// WithGlobal specifies server-wide settings, see [Global].
+func WithGlobal(global *Global) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.global = *global
+	})
+}
+
+func validateGlobal(global Global) error {
+	switch global.LogLevel {
+	case "", "info", "quiet":
+	default:
+		return fmt.Errorf("invalid log_level %q (expected info or quiet)", global.LogLevel)
+	}
+	if _, err := parseBandwidthLimit(global.BandwidthLimit); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseBandwidthLimit returns the bandwidth limit in bytes per second, or 0
+// if arg is empty or 0.
+//
+// rsync/options.c:parse_arguments (OPT_BWLIMIT)
+func parseBandwidthLimit(arg string) (int64, error) {
+	if arg == "" {
+		return 0, nil
+	}
+	limit, err := rsyncopts.ParseSizeArg(arg, 'K')
+	if err != nil {
+		return 0, fmt.Errorf("bwlimit: %v", err)
+	}
+	if limit > 0 && limit < 512 {
+		return 0, fmt.Errorf("bwlimit: %q is too small (minimum: 512 bytes per second)", arg)
+	}
+	return limit, nil
+}
+
+// maxConnections returns the connection limit for mod.
+func (s *Server) maxConnections(mod *Module) int {
+	if mod.MaxConnections != 0 {
+		return mod.MaxConnections
+	}
+	return s.global.MaxConnections
+}
+
+// bandwidthLimit returns the bandwidth limit for mod in bytes per second.
+// Limits were validated in NewServer.
+func (s *Server) bandwidthLimit(mod *Module) int64 {
+	arg := s.global.BandwidthLimit
+	if mod.BandwidthLimit != "" {
+		arg = mod.BandwidthLimit
+	}
+	limit, _ := parseBandwidthLimit(arg)
+	return limit
+}
+
+// ioTimeout returns the I/O timeout for a connection to mod, given the
+// timeout the client requested.
+//
+// rsync/clientserver.c:rsync_module (lp_timeout)
+func (s *Server) ioTimeout(mod *Module, requested time.Duration) time.Duration {
+	timeout := s.global.IOTimeout
+	if mod.IOTimeout != 0 {
+		timeout = mod.IOTimeout
+	}
+	if timeout > 0 && (requested == 0 || requested > timeout) {
+		return timeout
+	}
+	return requested
+}
+
+// bwLimitWriter limits the rate of writes to bytesPerSec by sleeping once
+// enough data was written.
+//
+// rsync/io.c:sleep_for_bwlimit
+type bwLimitWriter struct {
+	w           io.Writer
+	bytesPerSec int64
+
+	// for testing
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	prior   time.Time // when the last sleep ended
+	pending int64     // bytes written, but not yet accounted for by a sleep
+}
+
+func newBWLimitWriter(w io.Writer, bytesPerSec int64) *bwLimitWriter {
+	return &bwLimitWriter{
+		w:           w,
+		bytesPerSec: bytesPerSec,
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+}
+
+func (b *bwLimitWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	b.pending += int64(n)
+	start := b.now()
+	if !b.prior.IsZero() {
+		// Time passed since the last sleep makes up for some of the data.
+		elapsed := start.Sub(b.prior)
+		b.pending -= int64(elapsed.Seconds() * float64(b.bytesPerSec))
+		b.pending = max(b.pending, 0)
+	}
+	wait := time.Duration(float64(b.pending) / float64(b.bytesPerSec) * float64(time.Second))
+	if wait < 100*time.Millisecond {
+		// Not worth sleeping for yet.
+		b.prior = start
+		return n, err
+	}
+	b.sleep(wait)
+	b.prior = b.now()
+	// Account for oversleeping (or undersleeping).
+	b.pending = int64((wait - b.prior.Sub(start)).Seconds() * float64(b.bytesPerSec))
+	return n, err
+}
@@ -0,0 +1,118 @@
+package rsyncd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxConnections(t *testing.T) {
+	srv, err := NewServer([]Module{
+		{Name: "music", Path: t.TempDir()},
+		{Name: "photos", Path: t.TempDir(), MaxConnections: 2},
+	}, WithStderr(io.Discard), DontRestrict(), WithGlobal(&Global{
+		MaxConnections: 1,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connect selects the module and returns the server’s response.
+	connect := func(module string) (string, net.Conn) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			srv.HandleDaemonConn(context.Background(), NewConnection(server, server, "192.0.2.1:4711"))
+		}()
+		rd := bufio.NewReader(client)
+		if _, err := rd.ReadString('\n'); err != nil { // server greeting
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(client, "@RSYNCD: 31.0\n"+module+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line, client
+	}
+
+	// The global limit applies to the music module.
+	line, first := connect("music")
+	defer first.Close()
+	if line != "@RSYNCD: OK\n" {
+		t.Fatalf("unexpected server response %q", line)
+	}
+	line, second := connect("music")
+	defer second.Close()
+	if want := "@ERROR: max connections (1) reached"; !strings.HasPrefix(line, want) {
+		t.Errorf("second connection: got %q, want prefix %q", line, want)
+	}
+
+	// The photos module overrides the limit.
+	for range 2 {
+		line, conn := connect("photos")
+		defer conn.Close()
+		if line != "@RSYNCD: OK\n" {
+			t.Fatalf("unexpected server response %q", line)
+		}
+	}
+}
+
+func TestInvalidGlobal(t *testing.T) {
+	for _, global := range []Global{
+		{LogLevel: "chatty"},
+		{BandwidthLimit: "fast"},
+		{BandwidthLimit: "100b"}, // below the minimum
+	} {
+		if _, err := NewServer(nil, WithStderr(io.Discard), WithGlobal(&global)); err == nil {
+			t.Errorf("NewServer(%+v) unexpectedly succeeded", global)
+		}
+	}
+}
+
+func TestIOTimeout(t *testing.T) {
+	srv := &Server{global: Global{IOTimeout: time.Minute}}
+	for _, tt := range []struct {
+		mod       Module
+		requested time.Duration
+		want      time.Duration
+	}{
+		{requested: 0, want: time.Minute},
+		{requested: 10 * time.Second, want: 10 * time.Second},
+		{requested: time.Hour, want: time.Minute},
+		{mod: Module{IOTimeout: time.Second}, requested: 0, want: time.Second},
+	} {
+		if got := srv.ioTimeout(&tt.mod, tt.requested); got != tt.want {
+			t.Errorf("ioTimeout(%+v, %v) = %v, want %v", tt.mod, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	var now time.Time
+	var slept time.Duration
+	bw := newBWLimitWriter(io.Discard, 100*1024)
+	bw.now = func() time.Time { return now }
+	bw.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	now = time.Unix(1e9, 0)
+	buf := make([]byte, 1024)
+	for range 1000 {
+		if _, err := bw.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1000 KiB at 100 KiB/s take 10s, but data written since the last sleep
+	// (less than 100ms worth) is not slept for yet.
+	if lo, hi := 9900*time.Millisecond, 10*time.Second; slept < lo || slept > hi {
+		t.Errorf("slept %v, want between %v and %v", slept, lo, hi)
+	}
+}
@@ -0,0 +1,42 @@
+package rsyncd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestModulePaths(t *testing.T) {
+	for _, tt := range []struct {
+		paths []string
+		want  []string
+	}{
+		{paths: []string{"mod"}, want: []string{"."}},
+		{paths: []string{"mod/"}, want: []string{"/"}},
+		{paths: []string{"mod/sub dir/"}, want: []string{"/sub dir/"}},
+		{paths: []string{"mod/a", "mod/b"}, want: []string{"/a", "/b"}},
+		// Not prefixed by the module name: relative to the module.
+		{paths: []string{"modfoo/x", "b"}, want: []string{"modfoo/x", "b"}},
+		{paths: []string{"mod/a/../b"}, want: []string{"/a/../b"}},
+	} {
+		got, err := modulePaths("mod", tt.paths)
+		if err != nil {
+			t.Errorf("modulePaths(%q): %v", tt.paths, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("modulePaths(%q): unexpected result: diff (-want +got):\n%s", tt.paths, diff)
+		}
+	}
+
+	for _, paths := range [][]string{
+		{"mod/../othermod"},
+		{"mod/a", "mod/a/../../b"},
+		{".."},
+		{"mod/./.."},
+	} {
+		if got, err := modulePaths("mod", paths); err == nil {
+			t.Errorf("modulePaths(%q) = %q, want error", paths, got)
+		}
+	}
+}
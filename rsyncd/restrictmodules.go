@@ -22,5 +22,8 @@ func restrictToModules(modules []Module) error {
 			roDirs = append(roDirs, mod.Path)
 		}
 	}
-	return restrict.MaybeFileSystem(roDirs, rwDirs)
+	if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
+		return err
+	}
+	return restrict.MaybeSyscalls()
 }
@@ -15,12 +15,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/internal/progress"
 	"github.com/gokrazy/rsync/internal/receiver"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
@@ -33,6 +35,22 @@ type Module struct {
 	FS       fs.FS    `toml:"-"`    // If set, serve from this instead of Path
 	ACL      []string `toml:"acl"`
 	Writable bool     `toml:"writable"` // Must be false if FS is set
+
+	// Comment is shown next to the module name when clients list the
+	// modules. If empty, the module name is shown instead.
+	Comment string `toml:"comment"`
+
+	// SSHAuthorizedKeys is the path to an authorized_keys file. If set, the
+	// module is only available over SSH listeners, to clients authenticating
+	// with one of the listed keys (in addition to the listener’s own
+	// authorized_keys, if any).
+	SSHAuthorizedKeys string `toml:"ssh_authorized_keys"`
+
+	// MaxConnections, BandwidthLimit and IOTimeout override the server-wide
+	// defaults (see [Global]) if non-zero.
+	MaxConnections int           `toml:"max_connections"`
+	BandwidthLimit string        `toml:"bwlimit"`
+	IOTimeout      time.Duration `toml:"timeout"`
 }
 
 // Option specifies the server options.
@@ -75,11 +93,18 @@ func NewServer(modules []Module, opts ...Option) (*Server, error) {
 
 	server := &Server{
 		modules: modules,
+		conns:   make(map[string]*atomic.Int32, len(modules)),
+	}
+	for _, mod := range modules {
+		server.conns[mod.Name] = new(atomic.Int32)
 	}
 
 	for _, opt := range opts {
 		opt.applyServer(server)
 	}
+	if err := validateGlobal(server.global); err != nil {
+		return nil, err
+	}
 
 	// Default to os.Stderr if no stderr was specified.
 	// Explicitly use io.Discard if you do not want stderr.
@@ -89,7 +114,11 @@ func NewServer(modules []Module, opts ...Option) (*Server, error) {
 
 	if server.logger == nil {
 		// TODO: use the logger in a *rsyncos.Env instead
-		server.logger = log.New(server.stderr)
+		if server.global.LogLevel == "quiet" {
+			server.logger = log.New(io.Discard)
+		} else {
+			server.logger = log.New(server.stderr)
+		}
 	}
 
 	// An empty module list means this server is a sender
@@ -109,8 +138,13 @@ type Server struct {
 	stderr       io.Writer
 	logger       log.Logger
 	dontRestrict bool
+	global       Global
 
-	modules []Module
+	modules  []Module
+	sessions sessionRegistry
+	// conns counts the active connections per module name. The map itself
+	// is not modified after NewServer returns.
+	conns map[string]*atomic.Int32
 }
 
 func (s *Server) getModule(requestedModule string) (Module, error) {
@@ -129,7 +163,11 @@ func (s *Server) formatModuleList() string {
 	}
 	var list strings.Builder
 	for _, mod := range s.modules {
-		comment := mod.Name // for now
+		comment := mod.Comment
+		if comment == "" {
+			comment = mod.Name
+		}
+		// rsync/clientserver.c:send_listing
 		fmt.Fprintf(&list, "%s\t%s\n",
 			mod.Name,
 			comment)
@@ -191,19 +229,39 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
 	const terminationCommand = "@RSYNCD: OK\n"
 	cwr := conn.cwr
 	rd := conn.rd
-	// send server greeting
-
-	fmt.Fprintf(cwr, "@RSYNCD: %d\n", rsync.ProtocolVersion)
+	if timeout := s.global.ConnectTimeout; timeout > 0 && conn.dl != nil {
+		// The deadline covers the greeting, module selection and arguments,
+		// after which the transfer’s I/O timeout (if any) applies.
+		if err := conn.dl.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	// send server greeting, including the sub-protocol version (0 means a
+	// release version), without which rsync 3.x clients refuse protocol >= 30.
+	fmt.Fprintf(cwr, "@RSYNCD: %d.0\n", rsync.ProtocolVersion)
 
 	// read client greeting
 	clientGreeting, err := rd.ReadString('\n')
 	if err != nil {
 		return err
 	}
-	if !strings.HasPrefix(clientGreeting, "@RSYNCD: ") {
+	const greetingPrefix = "@RSYNCD: "
+	if !strings.HasPrefix(clientGreeting, greetingPrefix) {
 		return fmt.Errorf("invalid client greeting: got %q", clientGreeting)
 	}
-	// TODO: protocol negotiation
+	// The client greeting may contain a sub-protocol version (e.g. 31.0),
+	// which we ignore: only the major version is relevant for negotiation.
+	var remoteProtocol int32
+	if _, err := fmt.Sscanf(strings.TrimPrefix(clientGreeting, greetingPrefix), "%d", &remoteProtocol); err != nil {
+		fmt.Fprintf(cwr, "@ERROR: protocol startup error\n")
+		return fmt.Errorf("invalid client greeting %q: %v", clientGreeting, err)
+	}
+	protocol, err := rsynccommon.NegotiateProtocol(rsync.ProtocolVersion, remoteProtocol)
+	if err != nil {
+		fmt.Fprintf(cwr, "@ERROR: %v\n", err)
+		return err
+	}
+	conn.peer = rsynccommon.PeerFromGreeting(strings.TrimPrefix(clientGreeting, greetingPrefix))
 
 	// read requested module(s), if any
 	requestedModule, err := rd.ReadString('\n')
@@ -229,47 +287,55 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
 		return err
 	}
 
+	if n := s.conns[module.Name]; n != nil {
+		current := n.Add(1)
+		defer n.Add(-1)
+		// rsync/clientserver.c:rsync_module
+		if limit := s.maxConnections(&module); limit > 0 && current > int32(limit) {
+			fmt.Fprintf(cwr, "@ERROR: max connections (%d) reached -- try again later\n", limit)
+			return fmt.Errorf("max connections (%d) reached for module %q", limit, module.Name)
+		}
+	}
+
 	io.WriteString(cwr, terminationCommand)
 
-	// read requested flags
+	// read requested flags, which are NUL-terminated starting with protocol 30
+	// (rsync/io.c:read_args)
+	argDelim := byte('\n')
+	if protocol >= 30 {
+		argDelim = 0
+	}
 	var flags []string
 	for {
-		flag, err := rd.ReadString('\n')
+		flag, err := rd.ReadString(argDelim)
 		if err != nil {
 			return err
 		}
-		flag = strings.TrimSpace(flag)
+		flag = strings.TrimSuffix(flag, string(argDelim))
+		if argDelim == '\n' {
+			flag = strings.TrimSpace(flag)
+		}
 		s.logger.Printf("client sent: %q", flag)
 		if flag == "" {
 			break
 		}
 		flags = append(flags, flag)
 	}
+	if s.global.ConnectTimeout > 0 && conn.dl != nil {
+		if err := conn.dl.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
 
 	s.logger.Printf("flags: %+v", flags)
 	osenv := &rsyncos.Env{Stderr: s.stderr}
 	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(osenv))
-	if err := pc.ParseArguments(osenv, flags); err != nil {
-		err = fmt.Errorf("parsing server args: %v", err)
-
+	if err := pc.ParseArguments(osenv, flags, rsyncopts.ParseModeLibrary); err != nil {
 		// terminate connection with an error about which flag is not supported
-		c := &rsyncwire.Conn{
-			Reader: rd,
-			Writer: cwr,
-		}
-
-		const errorSeed = 0xee
-		if err := c.WriteInt32(errorSeed); err != nil {
-			return err
-		}
-
-		// Switch to multiplexing protocol, but only for server-side transmissions.
-		// Transmissions received from the client are not multiplexed.
-		mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
-		mpx.WriteMsg(rsyncwire.MsgError, fmt.Appendf(nil, "gokr-rsync [sender]: %v\n", err))
-
-		return err
+		return rejectArgs(cwr, fmt.Errorf("parsing server args: %v", err))
 	}
+	// The protocol version was negotiated as part of the greeting exchange.
+	pc.Options.SetProtocolVersion(protocol)
 	remaining := pc.RemainingArgs
 	s.logger.Printf("remaining: %q", remaining)
 	// remaining[0] is always "."
@@ -283,40 +349,89 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
 	paths := remaining[1:]
 	s.logger.Printf("paths: %q", paths)
 
-	// Strip the module_name/ prefix out of the paths,
-	// see rsync/io.c:read_args, glob_expand_module().
-	for idx, path := range pc.RemainingArgs {
-		if idx == 0 {
-			// skip pc.RemainingArgs[0], only strip RemainingArgs[1:]
-			continue
-		}
-		trimmed := strings.TrimPrefix(path, module.Name)
-		if trimmed == "" {
-			trimmed = "."
-		}
-		pc.RemainingArgs[idx] = trimmed
+	trimmed, err := modulePaths(module.Name, paths)
+	if err != nil {
+		return rejectArgs(cwr, err)
 	}
+	pc.RemainingArgs = append(pc.RemainingArgs[:1], trimmed...)
 
 	s.logger.Printf("trimmed paths: %q", pc.RemainingArgs[1:])
 
 	return s.handleConn(ctx, conn, &module, pc, false)
 }
 
+// rejectArgs terminates the connection with err, which is sent to the
+// client in place of the checksum seed, and returns err.
+func rejectArgs(w io.Writer, err error) error {
+	c := &rsyncwire.Conn{Writer: w}
+	const errorSeed = 0xee
+	if err := c.WriteInt32(errorSeed); err != nil {
+		return err
+	}
+
+	// Switch to multiplexing protocol, but only for server-side transmissions.
+	// Transmissions received from the client are not multiplexed.
+	mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
+	mpx.WriteMsg(rsyncwire.MsgErrorFatal, fmt.Appendf(nil, "gokr-rsync [sender]: %v\n", err))
+
+	return err
+}
+
+// modulePaths turns the paths requested by the client, which start with the
+// module name, into paths relative to the module (which keep a trailing
+// slash, if any). Paths which do not start with the module name are relative
+// to the module, too. A path consisting of only the module name refers to
+// the module itself. Paths which would escape the module using .. are
+// rejected.
+//
+// rsync/io.c:read_args, rsync/util1.c:glob_expand_module
+func modulePaths(module string, paths []string) ([]string, error) {
+	trimmed := make([]string, 0, len(paths))
+	for _, requested := range paths {
+		path := requested
+		if rest, ok := strings.CutPrefix(path, module); ok && (rest == "" || rest[0] == '/') {
+			path = rest
+		}
+		if path == "" {
+			path = "."
+		}
+		depth := 0
+		for elem := range strings.SplitSeq(path, "/") {
+			switch elem {
+			case "", ".":
+			case "..":
+				depth--
+			default:
+				depth++
+			}
+			if depth < 0 {
+				return nil, fmt.Errorf("path %q is outside of module %q", requested, module)
+			}
+		}
+		trimmed = append(trimmed, path)
+	}
+	return trimmed, nil
+}
+
 type Conn struct {
 	name string
 	crd  *rsyncwire.CountingReader
 	cwr  *rsyncwire.CountingWriter
 	rd   *bufio.Reader
+	dl   rsyncwire.ReadDeadliner // nil if r does not support deadlines
+	peer rsyncwire.Peer          // detected from the client greeting
 }
 
 func NewConnection(r io.Reader, w io.Writer, name string) *Conn {
 	crd, cwr := rsyncwire.CounterPair(r, w)
 	rd := bufio.NewReader(crd)
+	dl, _ := r.(rsyncwire.ReadDeadliner)
 	return &Conn{
 		name: name,
 		crd:  crd,
 		cwr:  cwr,
 		rd:   rd,
+		dl:   dl,
 	}
 }
 
@@ -328,7 +443,7 @@ func (s *Server) InternalHandleConn(ctx context.Context, conn *Conn, module *Mod
 func (s *Server) HandleConnArgs(ctx context.Context, conn *Conn, module *Module, args []string) error {
 	osenv := &rsyncos.Env{Stderr: s.stderr}
 	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(osenv))
-	if err := pc.ParseArguments(osenv, args); err != nil {
+	if err := pc.ParseArguments(osenv, args, rsyncopts.ParseModeLibrary); err != nil {
 		return fmt.Errorf("parsing server args: %v", err)
 	}
 	return s.handleConn(ctx, conn, module, pc, true /* negotiate */)
@@ -349,9 +464,21 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 	// matter. The goal is to have a checksum seed each time.
 	sessionChecksumSeed := int32(time.Now().Unix()) ^ (int32(os.Getpid()) << 6)
 
+	if module != nil {
+		if limit := s.bandwidthLimit(module); limit > 0 {
+			cwr.W = newBWLimitWriter(cwr.W, limit)
+		}
+		requested := time.Duration(opts.IOTimeoutSeconds()) * time.Second
+		if timeout := s.ioTimeout(module, requested); timeout != requested {
+			opts.SetIOTimeoutSeconds(max(1, int(timeout.Round(time.Second)/time.Second)))
+		}
+	}
+
 	c := &rsyncwire.Conn{
-		Reader: rd,
-		Writer: cwr,
+		Reader:        rd,
+		Writer:        cwr,
+		ReadDeadliner: conn.dl,
+		Capabilities:  rsyncwire.Capabilities{Peer: conn.peer},
 	}
 
 	if negotiate {
@@ -362,17 +489,40 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 		if opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
 			s.logger.Printf("remote protocol: %d", remoteProtocol)
 		}
-		if err := c.WriteInt32(rsync.ProtocolVersion); err != nil {
+		local := min(opts.ProtocolVersion(), rsync.ProtocolVersion)
+		if err := c.WriteInt32(local); err != nil {
 			return err
 		}
+		protocol, err := rsynccommon.NegotiateProtocol(local, remoteProtocol)
+		if err != nil {
+			return err
+		}
+		opts.SetProtocolVersion(protocol)
+		c.Capabilities.Peer = rsynccommon.PeerFromProtocol(remoteProtocol)
+	}
+	c.ProtocolVersion = opts.ProtocolVersion()
+	if opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
+		s.logger.Printf("negotiated protocol: %d, peer: %v", c.ProtocolVersion, c.Capabilities.Peer)
+	}
+
+	if err := rsynccommon.ExchangeCapabilities(c, true /* server */, opts.ShellCommand(), opts.AllowIncRecurse(), opts.Compression()); err != nil {
+		return err
+	}
+	if c.ProtocolVersion >= 30 && opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
+		s.logger.Printf("compat flags: 0x%x, checksum: %s", c.Capabilities.CompatFlags, rsynccommon.ChecksumName(c))
+	}
+	if c.Capabilities.Compression != "" && opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
+		s.logger.Printf("compression: %s", c.Capabilities.Compression)
 	}
 
 	if err := c.WriteInt32(sessionChecksumSeed); err != nil {
 		return err
 	}
 
-	// Switch to multiplexing protocol, but only for server-side transmissions.
-	// Transmissions received from the client are not multiplexed.
+	// Switch to multiplexing protocol for server-side transmissions.
+	// Transmissions received from the client are only multiplexed starting
+	// with protocol 30, or when the client receiver needs to send messages
+	// (MSG_SUCCESS for --remove-source-files) to us as the sender.
 	mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
 	// Update cwr to track the multiplexed writer,
 	// but copy the number of bytes written.
@@ -381,29 +531,65 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 		BytesWritten: cwr.BytesWritten,
 	}
 	c.Writer = cwr
+	if module != nil && c.ProtocolVersion >= 31 {
+		// Tell the client about our timeout, so that it sends keep-alive
+		// messages in time.
+		//
+		// rsync/main.c:start_server
+		if timeout := opts.IOTimeoutSeconds(); timeout > 0 {
+			var buf rsyncwire.Buffer
+			buf.WriteInt32(int32(timeout))
+			if _, err := mpx.WriteMsg(rsyncwire.MsgIOTimeout, []byte(buf.String())); err != nil {
+				return err
+			}
+		}
+	}
+	var mrd *rsyncwire.MultiplexReader
+	if c.ProtocolVersion >= 30 || (opts.Sender() && opts.RemoveSourceFiles()) {
+		mrd = &rsyncwire.MultiplexReader{
+			Env:    &rsyncos.Env{Stderr: s.stderr},
+			Reader: c.Reader,
+		}
+		c.Reader = bufio.NewReaderSize(mrd, 256*1024)
+	}
+
+	sess := &session{
+		remote:    conn.name,
+		direction: "receiver",
+		start:     time.Now(),
+	}
+	if module != nil {
+		sess.module = module.Name
+	}
+	if opts.Sender() {
+		sess.direction = "sender"
+	}
+	sess.setCounters(crd, cwr)
+	s.sessions.add(sess)
+	defer s.sessions.remove(sess)
 
 	if opts.Sender() {
 		// If returning an error, send the error to the client for display, too:
 		defer func() {
 			if err != nil {
-				mpx.WriteMsg(rsyncwire.MsgError, fmt.Appendf(nil, "gokr-rsync [sender]: %v\n", err))
+				mpx.WriteMsg(rsyncwire.MsgErrorFatal, fmt.Appendf(nil, "gokr-rsync [sender]: %v\n", err))
 			}
 		}()
 
-		return s.handleConnSender(module, crd, cwr, paths, opts, false, c, sessionChecksumSeed)
+		return s.handleConnSender(module, crd, cwr, paths, opts, false, c, mrd, sessionChecksumSeed, sess)
 	}
 
 	// If returning an error, send the error to the client for display, too:
 	defer func() {
 		if err != nil {
-			mpx.WriteMsg(rsyncwire.MsgError, fmt.Appendf(nil, "gokr-rsync [receiver]: %v\n", err))
+			mpx.WriteMsg(rsyncwire.MsgErrorFatal, fmt.Appendf(nil, "gokr-rsync [receiver]: %v\n", err))
 		}
 	}()
-	return s.handleConnReceiver(module, crd, cwr, paths, opts, false, c, sessionChecksumSeed)
+	return s.handleConnReceiver(ctx, module, crd, cwr, paths, opts, false, c, mrd, sessionChecksumSeed, sess)
 }
 
 // handleConnReceiver is equivalent to rsync/main.c:do_server_recv
-func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, sessionChecksumSeed int32) (err error) {
+func (s *Server) handleConnReceiver(ctx context.Context, module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, mrd *rsyncwire.MultiplexReader, sessionChecksumSeed int32, sess *session) (err error) {
 	var destPath string
 	implicitModule := module == nil
 	if implicitModule {
@@ -433,17 +619,34 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 			Verbose:  opts.Verbose(),
 			Progress: opts.Progress(),
 
-			DeleteMode:       opts.DeleteMode(),
-			PreserveGid:      opts.PreserveGid(),
-			PreserveUid:      opts.PreserveUid(),
-			PreserveLinks:    opts.PreserveLinks(),
-			PreservePerms:    opts.PreservePerms(),
-			PreserveDevices:  opts.PreserveDevices(),
-			PreserveSpecials: opts.PreserveSpecials(),
-			PreserveTimes:    opts.PreserveMTimes(),
-			// TODO: PreserveHardlinks: opts.PreserveHardlinks,
-			IgnoreTimes:    opts.IgnoreTimes(),
-			AlwaysChecksum: opts.AlwaysChecksum(),
+			DeleteMode:        opts.DeleteMode(),
+			Recurse:           opts.Recurse(),
+			ForceDelete:       opts.ForceDelete(),
+			IgnoreErrors:      opts.IgnoreErrors(),
+			PreserveGid:       opts.PreserveGid(),
+			PreserveUid:       opts.PreserveUid(),
+			NumericIds:        opts.NumericIds(),
+			SanitizePaths:     !implicitModule,
+			PreserveLinks:     opts.PreserveLinks(),
+			SafeLinks:         opts.SafeLinks(),
+			MungeLinks:        opts.MungeLinks(),
+			KeepDirlinks:      opts.KeepDirlinks(),
+			WriteDevices:      opts.WriteDevices(),
+			PreservePerms:     opts.PreservePerms(),
+			PreserveDevices:   opts.PreserveDevices(),
+			PreserveSpecials:  opts.PreserveSpecials(),
+			PreserveTimes:     opts.PreserveMTimes(),
+			OmitLinkTimes:     opts.OmitLinkTimes(),
+			PreserveHardlinks: opts.PreserveHardLinks(),
+			IgnoreTimes:       opts.IgnoreTimes(),
+			AlwaysChecksum:    opts.AlwaysChecksum(),
+			ModifyWindow:      opts.ModifyWindow(),
+			KeepPartial:       opts.KeepPartial(),
+			PartialDir:        opts.PartialDir(),
+			RemoveSourceFiles: opts.RemoveSourceFiles(),
+
+			IOTimeout:         time.Duration(opts.IOTimeoutSeconds()) * time.Second,
+			KeepaliveInterval: time.Duration(opts.IOTimeoutSeconds()) * time.Second / 2,
 
 			InfoGTE:  opts.InfoGTE,
 			DebugGTE: opts.DebugGTE,
@@ -452,9 +655,13 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 		Env: &rsyncos.Env{
 			Stderr: s.stderr,
 		},
-		Conn:     c,
-		Seed:     sessionChecksumSeed,
-		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn:        c,
+		Seed:        sessionChecksumSeed,
+		Progress:    progress.NewPrinter(io.Discard, time.Now),
+		FileStarted: sess.setCurrentFile,
+	}
+	if mrd != nil {
+		mrd.NoSend = rt.NoSend
 	}
 	if err := os.MkdirAll(rt.Dest, 0755); err != nil {
 		return fmt.Errorf("MkdirAll(dest=%s): %v", rt.Dest, err)
@@ -500,17 +707,16 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 		}
 	}
 
-	if opts.PreserveHardLinks() {
-		return fmt.Errorf("support for hard links not yet implemented")
-	}
-
-	if opts.DeleteMode() {
+	if opts.ReceiverWantsFilterList(c.ProtocolVersion) {
 		// receive the exclusion list (openrsync’s is always empty)
 		exclusionList, err := sender.RecvFilterList(c)
 		if err != nil {
 			return err
 		}
 		s.logger.Printf("exclusion list read (entries: %d)", len(exclusionList.Filters))
+		if !opts.DeleteExcluded() {
+			rt.Opts.Excluded = exclusionList.Excluded
+		}
 	}
 
 	// receive file list
@@ -521,10 +727,15 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 	if err != nil {
 		return err
 	}
+	if mrd != nil {
+		// A sender which could not use the file list end marker reports
+		// I/O errors with a MSG_IO_ERROR message instead.
+		rt.IOErrors |= mrd.IOError()
+	}
 	if opts.InfoGTE(rsyncopts.INFO_FLIST, 1) {
 		s.logger.Printf("received %d names", len(fileList))
 	}
-	stats, err := rt.Do(c, fileList, true)
+	stats, err := rt.Do(ctx, c, fileList, true)
 	if err != nil {
 		return err
 	}
@@ -535,14 +746,20 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 }
 
 // handleConnSender is equivalent to rsync/main.c:do_server_sender
-func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, sessionChecksumSeed int32) (err error) {
-	if module == nil {
+func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, mrd *rsyncwire.MultiplexReader, sessionChecksumSeed int32, sess *session) (err error) {
+	implicitModule := module == nil
+	if implicitModule {
 		module = &Module{
-			Name: "implicit",
-			Path: "/",
+			Name:     "implicit",
+			Path:     "/",
+			Writable: true,
 		}
 	}
 
+	if opts.RemoveSourceFiles() && !module.Writable {
+		return fmt.Errorf("ERROR: --remove-source-files cannot be used with a read-only module")
+	}
+
 	st := &sender.Transfer{
 		Logger: s.logger,
 		Opts:   opts,
@@ -551,7 +768,9 @@ func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader,
 		Env: &rsyncos.Env{
 			Stderr: s.stderr,
 		},
-		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Progress:    progress.NewPrinter(io.Discard, time.Now),
+		FileStarted: sess.setCurrentFile,
+		Confined:    !implicitModule,
 	}
 	// receive the exclusion list (openrsync’s is always empty)
 
@@ -559,6 +778,11 @@ func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader,
 		st.Source = sender.NewFSSource(module.FS)
 	}
 
+	if opts.RemoveSourceFiles() {
+		// Remove source files once the receiver confirms them.
+		mrd.Success = st.RemoveSourceFile
+	}
+
 	exclusionList, err := sender.RecvFilterList(st.Conn)
 	if err != nil {
 		return err
@@ -619,6 +843,9 @@ func validateModule(mod Module) error {
 			return fmt.Errorf("module %q has empty path", mod.Name)
 		}
 	}
+	if _, err := parseBandwidthLimit(mod.BandwidthLimit); err != nil {
+		return fmt.Errorf("module %q: %v", mod.Name, err)
+	}
 
 	return nil
 }
@@ -0,0 +1,184 @@
+package rsyncd
+
+import (
+	"cmp"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// session tracks one active connection for the /debug/rsyncd page.
+type session struct {
+	id        uint64
+	remote    string
+	module    string
+	direction string // "sender" or "receiver", from the server’s perspective
+	start     time.Time
+
+	mu          sync.Mutex
+	crd         *rsyncwire.CountingReader
+	cwr         *rsyncwire.CountingWriter
+	currentFile string
+}
+
+func (s *session) setCounters(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crd = crd
+	s.cwr = cwr
+}
+
+func (s *session) setCurrentFile(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentFile = name
+}
+
+// SessionInfo is a snapshot of an active connection, as rendered by
+// [Server.DebugHandler].
+type SessionInfo struct {
+	Remote       string    `json:"remote"`
+	Module       string    `json:"module"`
+	Direction    string    `json:"direction"`
+	Start        time.Time `json:"start"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+	CurrentFile  string    `json:"current_file"`
+}
+
+func (s *session) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SessionInfo{
+		Remote:      s.remote,
+		Module:      s.module,
+		Direction:   s.direction,
+		Start:       s.start,
+		CurrentFile: s.currentFile,
+	}
+	if s.crd != nil {
+		info.BytesRead = atomic.LoadInt64(&s.crd.BytesRead)
+	}
+	if s.cwr != nil {
+		info.BytesWritten = atomic.LoadInt64(&s.cwr.BytesWritten)
+	}
+	return info
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+}
+
+// add registers sess. The caller must call remove once the connection is done.
+func (r *sessionRegistry) add(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[uint64]*session)
+	}
+	r.nextID++
+	sess.id = r.nextID
+	r.sessions[sess.id] = sess
+}
+
+func (r *sessionRegistry) remove(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sess.id)
+}
+
+func (r *sessionRegistry) snapshot() []SessionInfo {
+	r.mu.Lock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(sessions, func(a, b *session) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	infos := make([]SessionInfo, len(sessions))
+	for idx, sess := range sessions {
+		infos[idx] = sess.info()
+	}
+	return infos
+}
+
+// Sessions returns a snapshot of the currently active connections, oldest
+// first.
+func (s *Server) Sessions() []SessionInfo {
+	return s.sessions.snapshot()
+}
+
+// ModuleConnections returns the number of active connections for each
+// configured module, keyed by module name.
+func (s *Server) ModuleConnections() map[string]int32 {
+	counts := make(map[string]int32, len(s.conns))
+	for name, n := range s.conns {
+		counts[name] = n.Load()
+	}
+	return counts
+}
+
+var debugTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head><title>rsyncd: active sessions</title></head>
+<body>
+<h1>{{ len .Sessions }} active session(s)</h1>
+{{ with .Modules }}
+<table border="1">
+<tr><th>module</th><th>connections</th></tr>
+{{ range $name, $count := . }}
+<tr><td>{{ $name }}</td><td>{{ $count }}</td></tr>
+{{ end }}
+</table>
+{{ end }}
+<table border="1">
+<tr><th>remote</th><th>module</th><th>direction</th><th>start</th><th>bytes read</th><th>bytes written</th><th>current file</th></tr>
+{{ range .Sessions }}
+<tr><td>{{ .Remote }}</td><td>{{ .Module }}</td><td>{{ .Direction }}</td><td>{{ .Start.Format "2006-01-02 15:04:05" }}</td><td>{{ .BytesRead }}</td><td>{{ .BytesWritten }}</td><td>{{ .CurrentFile }}</td></tr>
+{{ end }}
+</table>
+</body>
+</html>
+`))
+
+// DebugHandler returns an HTTP handler which renders the currently active
+// connections as HTML, or as JSON when requested via ?format=json or an
+// Accept: application/json header. The HTML page additionally shows the number
+// of active connections per module.
+func (s *Server) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos := s.Sessions()
+		if r.FormValue("format") == "json" ||
+			strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(infos); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			Sessions []SessionInfo
+			Modules  map[string]int32
+		}{
+			Sessions: infos,
+			Modules:  s.ModuleConnections(),
+		}
+		if err := debugTmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package rsyncd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDebugHandler(t *testing.T) {
+	srv := &Server{}
+	sess := &session{
+		remote:    "192.0.2.1:4711",
+		module:    "music",
+		direction: "sender",
+		start:     time.Now(),
+	}
+	crd, cwr := rsyncwire.CounterPair(strings.NewReader("hello"), &strings.Builder{})
+	sess.setCounters(crd, cwr)
+	srv.sessions.add(sess)
+	if _, err := crd.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	sess.setCurrentFile("album/track01.flac")
+
+	rec := httptest.NewRecorder()
+	srv.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/rsyncd?format=json", nil))
+	var infos []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(infos), 1; got != want {
+		t.Fatalf("unexpected number of sessions: got %d, want %d", got, want)
+	}
+	if got, want := infos[0].BytesRead, int64(5); got != want {
+		t.Errorf("BytesRead = %d, want %d", got, want)
+	}
+	if got, want := infos[0].CurrentFile, "album/track01.flac"; got != want {
+		t.Errorf("CurrentFile = %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/rsyncd", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "192.0.2.1:4711") {
+		t.Errorf("HTML output does not contain remote address: %s", body)
+	}
+
+	srv.sessions.remove(sess)
+	if got := srv.Sessions(); len(got) != 0 {
+		t.Errorf("sessions not removed: %+v", got)
+	}
+}
+
+func TestModuleConnections(t *testing.T) {
+	srv, err := NewServer([]Module{
+		{Name: "music", Path: t.TempDir()},
+		{Name: "photos", Path: t.TempDir()},
+	}, WithStderr(io.Discard), DontRestrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		done <- srv.HandleDaemonConn(context.Background(), NewConnection(server, server, "192.0.2.1:4711"))
+	}()
+	rd := bufio.NewReader(client)
+	if _, err := rd.ReadString('\n'); err != nil { // server greeting
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(client, "@RSYNCD: 31.0\nmusic\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := rd.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	} else if line != "@RSYNCD: OK\n" {
+		t.Fatalf("unexpected server response %q", line)
+	}
+
+	want := map[string]int32{"music": 1, "photos": 0}
+	if diff := cmp.Diff(want, srv.ModuleConnections()); diff != "" {
+		t.Errorf("ModuleConnections(): unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// Hang up before sending any flags, which fails the connection.
+	client.Close()
+	if err := <-done; err == nil {
+		t.Errorf("HandleDaemonConn unexpectedly succeeded")
+	}
+	want = map[string]int32{"music": 0, "photos": 0}
+	if diff := cmp.Diff(want, srv.ModuleConnections()); diff != "" {
+		t.Errorf("ModuleConnections() after disconnect: unexpected diff (-want +got):\n%s", diff)
+	}
+}
@@ -15,7 +15,7 @@ type SumBuf struct {
 	Sum2   [16]byte
 }
 
-// TODO: remove connection.go:sumHead in favor of this type
+// rsync/rsync.h:struct sum_struct
 type SumHead struct {
 	// “number of blocks” (openrsync)
 	// “how many chunks” (rsync)
@@ -36,8 +36,10 @@ type SumHead struct {
 }
 
 func (sh *SumHead) ReadFrom(c *rsyncwire.Conn) error {
-	// TODO(protocol>=30): update maxBlockLen
-	const maxBlockLen = 1 << 29 // see rsync.h:OLD_MAX_BLOCK_SIZE
+	maxBlockLen := int32(1 << 29) // see rsync.h:OLD_MAX_BLOCK_SIZE
+	if c.ProtocolVersion >= 30 {
+		maxBlockLen = 1 << 17 // see rsync.h:MAX_BLOCK_SIZE
+	}
 
 	var err error
 	sh.ChecksumCount, err = c.ReadInt32()
@@ -56,13 +58,18 @@ func (sh *SumHead) ReadFrom(c *rsyncwire.Conn) error {
 		return fmt.Errorf("invalid block length %d", sh.BlockLength)
 	}
 
-	sh.ChecksumLength, err = c.ReadInt32()
-	if err != nil {
-		return err
-	}
-	// TODO(protocol>=27): update max sh.ChecksumLength check
-	if sh.ChecksumLength < 0 || sh.ChecksumLength > 16 {
-		return fmt.Errorf("invalid checksum length %d", sh.ChecksumLength)
+	if c.ProtocolVersion < 27 {
+		// Implied by the protocol (csum_length in rsync).
+		sh.ChecksumLength = ShortSumLength
+	} else {
+		sh.ChecksumLength, err = c.ReadInt32()
+		if err != nil {
+			return err
+		}
+		// rsync/io.c:read_sum_head
+		if sh.ChecksumLength < 0 || sh.ChecksumLength > SumLength {
+			return fmt.Errorf("invalid checksum length %d", sh.ChecksumLength)
+		}
 	}
 
 	sh.RemainderLength, err = c.ReadInt32()
@@ -80,7 +87,9 @@ func (sh *SumHead) WriteTo(c *rsyncwire.Conn) error {
 	var buf rsyncwire.Buffer
 	buf.WriteInt32(sh.ChecksumCount)
 	buf.WriteInt32(sh.BlockLength)
-	buf.WriteInt32(sh.ChecksumLength)
+	if c.ProtocolVersion >= 27 {
+		buf.WriteInt32(sh.ChecksumLength)
+	}
 	buf.WriteInt32(sh.RemainderLength)
 	return c.WriteString(buf.String())
 }